@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/codegangsta/cli"
+	"github.com/sorah/etcvault/container"
+	"github.com/sorah/etcvault/engine"
+	"github.com/sorah/etcvault/etcdclient"
+	"github.com/sorah/etcvault/keys"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+const backupFormatVersion = 1
+
+// backup is a dump of etcd subtree. Values are kept as stored in etcd (containers aren't decrypted).
+type backup struct {
+	Version   int              `json:"version"`
+	Prefix    string           `json:"prefix"`
+	CreatedAt time.Time        `json:"created_at"`
+	Node      *etcdclient.Node `json:"node"`
+}
+
+func actionBackup(ctx *cli.Context) {
+	client := etcdClientFromFlags(ctx)
+	prefix := path.Join("/", ctx.String("prefix"))
+
+	root, err := fetchEtcdTree(client, prefix)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to retrieve %s: %s\n", prefix, err.Error())
+		os.Exit(1)
+	}
+
+	dump := &backup{
+		Version:   backupFormatVersion,
+		Prefix:    prefix,
+		CreatedAt: time.Now().UTC().Truncate(time.Second),
+		Node:      root,
+	}
+	content, err := json.MarshalIndent(dump, "", "  ")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to encode backup: %s\n", err.Error())
+		os.Exit(1)
+	}
+	content = append(content, '\n')
+
+	count := 0
+	walkEtcdNodes(root, func(node *etcdclient.Node) { count++ })
+
+	output := ctx.String("output")
+	if output == "" || output == "-" {
+		os.Stdout.Write(content)
+	} else {
+		// values may include plaintext which isn't encrypted by etcvault
+		if err := ioutil.WriteFile(output, content, 0600); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to write backup: %s\n", err.Error())
+			os.Exit(1)
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "backed up %d value(s) under %s\n", count, prefix)
+}
+
+// rewrapper decrypts containers with Source, and encrypts them again with Destination.
+type rewrapper struct {
+	Source      *engine.Engine
+	Destination *engine.Engine
+	// KeyName is a key name to encrypt with; when empty, the same name as the original container is used.
+	KeyName string
+}
+
+// Rewrap returns value encrypted with destination keys. Values not encrypted by a key are returned as is.
+func (rewrapper *rewrapper) Rewrap(value string, sourcePath string, destinationPath string) (string, error) {
+	if !strings.HasPrefix(value, "ETCVAULT::") {
+		return value, nil
+	}
+	c, err := container.Parse(value)
+	if err != nil {
+		log.Printf("couldn't parse container at %s (%s); restoring as is", sourcePath, err.Error())
+		return value, nil
+	}
+
+	v1, ok := c.(*container.V1)
+	if !ok {
+		return value, nil
+	}
+
+	plaintext, err := rewrapper.Source.TransformWithPath(value, sourcePath)
+	if err != nil {
+		return "", err
+	}
+
+	keyName := rewrapper.KeyName
+	if keyName == "" {
+		keyName = v1.KeyName
+	}
+	plain := &container.Plain1{KeyName: keyName, Content: plaintext}
+	return rewrapper.Destination.TransformWithPath(plain.String(), destinationPath)
+}
+
+func engineForKeychain(keychainDir string) *engine.Engine {
+	keychain := keys.NewKeychain(keychainDir)
+	eng := engine.NewEngine(keychain)
+	eng.RevocationList = keys.NewRevocationList()
+	if err := eng.RevocationList.LoadFile(keychain.RevocationListPath()); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to load revocation list: %s\n", err.Error())
+		os.Exit(1)
+	}
+	return eng
+}
+
+func actionRestore(ctx *cli.Context) {
+	if len(ctx.Args()) != 1 {
+		fmt.Fprintln(os.Stderr, "usage: etcvault restore [options] BACKUP_FILE")
+		os.Exit(1)
+	}
+
+	content, err := ioutil.ReadFile(ctx.Args()[0])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to read backup: %s\n", err.Error())
+		os.Exit(1)
+	}
+	dump := &backup{}
+	if err := json.Unmarshal(content, dump); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to parse backup: %s\n", err.Error())
+		os.Exit(1)
+	}
+	if dump.Version != backupFormatVersion || dump.Node == nil {
+		fmt.Fprintf(os.Stderr, "unsupported backup (version %d)\n", dump.Version)
+		os.Exit(1)
+	}
+
+	var rewrap *rewrapper
+	if ctx.Bool("rewrap") {
+		if ctx.String("keychain") == "" || ctx.String("dest-keychain") == "" {
+			fmt.Fprintln(os.Stderr, "Specify -keychain and -dest-keychain options to rewrap")
+			os.Exit(1)
+		}
+		rewrap = &rewrapper{
+			Source:      engineForKeychain(ctx.String("keychain")),
+			Destination: engineForKeychain(ctx.String("dest-keychain")),
+			KeyName:     ctx.String("rewrap-key"),
+		}
+	}
+
+	client := etcdClientFromFlags(ctx)
+
+	destPrefix := ctx.String("prefix")
+	if destPrefix == "" {
+		destPrefix = dump.Prefix
+	}
+	destinationPath := func(key string) string {
+		return path.Join("/", destPrefix, strings.TrimPrefix(key, dump.Prefix))
+	}
+
+	overwrite := ctx.Bool("overwrite")
+	restored, failed := 0, 0
+
+	var restore func(node *etcdclient.Node)
+	restore = func(node *etcdclient.Node) {
+		dest := destinationPath(node.Key)
+
+		opts := &etcdclient.SetOptions{TTL: node.TTL}
+
+		if node.Dir {
+			// directories are created implicitly by their children, but empty ones and ones with TTL have to be created
+			if dest != "/" && (node.TTL > 0 || len(node.Nodes) == 0) {
+				opts.Dir = true
+				opts.PrevExist = etcdclient.PrevNoExist
+				_, err := client.Set(dest, "", opts)
+				if etcdclient.IsNodeExist(err) {
+					log.Printf("directory %s already exists; leaving as is", dest)
+				} else if err != nil {
+					log.Printf("failed to restore %s: %s", dest, err.Error())
+					failed++
+				}
+			}
+			for _, child := range node.Nodes {
+				restore(child)
+			}
+			return
+		}
+
+		value := node.Value
+		if rewrap != nil {
+			var err error
+			value, err = rewrap.Rewrap(value, node.Key, dest)
+			if err != nil {
+				log.Printf("failed to rewrap %s: %s", node.Key, err.Error())
+				failed++
+				return
+			}
+		}
+
+		if !overwrite {
+			opts.PrevExist = etcdclient.PrevNoExist
+		}
+		if _, err := client.Set(dest, value, opts); err != nil {
+			log.Printf("failed to restore %s: %s", dest, err.Error())
+			failed++
+			return
+		}
+		restored++
+	}
+	restore(dump.Node)
+
+	fmt.Fprintf(os.Stderr, "restored %d value(s) to %s, %d failure(s)\n", restored, destPrefix, failed)
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
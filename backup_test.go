@@ -0,0 +1,108 @@
+package main
+
+import (
+	"github.com/sorah/etcvault/container"
+	"github.com/sorah/etcvault/engine"
+	"github.com/sorah/etcvault/keys"
+	"strings"
+	"testing"
+)
+
+func testEngineWithKeys(names ...string) *engine.Engine {
+	keyList := make([]*keys.Key, 0, len(names))
+	for _, name := range names {
+		key, err := keys.GenerateKey(name, 1024)
+		if err != nil {
+			panic(err)
+		}
+		keyList = append(keyList, key)
+	}
+	return engine.NewEngine(keys.NewMemoryStore(keyList))
+}
+
+func testEncrypt(eng *engine.Engine, keyName string, content string) string {
+	plain := &container.Plain1{KeyName: keyName, Content: content}
+	encrypted, err := eng.Transform(plain.String())
+	if err != nil {
+		panic(err)
+	}
+	return encrypted
+}
+
+func TestRewrap(t *testing.T) {
+	source := testEngineWithKeys("app")
+	destination := testEngineWithKeys("app", "other")
+	wrapper := &rewrapper{Source: source, Destination: destination}
+
+	encrypted := testEncrypt(source, "app", "secret")
+	rewrapped, err := wrapper.Rewrap(encrypted, "/src/password", "/dest/password")
+	if err != nil {
+		t.Fatalf("unexpected err %#v", err)
+	}
+	if rewrapped == encrypted || !strings.HasPrefix(rewrapped, "ETCVAULT::2:app@") {
+		t.Errorf("unexpected result %#v", rewrapped)
+	}
+	if plaintext, err := destination.Transform(rewrapped); err != nil || plaintext != "secret" {
+		t.Errorf("unexpected decrypted result %#v, %#v", plaintext, err)
+	}
+	if _, err := source.Transform(rewrapped); err == nil {
+		t.Errorf("source keys shouldn't decrypt rewrapped value")
+	}
+
+	wrapper.KeyName = "other"
+	rewrapped, err = wrapper.Rewrap(encrypted, "/src/password", "/dest/password")
+	if err != nil || !strings.HasPrefix(rewrapped, "ETCVAULT::2:other@") {
+		t.Errorf("unexpected result %#v, %#v", rewrapped, err)
+	}
+}
+
+func TestRewrapKeptAsIs(t *testing.T) {
+	wrapper := &rewrapper{Source: testEngineWithKeys("app"), Destination: testEngineWithKeys("app")}
+
+	tests := []struct {
+		Name string
+		Case string
+	}{
+		{"plain", "hello"},
+		{"broken", "ETCVAULT::1:app::!!!::ETCVAULT"},
+		{"unknown version", "ETCVAULT::42:app::ETCVAULT"},
+		{"asis", "ETCVAULT::asis:hello::ETCVAULT"},
+		{"plain1", "ETCVAULT::plain1:app:hello::ETCVAULT"},
+		{"remote1", "ETCVAULT::remote1:app:aG9sYQ==,aGVsbG8=::ETCVAULT"},
+	}
+
+	for _, test := range tests {
+		result, err := wrapper.Rewrap(test.Case, "/src/a", "/dest/a")
+		if err != nil || result != test.Case {
+			t.Errorf("%s: unexpected result %#v, %#v", test.Name, result, err)
+		}
+	}
+}
+
+func TestRewrapErrors(t *testing.T) {
+	source := testEngineWithKeys("app")
+	encrypted := testEncrypt(source, "app", "secret")
+
+	// source can't decrypt
+	wrapper := &rewrapper{Source: testEngineWithKeys("another"), Destination: testEngineWithKeys("app")}
+	if result, err := wrapper.Rewrap(encrypted, "/src/a", "/dest/a"); err != keys.ErrKeyNotFound {
+		t.Errorf("unexpected result %#v, %#v", result, err)
+	}
+
+	// destination doesn't have the key
+	wrapper = &rewrapper{Source: source, Destination: testEngineWithKeys("another")}
+	if result, err := wrapper.Rewrap(encrypted, "/src/a", "/dest/a"); err != keys.ErrKeyNotFound {
+		t.Errorf("unexpected result %#v, %#v", result, err)
+	}
+
+	// allowed paths of source key are checked against source path
+	key, _ := source.Keychain.Find("app")
+	key.AllowedPaths = []string{"/src"}
+	wrapper = &rewrapper{Source: source, Destination: testEngineWithKeys("app")}
+	if _, err := wrapper.Rewrap(encrypted, "/src/a", "/dest/a"); err != nil {
+		t.Errorf("unexpected err %#v", err)
+	}
+	if result, err := wrapper.Rewrap(encrypted, "/other/a", "/src/a"); err != engine.ErrPathNotAllowed {
+		t.Errorf("unexpected result %#v, %#v", result, err)
+	}
+}
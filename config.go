@@ -0,0 +1,439 @@
+package main
+
+import (
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"github.com/codegangsta/cli"
+	"github.com/sorah/etcvault/keys"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Config holds options for `etcvault start`. Every option can be given by
+// configuration file (TOML or YAML), environment variable (ETCVAULT_*) and
+// command line flag; later one wins.
+type Config struct {
+	Keychain         string `toml:"keychain" yaml:"keychain"`
+	Listen           string `toml:"listen" yaml:"listen"`
+	ListenSocketMode string `toml:"listen-socket-mode" yaml:"listen-socket-mode"`
+	AdvertiseUrl     string `toml:"advertise-url" yaml:"advertise-url"`
+
+	Keys       KeysConfig       `toml:"keys" yaml:"keys"`
+	KeyService KeyServiceConfig `toml:"key-service" yaml:"key-service"`
+	Revocation RevocationConfig `toml:"revocation" yaml:"revocation"`
+	Discovery  DiscoveryConfig  `toml:"discovery" yaml:"discovery"`
+	Tls        TlsConfig        `toml:"tls" yaml:"tls"`
+	Policy     PolicyConfig     `toml:"policy" yaml:"policy"`
+}
+
+// KeysConfig is for keys stored in etcd, in addition to keychain directory.
+type KeysConfig struct {
+	EtcdDir       string `toml:"etcd-dir" yaml:"etcd-dir"`
+	MasterKeyFile string `toml:"master-key-file" yaml:"master-key-file"`
+	EtcdInterval  int    `toml:"etcd-interval" yaml:"etcd-interval"`
+}
+
+// KeyServiceConfig is for remote key service to wrap and unwrap content keys.
+type KeyServiceConfig struct {
+	Url      string `toml:"url" yaml:"url"`
+	Timeout  int    `toml:"timeout" yaml:"timeout"`
+	CacheTtl int    `toml:"cache-ttl" yaml:"cache-ttl"`
+}
+
+// RevocationConfig is for revocation list in etcd, in addition to "revoked" file in keychain directory.
+type RevocationConfig struct {
+	EtcdKey  string `toml:"etcd-key" yaml:"etcd-key"`
+	Interval int    `toml:"interval" yaml:"interval"`
+}
+
+type DiscoveryConfig struct {
+	Srv             string `toml:"srv" yaml:"srv"`
+	Url             string `toml:"url" yaml:"url"`
+	File            string `toml:"file" yaml:"file"`
+	InitialBackends string `toml:"initial-backends" yaml:"initial-backends"`
+	Interval        int    `toml:"interval" yaml:"interval"`
+	PreferScheme    string `toml:"prefer-scheme" yaml:"prefer-scheme"`
+	PreferNetworks  string `toml:"prefer-networks" yaml:"prefer-networks"`
+}
+
+type TlsConfig struct {
+	ReloadInterval   int    `toml:"reload-interval" yaml:"reload-interval"`
+	MinVersion       string `toml:"min-version" yaml:"min-version"`
+	MaxVersion       string `toml:"max-version" yaml:"max-version"`
+	CipherSuites     string `toml:"cipher-suites" yaml:"cipher-suites"`
+	Curves           string `toml:"curves" yaml:"curves"`
+	ListenClientAuth string `toml:"listen-client-auth" yaml:"listen-client-auth"`
+
+	Client TlsFilesConfig `toml:"client" yaml:"client"`
+	Peer   TlsFilesConfig `toml:"peer" yaml:"peer"`
+	Listen TlsFilesConfig `toml:"listen" yaml:"listen"`
+}
+
+type TlsFilesConfig struct {
+	CaFile   string `toml:"ca-file" yaml:"ca-file"`
+	CertFile string `toml:"cert-file" yaml:"cert-file"`
+	KeyFile  string `toml:"key-file" yaml:"key-file"`
+}
+
+type PolicyConfig struct {
+	Readonly           bool `toml:"readonly" yaml:"readonly"`
+	OmitMetadata       bool `toml:"omit-metadata" yaml:"omit-metadata"`
+	Strict             bool `toml:"strict" yaml:"strict"`
+	DecryptConcurrency int  `toml:"decrypt-concurrency" yaml:"decrypt-concurrency"`
+}
+
+func envVarName(flagName string) string {
+	return "ETCVAULT_" + strings.ToUpper(strings.Replace(flagName, "-", "_", -1))
+}
+
+func LoadConfigFile(path string) (*Config, error) {
+	config := &Config{}
+
+	switch filepath.Ext(path) {
+	case ".yml", ".yaml":
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if err := yaml.UnmarshalStrict(content, config); err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err.Error())
+		}
+	default:
+		meta, err := toml.DecodeFile(path, config)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err.Error())
+		}
+		if undecoded := meta.Undecoded(); len(undecoded) > 0 {
+			undecodedKeys := make([]string, 0, len(undecoded))
+			for _, key := range undecoded {
+				undecodedKeys = append(undecodedKeys, key.String())
+			}
+			return nil, fmt.Errorf("%s: unknown keys: %s", path, strings.Join(undecodedKeys, ", "))
+		}
+	}
+
+	return config, nil
+}
+
+func (config *Config) stringOptions() map[string]*string {
+	return map[string]*string{
+		"keychain":                &config.Keychain,
+		"listen":                  &config.Listen,
+		"listen-socket-mode":      &config.ListenSocketMode,
+		"advertise-url":           &config.AdvertiseUrl,
+		"keys-etcd-dir":           &config.Keys.EtcdDir,
+		"master-key-file":         &config.Keys.MasterKeyFile,
+		"key-service-url":         &config.KeyService.Url,
+		"revocation-etcd-key":     &config.Revocation.EtcdKey,
+		"discovery-srv":           &config.Discovery.Srv,
+		"discovery-url":           &config.Discovery.Url,
+		"discovery-file":          &config.Discovery.File,
+		"initial-backends":        &config.Discovery.InitialBackends,
+		"backend-prefer-scheme":   &config.Discovery.PreferScheme,
+		"backend-prefer-networks": &config.Discovery.PreferNetworks,
+		"client-ca-file":          &config.Tls.Client.CaFile,
+		"client-cert-file":        &config.Tls.Client.CertFile,
+		"client-key-file":         &config.Tls.Client.KeyFile,
+		"peer-ca-file":            &config.Tls.Peer.CaFile,
+		"peer-cert-file":          &config.Tls.Peer.CertFile,
+		"peer-key-file":           &config.Tls.Peer.KeyFile,
+		"listen-ca-file":          &config.Tls.Listen.CaFile,
+		"listen-cert-file":        &config.Tls.Listen.CertFile,
+		"listen-key-file":         &config.Tls.Listen.KeyFile,
+		"tls-min-version":         &config.Tls.MinVersion,
+		"tls-max-version":         &config.Tls.MaxVersion,
+		"tls-cipher-suites":       &config.Tls.CipherSuites,
+		"tls-curves":              &config.Tls.Curves,
+		"listen-client-auth":      &config.Tls.ListenClientAuth,
+	}
+}
+
+func (config *Config) intOptions() map[string]*int {
+	return map[string]*int{
+		"discovery-interval":    &config.Discovery.Interval,
+		"keys-etcd-interval":    &config.Keys.EtcdInterval,
+		"key-service-timeout":   &config.KeyService.Timeout,
+		"key-service-cache-ttl": &config.KeyService.CacheTtl,
+		"revocation-interval":   &config.Revocation.Interval,
+		"tls-reload-interval":   &config.Tls.ReloadInterval,
+		"decrypt-concurrency":   &config.Policy.DecryptConcurrency,
+	}
+}
+
+func (config *Config) boolOptions() map[string]*bool {
+	return map[string]*bool{
+		"readonly":      &config.Policy.Readonly,
+		"omit-metadata": &config.Policy.OmitMetadata,
+		"strict":        &config.Policy.Strict,
+	}
+}
+
+// ApplyEnv overrides options by environment variables (e.g. ETCVAULT_LISTEN).
+func (config *Config) ApplyEnv() []error {
+	errs := []error{}
+
+	for name, ptr := range config.stringOptions() {
+		if value := os.Getenv(envVarName(name)); value != "" {
+			*ptr = value
+		}
+	}
+	for name, ptr := range config.intOptions() {
+		if value := os.Getenv(envVarName(name)); value != "" {
+			i, err := strconv.Atoi(value)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %s", envVarName(name), err.Error()))
+				continue
+			}
+			*ptr = i
+		}
+	}
+	for name, ptr := range config.boolOptions() {
+		if value := os.Getenv(envVarName(name)); value != "" {
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %s", envVarName(name), err.Error()))
+				continue
+			}
+			*ptr = b
+		}
+	}
+
+	return errs
+}
+
+// ApplyFlags overrides options by given flags, and fills missing options with flag defaults.
+func (config *Config) ApplyFlags(ctx *cli.Context) {
+	for name, ptr := range config.stringOptions() {
+		if ctx.IsSet(name) || *ptr == "" {
+			*ptr = ctx.String(name)
+		}
+	}
+	for name, ptr := range config.intOptions() {
+		if ctx.IsSet(name) || *ptr == 0 {
+			*ptr = ctx.Int(name)
+		}
+	}
+	for name, ptr := range config.boolOptions() {
+		if ctx.IsSet(name) {
+			*ptr = ctx.Bool(name)
+		}
+	}
+}
+
+func (config *Config) ListenUrls() ([]*url.URL, error) {
+	listenUrls := []*url.URL{}
+	for _, listenUrlString := range strings.Split(config.Listen, ",") {
+		listenUrl, err := url.Parse(strings.TrimSpace(listenUrlString))
+		if err != nil {
+			return nil, fmt.Errorf("couldn't parse listen as URL: %s", err.Error())
+		}
+		switch listenUrl.Scheme {
+		case "http", "https":
+			if listenUrl.Path != "" && listenUrl.Path != "/" {
+				return nil, fmt.Errorf("listen URL shouldn't include path: %s", listenUrl.Path)
+			}
+		case "unix":
+			if listenUrl.Path == "" {
+				return nil, fmt.Errorf("listen unix URL should include socket path: %s", listenUrl.String())
+			}
+		default:
+			return nil, fmt.Errorf("listen URL should be http, https or unix: %s", listenUrl.String())
+		}
+		listenUrls = append(listenUrls, listenUrl)
+	}
+	return listenUrls, nil
+}
+
+func (config *Config) KeyServiceUrl() (*url.URL, error) {
+	serviceUrl, err := url.Parse(config.KeyService.Url)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't parse key-service-url: %s", err.Error())
+	}
+	if serviceUrl.Scheme != "http" && serviceUrl.Scheme != "https" {
+		return nil, fmt.Errorf("key-service-url should be http or https: %s", config.KeyService.Url)
+	}
+	return serviceUrl, nil
+}
+
+func (config *Config) ListenSocketFileMode() (os.FileMode, error) {
+	mode, err := strconv.ParseUint(config.ListenSocketMode, 8, 32)
+	if err != nil {
+		return 0, fmt.Errorf("couldn't parse listen-socket-mode: %s", err.Error())
+	}
+	return os.FileMode(mode), nil
+}
+
+func (config *Config) BackendPreferNetworks() ([]*net.IPNet, error) {
+	networks := []*net.IPNet{}
+	if config.Discovery.PreferNetworks == "" {
+		return networks, nil
+	}
+	for _, cidr := range strings.Split(config.Discovery.PreferNetworks, ",") {
+		_, network, err := net.ParseCIDR(strings.TrimSpace(cidr))
+		if err != nil {
+			return nil, fmt.Errorf("couldn't parse backend-prefer-networks: %s", err.Error())
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+func (config *Config) TlsPolicy() (*TlsPolicy, []error) {
+	errs := []error{}
+	policy := DefaultTlsPolicy()
+
+	if config.Tls.MinVersion != "" {
+		version, err := ParseTlsVersion(config.Tls.MinVersion)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("tls-min-version: %s", err.Error()))
+		}
+		policy.MinVersion = version
+	}
+	if config.Tls.MaxVersion != "" {
+		version, err := ParseTlsVersion(config.Tls.MaxVersion)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("tls-max-version: %s", err.Error()))
+		}
+		policy.MaxVersion = version
+	}
+	if policy.MaxVersion != 0 && policy.MinVersion > policy.MaxVersion {
+		errs = append(errs, fmt.Errorf("tls-min-version is greater than tls-max-version"))
+	}
+	if config.Tls.CipherSuites != "" {
+		suites, err := ParseTlsCipherSuites(config.Tls.CipherSuites)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("tls-cipher-suites: %s", err.Error()))
+		}
+		policy.CipherSuites = suites
+	}
+	if config.Tls.Curves != "" {
+		curves, err := ParseTlsCurves(config.Tls.Curves)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("tls-curves: %s", err.Error()))
+		}
+		policy.CurvePreferences = curves
+	}
+	if config.Tls.ListenClientAuth != "" {
+		clientAuth, err := ParseTlsClientAuth(config.Tls.ListenClientAuth)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("listen-client-auth: %s", err.Error()))
+		}
+		policy.ClientAuth = clientAuth
+	}
+
+	return policy, errs
+}
+
+// Validate checks options and returns all errors found.
+func (config *Config) Validate() []error {
+	errs := []error{}
+
+	if config.Keychain == "" && config.KeyService.Url == "" && config.Keys.EtcdDir == "" {
+		errs = append(errs, fmt.Errorf("specify keychain (or key-service-url, keys-etcd-dir)"))
+	}
+
+	if config.Keys.EtcdInterval <= 0 {
+		errs = append(errs, fmt.Errorf("keys-etcd-interval should be positive: %d", config.Keys.EtcdInterval))
+	}
+	if config.Keys.EtcdDir != "" && config.Keys.MasterKeyFile == "" {
+		errs = append(errs, fmt.Errorf("keys-etcd-dir requires master-key-file"))
+	}
+	if config.Keys.MasterKeyFile != "" {
+		if _, err := keys.LoadMasterKeyFromFile(config.Keys.MasterKeyFile); err != nil {
+			errs = append(errs, fmt.Errorf("master-key-file: %s", err.Error()))
+		}
+	}
+
+	if config.Revocation.Interval <= 0 {
+		errs = append(errs, fmt.Errorf("revocation-interval should be positive: %d", config.Revocation.Interval))
+	}
+
+	if config.KeyService.Url != "" {
+		if _, err := config.KeyServiceUrl(); err != nil {
+			errs = append(errs, err)
+		}
+		if config.KeyService.Timeout <= 0 {
+			errs = append(errs, fmt.Errorf("key-service-timeout should be positive: %d", config.KeyService.Timeout))
+		}
+		if config.KeyService.CacheTtl < 0 {
+			errs = append(errs, fmt.Errorf("key-service-cache-ttl shouldn't be negative: %d", config.KeyService.CacheTtl))
+		}
+	}
+
+	discoveryOptionCount := 0
+	for _, option := range []string{config.Discovery.Srv, config.Discovery.Url, config.Discovery.File, config.Discovery.InitialBackends} {
+		if option != "" {
+			discoveryOptionCount++
+		}
+	}
+	if discoveryOptionCount == 0 {
+		errs = append(errs, fmt.Errorf("specify discovery-srv, discovery-url, discovery-file or initial-backends"))
+	}
+	if discoveryOptionCount > 1 {
+		errs = append(errs, fmt.Errorf("only one of discovery-srv, discovery-url, discovery-file or initial-backends is accepted"))
+	}
+	if config.Discovery.Interval <= 0 {
+		errs = append(errs, fmt.Errorf("discovery-interval should be positive: %d", config.Discovery.Interval))
+	}
+
+	if config.Policy.DecryptConcurrency < 0 {
+		errs = append(errs, fmt.Errorf("decrypt-concurrency shouldn't be negative: %d", config.Policy.DecryptConcurrency))
+	}
+
+	if config.Tls.ReloadInterval <= 0 {
+		errs = append(errs, fmt.Errorf("tls-reload-interval should be positive: %d", config.Tls.ReloadInterval))
+	}
+
+	scheme := config.Discovery.PreferScheme
+	if scheme != "" && scheme != "http" && scheme != "https" {
+		errs = append(errs, fmt.Errorf("backend-prefer-scheme should be http or https: %s", scheme))
+	}
+	if _, err := config.BackendPreferNetworks(); err != nil {
+		errs = append(errs, err)
+	}
+
+	tlsFiles := []struct {
+		Name  string
+		Files TlsFilesConfig
+	}{
+		{"client", config.Tls.Client},
+		{"peer", config.Tls.Peer},
+		{"listen", config.Tls.Listen},
+	}
+	for _, tlsFile := range tlsFiles {
+		if (tlsFile.Files.CertFile != "") != (tlsFile.Files.KeyFile != "") {
+			errs = append(errs, fmt.Errorf("provide both %s-cert-file and %s-key-file", tlsFile.Name, tlsFile.Name))
+		}
+	}
+
+	listenUrls, err := config.ListenUrls()
+	if err != nil {
+		errs = append(errs, err)
+	}
+	for _, listenUrl := range listenUrls {
+		if listenUrl.Scheme == "https" && !config.hasServerCertificate() {
+			errs = append(errs, fmt.Errorf("provide both listen-cert-file and listen-key-file (or client-cert-file and client-key-file) when listen https"))
+			break
+		}
+	}
+	if _, err := config.ListenSocketFileMode(); err != nil {
+		errs = append(errs, err)
+	}
+
+	_, tlsPolicyErrs := config.TlsPolicy()
+	errs = append(errs, tlsPolicyErrs...)
+
+	return errs
+}
+
+func (config *Config) hasServerCertificate() bool {
+	listen := config.Tls.Listen
+	client := config.Tls.Client
+	return (listen.CertFile != "" && listen.KeyFile != "") || (client.CertFile != "" && client.KeyFile != "")
+}
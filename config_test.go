@@ -0,0 +1,331 @@
+package main
+
+import (
+	"flag"
+	"github.com/codegangsta/cli"
+	"github.com/sorah/etcvault/keys"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// startContext returns cli.Context of `etcvault start` with args.
+func startContext(args ...string) *cli.Context {
+	set := flag.NewFlagSet("start", flag.ContinueOnError)
+	for _, f := range startFlags {
+		f.Apply(set)
+	}
+	if err := set.Parse(args); err != nil {
+		panic(err)
+	}
+	return cli.NewContext(cli.NewApp(), set, nil)
+}
+
+// validConfig returns Config passing Validate, with defaults of flags.
+func validConfig() *Config {
+	config := &Config{Keychain: "/keychain", Discovery: DiscoveryConfig{InitialBackends: "http://localhost:2379"}}
+	config.ApplyFlags(startContext())
+	return config
+}
+
+func writeConfigFile(name string, content string) string {
+	tmpDir, err := ioutil.TempDir("", "etcvault_test")
+	if err != nil {
+		panic(err)
+	}
+	filePath := path.Join(tmpDir, name)
+	if err := ioutil.WriteFile(filePath, []byte(content), 0644); err != nil {
+		panic(err)
+	}
+	return filePath
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	expected := &Config{
+		Keychain: "/etc/etcvault/keys",
+		Listen:   "http://localhost:2381",
+		Discovery: DiscoveryConfig{
+			Srv:      "example.org",
+			Interval: 30,
+		},
+		Tls: TlsConfig{
+			Client: TlsFilesConfig{CaFile: "/etc/etcvault/ca.pem"},
+		},
+		Policy: PolicyConfig{Readonly: true},
+	}
+
+	files := map[string]string{
+		"etcvault.toml": `
+keychain = "/etc/etcvault/keys"
+listen = "http://localhost:2381"
+
+[discovery]
+srv = "example.org"
+interval = 30
+
+[tls.client]
+ca-file = "/etc/etcvault/ca.pem"
+
+[policy]
+readonly = true
+`,
+		"etcvault.yml": `
+keychain: /etc/etcvault/keys
+listen: http://localhost:2381
+discovery:
+  srv: example.org
+  interval: 30
+tls:
+  client:
+    ca-file: /etc/etcvault/ca.pem
+policy:
+  readonly: true
+`,
+	}
+
+	for name, content := range files {
+		filePath := writeConfigFile(name, content)
+		defer os.RemoveAll(path.Dir(filePath))
+
+		config, err := LoadConfigFile(filePath)
+		if err != nil {
+			t.Errorf("%s: unexpected err %s", name, err.Error())
+			continue
+		}
+		if !reflect.DeepEqual(config, expected) {
+			t.Errorf("%s: unexpected config %#v", name, config)
+		}
+	}
+}
+
+func TestLoadConfigFileUnknownKeys(t *testing.T) {
+	files := map[string]string{
+		"etcvault.toml": "keychain = \"/keys\"\nlisten-url = \"http://localhost:2381\"\n",
+		"etcvault.yaml": "keychain: /keys\nlisten-url: http://localhost:2381\n",
+	}
+
+	for name, content := range files {
+		filePath := writeConfigFile(name, content)
+		defer os.RemoveAll(path.Dir(filePath))
+
+		_, err := LoadConfigFile(filePath)
+		if err == nil || !strings.Contains(err.Error(), "listen-url") {
+			t.Errorf("%s: unexpected err %#v", name, err)
+		}
+	}
+}
+
+func TestConfigApplyEnv(t *testing.T) {
+	env := map[string]string{
+		"ETCVAULT_KEYCHAIN":           "/env/keys",
+		"ETCVAULT_DISCOVERY_INTERVAL": "10",
+		"ETCVAULT_READONLY":           "true",
+		"ETCVAULT_CLIENT_CA_FILE":     "/env/ca.pem",
+	}
+	for name, value := range env {
+		os.Setenv(name, value)
+		defer os.Unsetenv(name)
+	}
+
+	config := &Config{Keychain: "/file/keys", Listen: "http://localhost:2381"}
+	if errs := config.ApplyEnv(); len(errs) > 0 {
+		t.Fatalf("unexpected errs %#v", errs)
+	}
+
+	if config.Keychain != "/env/keys" || config.Discovery.Interval != 10 || !config.Policy.Readonly || config.Tls.Client.CaFile != "/env/ca.pem" {
+		t.Errorf("unexpected config %#v", config)
+	}
+	if config.Listen != "http://localhost:2381" {
+		t.Errorf("option without env var should be kept: %s", config.Listen)
+	}
+}
+
+func TestConfigApplyEnvInvalid(t *testing.T) {
+	os.Setenv("ETCVAULT_DISCOVERY_INTERVAL", "ten")
+	defer os.Unsetenv("ETCVAULT_DISCOVERY_INTERVAL")
+	os.Setenv("ETCVAULT_STRICT", "maybe")
+	defer os.Unsetenv("ETCVAULT_STRICT")
+
+	errs := (&Config{}).ApplyEnv()
+	if len(errs) != 2 {
+		t.Errorf("unexpected errs %#v", errs)
+	}
+}
+
+func TestConfigApplyFlags(t *testing.T) {
+	config := &Config{Keychain: "/file/keys", Listen: "http://localhost:2381", Discovery: DiscoveryConfig{Interval: 30}, Policy: PolicyConfig{Readonly: true}}
+	config.ApplyFlags(startContext("-listen", "http://localhost:2391", "-discovery-srv", "example.org"))
+
+	// given flags win
+	if config.Listen != "http://localhost:2391" || config.Discovery.Srv != "example.org" {
+		t.Errorf("unexpected config %#v", config)
+	}
+	// options from file (or env) are kept when flags aren't given
+	if config.Keychain != "/file/keys" || config.Discovery.Interval != 30 || !config.Policy.Readonly {
+		t.Errorf("unexpected config %#v", config)
+	}
+	// missing options are filled with flag defaults
+	if config.ListenSocketMode != "0660" || config.Tls.ReloadInterval != 60 || config.Tls.ListenClientAuth != "require" {
+		t.Errorf("unexpected config %#v", config)
+	}
+
+	config.ApplyFlags(startContext("-readonly=false"))
+	if config.Policy.Readonly {
+		t.Errorf("unexpected readonly")
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	tests := []struct {
+		Name   string
+		Modify func(config *Config)
+		Expect []string
+	}{
+		{
+			Name:   "valid",
+			Modify: func(config *Config) {},
+		},
+		{
+			Name:   "key service instead of keychain",
+			Modify: func(config *Config) { config.Keychain = ""; config.KeyService.Url = "https://keyservice:2390" },
+		},
+		{
+			Name: "keys in etcd instead of keychain",
+			Modify: func(config *Config) {
+				config.Keychain = ""
+				config.Keys.EtcdDir = "/etcvault/keys"
+				config.Keys.MasterKeyFile = writeConfigFile("master.key", string(keys.EncodeMasterKey([]byte(strings.Repeat("k", keys.MasterKeyLength)))))
+			},
+		},
+		{
+			Name:   "no keychain",
+			Modify: func(config *Config) { config.Keychain = "" },
+			Expect: []string{"specify keychain (or key-service-url, keys-etcd-dir)"},
+		},
+		{
+			Name:   "no discovery",
+			Modify: func(config *Config) { config.Discovery.InitialBackends = "" },
+			Expect: []string{"specify discovery-srv, discovery-url, discovery-file or initial-backends"},
+		},
+		{
+			Name:   "multiple discovery",
+			Modify: func(config *Config) { config.Discovery.Srv = "example.org" },
+			Expect: []string{"only one of discovery-srv, discovery-url, discovery-file or initial-backends is accepted"},
+		},
+		{
+			Name: "multiple errors",
+			Modify: func(config *Config) {
+				config.Discovery.Interval = 0
+				config.Discovery.PreferScheme = "ftp"
+				config.KeyService.Url = "ftp://keyservice"
+			},
+			Expect: []string{
+				"key-service-url should be http or https: ftp://keyservice",
+				"discovery-interval should be positive: 0",
+				"backend-prefer-scheme should be http or https: ftp",
+			},
+		},
+		{
+			Name:   "keys in etcd without master key",
+			Modify: func(config *Config) { config.Keys.EtcdDir = "/etcvault/keys" },
+			Expect: []string{"keys-etcd-dir requires master-key-file"},
+		},
+		{
+			Name:   "cert without key",
+			Modify: func(config *Config) { config.Tls.Client.CertFile = "/cert.pem" },
+			Expect: []string{"provide both client-cert-file and client-key-file"},
+		},
+		{
+			Name:   "https without certificate",
+			Modify: func(config *Config) { config.Listen = "https://0.0.0.0:2381" },
+			Expect: []string{"provide both listen-cert-file and listen-key-file (or client-cert-file and client-key-file) when listen https"},
+		},
+		{
+			Name: "https with client certificate",
+			Modify: func(config *Config) {
+				config.Listen = "https://0.0.0.0:2381"
+				config.Tls.Client.CertFile = "/cert.pem"
+				config.Tls.Client.KeyFile = "/key.pem"
+			},
+		},
+		{
+			Name:   "tls versions",
+			Modify: func(config *Config) { config.Tls.MinVersion = "1.3"; config.Tls.MaxVersion = "1.2" },
+			Expect: []string{"tls-min-version is greater than tls-max-version"},
+		},
+		{
+			Name:   "negative decrypt concurrency",
+			Modify: func(config *Config) { config.Policy.DecryptConcurrency = -1 },
+			Expect: []string{"decrypt-concurrency shouldn't be negative: -1"},
+		},
+	}
+
+	for _, test := range tests {
+		config := validConfig()
+		test.Modify(config)
+
+		messages := []string{}
+		for _, err := range config.Validate() {
+			messages = append(messages, err.Error())
+		}
+		if len(messages) != len(test.Expect) || (len(messages) > 0 && !reflect.DeepEqual(messages, test.Expect)) {
+			t.Errorf("%s: unexpected errors %#v", test.Name, messages)
+		}
+	}
+}
+
+func TestConfigListenUrls(t *testing.T) {
+	tests := []struct {
+		Name   string
+		Case   string
+		Expect []string
+		Err    bool
+	}{
+		{Name: "single", Case: "http://localhost:2381", Expect: []string{"http://localhost:2381"}},
+		{Name: "multiple", Case: "http://localhost:2381, https://0.0.0.0:2382,unix:///run/etcvault.sock", Expect: []string{"http://localhost:2381", "https://0.0.0.0:2382", "unix:///run/etcvault.sock"}},
+		{Name: "trailing slash", Case: "http://localhost:2381/", Expect: []string{"http://localhost:2381/"}},
+		{Name: "path", Case: "http://localhost:2381/foo", Err: true},
+		{Name: "unix without path", Case: "unix://", Err: true},
+		{Name: "unknown scheme", Case: "tcp://localhost:2381", Err: true},
+		{Name: "invalid", Case: "http://[::1", Err: true},
+	}
+
+	for _, test := range tests {
+		config := &Config{Listen: test.Case}
+		listenUrls, err := config.ListenUrls()
+
+		if test.Err {
+			if err == nil {
+				t.Errorf("%s: unexpected success", test.Name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected err %s", test.Name, err.Error())
+			continue
+		}
+		if len(listenUrls) != len(test.Expect) {
+			t.Errorf("%s: unexpected urls %#v", test.Name, listenUrls)
+			continue
+		}
+		for i, listenUrl := range listenUrls {
+			if listenUrl.String() != test.Expect[i] {
+				t.Errorf("%s: unexpected url[%d] %s", test.Name, i, listenUrl.String())
+			}
+		}
+	}
+}
+
+func TestConfigListenSocketFileMode(t *testing.T) {
+	mode, err := (&Config{ListenSocketMode: "0600"}).ListenSocketFileMode()
+	if err != nil || mode != os.FileMode(0600) {
+		t.Errorf("unexpected mode %#o, %#v", mode, err)
+	}
+
+	if _, err := (&Config{ListenSocketMode: "0999"}).ListenSocketFileMode(); err == nil {
+		t.Errorf("unexpected success")
+	}
+}
@@ -15,8 +15,10 @@ func Parse(str string) (Container, error) {
 	switch basic.Version {
 	case "asis":
 		return ParseAsis(str)
-	case "1":
+	case "1", "2":
 		return ParseV1(str)
+	case "remote1":
+		return ParseRemote1(str)
 	case "plain1", "plain":
 		return ParsePlain1(str)
 	default:
@@ -80,6 +80,23 @@ func TestParseForAsis(t *testing.T) {
 	}
 }
 
+func TestParseForRemote1(t *testing.T) {
+	rawResult, err := Parse("ETCVAULT::remote1:key:aG9sYQ==,aGVsbG8=::ETCVAULT")
+
+	if err != nil {
+		t.Errorf("unexpected error %#v", err)
+	}
+
+	result, ok := rawResult.(*Remote1)
+	if !ok {
+		t.Errorf("Remote1 has not returned")
+	}
+
+	if result.KeyName != "key" {
+		t.Errorf("unexpected KeyName %#v", result.KeyName)
+	}
+}
+
 func TestParseForUnknown(t *testing.T) {
 	result, err := Parse("ETCVAULT::unknown:XXX::ETCVAULT")
 
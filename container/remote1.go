@@ -0,0 +1,62 @@
+package container
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+)
+
+// Remote1 is a container whose content key is wrapped by remote key service,
+// so decryption requires asking the service to unwrap it.
+type Remote1 struct {
+	KeyName    string
+	WrappedKey []byte `json:"-"`
+	Content    []byte `json:"-"`
+}
+
+func ParseRemote1(str string) (*Remote1, error) {
+	basic, err := ParseBasic(str)
+	if err != nil {
+		return nil, err
+	}
+
+	if basic.Version != "remote1" {
+		return nil, ErrDifferentVersion
+	}
+
+	keyAndContent := strings.SplitN(basic.Content, ":", 2)
+	if len(keyAndContent) < 2 {
+		return nil, ErrParse
+	}
+
+	wrappedKeyAndContent := strings.SplitN(keyAndContent[1], ",", 2)
+	if len(wrappedKeyAndContent) < 2 {
+		return nil, ErrParse
+	}
+
+	wrappedKey, err := base64.StdEncoding.DecodeString(wrappedKeyAndContent[0])
+	if err != nil {
+		return nil, err
+	}
+
+	content, err := base64.StdEncoding.DecodeString(wrappedKeyAndContent[1])
+	if err != nil {
+		return nil, err
+	}
+
+	return &Remote1{
+		KeyName:    keyAndContent[0],
+		WrappedKey: wrappedKey,
+		Content:    content,
+	}, nil
+}
+
+func (container *Remote1) Version() string {
+	return "remote1"
+}
+
+func (container *Remote1) String() string {
+	encodedWrappedKey := base64.StdEncoding.EncodeToString(container.WrappedKey)
+	encodedContent := base64.StdEncoding.EncodeToString(container.Content)
+	return fmt.Sprintf("ETCVAULT::remote1:%s:%s,%s::ETCVAULT", container.KeyName, encodedWrappedKey, encodedContent)
+}
@@ -0,0 +1,51 @@
+package container
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestRemote1Parse(t *testing.T) {
+	result, err := ParseRemote1("ETCVAULT::remote1:key:aG9sYQ==,aGVsbG8=::ETCVAULT")
+
+	if err != nil {
+		t.Errorf("unexpected error %#v", err)
+	}
+
+	if result.Version() != "remote1" {
+		t.Errorf("unexpected version %#v", result.Version())
+	}
+
+	if result.KeyName != "key" {
+		t.Errorf("unexpected KeyName %#v", result.KeyName)
+	}
+
+	if !bytes.Equal(result.WrappedKey, []byte(`hola`)) {
+		t.Errorf("unexpected WrappedKey %#v", result.WrappedKey)
+	}
+
+	if !bytes.Equal(result.Content, []byte(`hello`)) {
+		t.Errorf("unexpected Content %#v", result.Content)
+	}
+}
+
+func TestRemote1ParseMissingContent(t *testing.T) {
+	_, err := ParseRemote1("ETCVAULT::remote1:key:aG9sYQ==::ETCVAULT")
+
+	if err != ErrParse {
+		t.Errorf("unexpected error %#v", err)
+	}
+}
+
+func TestRemote1String(t *testing.T) {
+	container := &Remote1{
+		KeyName:    "key",
+		WrappedKey: []byte(`hola`),
+		Content:    []byte(`hello`),
+	}
+
+	str := container.String()
+	if str != "ETCVAULT::remote1:key:aG9sYQ==,aGVsbG8=::ETCVAULT" {
+		t.Errorf("unexpected String() %#v", str)
+	}
+}
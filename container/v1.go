@@ -6,10 +6,17 @@ import (
 	"strings"
 )
 
+// V1 is an RSA encrypted container. Containers with KeyFingerprint are written in version 2
+// (ETCVAULT::2:KEYNAME@FINGERPRINT:...), so older versions, which don't know fingerprints,
+// refuse them as unknown version rather than looking for a key named "KEYNAME@FINGERPRINT".
+// Otherwise the format is the same as version 1.
 type V1 struct {
-	KeyName    string
-	ContentKey []byte `json:"-"`
-	Content    []byte `json:"-"`
+	KeyName string
+	// KeyFingerprint is short fingerprint of the public key used (keys.Key.Fingerprint).
+	// Empty for containers in version 1, made by older versions.
+	KeyFingerprint string `json:",omitempty"`
+	ContentKey     []byte `json:"-"`
+	Content        []byte `json:"-"`
 }
 
 func ParseV1(str string) (*V1, error) {
@@ -18,7 +25,7 @@ func ParseV1(str string) (*V1, error) {
 		return nil, err
 	}
 
-	if basic.Version != "1" {
+	if basic.Version != "1" && basic.Version != "2" {
 		return nil, ErrDifferentVersion
 	}
 
@@ -29,6 +36,15 @@ func ParseV1(str string) (*V1, error) {
 	}
 
 	keyName := parts[0]
+	keyFingerprint := ""
+	if basic.Version == "2" {
+		i := strings.LastIndex(keyName, "@")
+		if i == -1 || i == len(keyName)-1 {
+			return nil, ErrParse
+		}
+		keyFingerprint = keyName[i+1:]
+		keyName = keyName[:i]
+	}
 	format := parts[1]
 	contentPart := parts[2]
 
@@ -36,7 +52,7 @@ func ParseV1(str string) (*V1, error) {
 	var content []byte
 	if format == "long" {
 		contentKeyAndContent := strings.SplitN(contentPart, ",", 2)
-		if len(parts) < 2 {
+		if len(contentKeyAndContent) < 2 {
 			return nil, ErrParse
 		}
 
@@ -57,22 +73,31 @@ func ParseV1(str string) (*V1, error) {
 	}
 
 	return &V1{
-		KeyName:    keyName,
-		ContentKey: contentKey,
-		Content:    content,
+		KeyName:        keyName,
+		KeyFingerprint: keyFingerprint,
+		ContentKey:     contentKey,
+		Content:        content,
 	}, nil
 }
 
 func (container *V1) Version() string {
+	if container.KeyFingerprint != "" {
+		return "2"
+	}
 	return "1"
 }
 
 func (container *V1) String() string {
+	keyName := container.KeyName
+	if container.KeyFingerprint != "" {
+		keyName = fmt.Sprintf("%s@%s", container.KeyName, container.KeyFingerprint)
+	}
+
 	encodedContent := base64.StdEncoding.EncodeToString(container.Content)
 	if container.ContentKey == nil {
-		return fmt.Sprintf("ETCVAULT::1:%s::%s::ETCVAULT", container.KeyName, encodedContent)
+		return fmt.Sprintf("ETCVAULT::%s:%s::%s::ETCVAULT", container.Version(), keyName, encodedContent)
 	} else {
 		encodedContentKey := base64.StdEncoding.EncodeToString(container.ContentKey)
-		return fmt.Sprintf("ETCVAULT::1:%s:long:%s,%s::ETCVAULT", container.KeyName, encodedContentKey, encodedContent)
+		return fmt.Sprintf("ETCVAULT::%s:%s:long:%s,%s::ETCVAULT", container.Version(), keyName, encodedContentKey, encodedContent)
 	}
 }
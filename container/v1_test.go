@@ -75,6 +75,17 @@ func TestV1ParseError(t *testing.T) {
 	}
 }
 
+func TestV1ParseLongWithoutContentKey(t *testing.T) {
+	result, err := ParseV1("ETCVAULT::1:the-key:long:aGVsbG8=::ETCVAULT")
+
+	if result != nil {
+		t.Errorf("unexpected result %#v", result)
+	}
+	if err != ErrParse {
+		t.Errorf("unexpected error %#v", err)
+	}
+}
+
 func TestV1ParseNotV1(t *testing.T) {
 	result, err := ParseV1("ETCVAULT::42:foo::ETCVAULT")
 
@@ -112,3 +123,65 @@ func TestV1StringLong(t *testing.T) {
 		t.Errorf("unexpected string %#v", result)
 	}
 }
+
+func TestV1ParseWithFingerprint(t *testing.T) {
+	result, err := ParseV1("ETCVAULT::2:key@0123456789abcdef:long:aG9sYQ==,aGVsbG8=::ETCVAULT")
+
+	if err != nil {
+		t.Errorf("unexpected error %#v", err)
+	}
+
+	if result.Version() != "2" {
+		t.Errorf("unexpected version %#v", result.Version())
+	}
+
+	if result.KeyName != "key" {
+		t.Errorf("unexpected KeyName %#v", result.KeyName)
+	}
+
+	if result.KeyFingerprint != "0123456789abcdef" {
+		t.Errorf("unexpected KeyFingerprint %#v", result.KeyFingerprint)
+	}
+}
+
+func TestV1StringWithFingerprint(t *testing.T) {
+	container := &V1{
+		KeyName:        "key",
+		KeyFingerprint: "0123456789abcdef",
+		Content:        []byte("hello"),
+	}
+
+	result := container.String()
+
+	if result != "ETCVAULT::2:key@0123456789abcdef::aGVsbG8=::ETCVAULT" {
+		t.Errorf("unexpected string %#v", result)
+	}
+}
+
+func TestV1ParseVersion1WithAtSign(t *testing.T) {
+	// version 1 has no fingerprint; "@" is a part of key name
+	result, err := ParseV1("ETCVAULT::1:key@host::aGVsbG8=::ETCVAULT")
+
+	if err != nil {
+		t.Errorf("unexpected error %#v", err)
+	}
+	if result.KeyName != "key@host" || result.KeyFingerprint != "" {
+		t.Errorf("unexpected result %#v", result)
+	}
+	if result.String() != "ETCVAULT::1:key@host::aGVsbG8=::ETCVAULT" {
+		t.Errorf("unexpected string %#v", result.String())
+	}
+}
+
+func TestV1ParseVersion2WithoutFingerprint(t *testing.T) {
+	for _, str := range []string{"ETCVAULT::2:key::aGVsbG8=::ETCVAULT", "ETCVAULT::2:key@::aGVsbG8=::ETCVAULT"} {
+		result, err := ParseV1(str)
+
+		if result != nil {
+			t.Errorf("unexpected result %#v", result)
+		}
+		if err != ErrParse {
+			t.Errorf("unexpected error %#v", err)
+		}
+	}
+}
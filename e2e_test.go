@@ -0,0 +1,176 @@
+package main
+
+import (
+	"github.com/sorah/etcvault/etcdtest"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+// runCommand runs etcvault with args, and returns its stdout.
+func runCommand(args ...string) string {
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		panic(err)
+	}
+
+	stdout := os.Stdout
+	os.Stdout = writer
+	defer func() { os.Stdout = stdout }()
+
+	outCh := make(chan []byte)
+	go func() {
+		out, _ := ioutil.ReadAll(reader)
+		outCh <- out
+	}()
+
+	err = newApp().Run(append([]string{"etcvault"}, args...))
+	writer.Close()
+	out := <-outCh
+	if err != nil {
+		panic(err)
+	}
+	return string(out)
+}
+
+// e2eKeychain returns a keychain directory with a key generated by keygen command.
+func e2eKeychain(names ...string) string {
+	dir, err := ioutil.TempDir("", "etcvault_e2e")
+	if err != nil {
+		panic(err)
+	}
+	for _, name := range names {
+		runCommand("keygen", "-bits", "1024", "-save", dir, name)
+	}
+	return dir
+}
+
+func startEtcdtest() (*etcdtest.Server, *httptest.Server) {
+	etcd := etcdtest.NewServer()
+	return etcd, httptest.NewServer(etcd)
+}
+
+func TestE2eTransformCommand(t *testing.T) {
+	keychainDir := e2eKeychain("app")
+	defer os.RemoveAll(keychainDir)
+
+	if _, err := os.Stat(path.Join(keychainDir, "app.pem")); err != nil {
+		t.Fatalf("key isn't saved: %s", err.Error())
+	}
+
+	encrypted := strings.TrimSpace(runCommand("transform", "-keychain", keychainDir, "ETCVAULT::plain:app:hello::ETCVAULT"))
+	if !strings.HasPrefix(encrypted, "ETCVAULT::2:app@") || strings.Contains(encrypted, "hello") {
+		t.Fatalf("unexpected encrypted value %#v", encrypted)
+	}
+
+	decrypted := runCommand("transform", "-keychain", keychainDir, encrypted, "plain text")
+	if decrypted != "hello\nplain text\n" {
+		t.Errorf("unexpected decrypted value %#v", decrypted)
+	}
+
+	// another keychain can't decrypt, and the value is printed as is
+	anotherKeychainDir := e2eKeychain("app")
+	defer os.RemoveAll(anotherKeychainDir)
+	if out := runCommand("transform", "-keychain", anotherKeychainDir, encrypted); out != encrypted+"\n" {
+		t.Errorf("unexpected output %#v", out)
+	}
+}
+
+func TestE2eProxyRoundtrip(t *testing.T) {
+	keychainDir := e2eKeychain("app")
+	defer os.RemoveAll(keychainDir)
+
+	etcd, etcdServer := startEtcdtest()
+	defer etcdServer.Close()
+
+	config := validConfig()
+	config.Keychain = keychainDir
+	config.Discovery.InitialBackends = etcdServer.URL
+	proxyServer := httptest.NewServer(NewProxyStarter(config).Proxy())
+	defer proxyServer.Close()
+
+	form := url.Values{"value": {"ETCVAULT::plain:app:hello::ETCVAULT"}}
+	request, _ := http.NewRequest("PUT", proxyServer.URL+"/v2/keys/app/greeting", strings.NewReader(form.Encode()))
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatalf("unexpected err %s", err.Error())
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 201 {
+		t.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	stored, _ := etcd.Get("/app/greeting")
+	if !strings.HasPrefix(stored, "ETCVAULT::2:app@") || strings.Contains(stored, "hello") {
+		t.Fatalf("value isn't encrypted in etcd: %#v", stored)
+	}
+
+	resp, err = http.Get(proxyServer.URL + "/v2/keys/app/greeting")
+	if err != nil {
+		t.Fatalf("unexpected err %s", err.Error())
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(body), `"value":"hello"`) || strings.Contains(string(body), stored) {
+		t.Errorf("unexpected body %s", body)
+	}
+
+	// encrypted values are written as is, not decrypted
+	form = url.Values{"value": {stored}}
+	request, _ = http.NewRequest("PUT", proxyServer.URL+"/v2/keys/app/copy", strings.NewReader(form.Encode()))
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err = http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatalf("unexpected err %s", err.Error())
+	}
+	resp.Body.Close()
+	if copied, _ := etcd.Get("/app/copy"); copied != stored {
+		t.Errorf("unexpected copied value %#v", copied)
+	}
+}
+
+func TestE2eScanCommand(t *testing.T) {
+	keychainDir := e2eKeychain("app")
+	defer os.RemoveAll(keychainDir)
+
+	etcd, etcdServer := startEtcdtest()
+	defer etcdServer.Close()
+
+	encrypted := strings.TrimSpace(runCommand("transform", "-keychain", keychainDir, "ETCVAULT::plain:app:hello::ETCVAULT"))
+	etcd.Set("/app/encrypted", encrypted)
+	etcd.Set("/app/plain", "hello")
+	etcd.Set("/app/db/password", "hunter2")
+	etcd.Set("/app/written-without-etcvault", "ETCVAULT::plain:app:hello::ETCVAULT")
+	etcd.Set("/other/value", "hello")
+
+	out := runCommand("scan", "-etcd", etcdServer.URL, "-prefix", "/app", "-detect-secrets")
+
+	for _, expected := range []string{
+		"/app/encrypted",
+		"/app/plain ",
+		"/app/db/password",
+		"possible secret (key name)",
+		"v1-short 1",
+		"plain    2",
+		"plain1   1",
+		"app 1        0       0       1",
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("output doesn't contain %#v:\n%s", expected, out)
+		}
+	}
+	if strings.Contains(out, "/other/value") {
+		t.Errorf("output contains values outside of prefix:\n%s", out)
+	}
+
+	out = runCommand("scan", "-etcd", etcdServer.URL, "-prefix", "/app", "-summary")
+	if strings.Contains(out, "/app/encrypted") || !strings.Contains(out, "v1-short 1") {
+		t.Errorf("unexpected summary:\n%s", out)
+	}
+}
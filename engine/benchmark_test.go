@@ -1,9 +1,14 @@
 package engine
 
 import (
+	"bytes"
+	"encoding/json"
+	"fmt"
 	"testing"
 )
 
+const benchmarkV1Short = "ETCVAULT::1:the-key::oXKv3edU7AjUXK1+7+Ng7y5tjByLzMe8MRL2lCxlsE03pHS2AXnd3mvar5dkbgeTU4dY8lcMPYAqRGXi2y9YJ7MD+8vKpkORczLYOBTiSXY8cuttvWY+ffjeJMSsLiHn0tDdtjvCtshSBTe9vLz75yyW8J91DUm9CriHWtQhaXw=::ETCVAULT"
+
 func BenchmarkEncryptV1Short(b *testing.B) {
 	engine := NewEngine(testKeychain)
 	b.ResetTimer()
@@ -24,7 +29,7 @@ func BenchmarkDecryptV1Short(b *testing.B) {
 	engine := NewEngine(testKeychain)
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		_, _ = engine.Transform("ETCVAULT::1:the-key::oXKv3edU7AjUXK1+7+Ng7y5tjByLzMe8MRL2lCxlsE03pHS2AXnd3mvar5dkbgeTU4dY8lcMPYAqRGXi2y9YJ7MD+8vKpkORczLYOBTiSXY8cuttvWY+ffjeJMSsLiHn0tDdtjvCtshSBTe9vLz75yyW8J91DUm9CriHWtQhaXw=::ETCVAULT")
+		_, _ = engine.Transform(benchmarkV1Short)
 	}
 }
 
@@ -43,3 +48,64 @@ func BenchmarkPlain(b *testing.B) {
 		_, _ = engine.Transform("i'm plain text.")
 	}
 }
+
+// etcdDirectoryJson returns a response of recursive GET on a directory with n nodes having value.
+func etcdDirectoryJson(n int, value string) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(`{"action":"get","node":{"key":"/dir","dir":true,"nodes":[`)
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			buf.WriteString(",")
+		}
+		fmt.Fprintf(&buf, `{"key":"/dir/%d","value":%q,"modifiedIndex":%d,"createdIndex":%d}`, i, value, 9007199254740993+i, 9007199254740993+i)
+	}
+	buf.WriteString(`],"modifiedIndex":3,"createdIndex":3}}`)
+	return buf.Bytes()
+}
+
+func benchmarkTransformEtcdJsonResponse(b *testing.B, jsonData []byte, concurrency int) {
+	engine := NewEngine(testKeychain)
+	engine.Concurrency = concurrency
+	b.SetBytes(int64(len(jsonData)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, _ = engine.TransformEtcdJsonResponse(jsonData)
+	}
+}
+
+func BenchmarkTransformEtcdJsonResponsePlain(b *testing.B) {
+	benchmarkTransformEtcdJsonResponse(b, etcdDirectoryJson(100, "i'm plain text."), 0)
+}
+
+func BenchmarkTransformEtcdJsonResponseAsis(b *testing.B) {
+	benchmarkTransformEtcdJsonResponse(b, etcdDirectoryJson(100, "ETCVAULT::asis:i'm plain text.::ETCVAULT"), 0)
+}
+
+func BenchmarkTransformEtcdJsonResponseDecryptV1Short(b *testing.B) {
+	benchmarkTransformEtcdJsonResponse(b, etcdDirectoryJson(10, benchmarkV1Short), 0)
+}
+
+// Large directories, to compare serial decryption with parallel one, which uses GOMAXPROCS workers.
+// Run with e.g. -benchtime 3x -cpu 1,2,4, as each operation decrypts 10,000 values.
+
+func BenchmarkTransformEtcdJsonResponseDecryptLargeSerial(b *testing.B) {
+	benchmarkTransformEtcdJsonResponse(b, etcdDirectoryJson(10000, benchmarkV1Short), 1)
+}
+
+func BenchmarkTransformEtcdJsonResponseDecryptLargeParallel(b *testing.B) {
+	benchmarkTransformEtcdJsonResponse(b, etcdDirectoryJson(10000, benchmarkV1Short), 0)
+}
+
+// BenchmarkJsonRoundTrip is for comparison; the cost of unmarshaling into interface{} and marshaling again.
+func BenchmarkJsonRoundTrip(b *testing.B) {
+	jsonData := etcdDirectoryJson(100, "i'm plain text.")
+	b.SetBytes(int64(len(jsonData)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var data interface{}
+		decoder := json.NewDecoder(bytes.NewReader(jsonData))
+		decoder.UseNumber()
+		_ = decoder.Decode(&data)
+		_, _ = json.Marshal(data)
+	}
+}
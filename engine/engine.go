@@ -13,24 +13,62 @@ import (
 
 var ErrNoPrivateKey = errors.New("no private key provided")
 var ErrTooShortKey = errors.New("key too short; couldn't generate 16, 24, and 32 bytes aes key")
+var ErrNoKeyWrapper = errors.New("remote key service is not configured")
+var ErrKeyExpired = errors.New("key has expired; couldn't be used for encryption")
+var ErrKeyNotForEncryption = errors.New("key is not allowed to be used for encryption")
+var ErrKeyNotForDecryption = errors.New("key is not allowed to be used for decryption")
+var ErrPathNotAllowed = errors.New("key is not allowed to be used for this path")
+var ErrKeyRevoked = errors.New("key has been revoked")
+
+// KeyFingerprintMismatchError is returned when a value was encrypted with a different key
+// than the one in keychain under the same name.
+type KeyFingerprintMismatchError struct {
+	KeyName  string
+	Expected string
+	Actual   string
+}
+
+func (err *KeyFingerprintMismatchError) Error() string {
+	return fmt.Sprintf("key fingerprint mismatch: value is encrypted with %s@%s, but keychain has %s@%s", err.KeyName, err.Expected, err.KeyName, err.Actual)
+}
 
 type Transformable interface {
 	Transform(text string) (string, error)
+	TransformWithPath(text string, path string) (string, error)
+	TransformForWrite(text string) (string, error)
 	TransformEtcdJsonResponse(jsonData []byte) ([]byte, error)
-	GetKeychain() *keys.Keychain
+	TransformEtcdV3JsonResponse(jsonData []byte) ([]byte, error)
+	TransformEtcdJsonResponseWithOptions(jsonData []byte, options ResponseOptions) ([]byte, error)
+	TransformEtcdV3JsonResponseWithOptions(jsonData []byte, options ResponseOptions) ([]byte, error)
+	GetKeychain() keys.Store
+}
+
+// KeyWrapper wraps and unwraps content keys with the named key, held remotely (e.g. keyservice.Client).
+type KeyWrapper interface {
+	WrapKey(keyName string, dataKey []byte) ([]byte, error)
+	// UnwrapKey unwraps a content key of a value at etcd path, so the path can be checked against AllowedPaths.
+	UnwrapKey(keyName string, wrappedKey []byte, path string) ([]byte, error)
 }
 
 type Engine struct {
-	Keychain *keys.Keychain
+	Keychain keys.Store
+	// When KeyWrapper is present, plain containers are encrypted into remote1 containers
+	// using it instead of local keys.
+	KeyWrapper KeyWrapper
+	// Keys in RevocationList are refused for both encryption and decryption.
+	RevocationList *keys.RevocationList
+	// Concurrency is the number of values decrypted in parallel in a JSON response.
+	// Zero means GOMAXPROCS, which is the number of CPUs by default.
+	Concurrency int
 }
 
-func NewEngine(keychain *keys.Keychain) *Engine {
+func NewEngine(keychain keys.Store) *Engine {
 	return &Engine{
 		Keychain: keychain,
 	}
 }
 
-func (engine *Engine) GetKeychain() *keys.Keychain {
+func (engine *Engine) GetKeychain() keys.Store {
 	return engine.Keychain
 }
 
@@ -39,7 +77,20 @@ func (engine *Engine) Transform(text string) (string, error) {
 	return s, e
 }
 
+// TransformWithPath transforms text stored at etcd path. Keys with AllowedPaths refuse to decrypt
+// values outside of them.
+func (engine *Engine) TransformWithPath(text string, path string) (string, error) {
+	s, _, e := engine.TransformAndParseWithPath(text, path)
+	return s, e
+}
+
 func (engine *Engine) TransformAndParse(text string) (string, container.Container, error) {
+	return engine.TransformAndParseWithPath(text, "")
+}
+
+// TransformAndParseWithPath is TransformAndParse for a value at etcd path. Keys with AllowedPaths refuse
+// to decrypt values when path is empty.
+func (engine *Engine) TransformAndParseWithPath(text string, path string) (string, container.Container, error) {
 	// FIXME: test for this
 	rawContainer, err := container.Parse(text)
 
@@ -59,18 +110,49 @@ func (engine *Engine) TransformAndParse(text string) (string, container.Containe
 		result, err := engine.TransformAsis(c)
 		return result, c, err
 	case *container.V1:
-		result, err := engine.TransformV1(c)
+		result, err := engine.transformV1(c, path)
+		return result, c, err
+	case *container.Remote1:
+		result, err := engine.transformRemote1(c, path)
 		return result, c, err
 	}
 	// shouldnt reach
 	panic(fmt.Errorf("BUG: unsupported container type %#v", rawContainer))
 }
 
+// TransformForWrite transforms a value being written into etcd. Plain containers are encrypted,
+// but encrypted containers are kept as is; values are never decrypted on the way to etcd.
+func (engine *Engine) TransformForWrite(text string) (string, error) {
+	rawContainer, err := container.Parse(text)
+	if err != nil {
+		if err == container.ErrInvalid {
+			return text, nil
+		} else {
+			return "", err
+		}
+	}
+
+	switch c := rawContainer.(type) {
+	case *container.Plain1:
+		return engine.TransformPlain1(c)
+	case *container.Asis:
+		return engine.TransformAsis(c)
+	}
+	return text, nil
+}
+
 func (engine *Engine) TransformPlain1(c *container.Plain1) (string, error) {
+	if engine.KeyWrapper != nil {
+		return engine.transformPlain1Remote(c)
+	}
+
 	key, err := engine.Keychain.Find(c.KeyName)
 	if err != nil {
 		return "", err
 	}
+	if err := engine.checkKeyForEncryption(key); err != nil {
+		return "", err
+	}
 
 	encryptedContent, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, key.Public, []byte(c.Content), []byte{})
 	if err == rsa.ErrMessageTooLong {
@@ -81,8 +163,9 @@ func (engine *Engine) TransformPlain1(c *container.Plain1) (string, error) {
 	}
 
 	result := &container.V1{
-		KeyName: key.Name,
-		Content: encryptedContent,
+		KeyName:        key.Name,
+		KeyFingerprint: key.Fingerprint(),
+		Content:        encryptedContent,
 	}
 
 	return result.String(), nil
@@ -126,30 +209,76 @@ func (engine *Engine) transformPlain1Long(key *keys.Key, c *container.Plain1) (s
 	encryptedContent := *(encryptAesWithPkcs7Padding(&cipher, &content))
 
 	result := &container.V1{
-		KeyName:    key.Name,
-		ContentKey: encryptedContentKey,
-		Content:    encryptedContent,
+		KeyName:        key.Name,
+		KeyFingerprint: key.Fingerprint(),
+		ContentKey:     encryptedContentKey,
+		Content:        encryptedContent,
 	}
 	return result.String(), nil
 }
 
 func (engine *Engine) TransformV1(c *container.V1) (string, error) {
-	if c.ContentKey == nil {
-		return engine.transformV1Short(c)
-	} else {
-		return engine.transformV1Long(c)
-	}
+	return engine.transformV1(c, "")
 }
 
-func (engine *Engine) transformV1Short(c *container.V1) (string, error) {
+func (engine *Engine) transformV1(c *container.V1, path string) (string, error) {
 	key, err := engine.Keychain.Find(c.KeyName)
 	if err != nil {
 		return "", err
 	}
+	if err := engine.checkKeyForDecryption(key, path); err != nil {
+		return "", err
+	}
+	if c.KeyFingerprint != "" && c.KeyFingerprint != key.Fingerprint() {
+		return "", &KeyFingerprintMismatchError{KeyName: key.Name, Expected: c.KeyFingerprint, Actual: key.Fingerprint()}
+	}
+
+	if c.ContentKey == nil {
+		return engine.transformV1Short(key, c)
+	} else {
+		return engine.transformV1Long(key, c)
+	}
+}
+
+func (engine *Engine) isRevoked(key *keys.Key) bool {
+	return engine.RevocationList != nil && engine.RevocationList.IsKeyRevoked(key)
+}
+
+func (engine *Engine) checkKeyForEncryption(key *keys.Key) error {
+	if engine.isRevoked(key) {
+		return ErrKeyRevoked
+	}
+	if !key.CanEncrypt() {
+		return ErrKeyNotForEncryption
+	}
+	if key.Expired() {
+		return ErrKeyExpired
+	}
+	return nil
+}
+
+func (engine *Engine) checkKeyForDecryption(key *keys.Key, path string) error {
+	if engine.isRevoked(key) {
+		return ErrKeyRevoked
+	}
 	if key.Private == nil {
-		return "", ErrNoPrivateKey
+		return ErrNoPrivateKey
+	}
+	return checkKeyPolicyForDecryption(key, path)
+}
+
+// checkKeyPolicyForDecryption checks Usage and AllowedPaths of key. Empty path is refused when key has AllowedPaths.
+func checkKeyPolicyForDecryption(key *keys.Key, path string) error {
+	if !key.CanDecrypt() {
+		return ErrKeyNotForDecryption
 	}
+	if !key.AllowsPath(path) {
+		return ErrPathNotAllowed
+	}
+	return nil
+}
 
+func (engine *Engine) transformV1Short(key *keys.Key, c *container.V1) (string, error) {
 	hash := sha256.New()
 	decryptedContent, err := rsa.DecryptOAEP(hash, rand.Reader, key.Private, c.Content, []byte{})
 	if err != nil {
@@ -158,15 +287,7 @@ func (engine *Engine) transformV1Short(c *container.V1) (string, error) {
 	return string(decryptedContent), nil
 }
 
-func (engine *Engine) transformV1Long(c *container.V1) (string, error) {
-	key, err := engine.Keychain.Find(c.KeyName)
-	if err != nil {
-		return "", err
-	}
-	if key.Private == nil {
-		return "", ErrNoPrivateKey
-	}
-
+func (engine *Engine) transformV1Long(key *keys.Key, c *container.V1) (string, error) {
 	hash := sha256.New()
 	decryptedContentKey, err := rsa.DecryptOAEP(hash, rand.Reader, key.Private, c.ContentKey, []byte{})
 	if err != nil {
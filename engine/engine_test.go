@@ -1,8 +1,10 @@
 package engine
 
 import (
+	"github.com/sorah/etcvault/keys"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestTransformPlainToPlain(t *testing.T) {
@@ -28,7 +30,7 @@ func TestTransformPlainRoundtrip(t *testing.T) {
 	if strings.Index(encryptedText, "this text should be encrypted") != -1 {
 		t.Errorf("encrypted text contains original text: %#v", encryptedText)
 	}
-	if strings.Index(encryptedText, "ETCVAULT::1:the-key::") != 0 {
+	if strings.Index(encryptedText, "ETCVAULT::2:the-key@318e40c9eb5ee156::") != 0 {
 		t.Errorf("encrypted text unexpected: %#v", encryptedText)
 	}
 
@@ -51,7 +53,7 @@ func TestTransformV1RoundtripShort(t *testing.T) {
 	if strings.Index(encryptedText, "this text should be encrypted") != -1 {
 		t.Errorf("encrypted text contains original text: %#v", encryptedText)
 	}
-	if strings.Index(encryptedText, "ETCVAULT::1:the-key::") != 0 {
+	if strings.Index(encryptedText, "ETCVAULT::2:the-key@318e40c9eb5ee156::") != 0 {
 		t.Errorf("encrypted text unexpected: %#v", encryptedText)
 	}
 
@@ -86,7 +88,7 @@ func TestTransformV1RoundtripLong(t *testing.T) {
 	if strings.Index(encryptedText, "this text is too long so this should be long format aaaaaaaaaaaaaaaaaaaaaaaaaa") != -1 {
 		t.Errorf("encrypted text contains original text: %#v", encryptedText)
 	}
-	if strings.Index(encryptedText, "ETCVAULT::1:the-key:long:") != 0 {
+	if strings.Index(encryptedText, "ETCVAULT::2:the-key@318e40c9eb5ee156:long:") != 0 {
 		t.Errorf("encrypted text unexpected: %#v", encryptedText)
 	}
 
@@ -109,3 +111,168 @@ func TestTransformV1DecryptionLong(t *testing.T) {
 		t.Errorf("unexpected text %#v", decryptedText)
 	}
 }
+
+func TestTransformWithMemoryStore(t *testing.T) {
+	keychainKey, err := testKeychain.Find("the-key")
+	if err != nil {
+		panic(err)
+	}
+	engine := NewEngine(keys.NewMemoryStore([]*keys.Key{keychainKey}))
+
+	encryptedText, err := engine.Transform("ETCVAULT::plain:the-key:this text should be encrypted::ETCVAULT")
+	if err != nil {
+		t.Errorf("1 unexpected err: %#v", err)
+	}
+
+	plainText, err := NewEngine(testKeychain).Transform(encryptedText)
+	if err != nil {
+		t.Errorf("2 unexpected err: %#v", err)
+	}
+	if plainText != "this text should be encrypted" {
+		t.Errorf("unexpected result: %#v", plainText)
+	}
+}
+
+func testKeyWithMetadata(modify func(key *keys.Key)) *keys.Key {
+	origKey, err := testKeychain.Find("the-key")
+	if err != nil {
+		panic(err)
+	}
+	key := keys.NewPrivateKey("the-key", origKey.Private)
+	modify(key)
+	return key
+}
+
+func TestTransformPlainWithExpiredKey(t *testing.T) {
+	key := testKeyWithMetadata(func(key *keys.Key) {
+		key.NotAfter = time.Now().Add(-time.Hour)
+	})
+	engine := NewEngine(keys.NewMemoryStore([]*keys.Key{key}))
+
+	_, err := engine.Transform("ETCVAULT::plain:the-key:this text should be encrypted::ETCVAULT")
+	if err != ErrKeyExpired {
+		t.Errorf("unexpected err: %#v", err)
+	}
+
+	// expired keys still can decrypt
+	encryptedText, _ := NewEngine(testKeychain).Transform("ETCVAULT::plain:the-key:this text should be encrypted::ETCVAULT")
+	plainText, err := engine.Transform(encryptedText)
+	if err != nil {
+		t.Errorf("unexpected err: %#v", err)
+	}
+	if plainText != "this text should be encrypted" {
+		t.Errorf("unexpected result: %#v", plainText)
+	}
+}
+
+func TestTransformWithKeyUsage(t *testing.T) {
+	encryptedText, _ := NewEngine(testKeychain).Transform("ETCVAULT::plain:the-key:this text should be encrypted::ETCVAULT")
+
+	decryptOnly := NewEngine(keys.NewMemoryStore([]*keys.Key{testKeyWithMetadata(func(key *keys.Key) {
+		key.Usage = keys.KeyUsageDecrypt
+	})}))
+	if _, err := decryptOnly.Transform("ETCVAULT::plain:the-key:this text should be encrypted::ETCVAULT"); err != ErrKeyNotForEncryption {
+		t.Errorf("unexpected err: %#v", err)
+	}
+	if _, err := decryptOnly.Transform(encryptedText); err != nil {
+		t.Errorf("unexpected err: %#v", err)
+	}
+
+	encryptOnly := NewEngine(keys.NewMemoryStore([]*keys.Key{testKeyWithMetadata(func(key *keys.Key) {
+		key.Usage = keys.KeyUsageEncrypt
+	})}))
+	if _, err := encryptOnly.Transform("ETCVAULT::plain:the-key:this text should be encrypted::ETCVAULT"); err != nil {
+		t.Errorf("unexpected err: %#v", err)
+	}
+	if _, err := encryptOnly.Transform(encryptedText); err != ErrKeyNotForDecryption {
+		t.Errorf("unexpected err: %#v", err)
+	}
+}
+
+func TestTransformWithPathAllowedPaths(t *testing.T) {
+	encryptedText, _ := NewEngine(testKeychain).Transform("ETCVAULT::plain:the-key:this text should be encrypted::ETCVAULT")
+
+	engine := NewEngine(keys.NewMemoryStore([]*keys.Key{testKeyWithMetadata(func(key *keys.Key) {
+		key.AllowedPaths = []string{"/app1/"}
+	})}))
+
+	plainText, err := engine.TransformWithPath(encryptedText, "/app1/password")
+	if err != nil {
+		t.Errorf("unexpected err: %#v", err)
+	}
+	if plainText != "this text should be encrypted" {
+		t.Errorf("unexpected result: %#v", plainText)
+	}
+
+	_, err = engine.TransformWithPath(encryptedText, "/app2/password")
+	if err != ErrPathNotAllowed {
+		t.Errorf("unexpected err: %#v", err)
+	}
+
+	_, err = engine.Transform(encryptedText)
+	if err != ErrPathNotAllowed {
+		t.Errorf("unexpected err for empty path: %#v", err)
+	}
+}
+
+func TestTransformForWrite(t *testing.T) {
+	engine := NewEngine(testKeychain)
+
+	encryptedText, err := engine.TransformForWrite("ETCVAULT::plain:the-key:this text should be encrypted::ETCVAULT")
+	if err != nil {
+		t.Errorf("unexpected err: %#v", err)
+	}
+	if strings.Index(encryptedText, "ETCVAULT::2:the-key@") != 0 {
+		t.Errorf("unexpected result: %#v", encryptedText)
+	}
+
+	result, err := engine.TransformForWrite(encryptedText)
+	if err != nil {
+		t.Errorf("unexpected err: %#v", err)
+	}
+	if result != encryptedText {
+		t.Errorf("encrypted value shouldn't be decrypted on write: %#v", result)
+	}
+
+	result, err = engine.TransformForWrite("plain text")
+	if err != nil {
+		t.Errorf("unexpected err: %#v", err)
+	}
+	if result != "plain text" {
+		t.Errorf("unexpected result: %#v", result)
+	}
+}
+
+func TestTransformV1FingerprintMismatch(t *testing.T) {
+	engine := NewEngine(testKeychain)
+	_, err := engine.Transform("ETCVAULT::2:the-key@0000000000000000::oXKv3edU7AjUXK1+7+Ng7y5tjByLzMe8MRL2lCxlsE03pHS2AXnd3mvar5dkbgeTU4dY8lcMPYAqRGXi2y9YJ7MD+8vKpkORczLYOBTiSXY8cuttvWY+ffjeJMSsLiHn0tDdtjvCtshSBTe9vLz75yyW8J91DUm9CriHWtQhaXw=::ETCVAULT")
+
+	mismatchErr, ok := err.(*KeyFingerprintMismatchError)
+	if !ok {
+		t.Fatalf("unexpected err: %#v", err)
+	}
+	if mismatchErr.Expected != "0000000000000000" || mismatchErr.Actual != "318e40c9eb5ee156" {
+		t.Errorf("unexpected err: %#v", mismatchErr)
+	}
+}
+
+func TestTransformWithRevokedKey(t *testing.T) {
+	encryptedText, _ := NewEngine(testKeychain).Transform("ETCVAULT::plain:the-key:this text should be encrypted::ETCVAULT")
+
+	engine := NewEngine(testKeychain)
+	engine.RevocationList = keys.NewRevocationList()
+	engine.RevocationList.Load([]byte("@318e40c9eb5ee156\n"))
+
+	if _, err := engine.Transform(encryptedText); err != ErrKeyRevoked {
+		t.Errorf("unexpected err: %#v", err)
+	}
+	if _, err := engine.Transform("ETCVAULT::plain:the-key:this text should be encrypted::ETCVAULT"); err != ErrKeyRevoked {
+		t.Errorf("unexpected err: %#v", err)
+	}
+
+	jsonData := []byte(`{"node":{"key":"/secret","value":"` + encryptedText + `"}}`)
+	transformedJson, _ := engine.TransformEtcdJsonResponse(jsonData)
+	if !strings.Contains(string(transformedJson), `"_etcvault_error":"key has been revoked"`) {
+		t.Errorf("unexpected json: %s", transformedJson)
+	}
+}
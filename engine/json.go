@@ -1,70 +1,259 @@
 package engine
 
 import (
+	"bytes"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"runtime"
+	"sync"
+	"sync/atomic"
 )
 
+var ErrMalformedJson = errors.New("malformed JSON")
+
+var containerPattern = regexp.MustCompile(`ETCVAULT::.*?::ETCVAULT`)
+
+const redactedContainer = "ETCVAULT::redacted::ETCVAULT"
+
+// redactContainers replaces containers in text, so ciphertexts (and plain values to be encrypted) don't appear in messages.
+func redactContainers(text string) string {
+	return containerPattern.ReplaceAllString(text, redactedContainer)
+}
+
+// ResponseOptions controls how values in etcd JSON responses are transformed.
+type ResponseOptions struct {
+	// OmitMetadata omits _etcvault (version and container) and _etcvault_error from transformed nodes.
+	OmitMetadata bool
+	// Strict makes transformation fail with TransformFailedError when any value couldn't be transformed,
+	// instead of leaving the value as is.
+	Strict bool
+}
+
+// TransformFailedError is returned in strict mode, for the first value couldn't be transformed.
+type TransformFailedError struct {
+	Key string
+	Err error
+}
+
+func (err *TransformFailedError) Error() string {
+	return fmt.Sprintf("couldn't transform value of %s: %s", err.Key, err.Err.Error())
+}
+
 // transform node.value, node.**.nodes[].value, prevNode.value, prevNode.**.nodes[].value.
+// For error responses, containers in cause and message are redacted; e.g. "Compare failed" error of
+// compareAndSwap and compareAndDelete has a stored value in its cause.
+// Only these values are rewritten (and metadata is added next to values); the rest of jsonData is kept
+// byte-identical, including precision of numbers and order of keys.
 func (engine *Engine) TransformEtcdJsonResponse(jsonData []byte) ([]byte, error) {
-	var data interface{}
-	json.Unmarshal(jsonData, &data)
+	return engine.TransformEtcdJsonResponseWithOptions(jsonData, ResponseOptions{})
+}
 
-	root, ok := data.(map[string]interface{})
-	if !ok {
-		return jsonData, nil
+func (engine *Engine) TransformEtcdJsonResponseWithOptions(jsonData []byte, options ResponseOptions) ([]byte, error) {
+	if !json.Valid(jsonData) {
+		return nil, ErrMalformedJson
 	}
 
-	if nodeRaw, ok := root["node"]; ok {
-		if node, ok := nodeRaw.(map[string]interface{}); ok {
-			engine.transformEtcdJsonResponse0(&node, 0)
+	members := jsonObjectMembers(jsonData, jsonRoot(jsonData))
+	isError := false
+	for _, member := range members {
+		if member.name == "errorCode" {
+			isError = true
 		}
 	}
 
-	if nodeRaw, ok := root["prevNode"]; ok {
-		if node, ok := nodeRaw.(map[string]interface{}); ok {
-			engine.transformEtcdJsonResponse0(&node, 0)
+	edits := []jsonEdit{}
+	targets := []jsonValueTarget{}
+	for _, member := range members {
+		switch member.name {
+		case "node", "prevNode":
+			targets = collectEtcdNodeValues(jsonData, member.value, targets, 0)
+		case "cause", "message":
+			if !isError {
+				continue
+			}
+			if str, ok := decodeJsonString(jsonData, member.value); ok {
+				if redacted := redactContainers(str); redacted != str {
+					replacement, _ := json.Marshal(redacted)
+					edits = append(edits, jsonEdit{span: member.value, replacement: replacement})
+				}
+			}
 		}
 	}
 
-	return json.Marshal(data)
+	valueEdits, err := engine.transformJsonValues(jsonData, targets, options)
+	if err != nil {
+		return nil, err
+	}
+
+	return applyJsonEdits(jsonData, append(edits, valueEdits...)), nil
 }
 
-func (engine *Engine) transformEtcdJsonResponse0(nodePtr *map[string]interface{}, depth int) {
+func collectEtcdNodeValues(data []byte, span jsonSpan, targets []jsonValueTarget, depth int) []jsonValueTarget {
 	if depth > 100 {
-		return
+		return targets
+	}
+
+	members := jsonObjectMembers(data, span)
+
+	path := ""
+	for _, member := range members {
+		if member.name == "key" {
+			path, _ = decodeJsonString(data, member.value)
+		}
+	}
+
+	for _, member := range members {
+		switch member.name {
+		case "value":
+			if data[member.value.start] == '"' {
+				targets = append(targets, jsonValueTarget{span: member.value, path: path})
+			}
+		case "nodes":
+			for _, subNode := range jsonArrayElements(data, member.value) {
+				targets = collectEtcdNodeValues(data, subNode, targets, depth+1)
+			}
+		}
 	}
 
-	node := *nodePtr
+	return targets
+}
+
+// jsonValueTarget is a string value in a JSON document to transform.
+type jsonValueTarget struct {
+	span jsonSpan
+	path string
+	// v3 JSON gateway encodes values in base64
+	base64 bool
+}
 
-	if value, ok := node["value"]; ok {
-		if str, ok := value.(string); ok {
-			newValue, container, err := engine.TransformAndParse(str)
-			if err == nil {
-				node["value"] = newValue
-				if container != nil {
-					node["_etcvault"] = map[string]interface{}{
-						"version":   container.Version(),
-						"container": container,
+func (engine *Engine) concurrency() int {
+	if engine.Concurrency > 0 {
+		return engine.Concurrency
+	}
+	return runtime.GOMAXPROCS(0)
+}
+
+// transformJsonValues transforms targets with a bounded pool of workers. Edits are kept in the order of targets,
+// and in strict mode the error for the first failed target is returned, so results don't depend on scheduling.
+func (engine *Engine) transformJsonValues(data []byte, targets []jsonValueTarget, options ResponseOptions) ([]jsonEdit, error) {
+	type result struct {
+		edit    jsonEdit
+		changed bool
+		err     error
+	}
+	results := make([]result, len(targets))
+
+	workers := engine.concurrency()
+	if workers > len(targets) {
+		workers = len(targets)
+	}
+	if workers <= 1 {
+		for i, target := range targets {
+			edit, changed, err := engine.transformJsonValue(data, target, options)
+			if err != nil {
+				return nil, err
+			}
+			results[i] = result{edit, changed, nil}
+		}
+	} else {
+		var failed int32
+		indices := make(chan int)
+		var wg sync.WaitGroup
+		for w := 0; w < workers; w++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := range indices {
+					edit, changed, err := engine.transformJsonValue(data, targets[i], options)
+					if err != nil {
+						atomic.StoreInt32(&failed, 1)
 					}
+					results[i] = result{edit, changed, err}
 				}
-			} else {
-				node["_etcvault_error"] = err.Error()
+			}()
+		}
+		// stop handing out targets once any of them failed; the response is an error anyway
+		for i := range targets {
+			if atomic.LoadInt32(&failed) != 0 {
+				break
 			}
+			indices <- i
 		}
+		close(indices)
+		wg.Wait()
 	}
 
-	if nodesRaw, ok := node["nodes"]; ok {
-		if nodes, ok := nodesRaw.([]interface{}); ok {
-			for _, subNodeRaw := range nodes {
-				subNode, ok := subNodeRaw.(map[string]interface{})
-				if !ok {
-					continue
-				}
+	edits := []jsonEdit{}
+	for _, r := range results {
+		if r.err != nil {
+			return nil, r.err
+		}
+		if r.changed {
+			edits = append(edits, r.edit)
+		}
+	}
+	return edits, nil
+}
 
-				engine.transformEtcdJsonResponse0(&subNode, depth+1)
-			}
+// transformJsonValue returns an edit replacing the value with transformed one, followed by metadata.
+// When the value couldn't be transformed, it's left as is, or TransformFailedError is returned in strict mode.
+func (engine *Engine) transformJsonValue(data []byte, target jsonValueTarget, options ResponseOptions) (jsonEdit, bool, error) {
+	text, _ := decodeJsonString(data, target.span)
+	if target.base64 {
+		decoded, err := base64.StdEncoding.DecodeString(text)
+		if err != nil {
+			return jsonEdit{}, false, nil
+		}
+		text = string(decoded)
+	}
+
+	var metadataName string
+	var metadata interface{}
+	newValue, container, err := engine.TransformAndParseWithPath(text, target.path)
+	if err != nil {
+		if options.Strict {
+			return jsonEdit{}, false, &TransformFailedError{Key: target.path, Err: err}
+		}
+		newValue = text
+		metadataName, metadata = "_etcvault_error", err.Error()
+	} else if container != nil {
+		metadataName, metadata = "_etcvault", map[string]interface{}{
+			"version":   container.Version(),
+			"container": container,
+		}
+	}
+	if options.OmitMetadata {
+		metadata = nil
+	}
+
+	if newValue == text && metadata == nil {
+		return jsonEdit{}, false, nil
+	}
+
+	var buf bytes.Buffer
+	if newValue == text {
+		buf.Write(data[target.span.start:target.span.end])
+	} else {
+		if target.base64 {
+			newValue = base64.StdEncoding.EncodeToString([]byte(newValue))
+		}
+		encodedValue, err := json.Marshal(newValue)
+		if err != nil {
+			return jsonEdit{}, false, err
+		}
+		buf.Write(encodedValue)
+	}
+	if metadata != nil {
+		encodedMetadata, err := json.Marshal(metadata)
+		if err != nil {
+			return jsonEdit{}, false, err
 		}
+		fmt.Fprintf(&buf, `,"%s":`, metadataName)
+		buf.Write(encodedMetadata)
 	}
 
-	return
+	return jsonEdit{span: target.span, replacement: buf.Bytes()}, true, nil
 }
@@ -1,6 +1,10 @@
 package engine
 
 import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/sorah/etcvault/keys"
 	"reflect"
 	"testing"
 )
@@ -14,37 +18,37 @@ func TestTransformEtcdJsonResponse(t *testing.T) {
 		{
 			Name:   "non-container (node.value)",
 			Case:   []byte(`{"node": {"value": "non-container"}}`),
-			Expect: []byte(`{"node":{"value":"non-container"}}`),
+			Expect: []byte(`{"node": {"value": "non-container"}}`),
 		},
 		{
 			Name:   "plain (node.value)",
 			Case:   []byte(`{"node": {"value": "ETCVAULT::asis:plain::ETCVAULT"}}`),
-			Expect: []byte(`{"node":{"_etcvault":{"container":{"Content":"plain"},"version":"asis"},"value":"plain"}}`),
+			Expect: []byte(`{"node": {"value": "plain","_etcvault":{"container":{"Content":"plain"},"version":"asis"}}}`),
 		},
 		{
 			Name:   "plain (prevNode.value)",
 			Case:   []byte(`{"prevNode": {"value": "ETCVAULT::asis:plain::ETCVAULT"}}`),
-			Expect: []byte(`{"prevNode":{"_etcvault":{"container":{"Content":"plain"},"version":"asis"},"value":"plain"}}`),
+			Expect: []byte(`{"prevNode": {"value": "plain","_etcvault":{"container":{"Content":"plain"},"version":"asis"}}}`),
 		},
 		{
 			Name:   "both (node.value, prevNode.value)",
 			Case:   []byte(`{"node": {"value": "ETCVAULT::asis:plain::ETCVAULT"}, "prevNode": {"value": "ETCVAULT::asis:plain::ETCVAULT"}}`),
-			Expect: []byte(`{"node":{"_etcvault":{"container":{"Content":"plain"},"version":"asis"},"value":"plain"},"prevNode":{"_etcvault":{"container":{"Content":"plain"},"version":"asis"},"value":"plain"}}`),
+			Expect: []byte(`{"node": {"value": "plain","_etcvault":{"container":{"Content":"plain"},"version":"asis"}}, "prevNode": {"value": "plain","_etcvault":{"container":{"Content":"plain"},"version":"asis"}}}`),
 		},
 		{
 			Name:   "inside directory (node.nodes[0].value)",
 			Case:   []byte(`{"node": {"nodes": [{"value": "ETCVAULT::asis:plain::ETCVAULT"}]}}`),
-			Expect: []byte(`{"node":{"nodes":[{"_etcvault":{"container":{"Content":"plain"},"version":"asis"},"value":"plain"}]}}`),
+			Expect: []byte(`{"node": {"nodes": [{"value": "plain","_etcvault":{"container":{"Content":"plain"},"version":"asis"}}]}}`),
 		},
 		{
 			Name:   "inside directory, multiple (node.nodes[0].value, node.nodes[1].value)",
 			Case:   []byte(`{"node": {"nodes": [{"value": "ETCVAULT::asis:plain::ETCVAULT"}, {"value": "ETCVAULT::asis:plain::ETCVAULT"}]}}`),
-			Expect: []byte(`{"node":{"nodes":[{"_etcvault":{"container":{"Content":"plain"},"version":"asis"},"value":"plain"},{"_etcvault":{"container":{"Content":"plain"},"version":"asis"},"value":"plain"}]}}`),
+			Expect: []byte(`{"node": {"nodes": [{"value": "plain","_etcvault":{"container":{"Content":"plain"},"version":"asis"}}, {"value": "plain","_etcvault":{"container":{"Content":"plain"},"version":"asis"}}]}}`),
 		},
 		{
 			Name:   "nested, inside directory (node.nodes[0].nodes[0].value)",
 			Case:   []byte(`{"node": {"nodes": [{"nodes": [{"value": "ETCVAULT::asis:plain::ETCVAULT"}]}]}}`),
-			Expect: []byte(`{"node":{"nodes":[{"nodes":[{"_etcvault":{"container":{"Content":"plain"},"version":"asis"},"value":"plain"}]}]}}`),
+			Expect: []byte(`{"node": {"nodes": [{"nodes": [{"value": "plain","_etcvault":{"container":{"Content":"plain"},"version":"asis"}}]}]}}`),
 		},
 	}
 
@@ -72,32 +76,32 @@ func TestTransformEtcdJsonResponseFailures(t *testing.T) {
 		{
 			Name:   "plain (node.value)",
 			Case:   []byte(`{"node": {"value": "ETCVAULT::plain1::ETCVAULT"}}`),
-			Expect: []byte(`{"node":{"_etcvault_error":"couldn't parse","value":"ETCVAULT::plain1::ETCVAULT"}}`),
+			Expect: []byte(`{"node": {"value": "ETCVAULT::plain1::ETCVAULT","_etcvault_error":"couldn't parse"}}`),
 		},
 		{
 			Name:   "plain (prevNode.value)",
 			Case:   []byte(`{"prevNode": {"value": "ETCVAULT::plain1::ETCVAULT"}}`),
-			Expect: []byte(`{"prevNode":{"_etcvault_error":"couldn't parse","value":"ETCVAULT::plain1::ETCVAULT"}}`),
+			Expect: []byte(`{"prevNode": {"value": "ETCVAULT::plain1::ETCVAULT","_etcvault_error":"couldn't parse"}}`),
 		},
 		{
 			Name:   "both (node.value, prevNode.value)",
 			Case:   []byte(`{"node": {"value": "ETCVAULT::plain1::ETCVAULT"}, "prevNode": {"value": "ETCVAULT::plain1::ETCVAULT"}}`),
-			Expect: []byte(`{"node":{"_etcvault_error":"couldn't parse","value":"ETCVAULT::plain1::ETCVAULT"},"prevNode":{"_etcvault_error":"couldn't parse","value":"ETCVAULT::plain1::ETCVAULT"}}`),
+			Expect: []byte(`{"node": {"value": "ETCVAULT::plain1::ETCVAULT","_etcvault_error":"couldn't parse"}, "prevNode": {"value": "ETCVAULT::plain1::ETCVAULT","_etcvault_error":"couldn't parse"}}`),
 		},
 		{
 			Name:   "inside directory (node.nodes[0].value)",
 			Case:   []byte(`{"node": {"nodes": [{"value": "ETCVAULT::plain1::ETCVAULT"}]}}`),
-			Expect: []byte(`{"node":{"nodes":[{"_etcvault_error":"couldn't parse","value":"ETCVAULT::plain1::ETCVAULT"}]}}`),
+			Expect: []byte(`{"node": {"nodes": [{"value": "ETCVAULT::plain1::ETCVAULT","_etcvault_error":"couldn't parse"}]}}`),
 		},
 		{
 			Name:   "inside directory, multiple (node.nodes[0].value, node.nodes[1].value)",
 			Case:   []byte(`{"node": {"nodes": [{"value": "ETCVAULT::plain1::ETCVAULT"}, {"value": "ETCVAULT::plain1::ETCVAULT"}]}}`),
-			Expect: []byte(`{"node":{"nodes":[{"_etcvault_error":"couldn't parse","value":"ETCVAULT::plain1::ETCVAULT"},{"_etcvault_error":"couldn't parse","value":"ETCVAULT::plain1::ETCVAULT"}]}}`),
+			Expect: []byte(`{"node": {"nodes": [{"value": "ETCVAULT::plain1::ETCVAULT","_etcvault_error":"couldn't parse"}, {"value": "ETCVAULT::plain1::ETCVAULT","_etcvault_error":"couldn't parse"}]}}`),
 		},
 		{
 			Name:   "nested, inside directory (node.nodes[0].nodes[0].value)",
 			Case:   []byte(`{"node": {"nodes": [{"nodes": [{"value": "ETCVAULT::plain1::ETCVAULT"}]}]}}`),
-			Expect: []byte(`{"node":{"nodes":[{"nodes":[{"_etcvault_error":"couldn't parse","value":"ETCVAULT::plain1::ETCVAULT"}]}]}}`),
+			Expect: []byte(`{"node": {"nodes": [{"nodes": [{"value": "ETCVAULT::plain1::ETCVAULT","_etcvault_error":"couldn't parse"}]}]}}`),
 		},
 	}
 
@@ -115,3 +119,276 @@ func TestTransformEtcdJsonResponseFailures(t *testing.T) {
 		}
 	}
 }
+
+func TestTransformEtcdJsonResponseAllowedPaths(t *testing.T) {
+	encryptedText, _ := NewEngine(testKeychain).Transform("ETCVAULT::plain:the-key:secret::ETCVAULT")
+
+	engine := NewEngine(keys.NewMemoryStore([]*keys.Key{testKeyWithMetadata(func(key *keys.Key) {
+		key.AllowedPaths = []string{"/app1/"}
+	})}))
+
+	jsonData := []byte(`{"node": {"key": "/", "dir": true, "nodes": [{"key": "/app1/password", "value": "` + encryptedText + `"}, {"key": "/app2/password", "value": "` + encryptedText + `"}]}}`)
+	transformedJson, err := engine.TransformEtcdJsonResponse(jsonData)
+	if err != nil {
+		t.Errorf("unexpected err: %s", err.Error())
+	}
+
+	var data struct {
+		Node struct {
+			Nodes []map[string]interface{}
+		}
+	}
+	json.Unmarshal(transformedJson, &data)
+
+	if data.Node.Nodes[0]["value"] != "secret" {
+		t.Errorf("unexpected value in allowed path: %#v", data.Node.Nodes[0])
+	}
+	if data.Node.Nodes[1]["value"] != encryptedText || data.Node.Nodes[1]["_etcvault_error"] != ErrPathNotAllowed.Error() {
+		t.Errorf("unexpected value in disallowed path: %#v", data.Node.Nodes[1])
+	}
+}
+
+func TestTransformEtcdJsonResponseActions(t *testing.T) {
+	const c = "ETCVAULT::asis:plain::ETCVAULT"
+	const meta = `"_etcvault":{"container":{"Content":"plain"},"version":"asis"}`
+
+	tests := []struct {
+		Name   string
+		Case   string
+		Expect string
+	}{
+		{
+			Name:   "get",
+			Case:   `{"action":"get","node":{"key":"/a","value":"` + c + `","modifiedIndex":2,"createdIndex":2}}`,
+			Expect: `{"action":"get","node":{"key":"/a","value":"plain",` + meta + `,"modifiedIndex":2,"createdIndex":2}}`,
+		},
+		{
+			Name:   "get (recursive directory)",
+			Case:   `{"action":"get","node":{"key":"/d","dir":true,"nodes":[{"key":"/d/a","value":"` + c + `"},{"key":"/d/e","dir":true,"nodes":[{"key":"/d/e/b","value":"` + c + `"}]}]}}`,
+			Expect: `{"action":"get","node":{"key":"/d","dir":true,"nodes":[{"key":"/d/a","value":"plain",` + meta + `},{"key":"/d/e","dir":true,"nodes":[{"key":"/d/e/b","value":"plain",` + meta + `}]}]}}`,
+		},
+		{
+			Name:   "set",
+			Case:   `{"action":"set","node":{"key":"/a","value":"` + c + `"},"prevNode":{"key":"/a","value":"` + c + `"}}`,
+			Expect: `{"action":"set","node":{"key":"/a","value":"plain",` + meta + `},"prevNode":{"key":"/a","value":"plain",` + meta + `}}`,
+		},
+		{
+			Name:   "create (in-order key)",
+			Case:   `{"action":"create","node":{"key":"/q/00000000000000000003","value":"` + c + `"}}`,
+			Expect: `{"action":"create","node":{"key":"/q/00000000000000000003","value":"plain",` + meta + `}}`,
+		},
+		{
+			Name:   "update",
+			Case:   `{"action":"update","node":{"key":"/a","value":"` + c + `","ttl":30,"expiration":"2015-01-01T00:00:00Z"},"prevNode":{"key":"/a","value":"` + c + `"}}`,
+			Expect: `{"action":"update","node":{"key":"/a","value":"plain",` + meta + `,"ttl":30,"expiration":"2015-01-01T00:00:00Z"},"prevNode":{"key":"/a","value":"plain",` + meta + `}}`,
+		},
+		{
+			Name:   "compareAndSwap",
+			Case:   `{"action":"compareAndSwap","node":{"key":"/a","value":"` + c + `"},"prevNode":{"key":"/a","value":"` + c + `"}}`,
+			Expect: `{"action":"compareAndSwap","node":{"key":"/a","value":"plain",` + meta + `},"prevNode":{"key":"/a","value":"plain",` + meta + `}}`,
+		},
+		{
+			Name:   "delete",
+			Case:   `{"action":"delete","node":{"key":"/a","modifiedIndex":5},"prevNode":{"key":"/a","value":"` + c + `","modifiedIndex":4}}`,
+			Expect: `{"action":"delete","node":{"key":"/a","modifiedIndex":5},"prevNode":{"key":"/a","value":"plain",` + meta + `,"modifiedIndex":4}}`,
+		},
+		{
+			Name:   "delete (recursive directory)",
+			Case:   `{"action":"delete","node":{"key":"/d","dir":true},"prevNode":{"key":"/d","dir":true}}`,
+			Expect: `{"action":"delete","node":{"key":"/d","dir":true},"prevNode":{"key":"/d","dir":true}}`,
+		},
+		{
+			Name:   "compareAndDelete",
+			Case:   `{"action":"compareAndDelete","node":{"key":"/a"},"prevNode":{"key":"/a","value":"` + c + `"}}`,
+			Expect: `{"action":"compareAndDelete","node":{"key":"/a"},"prevNode":{"key":"/a","value":"plain",` + meta + `}}`,
+		},
+		{
+			Name:   "expire",
+			Case:   `{"action":"expire","node":{"key":"/a","modifiedIndex":6},"prevNode":{"key":"/a","value":"` + c + `","ttl":1,"expiration":"2015-01-01T00:00:00Z"}}`,
+			Expect: `{"action":"expire","node":{"key":"/a","modifiedIndex":6},"prevNode":{"key":"/a","value":"plain",` + meta + `,"ttl":1,"expiration":"2015-01-01T00:00:00Z"}}`,
+		},
+		{
+			Name:   "error, compare failed (prevValue)",
+			Case:   `{"errorCode":101,"message":"Compare failed","cause":"[ETCVAULT::plain:the-key:guess::ETCVAULT != ETCVAULT::1:the-key::c2VjcmV0::ETCVAULT]","index":6}`,
+			Expect: `{"errorCode":101,"message":"Compare failed","cause":"[` + redactedContainer + ` != ` + redactedContainer + `]","index":6}`,
+		},
+		{
+			Name:   "error, compare failed (prevValue and prevIndex)",
+			Case:   `{"errorCode":101,"message":"Compare failed","cause":"[guess != ETCVAULT::1:the-key:long:a2V5,c2VjcmV0::ETCVAULT] [5 != 6]","index":6}`,
+			Expect: `{"errorCode":101,"message":"Compare failed","cause":"[guess != ` + redactedContainer + `] [5 != 6]","index":6}`,
+		},
+		{
+			Name:   "error, key not found",
+			Case:   `{"errorCode":100,"message":"Key not found","cause":"/a","index":6}`,
+			Expect: `{"errorCode":100,"message":"Key not found","cause":"/a","index":6}`,
+		},
+	}
+
+	engine := NewEngine(testKeychain)
+
+	for _, test := range tests {
+		transformedJson, err := engine.TransformEtcdJsonResponse([]byte(test.Case))
+
+		if err != nil {
+			t.Errorf("%s:\n\tunexpected err: %s", test.Name, err.Error())
+		}
+
+		if string(transformedJson) != test.Expect {
+			t.Errorf("%s:\n\t  expected result: %s\n\tunexpected result: %s", test.Name, test.Expect, transformedJson)
+		}
+	}
+}
+
+func TestTransformEtcdJsonResponseWithOptions(t *testing.T) {
+	tests := []struct {
+		Name    string
+		Options ResponseOptions
+		Case    string
+		Expect  string
+		Err     string
+	}{
+		{
+			Name:    "omit metadata",
+			Options: ResponseOptions{OmitMetadata: true},
+			Case:    `{"node":{"key":"/d","nodes":[{"key":"/d/a","value":"ETCVAULT::asis:plain::ETCVAULT"},{"key":"/d/b","value":"ETCVAULT::plain1::ETCVAULT"}]}}`,
+			Expect:  `{"node":{"key":"/d","nodes":[{"key":"/d/a","value":"plain"},{"key":"/d/b","value":"ETCVAULT::plain1::ETCVAULT"}]}}`,
+		},
+		{
+			Name:    "strict",
+			Options: ResponseOptions{Strict: true},
+			Case:    `{"node":{"key":"/d","nodes":[{"key":"/d/a","value":"ETCVAULT::asis:plain::ETCVAULT"},{"key":"/d/b","value":"ETCVAULT::plain1::ETCVAULT"}]}}`,
+			Err:     "couldn't transform value of /d/b: couldn't parse",
+		},
+		{
+			Name:    "strict (prevNode)",
+			Options: ResponseOptions{Strict: true},
+			Case:    `{"node":{"key":"/a"},"prevNode":{"key":"/a","value":"ETCVAULT::plain1::ETCVAULT"}}`,
+			Err:     "couldn't transform value of /a: couldn't parse",
+		},
+		{
+			Name:    "strict, succeeded",
+			Options: ResponseOptions{Strict: true, OmitMetadata: true},
+			Case:    `{"node":{"key":"/a","value":"ETCVAULT::asis:plain::ETCVAULT"}}`,
+			Expect:  `{"node":{"key":"/a","value":"plain"}}`,
+		},
+	}
+
+	engine := NewEngine(testKeychain)
+
+	for _, test := range tests {
+		transformedJson, err := engine.TransformEtcdJsonResponseWithOptions([]byte(test.Case), test.Options)
+
+		if test.Err != "" {
+			if _, ok := err.(*TransformFailedError); !ok || err.Error() != test.Err {
+				t.Errorf("%s:\n\tunexpected err: %#v", test.Name, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s:\n\tunexpected err: %s", test.Name, err.Error())
+		}
+		if string(transformedJson) != test.Expect {
+			t.Errorf("%s:\n\t  expected result: %s\n\tunexpected result: %s", test.Name, test.Expect, transformedJson)
+		}
+	}
+}
+
+func TestTransformEtcdJsonResponsePreservesDocument(t *testing.T) {
+	tests := []struct {
+		Name   string
+		Case   string
+		Expect string
+	}{
+		{
+			Name:   "large index",
+			Case:   `{"action":"get","node":{"key":"/a","value":"ETCVAULT::asis:plain::ETCVAULT","modifiedIndex":9007199254740993,"createdIndex":18446744073709551615}}`,
+			Expect: `{"action":"get","node":{"key":"/a","value":"plain","_etcvault":{"container":{"Content":"plain"},"version":"asis"},"modifiedIndex":9007199254740993,"createdIndex":18446744073709551615}}`,
+		},
+		{
+			Name:   "unknown fields, spaces, and newline",
+			Case:   "{ \"zzz\" : [1.50, {\"value\": \"ETCVAULT::asis:x::ETCVAULT\"}],\n \"node\" :\t{ \"value\" : \"ETCVAULT::asis:plain::ETCVAULT\" , \"ttl\" : 1e3 } }\n",
+			Expect: "{ \"zzz\" : [1.50, {\"value\": \"ETCVAULT::asis:x::ETCVAULT\"}],\n \"node\" :\t{ \"value\" : \"plain\",\"_etcvault\":{\"container\":{\"Content\":\"plain\"},\"version\":\"asis\"} , \"ttl\" : 1e3 } }\n",
+		},
+		{
+			Name:   "escaped strings",
+			Case:   `{"node":{"key":"/\u0061\"b","value":"ETCVAULT::asis:\u3042\n\"::ETCVAULT"}}`,
+			Expect: `{"node":{"key":"/\u0061\"b","value":"あ\n\"","_etcvault":{"container":{"Content":"あ\n\""},"version":"asis"}}}`,
+		},
+		{
+			Name:   "non-string value",
+			Case:   `{"node":{"key":"/a","value":null,"nodes":{"value":"ETCVAULT::asis:plain::ETCVAULT"}}}`,
+			Expect: `{"node":{"key":"/a","value":null,"nodes":{"value":"ETCVAULT::asis:plain::ETCVAULT"}}}`,
+		},
+		{
+			Name:   "not an object",
+			Case:   `["ETCVAULT::asis:plain::ETCVAULT"]`,
+			Expect: `["ETCVAULT::asis:plain::ETCVAULT"]`,
+		},
+	}
+
+	engine := NewEngine(testKeychain)
+
+	for _, test := range tests {
+		transformedJson, err := engine.TransformEtcdJsonResponse([]byte(test.Case))
+
+		if err != nil {
+			t.Errorf("%s:\n\tunexpected err: %s", test.Name, err.Error())
+		}
+
+		if string(transformedJson) != test.Expect {
+			t.Errorf("%s:\n\t  expected result: %s\n\tunexpected result: %s", test.Name, test.Expect, transformedJson)
+		}
+	}
+}
+
+func TestTransformEtcdJsonResponseMalformed(t *testing.T) {
+	engine := NewEngine(testKeychain)
+
+	for _, jsonData := range []string{``, `{"node":{"key":"`, `{"node":{}} {}`, `{"node":{"value":"a"},}`} {
+		if _, err := engine.TransformEtcdJsonResponse([]byte(jsonData)); err != ErrMalformedJson {
+			t.Errorf("%#v: unexpected err: %#v", jsonData, err)
+		}
+	}
+}
+
+func TestTransformEtcdJsonResponseConcurrency(t *testing.T) {
+	var buf bytes.Buffer
+	buf.WriteString(`{"node":{"key":"/d","nodes":[`)
+	for i := 0; i < 200; i++ {
+		if i > 0 {
+			buf.WriteString(",")
+		}
+		value := fmt.Sprintf("ETCVAULT::asis:%d::ETCVAULT", i)
+		if i%50 == 7 {
+			value = "ETCVAULT::plain1::ETCVAULT"
+		}
+		fmt.Fprintf(&buf, `{"key":"/d/%d","value":%q}`, i, value)
+	}
+	buf.WriteString(`]}}`)
+	jsonData := buf.Bytes()
+
+	serialEngine := NewEngine(testKeychain)
+	serialEngine.Concurrency = 1
+	expected, err := serialEngine.TransformEtcdJsonResponse(jsonData)
+	if err != nil {
+		t.Fatalf("unexpected err: %s", err.Error())
+	}
+
+	for _, concurrency := range []int{0, 2, 8, 500} {
+		engine := NewEngine(testKeychain)
+		engine.Concurrency = concurrency
+
+		for i := 0; i < 10; i++ {
+			transformedJson, err := engine.TransformEtcdJsonResponse(jsonData)
+			if err != nil || !bytes.Equal(transformedJson, expected) {
+				t.Fatalf("concurrency %d: unexpected result: %s, %#v", concurrency, transformedJson, err)
+			}
+
+			// the first failed node is reported, whichever finished first
+			_, err = engine.TransformEtcdJsonResponseWithOptions(jsonData, ResponseOptions{Strict: true})
+			if failure, ok := err.(*TransformFailedError); !ok || failure.Key != "/d/7" {
+				t.Fatalf("concurrency %d: unexpected err: %#v", concurrency, err)
+			}
+		}
+	}
+}
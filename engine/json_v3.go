@@ -0,0 +1,89 @@
+package engine
+
+import (
+	"encoding/base64"
+	"encoding/json"
+)
+
+// TransformEtcdV3JsonResponse transforms values in responses of v3 JSON gateway:
+// kvs[].value (range), prev_kv.value (put), prev_kvs[].value (deleterange),
+// result.events[].kv.value, result.events[].prev_kv.value (a message of watch stream),
+// and responses[].response_range, response_put, response_delete_range of txn, recursively for nested txn.
+// The gateway encodes keys and values in base64. Like TransformEtcdJsonResponse, the rest is kept as is.
+func (engine *Engine) TransformEtcdV3JsonResponse(jsonData []byte) ([]byte, error) {
+	return engine.TransformEtcdV3JsonResponseWithOptions(jsonData, ResponseOptions{})
+}
+
+func (engine *Engine) TransformEtcdV3JsonResponseWithOptions(jsonData []byte, options ResponseOptions) ([]byte, error) {
+	if !json.Valid(jsonData) {
+		return nil, ErrMalformedJson
+	}
+
+	targets := collectEtcdV3ResponseValues(jsonData, jsonRoot(jsonData), []jsonValueTarget{})
+
+	edits, err := engine.transformJsonValues(jsonData, targets, options)
+	if err != nil {
+		return nil, err
+	}
+
+	return applyJsonEdits(jsonData, edits), nil
+}
+
+func collectEtcdV3ResponseValues(data []byte, span jsonSpan, targets []jsonValueTarget) []jsonValueTarget {
+	for _, member := range jsonObjectMembers(data, span) {
+		switch member.name {
+		case "kvs", "prev_kvs":
+			for _, kv := range jsonArrayElements(data, member.value) {
+				targets = collectEtcdV3KvValue(data, kv, targets)
+			}
+		case "prev_kv":
+			targets = collectEtcdV3KvValue(data, member.value, targets)
+		case "result":
+			for _, resultMember := range jsonObjectMembers(data, member.value) {
+				if resultMember.name != "events" {
+					continue
+				}
+				for _, event := range jsonArrayElements(data, resultMember.value) {
+					for _, eventMember := range jsonObjectMembers(data, event) {
+						if eventMember.name == "kv" || eventMember.name == "prev_kv" {
+							targets = collectEtcdV3KvValue(data, eventMember.value, targets)
+						}
+					}
+				}
+			}
+		case "responses":
+			for _, op := range jsonArrayElements(data, member.value) {
+				for _, opMember := range jsonObjectMembers(data, op) {
+					switch opMember.name {
+					case "response_range", "response_put", "response_delete_range", "response_txn":
+						targets = collectEtcdV3ResponseValues(data, opMember.value, targets)
+					}
+				}
+			}
+		}
+	}
+	return targets
+}
+
+func collectEtcdV3KvValue(data []byte, span jsonSpan, targets []jsonValueTarget) []jsonValueTarget {
+	members := jsonObjectMembers(data, span)
+
+	path := ""
+	for _, member := range members {
+		if member.name != "key" {
+			continue
+		}
+		encodedKey, _ := decodeJsonString(data, member.value)
+		if key, err := base64.StdEncoding.DecodeString(encodedKey); err == nil {
+			path = string(key)
+		}
+	}
+
+	for _, member := range members {
+		if member.name == "value" && data[member.value.start] == '"' {
+			targets = append(targets, jsonValueTarget{span: member.value, path: path, base64: true})
+		}
+	}
+
+	return targets
+}
@@ -0,0 +1,148 @@
+package engine
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"github.com/sorah/etcvault/keys"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func b64(str string) string {
+	return base64.StdEncoding.EncodeToString([]byte(str))
+}
+
+// v3Json replaces {{text}} in template with base64 encoded text.
+func v3Json(template string, texts ...string) []byte {
+	for _, text := range texts {
+		template = strings.Replace(template, "{{"+text+"}}", b64(text), -1)
+	}
+	return []byte(template)
+}
+
+func TestTransformEtcdV3JsonResponse(t *testing.T) {
+	container := "ETCVAULT::asis:plain::ETCVAULT"
+	metadata := `"_etcvault":{"container":{"Content":"plain"},"version":"asis"}`
+
+	tests := []struct {
+		Name   string
+		Case   []byte
+		Expect []byte
+	}{
+		{
+			Name:   "non-container (kvs[0].value)",
+			Case:   v3Json(`{"kvs": [{"key": "{{/a}}", "value": "{{non-container}}"}]}`, "/a", "non-container"),
+			Expect: v3Json(`{"kvs": [{"key": "{{/a}}", "value": "{{non-container}}"}]}`, "/a", "non-container"),
+		},
+		{
+			Name:   "range (kvs[].value)",
+			Case:   v3Json(`{"header": {"revision": "9007199254740993"}, "kvs": [{"key": "{{/a}}", "value": "{{`+container+`}}", "mod_revision": "3"}, {"key": "{{/b}}", "value": "{{`+container+`}}"}], "count": "2"}`, "/a", "/b", container),
+			Expect: v3Json(`{"header": {"revision": "9007199254740993"}, "kvs": [{"key": "{{/a}}", "value": "{{plain}}",`+metadata+`, "mod_revision": "3"}, {"key": "{{/b}}", "value": "{{plain}}",`+metadata+`}], "count": "2"}`, "/a", "/b", "plain"),
+		},
+		{
+			Name:   "put (prev_kv.value)",
+			Case:   v3Json(`{"prev_kv": {"key": "{{/a}}", "value": "{{`+container+`}}"}}`, "/a", container),
+			Expect: v3Json(`{"prev_kv": {"key": "{{/a}}", "value": "{{plain}}",`+metadata+`}}`, "/a", "plain"),
+		},
+		{
+			Name:   "deleterange (prev_kvs[].value)",
+			Case:   v3Json(`{"deleted": "1", "prev_kvs": [{"key": "{{/a}}", "value": "{{`+container+`}}"}]}`, "/a", container),
+			Expect: v3Json(`{"deleted": "1", "prev_kvs": [{"key": "{{/a}}", "value": "{{plain}}",`+metadata+`}]}`, "/a", "plain"),
+		},
+		{
+			Name:   "watch (result.events[].kv.value, result.events[].prev_kv.value)",
+			Case:   v3Json(`{"result": {"events": [{"kv": {"key": "{{/a}}", "value": "{{`+container+`}}"}, "prev_kv": {"key": "{{/a}}", "value": "{{`+container+`}}"}}]}}`, "/a", container),
+			Expect: v3Json(`{"result": {"events": [{"kv": {"key": "{{/a}}", "value": "{{plain}}",`+metadata+`}, "prev_kv": {"key": "{{/a}}", "value": "{{plain}}",`+metadata+`}}]}}`, "/a", "plain"),
+		},
+		{
+			Name:   "txn (responses[].response_range, response_put, response_delete_range)",
+			Case:   v3Json(`{"succeeded": true, "responses": [{"response_range": {"kvs": [{"key": "{{/a}}", "value": "{{`+container+`}}"}]}}, {"response_put": {"prev_kv": {"key": "{{/a}}", "value": "{{`+container+`}}"}}}, {"response_delete_range": {"prev_kvs": [{"key": "{{/a}}", "value": "{{`+container+`}}"}]}}]}`, "/a", container),
+			Expect: v3Json(`{"succeeded": true, "responses": [{"response_range": {"kvs": [{"key": "{{/a}}", "value": "{{plain}}",`+metadata+`}]}}, {"response_put": {"prev_kv": {"key": "{{/a}}", "value": "{{plain}}",`+metadata+`}}}, {"response_delete_range": {"prev_kvs": [{"key": "{{/a}}", "value": "{{plain}}",`+metadata+`}]}}]}`, "/a", "plain"),
+		},
+		{
+			Name:   "nested txn (responses[].response_txn.responses[])",
+			Case:   v3Json(`{"responses": [{"response_txn": {"responses": [{"response_range": {"kvs": [{"key": "{{/a}}", "value": "{{`+container+`}}"}]}}]}}]}`, "/a", container),
+			Expect: v3Json(`{"responses": [{"response_txn": {"responses": [{"response_range": {"kvs": [{"key": "{{/a}}", "value": "{{plain}}",`+metadata+`}]}}]}}]}`, "/a", "plain"),
+		},
+		{
+			Name:   "watch, created",
+			Case:   []byte(`{"result": {"header": {"revision": "1"}, "created": true}}`),
+			Expect: []byte(`{"result": {"header": {"revision": "1"}, "created": true}}`),
+		},
+		{
+			Name:   "failure",
+			Case:   v3Json(`{"kvs": [{"key": "{{/a}}", "value": "{{ETCVAULT::plain1::ETCVAULT}}"}]}`, "/a", "ETCVAULT::plain1::ETCVAULT"),
+			Expect: v3Json(`{"kvs": [{"key": "{{/a}}", "value": "{{ETCVAULT::plain1::ETCVAULT}}","_etcvault_error":"couldn't parse"}]}`, "/a", "ETCVAULT::plain1::ETCVAULT"),
+		},
+		{
+			Name:   "invalid base64",
+			Case:   []byte(`{"kvs": [{"key": "!", "value": "!"}]}`),
+			Expect: []byte(`{"kvs": [{"key": "!", "value": "!"}]}`),
+		},
+	}
+
+	engine := NewEngine(testKeychain)
+
+	for _, test := range tests {
+		transformedJson, err := engine.TransformEtcdV3JsonResponse(test.Case)
+
+		if err != nil {
+			t.Errorf("%s:\n\tunexpected err: %s", test.Name, err.Error())
+		}
+
+		if !reflect.DeepEqual(transformedJson, test.Expect) {
+			t.Errorf("%s:\n\t  expected result: %s\n\tunexpected result: %s", test.Name, test.Expect, transformedJson)
+		}
+	}
+}
+
+func TestTransformEtcdV3JsonResponseAllowedPaths(t *testing.T) {
+	encryptedText, _ := NewEngine(testKeychain).Transform("ETCVAULT::plain:the-key:secret::ETCVAULT")
+
+	engine := NewEngine(keys.NewMemoryStore([]*keys.Key{testKeyWithMetadata(func(key *keys.Key) {
+		key.AllowedPaths = []string{"/app1/"}
+	})}))
+
+	jsonData := v3Json(`{"kvs": [{"key": "{{/app1/password}}", "value": "{{`+encryptedText+`}}"}, {"key": "{{/app2/password}}", "value": "{{`+encryptedText+`}}"}]}`, "/app1/password", "/app2/password", encryptedText)
+	transformedJson, err := engine.TransformEtcdV3JsonResponse(jsonData)
+	if err != nil {
+		t.Errorf("unexpected err: %s", err.Error())
+	}
+
+	var data struct {
+		Kvs []map[string]interface{}
+	}
+	json.Unmarshal(transformedJson, &data)
+
+	if data.Kvs[0]["value"] != b64("secret") {
+		t.Errorf("unexpected value in allowed path: %#v", data.Kvs[0])
+	}
+	if data.Kvs[1]["value"] != b64(encryptedText) || data.Kvs[1]["_etcvault_error"] != ErrPathNotAllowed.Error() {
+		t.Errorf("unexpected value in disallowed path: %#v", data.Kvs[1])
+	}
+}
+
+func TestTransformEtcdV3JsonResponseWithOptions(t *testing.T) {
+	engine := NewEngine(testKeychain)
+	jsonData := v3Json(`{"kvs": [{"key": "{{/a}}", "value": "{{ETCVAULT::asis:plain::ETCVAULT}}"}]}`, "/a", "ETCVAULT::asis:plain::ETCVAULT")
+
+	transformedJson, err := engine.TransformEtcdV3JsonResponseWithOptions(jsonData, ResponseOptions{OmitMetadata: true})
+	if expected := v3Json(`{"kvs": [{"key": "{{/a}}", "value": "{{plain}}"}]}`, "/a", "plain"); err != nil || !reflect.DeepEqual(transformedJson, expected) {
+		t.Errorf("unexpected result: %s, %#v", transformedJson, err)
+	}
+
+	jsonData = v3Json(`{"result": {"events": [{"kv": {"key": "{{/a}}", "value": "{{ETCVAULT::plain1::ETCVAULT}}"}}]}}`, "/a", "ETCVAULT::plain1::ETCVAULT")
+	_, err = engine.TransformEtcdV3JsonResponseWithOptions(jsonData, ResponseOptions{Strict: true})
+	if failure, ok := err.(*TransformFailedError); !ok || failure.Key != "/a" {
+		t.Errorf("unexpected err: %#v", err)
+	}
+}
+
+func TestTransformEtcdV3JsonResponseMalformed(t *testing.T) {
+	engine := NewEngine(testKeychain)
+
+	if _, err := engine.TransformEtcdV3JsonResponse([]byte(`{"kvs": [`)); err != ErrMalformedJson {
+		t.Errorf("unexpected err: %#v", err)
+	}
+}
@@ -0,0 +1,160 @@
+package engine
+
+import (
+	"bytes"
+	"encoding/json"
+	"sort"
+	"strings"
+)
+
+// Minimal scanner over valid JSON documents (checked by json.Valid beforehand), to rewrite values in place
+// while keeping the rest of a document byte-identical; unmarshaling into interface{} loses precision of
+// numbers and order of keys.
+
+type jsonSpan struct {
+	start int
+	end   int
+}
+
+type jsonMember struct {
+	name  string
+	value jsonSpan
+}
+
+// jsonEdit replaces data[span.start:span.end] with replacement.
+type jsonEdit struct {
+	span        jsonSpan
+	replacement []byte
+}
+
+func skipJsonSpace(data []byte, i int) int {
+	for i < len(data) && (data[i] == ' ' || data[i] == '\t' || data[i] == '\r' || data[i] == '\n') {
+		i++
+	}
+	return i
+}
+
+// scanJsonValue returns the end of the value starting at i.
+func scanJsonValue(data []byte, i int) int {
+	switch data[i] {
+	case '"':
+		return scanJsonString(data, i)
+	case '{', '[':
+		depth := 0
+		for i < len(data) {
+			switch data[i] {
+			case '"':
+				i = scanJsonString(data, i)
+				continue
+			case '{', '[':
+				depth++
+			case '}', ']':
+				depth--
+				if depth == 0 {
+					return i + 1
+				}
+			}
+			i++
+		}
+		return i
+	default:
+		for i < len(data) && strings.IndexByte(",}] \t\r\n", data[i]) == -1 {
+			i++
+		}
+		return i
+	}
+}
+
+func scanJsonString(data []byte, i int) int {
+	for i++; i < len(data); i++ {
+		switch data[i] {
+		case '\\':
+			i++
+		case '"':
+			return i + 1
+		}
+	}
+	return i
+}
+
+// decodeJsonString returns the string at span, or false when it's not a string.
+func decodeJsonString(data []byte, span jsonSpan) (string, bool) {
+	if data[span.start] != '"' {
+		return "", false
+	}
+	raw := data[span.start+1 : span.end-1]
+	if bytes.IndexByte(raw, '\\') == -1 {
+		return string(raw), true
+	}
+	var str string
+	if err := json.Unmarshal(data[span.start:span.end], &str); err != nil {
+		return "", false
+	}
+	return str, true
+}
+
+// jsonObjectMembers returns members of the object at span in order, or nil when it's not an object.
+func jsonObjectMembers(data []byte, span jsonSpan) []jsonMember {
+	if data[span.start] != '{' {
+		return nil
+	}
+	members := []jsonMember{}
+	i := skipJsonSpace(data, span.start+1)
+	for i < span.end && data[i] == '"' {
+		nameSpan := jsonSpan{i, scanJsonString(data, i)}
+		name, _ := decodeJsonString(data, nameSpan)
+
+		i = skipJsonSpace(data, nameSpan.end) + 1 // ':'
+		i = skipJsonSpace(data, i)
+		value := jsonSpan{i, scanJsonValue(data, i)}
+		members = append(members, jsonMember{name: name, value: value})
+
+		i = skipJsonSpace(data, value.end)
+		if data[i] == ',' {
+			i = skipJsonSpace(data, i+1)
+		}
+	}
+	return members
+}
+
+// jsonArrayElements returns elements of the array at span, or nil when it's not an array.
+func jsonArrayElements(data []byte, span jsonSpan) []jsonSpan {
+	if data[span.start] != '[' {
+		return nil
+	}
+	elements := []jsonSpan{}
+	i := skipJsonSpace(data, span.start+1)
+	for i < span.end && data[i] != ']' {
+		element := jsonSpan{i, scanJsonValue(data, i)}
+		elements = append(elements, element)
+
+		i = skipJsonSpace(data, element.end)
+		if data[i] == ',' {
+			i = skipJsonSpace(data, i+1)
+		}
+	}
+	return elements
+}
+
+// jsonRoot returns the span of the document, without surrounding spaces.
+func jsonRoot(data []byte) jsonSpan {
+	start := skipJsonSpace(data, 0)
+	return jsonSpan{start, scanJsonValue(data, start)}
+}
+
+func applyJsonEdits(data []byte, edits []jsonEdit) []byte {
+	if len(edits) == 0 {
+		return data
+	}
+	sort.Slice(edits, func(i, j int) bool { return edits[i].span.start < edits[j].span.start })
+
+	var buf bytes.Buffer
+	last := 0
+	for _, edit := range edits {
+		buf.Write(data[last:edit.span.start])
+		buf.Write(edit.replacement)
+		last = edit.span.end
+	}
+	buf.Write(data[last:])
+	return buf.Bytes()
+}
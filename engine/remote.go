@@ -0,0 +1,105 @@
+package engine
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"github.com/sorah/etcvault/container"
+	"github.com/sorah/etcvault/keys"
+)
+
+var ErrInvalidRemoteContent = errors.New("invalid remote1 content")
+
+const remoteDataKeyLength = 32
+
+func (engine *Engine) transformPlain1Remote(c *container.Plain1) (string, error) {
+	if engine.RevocationList != nil && engine.RevocationList.IsRevoked(c.KeyName, "") {
+		return "", ErrKeyRevoked
+	}
+
+	dataKey := make([]byte, remoteDataKeyLength)
+	if _, err := rand.Read(dataKey); err != nil {
+		return "", err
+	}
+
+	wrappedKey, err := engine.KeyWrapper.WrapKey(c.KeyName, dataKey)
+	if err != nil {
+		return "", err
+	}
+
+	aead, err := dataKeyAead(dataKey)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	result := &container.Remote1{
+		KeyName:    c.KeyName,
+		WrappedKey: wrappedKey,
+		Content:    aead.Seal(nonce, nonce, []byte(c.Content), []byte(c.KeyName)),
+	}
+	return result.String(), nil
+}
+
+// TransformRemote1 decrypts remote1 container, asking KeyWrapper to unwrap its content key.
+func (engine *Engine) TransformRemote1(c *container.Remote1) (string, error) {
+	return engine.transformRemote1(c, "")
+}
+
+// transformRemote1 decrypts remote1 container at etcd path. Usage and AllowedPaths are checked by
+// the key service, and also here when the key is in local keychain.
+func (engine *Engine) transformRemote1(c *container.Remote1, path string) (string, error) {
+	if engine.KeyWrapper == nil {
+		return "", ErrNoKeyWrapper
+	}
+
+	if engine.RevocationList != nil && engine.RevocationList.IsRevoked(c.KeyName, "") {
+		return "", ErrKeyRevoked
+	}
+
+	if engine.Keychain != nil {
+		key, err := engine.Keychain.Find(c.KeyName)
+		if err == nil {
+			if err := checkKeyPolicyForDecryption(key, path); err != nil {
+				return "", err
+			}
+		} else if err != keys.ErrKeyNotFound {
+			return "", err
+		}
+	}
+
+	dataKey, err := engine.KeyWrapper.UnwrapKey(c.KeyName, c.WrappedKey, path)
+	if err != nil {
+		return "", err
+	}
+
+	aead, err := dataKeyAead(dataKey)
+	if err != nil {
+		return "", err
+	}
+
+	if len(c.Content) < aead.NonceSize() {
+		return "", ErrInvalidRemoteContent
+	}
+
+	nonce := c.Content[0:aead.NonceSize()]
+	content, err := aead.Open(nil, nonce, c.Content[aead.NonceSize():], []byte(c.KeyName))
+	if err != nil {
+		return "", ErrInvalidRemoteContent
+	}
+
+	return string(content), nil
+}
+
+func dataKeyAead(dataKey []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
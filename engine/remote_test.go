@@ -0,0 +1,102 @@
+package engine
+
+import (
+	"github.com/sorah/etcvault/keys"
+	"github.com/sorah/etcvault/keyservice"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTransformRemote1Roundtrip(t *testing.T) {
+	server := httptest.NewServer(keyservice.NewServer(testKeychain))
+	defer server.Close()
+	serverUrl, _ := url.Parse(server.URL)
+
+	engine := NewEngine(keys.NewMemoryStore([]*keys.Key{}))
+	engine.KeyWrapper = keyservice.NewClient(serverUrl, http.DefaultTransport, 5*time.Second, time.Minute)
+
+	encryptedText, err := engine.Transform("ETCVAULT::plain:the-key:this text should be encrypted::ETCVAULT")
+	if err != nil {
+		t.Errorf("1 unexpected err: %#v", err)
+	}
+	if strings.Index(encryptedText, "this text should be encrypted") != -1 {
+		t.Errorf("encrypted text contains original text: %#v", encryptedText)
+	}
+	if strings.Index(encryptedText, "ETCVAULT::remote1:the-key:") != 0 {
+		t.Errorf("encrypted text unexpected: %#v", encryptedText)
+	}
+
+	plainText, err := engine.Transform(encryptedText)
+	if err != nil {
+		t.Errorf("2 unexpected err: %#v", err)
+	}
+	if plainText != "this text should be encrypted" {
+		t.Errorf("unexpected result: %#v", plainText)
+	}
+}
+
+func TestTransformRemote1WithoutKeyWrapper(t *testing.T) {
+	engine := NewEngine(testKeychain)
+
+	_, err := engine.Transform("ETCVAULT::remote1:the-key:aG9sYQ==,aGVsbG8=::ETCVAULT")
+	if err != ErrNoKeyWrapper {
+		t.Errorf("unexpected err: %#v", err)
+	}
+}
+
+func TestTransformRemote1WithAllowedPaths(t *testing.T) {
+	key, _ := keys.LoadKey(testRsaPrivateKey)
+	key.AllowedPaths = []string{"/app1"}
+	server := httptest.NewServer(keyservice.NewServer(keys.NewMemoryStore([]*keys.Key{key})))
+	defer server.Close()
+	serverUrl, _ := url.Parse(server.URL)
+
+	engine := NewEngine(keys.NewMemoryStore([]*keys.Key{}))
+	engine.KeyWrapper = keyservice.NewClient(serverUrl, http.DefaultTransport, 5*time.Second, time.Minute)
+
+	encryptedText, err := engine.Transform("ETCVAULT::plain:the-key:this text should be encrypted::ETCVAULT")
+	if err != nil {
+		t.Fatalf("unexpected err: %#v", err)
+	}
+
+	plainText, err := engine.TransformWithPath(encryptedText, "/app1/password")
+	if err != nil {
+		t.Errorf("unexpected err: %#v", err)
+	}
+	if plainText != "this text should be encrypted" {
+		t.Errorf("unexpected result: %#v", plainText)
+	}
+
+	// cached data key for /app1/password shouldn't be used for other paths
+	for _, path := range []string{"/app2/password", ""} {
+		_, err = engine.TransformWithPath(encryptedText, path)
+		if err == nil || !strings.Contains(err.Error(), "status 403") {
+			t.Errorf("unexpected err for %#v: %#v", path, err)
+		}
+	}
+}
+
+func TestTransformRemote1WithLocalKeyPolicy(t *testing.T) {
+	server := httptest.NewServer(keyservice.NewServer(testKeychain))
+	defer server.Close()
+	serverUrl, _ := url.Parse(server.URL)
+
+	key, _ := keys.LoadKey(testRsaPublicKey)
+	key.Usage = keys.KeyUsageEncrypt
+	engine := NewEngine(keys.NewMemoryStore([]*keys.Key{key}))
+	engine.KeyWrapper = keyservice.NewClient(serverUrl, http.DefaultTransport, 5*time.Second, time.Minute)
+
+	encryptedText, err := engine.Transform("ETCVAULT::plain:the-key:this text should be encrypted::ETCVAULT")
+	if err != nil {
+		t.Fatalf("unexpected err: %#v", err)
+	}
+
+	_, err = engine.Transform(encryptedText)
+	if err != ErrKeyNotForDecryption {
+		t.Errorf("unexpected err: %#v", err)
+	}
+}
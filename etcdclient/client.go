@@ -0,0 +1,215 @@
+package etcdclient
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Client struct {
+	Transport http.RoundTripper
+	// Endpoints returns endpoints to try, in order; e.g. Router.ShuffledAvailableBackends.
+	Endpoints func() []Endpoint
+	// Timeout for requests except Watch; 0 for no timeout.
+	Timeout time.Duration
+}
+
+func NewClient(transport http.RoundTripper, endpoints func() []Endpoint) *Client {
+	return &Client{
+		Transport: transport,
+		Endpoints: endpoints,
+		Timeout:   time.Duration(5) * time.Minute,
+	}
+}
+
+// NewClientWithUrls returns a client sending requests to urls, in order.
+func NewClientWithUrls(transport http.RoundTripper, urls []*url.URL) *Client {
+	return NewClient(transport, StaticEndpoints(urls))
+}
+
+func (client *Client) Get(key string, opts *GetOptions) (*Response, error) {
+	if opts == nil {
+		opts = &GetOptions{}
+	}
+	query := url.Values{}
+	if opts.Recursive {
+		query.Set("recursive", "true")
+	}
+	if opts.Sorted {
+		query.Set("sorted", "true")
+	}
+	if opts.Quorum {
+		query.Set("quorum", "true")
+	}
+	return client.do("GET", key, query, nil, client.Timeout)
+}
+
+func (client *Client) Set(key string, value string, opts *SetOptions) (*Response, error) {
+	if opts == nil {
+		opts = &SetOptions{}
+	}
+	form := url.Values{}
+	if opts.Dir {
+		form.Set("dir", "true")
+	} else {
+		form.Set("value", value)
+	}
+	if opts.TTL > 0 {
+		form.Set("ttl", strconv.FormatInt(opts.TTL, 10))
+	}
+	if opts.PrevExist != PrevIgnore {
+		form.Set("prevExist", opts.PrevExist)
+	}
+	if opts.PrevValue != "" {
+		form.Set("prevValue", opts.PrevValue)
+	}
+	if opts.PrevIndex != 0 {
+		form.Set("prevIndex", strconv.FormatUint(opts.PrevIndex, 10))
+	}
+	return client.do("PUT", key, nil, form, client.Timeout)
+}
+
+func (client *Client) Delete(key string, opts *DeleteOptions) (*Response, error) {
+	if opts == nil {
+		opts = &DeleteOptions{}
+	}
+	query := url.Values{}
+	if opts.Recursive {
+		query.Set("recursive", "true")
+	}
+	if opts.Dir {
+		query.Set("dir", "true")
+	}
+	if opts.PrevValue != "" {
+		query.Set("prevValue", opts.PrevValue)
+	}
+	if opts.PrevIndex != 0 {
+		query.Set("prevIndex", strconv.FormatUint(opts.PrevIndex, 10))
+	}
+	return client.do("DELETE", key, query, nil, client.Timeout)
+}
+
+// Watch waits for the next change of key, and returns it. Not affected by Timeout.
+func (client *Client) Watch(key string, opts *WatchOptions) (*Response, error) {
+	if opts == nil {
+		opts = &WatchOptions{}
+	}
+	query := url.Values{}
+	query.Set("wait", "true")
+	if opts.Recursive {
+		query.Set("recursive", "true")
+	}
+	if opts.WaitIndex != 0 {
+		query.Set("waitIndex", strconv.FormatUint(opts.WaitIndex, 10))
+	}
+	return client.do("GET", key, query, nil, 0)
+}
+
+func (client *Client) keyUrl(endpointUrl *url.URL, key string, query url.Values) *url.URL {
+	u := new(url.URL)
+	*u = *endpointUrl
+	u.Path = path.Join("/v2/keys", key)
+	if query != nil {
+		u.RawQuery = query.Encode()
+	}
+	return u
+}
+
+func (client *Client) do(method string, key string, query url.Values, form url.Values, timeout time.Duration) (*Response, error) {
+	httpClient := &http.Client{Transport: client.Transport, Timeout: timeout}
+
+	var lastErr error
+	for _, endpoint := range client.Endpoints() {
+		// try all URLs of the member before moving to another member
+		var resp *http.Response
+		var body []byte
+		for _, endpointUrl := range endpoint.CandidateUrls() {
+			u := client.keyUrl(endpointUrl, key, query)
+
+			var err error
+			resp, body, err = client.roundTrip(httpClient, method, u, form)
+			if err != nil {
+				log.Printf("error when requesting %s %s: %s", method, u.String(), err.Error())
+				lastErr = err
+				resp = nil
+				continue
+			}
+			endpoint.SwitchUrl(endpointUrl)
+			break
+		}
+
+		if resp == nil {
+			endpoint.Fail()
+			continue
+		}
+		endpoint.Ok()
+
+		return parseResponse(resp, body)
+	}
+
+	if lastErr == nil {
+		return nil, ErrNoEndpointsAvailable
+	}
+	return nil, fmt.Errorf("%s: %s", ErrNoEndpointsAvailable.Error(), lastErr.Error())
+}
+
+func (client *Client) roundTrip(httpClient *http.Client, method string, u *url.URL, form url.Values) (*http.Response, []byte, error) {
+	var request *http.Request
+	var err error
+	if form == nil {
+		request, err = http.NewRequest(method, u.String(), nil)
+	} else {
+		request, err = http.NewRequest(method, u.String(), strings.NewReader(form.Encode()))
+		if err == nil {
+			request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	resp, err := httpClient.Do(request)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	return resp, body, nil
+}
+
+func parseResponse(resp *http.Response, body []byte) (*Response, error) {
+	var index uint64
+	if indexHeader := resp.Header.Get("X-Etcd-Index"); indexHeader != "" {
+		index, _ = strconv.ParseUint(indexHeader, 10, 64)
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		etcdErr := &Error{}
+		if err := json.Unmarshal(body, etcdErr); err != nil || etcdErr.ErrorCode == 0 {
+			return nil, fmt.Errorf("etcd returned status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+		}
+		etcdErr.StatusCode = resp.StatusCode
+		return nil, etcdErr
+	}
+
+	response := &Response{}
+	if err := json.Unmarshal(body, response); err != nil {
+		return nil, err
+	}
+	if response.Node == nil {
+		return nil, fmt.Errorf("etcd returned no node")
+	}
+	response.Index = index
+	return response, nil
+}
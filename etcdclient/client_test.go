@@ -0,0 +1,289 @@
+package etcdclient
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+type testEndpoint struct {
+	urls     []*url.URL
+	switched *url.URL
+	failed   bool
+	ok       bool
+}
+
+func (endpoint *testEndpoint) CandidateUrls() []*url.URL { return endpoint.urls }
+func (endpoint *testEndpoint) SwitchUrl(u *url.URL)      { endpoint.switched = u }
+func (endpoint *testEndpoint) Fail()                     { endpoint.failed = true }
+func (endpoint *testEndpoint) Ok()                       { endpoint.ok = true }
+
+func mustParseUrl(str string) *url.URL {
+	u, err := url.Parse(str)
+	if err != nil {
+		panic(err)
+	}
+	return u
+}
+
+// deadUrl returns URL of a server which has been closed.
+func deadUrl() *url.URL {
+	server := httptest.NewServer(http.NotFoundHandler())
+	u := mustParseUrl(server.URL)
+	server.Close()
+	return u
+}
+
+func testClient(handler http.HandlerFunc) (*Client, *httptest.Server) {
+	server := httptest.NewServer(handler)
+	client := NewClientWithUrls(http.DefaultTransport, []*url.URL{mustParseUrl(server.URL)})
+	return client, server
+}
+
+func TestGetRecursive(t *testing.T) {
+	client, server := testClient(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" || r.URL.Path != "/v2/keys/dir" {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		}
+		if r.URL.Query().Get("recursive") != "true" || r.URL.Query().Get("sorted") != "true" {
+			t.Errorf("unexpected query %#v", r.URL.RawQuery)
+		}
+		w.Header().Set("X-Etcd-Index", "42")
+		fmt.Fprint(w, `{"action":"get","node":{"key":"/dir","dir":true,"nodes":[{"key":"/dir/a","value":"A","modifiedIndex":3,"createdIndex":2},{"key":"/dir/sub","dir":true,"nodes":[{"key":"/dir/sub/b","value":"B","ttl":30}]}]}}`)
+	})
+	defer server.Close()
+
+	resp, err := client.Get("/dir", &GetOptions{Recursive: true, Sorted: true})
+	if err != nil {
+		t.Fatalf("unexpected error %#v", err)
+	}
+	if resp.Index != 42 {
+		t.Errorf("unexpected index %#v", resp.Index)
+	}
+	if !resp.Node.Dir || len(resp.Node.Nodes) != 2 {
+		t.Fatalf("unexpected node %#v", resp.Node)
+	}
+	if a := resp.Node.Nodes[0]; a.Key != "/dir/a" || a.Value != "A" || a.ModifiedIndex != 3 || a.CreatedIndex != 2 {
+		t.Errorf("unexpected node %#v", a)
+	}
+	if b := resp.Node.Nodes[1].Nodes[0]; b.Key != "/dir/sub/b" || b.Value != "B" || b.TTL != 30 {
+		t.Errorf("unexpected node %#v", b)
+	}
+}
+
+func TestGetNotFound(t *testing.T) {
+	client, server := testClient(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(404)
+		fmt.Fprint(w, `{"errorCode":100,"message":"Key not found","cause":"/nope","index":7}`)
+	})
+	defer server.Close()
+
+	resp, err := client.Get("/nope", nil)
+	if resp != nil {
+		t.Errorf("unexpected response %#v", resp)
+	}
+	if !IsKeyNotFound(err) {
+		t.Fatalf("unexpected error %#v", err)
+	}
+	etcdErr := err.(*Error)
+	if etcdErr.Cause != "/nope" || etcdErr.Index != 7 || etcdErr.StatusCode != 404 {
+		t.Errorf("unexpected error %#v", etcdErr)
+	}
+}
+
+func TestGetUnexpectedError(t *testing.T) {
+	client, server := testClient(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "oops", 500)
+	})
+	defer server.Close()
+
+	_, err := client.Get("/key", nil)
+	if err == nil || err.Error() != "etcd returned status 500: oops" {
+		t.Errorf("unexpected error %#v", err)
+	}
+}
+
+func TestSetWithPrevIndex(t *testing.T) {
+	client, server := testClient(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "PUT" || r.URL.Path != "/v2/keys/key" {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		}
+		if r.FormValue("value") != "val" || r.FormValue("prevIndex") != "5" || r.FormValue("ttl") != "10" {
+			t.Errorf("unexpected form %#v", r.Form)
+		}
+		if _, ok := r.Form["prevExist"]; ok {
+			t.Errorf("unexpected prevExist %#v", r.Form)
+		}
+		fmt.Fprint(w, `{"action":"compareAndSwap","node":{"key":"/key","value":"val","modifiedIndex":6},"prevNode":{"key":"/key","value":"old","modifiedIndex":5}}`)
+	})
+	defer server.Close()
+
+	resp, err := client.Set("/key", "val", &SetOptions{PrevIndex: 5, TTL: 10})
+	if err != nil {
+		t.Fatalf("unexpected error %#v", err)
+	}
+	if resp.Action != "compareAndSwap" || resp.Node.ModifiedIndex != 6 || resp.PrevNode.Value != "old" {
+		t.Errorf("unexpected response %#v", resp)
+	}
+}
+
+func TestSetPrevIndexFailed(t *testing.T) {
+	client, server := testClient(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(412)
+		fmt.Fprint(w, `{"errorCode":101,"message":"Compare failed","cause":"[5 != 6]","index":6}`)
+	})
+	defer server.Close()
+
+	_, err := client.Set("/key", "val", &SetOptions{PrevIndex: 5})
+	if !IsTestFailed(err) {
+		t.Errorf("unexpected error %#v", err)
+	}
+}
+
+func TestSetPrevNoExist(t *testing.T) {
+	client, server := testClient(func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("prevExist") != "false" {
+			t.Errorf("unexpected form %#v", r.Form)
+		}
+		w.WriteHeader(412)
+		fmt.Fprint(w, `{"errorCode":105,"message":"Key already exists","cause":"/key","index":6}`)
+	})
+	defer server.Close()
+
+	_, err := client.Set("/key", "val", &SetOptions{PrevExist: PrevNoExist})
+	if !IsNodeExist(err) {
+		t.Errorf("unexpected error %#v", err)
+	}
+}
+
+func TestSetDir(t *testing.T) {
+	client, server := testClient(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.FormValue("dir") != "true" {
+			t.Errorf("unexpected form %#v", r.Form)
+		}
+		if _, ok := r.PostForm["value"]; ok {
+			t.Errorf("unexpected value %#v", r.Form)
+		}
+		w.WriteHeader(201)
+		fmt.Fprint(w, `{"action":"set","node":{"key":"/dir","dir":true,"modifiedIndex":8}}`)
+	})
+	defer server.Close()
+
+	resp, err := client.Set("/dir", "", &SetOptions{Dir: true})
+	if err != nil {
+		t.Fatalf("unexpected error %#v", err)
+	}
+	if !resp.Node.Dir {
+		t.Errorf("unexpected node %#v", resp.Node)
+	}
+}
+
+func TestDelete(t *testing.T) {
+	client, server := testClient(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "DELETE" || r.URL.Path != "/v2/keys/dir" {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		}
+		if r.URL.Query().Get("recursive") != "true" || r.URL.Query().Get("dir") != "true" {
+			t.Errorf("unexpected query %#v", r.URL.RawQuery)
+		}
+		fmt.Fprint(w, `{"action":"delete","node":{"key":"/dir","dir":true,"modifiedIndex":9},"prevNode":{"key":"/dir","dir":true}}`)
+	})
+	defer server.Close()
+
+	resp, err := client.Delete("/dir", &DeleteOptions{Recursive: true, Dir: true})
+	if err != nil {
+		t.Fatalf("unexpected error %#v", err)
+	}
+	if resp.Action != "delete" {
+		t.Errorf("unexpected response %#v", resp)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	client, server := testClient(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if query.Get("wait") != "true" || query.Get("recursive") != "true" || query.Get("waitIndex") != "10" {
+			t.Errorf("unexpected query %#v", r.URL.RawQuery)
+		}
+		fmt.Fprint(w, `{"action":"set","node":{"key":"/dir/a","value":"new","modifiedIndex":12}}`)
+	})
+	defer server.Close()
+	client.Timeout = 1 // Watch shouldn't time out
+
+	resp, err := client.Watch("/dir", &WatchOptions{Recursive: true, WaitIndex: 10})
+	if err != nil {
+		t.Fatalf("unexpected error %#v", err)
+	}
+	if resp.Node.Key != "/dir/a" || resp.Node.ModifiedIndex != 12 {
+		t.Errorf("unexpected node %#v", resp.Node)
+	}
+}
+
+func TestFailover(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"action":"get","node":{"key":"/key","value":"val"}}`)
+	}))
+	defer server.Close()
+	liveUrl := mustParseUrl(server.URL)
+
+	deadEndpoint := &testEndpoint{urls: []*url.URL{deadUrl()}}
+	liveEndpoint := &testEndpoint{urls: []*url.URL{deadUrl(), liveUrl}}
+	client := NewClient(http.DefaultTransport, func() []Endpoint {
+		return []Endpoint{deadEndpoint, liveEndpoint}
+	})
+
+	resp, err := client.Get("/key", nil)
+	if err != nil {
+		t.Fatalf("unexpected error %#v", err)
+	}
+	if resp.Node.Value != "val" {
+		t.Errorf("unexpected node %#v", resp.Node)
+	}
+
+	if !deadEndpoint.failed || deadEndpoint.ok {
+		t.Errorf("unexpected endpoint state %#v", deadEndpoint)
+	}
+	if liveEndpoint.failed || !liveEndpoint.ok || liveEndpoint.switched != liveUrl {
+		t.Errorf("unexpected endpoint state %#v", liveEndpoint)
+	}
+}
+
+func TestFailoverOnTimeout(t *testing.T) {
+	release := make(chan struct{})
+	hungServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer hungServer.Close()
+	defer close(release)
+	liveServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"action":"get","node":{"key":"/key","value":"val"}}`)
+	}))
+	defer liveServer.Close()
+
+	client := NewClientWithUrls(http.DefaultTransport, []*url.URL{mustParseUrl(hungServer.URL), mustParseUrl(liveServer.URL)})
+	client.Timeout = 100 * time.Millisecond
+
+	resp, err := client.Get("/key", nil)
+	if err != nil {
+		t.Fatalf("unexpected error %#v", err)
+	}
+	if resp.Node.Value != "val" {
+		t.Errorf("unexpected node %#v", resp.Node)
+	}
+}
+
+func TestNoEndpointsAvailable(t *testing.T) {
+	client := NewClientWithUrls(http.DefaultTransport, []*url.URL{deadUrl()})
+	if _, err := client.Get("/key", nil); err == nil {
+		t.Errorf("unexpected success")
+	}
+
+	client = NewClient(http.DefaultTransport, func() []Endpoint { return []Endpoint{} })
+	if _, err := client.Get("/key", nil); err != ErrNoEndpointsAvailable {
+		t.Errorf("unexpected error %#v", err)
+	}
+}
@@ -0,0 +1,146 @@
+// Package etcdclient is a small client for etcd v2 keys API, used by etcvault commands talking to etcd directly.
+//
+// Requests fail over across endpoints: each endpoint (e.g. *proxy.Backend) may have multiple URLs,
+// which are tried in order before moving to the next endpoint.
+package etcdclient
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+)
+
+var ErrNoEndpointsAvailable = errors.New("couldn't communicate with any etcd")
+
+// error codes of etcd v2 API
+const (
+	ErrorCodeKeyNotFound       = 100
+	ErrorCodeTestFailed        = 101
+	ErrorCodeNotFile           = 102
+	ErrorCodeNotDir            = 104
+	ErrorCodeNodeExist         = 105
+	ErrorCodeDirNotEmpty       = 108
+	ErrorCodeEventIndexCleared = 401
+)
+
+// values for SetOptions.PrevExist
+const (
+	PrevIgnore  = ""
+	PrevExist   = "true"
+	PrevNoExist = "false"
+)
+
+type Node struct {
+	Key           string  `json:"key"`
+	Value         string  `json:"value,omitempty"`
+	Dir           bool    `json:"dir,omitempty"`
+	TTL           int64   `json:"ttl,omitempty"`
+	Expiration    string  `json:"expiration,omitempty"`
+	ModifiedIndex uint64  `json:"modifiedIndex,omitempty"`
+	CreatedIndex  uint64  `json:"createdIndex,omitempty"`
+	Nodes         []*Node `json:"nodes,omitempty"`
+}
+
+type Response struct {
+	Action   string `json:"action"`
+	Node     *Node  `json:"node"`
+	PrevNode *Node  `json:"prevNode,omitempty"`
+	// Index is X-Etcd-Index of the response.
+	Index uint64 `json:"-"`
+}
+
+// Error is an error returned from etcd.
+type Error struct {
+	ErrorCode  int    `json:"errorCode"`
+	Message    string `json:"message"`
+	Cause      string `json:"cause"`
+	Index      uint64 `json:"index"`
+	StatusCode int    `json:"-"`
+}
+
+func (err *Error) Error() string {
+	return fmt.Sprintf("etcd error %d: %s (%s)", err.ErrorCode, err.Message, err.Cause)
+}
+
+// IsKeyNotFound returns true when err is an etcd "key not found" error.
+func IsKeyNotFound(err error) bool {
+	etcdErr, ok := err.(*Error)
+	return ok && etcdErr.ErrorCode == ErrorCodeKeyNotFound
+}
+
+// IsNodeExist returns true when err is an etcd "key already exists" error, e.g. PrevExist=false is given.
+func IsNodeExist(err error) bool {
+	etcdErr, ok := err.(*Error)
+	return ok && etcdErr.ErrorCode == ErrorCodeNodeExist
+}
+
+// IsTestFailed returns true when err is an etcd "compare failed" error, e.g. PrevIndex is outdated.
+func IsTestFailed(err error) bool {
+	etcdErr, ok := err.(*Error)
+	return ok && etcdErr.ErrorCode == ErrorCodeTestFailed
+}
+
+// Endpoint is a etcd member to send requests. *proxy.Backend satisfies this.
+type Endpoint interface {
+	// CandidateUrls returns URLs to try in order.
+	CandidateUrls() []*url.URL
+	// SwitchUrl is called with URL which succeeded.
+	SwitchUrl(u *url.URL)
+	// Fail is called when all URLs failed.
+	Fail()
+	// Ok is called when a request succeeded.
+	Ok()
+}
+
+// staticEndpoint is an Endpoint with a single URL, which doesn't remember failures.
+type staticEndpoint struct {
+	url *url.URL
+}
+
+func (endpoint *staticEndpoint) CandidateUrls() []*url.URL {
+	return []*url.URL{endpoint.url}
+}
+
+func (endpoint *staticEndpoint) SwitchUrl(u *url.URL) {}
+func (endpoint *staticEndpoint) Fail()                {}
+func (endpoint *staticEndpoint) Ok()                  {}
+
+// StaticEndpoints returns an endpoint source always returning urls, in order.
+func StaticEndpoints(urls []*url.URL) func() []Endpoint {
+	endpoints := make([]Endpoint, 0, len(urls))
+	for _, u := range urls {
+		endpoints = append(endpoints, &staticEndpoint{url: u})
+	}
+	return func() []Endpoint {
+		return endpoints
+	}
+}
+
+type GetOptions struct {
+	Recursive bool
+	Sorted    bool
+	Quorum    bool
+}
+
+type SetOptions struct {
+	// TTL in seconds; 0 for no TTL.
+	TTL int64
+	Dir bool
+	// PrevExist is one of PrevIgnore, PrevExist and PrevNoExist.
+	PrevExist string
+	PrevValue string
+	PrevIndex uint64
+}
+
+type DeleteOptions struct {
+	Recursive bool
+	Dir       bool
+	PrevValue string
+	PrevIndex uint64
+}
+
+type WatchOptions struct {
+	Recursive bool
+	// WaitIndex is an index to watch from; 0 for changes after the request.
+	WaitIndex uint64
+}
@@ -0,0 +1,609 @@
+// Package etcdtest provides an in-memory fake of etcd for tests.
+//
+// Server implements a subset of etcd v2 keys API (GET, PUT, DELETE with recursive listings,
+// TTLs, prevExist/prevValue/prevIndex conditions and wait=true watches), and members API
+// (/v2/members and /members on peer port). Indices behave like etcd: each modification
+// increments the index, and the current index is returned as X-Etcd-Index.
+//
+// Server also stands in for etcd v3 JSON gateway (/v3/kv/put, /v3/kv/range, /v3/kv/deleterange,
+// a subset of /v3/kv/txn and /v3/watch) with a separate key-value store, like etcd keeping v2
+// and v3 data apart.
+//
+//	etcd := etcdtest.NewServer()
+//	server := httptest.NewServer(etcd)
+//	defer server.Close()
+//	etcd.Set("/greeting", "hello")
+package etcdtest
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HistoryLength is the number of events kept for watches with waitIndex, like etcd.
+const HistoryLength = 1000
+
+type Member struct {
+	Id         string   `json:"id"`
+	Name       string   `json:"name"`
+	PeerURLs   []string `json:"peerURLs"`
+	ClientURLs []string `json:"clientURLs"`
+}
+
+type Server struct {
+	sync.Mutex
+	// Members are returned by members API. When empty, a single member with the requested host is returned.
+	Members []Member
+	// Now returns current time, used for TTLs.
+	Now func() time.Time
+
+	index   uint64
+	root    *node
+	history []*event
+	changed chan struct{}
+
+	revision  int64
+	kvs       map[string]*v3Kv
+	v3History []*v3Event
+}
+
+type node struct {
+	key           string
+	value         string
+	dir           bool
+	children      map[string]*node
+	expiration    *time.Time
+	createdIndex  uint64
+	modifiedIndex uint64
+}
+
+type event struct {
+	Action   string    `json:"action"`
+	Node     *jsonNode `json:"node"`
+	PrevNode *jsonNode `json:"prevNode,omitempty"`
+	index    uint64
+	key      string
+}
+
+type jsonNode struct {
+	Key           string      `json:"key,omitempty"`
+	Value         *string     `json:"value,omitempty"`
+	Dir           bool        `json:"dir,omitempty"`
+	Expiration    *time.Time  `json:"expiration,omitempty"`
+	TTL           int64       `json:"ttl,omitempty"`
+	Nodes         []*jsonNode `json:"nodes,omitempty"`
+	ModifiedIndex uint64      `json:"modifiedIndex,omitempty"`
+	CreatedIndex  uint64      `json:"createdIndex,omitempty"`
+}
+
+type etcdError struct {
+	status    int
+	ErrorCode int    `json:"errorCode"`
+	Message   string `json:"message"`
+	Cause     string `json:"cause"`
+	Index     uint64 `json:"index"`
+}
+
+func NewServer() *Server {
+	return &Server{
+		Now:     time.Now,
+		root:    &node{key: "/", dir: true, children: map[string]*node{}},
+		history: []*event{},
+		changed: make(chan struct{}),
+		kvs:     map[string]*v3Kv{},
+	}
+}
+
+// Index returns the current index.
+func (server *Server) Index() uint64 {
+	server.Lock()
+	defer server.Unlock()
+	return server.index
+}
+
+// Set sets value to key, creating parent directories; for preparing tests.
+func (server *Server) Set(key string, value string) {
+	server.Lock()
+	defer server.Unlock()
+	server.expire()
+	if _, err := server.set(normalizeKey(key), value, false, 0, "", nil, 0); err != nil {
+		panic(err)
+	}
+}
+
+// SetDir creates a directory; for preparing tests.
+func (server *Server) SetDir(key string) {
+	server.Lock()
+	defer server.Unlock()
+	server.expire()
+	if _, err := server.set(normalizeKey(key), "", true, 0, "", nil, 0); err != nil {
+		panic(err)
+	}
+}
+
+// Get returns value of key.
+func (server *Server) Get(key string) (string, bool) {
+	server.Lock()
+	defer server.Unlock()
+	server.expire()
+	n := server.find(normalizeKey(key))
+	if n == nil || n.dir {
+		return "", false
+	}
+	return n.value, true
+}
+
+func normalizeKey(key string) string {
+	return path.Join("/", key)
+}
+
+func newError(status int, code int, message string, cause string, index uint64) *etcdError {
+	return &etcdError{status: status, ErrorCode: code, Message: message, Cause: cause, Index: index}
+}
+
+func (err *etcdError) Error() string {
+	return fmt.Sprintf("%d: %s (%s)", err.ErrorCode, err.Message, err.Cause)
+}
+
+func (server *Server) ServeHTTP(response http.ResponseWriter, request *http.Request) {
+	switch {
+	case request.URL.Path == "/v2/members" || request.URL.Path == "/members":
+		server.serveMembers(response, request)
+	case request.URL.Path == "/v2/keys" || strings.HasPrefix(request.URL.Path, "/v2/keys/"):
+		server.serveKeys(response, request)
+	case strings.HasPrefix(request.URL.Path, "/v3/"):
+		server.serveV3(response, request)
+	default:
+		http.Error(response, "404 page not found", http.StatusNotFound)
+	}
+}
+
+func (server *Server) serveMembers(response http.ResponseWriter, request *http.Request) {
+	members := server.Members
+	if len(members) == 0 {
+		members = []Member{
+			{
+				Id:         "1",
+				Name:       "default",
+				PeerURLs:   []string{"http://" + request.Host},
+				ClientURLs: []string{"http://" + request.Host},
+			},
+		}
+	}
+
+	response.Header().Set("Content-Type", "application/json")
+	if request.URL.Path == "/members" {
+		json.NewEncoder(response).Encode(members)
+	} else {
+		json.NewEncoder(response).Encode(struct {
+			Members []Member `json:"members"`
+		}{Members: members})
+	}
+}
+
+func (server *Server) serveKeys(response http.ResponseWriter, request *http.Request) {
+	if err := request.ParseForm(); err != nil {
+		http.Error(response, err.Error(), http.StatusBadRequest)
+		return
+	}
+	key := normalizeKey(strings.TrimPrefix(request.URL.Path, "/v2/keys"))
+
+	if request.Method == "GET" && request.Form.Get("wait") == "true" {
+		server.serveWatch(response, request, key)
+		return
+	}
+
+	server.Lock()
+	server.expire()
+	var result interface{}
+	var status int
+	var err error
+	switch request.Method {
+	case "GET":
+		result, err = server.get(key, request.Form.Get("recursive") == "true")
+		status = http.StatusOK
+	case "PUT":
+		result, status, err = server.put(key, request)
+	case "DELETE":
+		result, err = server.delete(key, request)
+		status = http.StatusOK
+	default:
+		server.Unlock()
+		http.Error(response, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	index := server.index
+	server.Unlock()
+
+	if etcdErr, ok := err.(*etcdError); ok {
+		writeJson(response, etcdErr.status, index, etcdErr)
+		return
+	}
+	writeJson(response, status, index, result)
+}
+
+func writeJson(response http.ResponseWriter, status int, index uint64, body interface{}) {
+	response.Header().Set("Content-Type", "application/json")
+	response.Header().Set("X-Etcd-Index", strconv.FormatUint(index, 10))
+	response.WriteHeader(status)
+	json.NewEncoder(response).Encode(body)
+}
+
+// find returns node at key, or nil.
+func (server *Server) find(key string) *node {
+	if key == "/" {
+		return server.root
+	}
+	current := server.root
+	for _, name := range strings.Split(strings.TrimPrefix(key, "/"), "/") {
+		if !current.dir {
+			return nil
+		}
+		child, ok := current.children[name]
+		if !ok {
+			return nil
+		}
+		current = child
+	}
+	return current
+}
+
+func (server *Server) parentOf(key string) *node {
+	return server.find(path.Dir(key))
+}
+
+func (server *Server) toJson(n *node, recursive bool, depth int) *jsonNode {
+	j := &jsonNode{
+		Dir:           n.dir,
+		ModifiedIndex: n.modifiedIndex,
+		CreatedIndex:  n.createdIndex,
+	}
+	if n != server.root {
+		j.Key = n.key
+	}
+	if !n.dir {
+		value := n.value
+		j.Value = &value
+	}
+	if n.expiration != nil {
+		expiration := *n.expiration
+		j.Expiration = &expiration
+		j.TTL = int64(math.Ceil(expiration.Sub(server.Now()).Seconds()))
+	}
+
+	if n.dir && (recursive || depth == 0) {
+		names := make([]string, 0, len(n.children))
+		for name := range n.children {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		j.Nodes = make([]*jsonNode, 0, len(names))
+		for _, name := range names {
+			j.Nodes = append(j.Nodes, server.toJson(n.children[name], recursive, depth+1))
+		}
+	}
+	return j
+}
+
+// snapshot returns n as in events and prevNode (without children).
+func (server *Server) snapshot(n *node) *jsonNode {
+	if n == nil {
+		return nil
+	}
+	j := server.toJson(n, false, 1)
+	j.Key = n.key
+	return j
+}
+
+// record appends an event to history, and wakes up watchers.
+func (server *Server) record(action string, key string, n *jsonNode, prevNode *jsonNode) *event {
+	e := &event{Action: action, Node: n, PrevNode: prevNode, index: server.index, key: key}
+	server.history = append(server.history, e)
+	if len(server.history) > HistoryLength {
+		server.history = server.history[len(server.history)-HistoryLength:]
+	}
+	server.broadcast()
+	return e
+}
+
+// broadcast wakes up watchers.
+func (server *Server) broadcast() {
+	close(server.changed)
+	server.changed = make(chan struct{})
+}
+
+// expire removes expired nodes, recording expire events.
+func (server *Server) expire() {
+	now := server.Now()
+	var walk func(n *node)
+	walk = func(n *node) {
+		names := make([]string, 0, len(n.children))
+		for name := range n.children {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			child := n.children[name]
+			if child.expiration != nil && !child.expiration.After(now) {
+				prevNode := server.snapshot(child)
+				delete(n.children, name)
+				server.index++
+				server.record("expire", child.key, &jsonNode{Key: child.key, Dir: child.dir, ModifiedIndex: server.index, CreatedIndex: child.createdIndex}, prevNode)
+				continue
+			}
+			if child.dir {
+				walk(child)
+			}
+		}
+	}
+	walk(server.root)
+}
+
+func (server *Server) get(key string, recursive bool) (*event, error) {
+	n := server.find(key)
+	if n == nil {
+		return nil, newError(404, 100, "Key not found", key, server.index)
+	}
+	j := server.toJson(n, recursive, 0)
+	return &event{Action: "get", Node: j}, nil
+}
+
+func (server *Server) put(key string, request *http.Request) (*event, int, error) {
+	if key == "/" {
+		return nil, 0, newError(403, 107, "Root is read only", "/", server.index)
+	}
+
+	var ttl int64
+	if ttlString := request.Form.Get("ttl"); ttlString != "" {
+		var err error
+		ttl, err = strconv.ParseInt(ttlString, 10, 64)
+		if err != nil || ttl < 0 {
+			return nil, 0, newError(400, 202, "The given TTL in POST form is not a number", "Update", server.index)
+		}
+	}
+
+	var prevExist *bool
+	if prevExistString := request.Form.Get("prevExist"); prevExistString != "" {
+		value, err := strconv.ParseBool(prevExistString)
+		if err != nil {
+			return nil, 0, newError(400, 203, "The given prevExist in POST form is not a boolean", "Update", server.index)
+		}
+		prevExist = &value
+	}
+
+	var prevIndex uint64
+	if prevIndexString := request.Form.Get("prevIndex"); prevIndexString != "" {
+		var err error
+		prevIndex, err = strconv.ParseUint(prevIndexString, 10, 64)
+		if err != nil {
+			return nil, 0, newError(400, 203, "The given index in POST form is not a number", "CompareAndSwap", server.index)
+		}
+	}
+
+	e, err := server.set(key, request.Form.Get("value"), request.Form.Get("dir") == "true", ttl, request.Form.Get("prevValue"), prevExist, prevIndex)
+	if err != nil {
+		return nil, 0, err
+	}
+	if e.PrevNode == nil {
+		return e, http.StatusCreated, nil
+	}
+	return e, http.StatusOK, nil
+}
+
+func (server *Server) set(key string, value string, dir bool, ttl int64, prevValue string, prevExist *bool, prevIndex uint64) (*event, error) {
+	existing := server.find(key)
+
+	action := "set"
+	if prevExist != nil {
+		if *prevExist {
+			action = "update"
+			if existing == nil {
+				return nil, newError(404, 100, "Key not found", key, server.index)
+			}
+		} else {
+			action = "create"
+			if existing != nil {
+				return nil, newError(412, 105, "Key already exists", key, server.index)
+			}
+		}
+	}
+
+	if prevValue != "" || prevIndex != 0 {
+		action = "compareAndSwap"
+		if existing == nil {
+			return nil, newError(404, 100, "Key not found", key, server.index)
+		}
+		if existing.dir {
+			return nil, newError(403, 102, "Not a file", key, server.index)
+		}
+		if (prevValue != "" && prevValue != existing.value) || (prevIndex != 0 && prevIndex != existing.modifiedIndex) {
+			cause := fmt.Sprintf("[%s != %s] [%d != %d]", prevValue, existing.value, prevIndex, existing.modifiedIndex)
+			if prevValue == "" {
+				cause = fmt.Sprintf("[%d != %d]", prevIndex, existing.modifiedIndex)
+			} else if prevIndex == 0 {
+				cause = fmt.Sprintf("[%s != %s]", prevValue, existing.value)
+			}
+			return nil, newError(412, 101, "Compare failed", cause, server.index)
+		}
+	}
+
+	if existing != nil && existing.dir && !(dir && action == "update") {
+		// etcd refuses to overwrite a directory, except updating TTL of it
+		return nil, newError(403, 102, "Not a file", key, server.index)
+	}
+	if existing != nil && !existing.dir && dir {
+		return nil, newError(403, 104, "Not a directory", key, server.index)
+	}
+
+	// check ancestors before creating parent directories
+	for ancestor := path.Dir(key); ancestor != "/"; ancestor = path.Dir(ancestor) {
+		if n := server.find(ancestor); n != nil && !n.dir {
+			return nil, newError(403, 104, "Not a directory", ancestor, server.index)
+		}
+	}
+
+	server.index++
+	prevNode := server.snapshot(existing)
+
+	parent := server.root
+	for _, name := range strings.Split(strings.TrimPrefix(path.Dir(key), "/"), "/") {
+		if name == "" {
+			continue
+		}
+		child, ok := parent.children[name]
+		if !ok {
+			child = &node{key: path.Join(parent.key, name), dir: true, children: map[string]*node{}, createdIndex: server.index, modifiedIndex: server.index}
+			parent.children[name] = child
+		}
+		parent = child
+	}
+
+	n := existing
+	if n == nil {
+		n = &node{key: key, dir: dir}
+		if dir {
+			n.children = map[string]*node{}
+		}
+		parent.children[path.Base(key)] = n
+	}
+	if existing == nil || action == "set" || action == "create" {
+		n.createdIndex = server.index
+	}
+	n.value = value
+	n.modifiedIndex = server.index
+	n.expiration = nil
+	if ttl > 0 {
+		expiration := server.Now().Add(time.Duration(ttl) * time.Second)
+		n.expiration = &expiration
+	}
+
+	return server.record(action, key, server.snapshot(n), prevNode), nil
+}
+
+func (server *Server) delete(key string, request *http.Request) (*event, error) {
+	if key == "/" {
+		return nil, newError(403, 107, "Root is read only", "/", server.index)
+	}
+
+	n := server.find(key)
+	if n == nil {
+		return nil, newError(404, 100, "Key not found", key, server.index)
+	}
+
+	recursive := request.Form.Get("recursive") == "true"
+	if n.dir {
+		if request.Form.Get("dir") != "true" && !recursive {
+			return nil, newError(403, 102, "Not a file", key, server.index)
+		}
+		if len(n.children) > 0 && !recursive {
+			return nil, newError(403, 108, "Directory not empty", key, server.index)
+		}
+	}
+
+	action := "delete"
+	prevValue := request.Form.Get("prevValue")
+	var prevIndex uint64
+	if prevIndexString := request.Form.Get("prevIndex"); prevIndexString != "" {
+		var err error
+		prevIndex, err = strconv.ParseUint(prevIndexString, 10, 64)
+		if err != nil {
+			return nil, newError(400, 203, "The given index in POST form is not a number", "CompareAndDelete", server.index)
+		}
+	}
+	if prevValue != "" || prevIndex != 0 {
+		action = "compareAndDelete"
+		if n.dir {
+			return nil, newError(403, 102, "Not a file", key, server.index)
+		}
+		if (prevValue != "" && prevValue != n.value) || (prevIndex != 0 && prevIndex != n.modifiedIndex) {
+			cause := fmt.Sprintf("[%s != %s] [%d != %d]", prevValue, n.value, prevIndex, n.modifiedIndex)
+			return nil, newError(412, 101, "Compare failed", cause, server.index)
+		}
+	}
+
+	server.index++
+	prevNode := server.snapshot(n)
+	delete(server.parentOf(key).children, path.Base(key))
+
+	return server.record(action, key, &jsonNode{Key: key, Dir: n.dir, ModifiedIndex: server.index, CreatedIndex: n.createdIndex}, prevNode), nil
+}
+
+// matches returns true when event on eventKey should be notified to watcher of key.
+func matches(key string, eventKey string, recursive bool) bool {
+	if key == eventKey {
+		return true
+	}
+	// deletion of a directory notifies watchers of its descendants, like etcd
+	if strings.HasPrefix(key, eventKey+"/") {
+		return true
+	}
+	if recursive {
+		return key == "/" || strings.HasPrefix(eventKey, key+"/")
+	}
+	return false
+}
+
+func (server *Server) serveWatch(response http.ResponseWriter, request *http.Request, key string) {
+	recursive := request.Form.Get("recursive") == "true"
+
+	server.Lock()
+	server.expire()
+	waitIndex := server.index + 1
+	if waitIndexString := request.Form.Get("waitIndex"); waitIndexString != "" {
+		var err error
+		waitIndex, err = strconv.ParseUint(waitIndexString, 10, 64)
+		if err != nil {
+			index := server.index
+			server.Unlock()
+			writeJson(response, 400, index, newError(400, 203, "The given index in POST form is not a number", "Watch", index))
+			return
+		}
+	}
+
+	if len(server.history) == HistoryLength && waitIndex < server.history[0].index {
+		index := server.index
+		cause := fmt.Sprintf("the requested history has been cleared [%d/%d]", server.history[0].index, waitIndex)
+		server.Unlock()
+		writeJson(response, 400, index, newError(400, 401, "The event in requested index is outdated and cleared", cause, index))
+		return
+	}
+
+	for {
+		for _, e := range server.history {
+			if e.index >= waitIndex && matches(key, e.key, recursive) {
+				index := server.index
+				server.Unlock()
+				writeJson(response, http.StatusOK, index, e)
+				return
+			}
+		}
+
+		changed := server.changed
+		server.Unlock()
+
+		closeNotifyCh := make(<-chan bool)
+		if closeNotifier, ok := response.(http.CloseNotifier); ok {
+			closeNotifyCh = closeNotifier.CloseNotify()
+		}
+		select {
+		case <-changed:
+		case <-closeNotifyCh:
+			return
+		case <-time.After(time.Second):
+			// to notice expiration
+		}
+
+		server.Lock()
+		server.expire()
+	}
+}
@@ -0,0 +1,610 @@
+package etcdtest
+
+import (
+	"encoding/json"
+	"github.com/sorah/etcvault/etcdclient"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testServer() (*Server, *httptest.Server, *etcdclient.Client) {
+	etcd := NewServer()
+	server := httptest.NewServer(etcd)
+	u, err := url.Parse(server.URL)
+	if err != nil {
+		panic(err)
+	}
+	return etcd, server, etcdclient.NewClientWithUrls(http.DefaultTransport, []*url.URL{u})
+}
+
+func errorCode(err error) int {
+	if etcdErr, ok := err.(*etcdclient.Error); ok {
+		return etcdErr.ErrorCode
+	}
+	return 0
+}
+
+func TestSetAndGet(t *testing.T) {
+	etcd, server, client := testServer()
+	defer server.Close()
+
+	resp, err := client.Set("/greeting", "hello", nil)
+	if err != nil {
+		t.Fatalf("unexpected error %#v", err)
+	}
+	if resp.Action != "set" || resp.Node.Value != "hello" || resp.Node.ModifiedIndex != 1 || resp.Node.CreatedIndex != 1 || resp.Index != 1 {
+		t.Errorf("unexpected response %#v %#v", resp, resp.Node)
+	}
+	if resp.PrevNode != nil {
+		t.Errorf("unexpected prevNode %#v", resp.PrevNode)
+	}
+
+	resp, err = client.Set("/greeting", "hola", nil)
+	if err != nil {
+		t.Fatalf("unexpected error %#v", err)
+	}
+	if resp.Node.ModifiedIndex != 2 || resp.PrevNode == nil || resp.PrevNode.Value != "hello" {
+		t.Errorf("unexpected response %#v", resp)
+	}
+
+	resp, err = client.Get("/greeting", nil)
+	if err != nil {
+		t.Fatalf("unexpected error %#v", err)
+	}
+	if resp.Action != "get" || resp.Node.Value != "hola" || resp.Index != 2 {
+		t.Errorf("unexpected response %#v", resp)
+	}
+
+	if value, ok := etcd.Get("/greeting"); !ok || value != "hola" {
+		t.Errorf("unexpected value %#v", value)
+	}
+	if etcd.Index() != 2 {
+		t.Errorf("unexpected index %#v", etcd.Index())
+	}
+}
+
+func TestGetNotFound(t *testing.T) {
+	_, server, client := testServer()
+	defer server.Close()
+
+	_, err := client.Get("/nope", nil)
+	if !etcdclient.IsKeyNotFound(err) {
+		t.Fatalf("unexpected error %#v", err)
+	}
+	if etcdErr := err.(*etcdclient.Error); etcdErr.StatusCode != 404 || etcdErr.Cause != "/nope" {
+		t.Errorf("unexpected error %#v", etcdErr)
+	}
+}
+
+func TestGetDirectory(t *testing.T) {
+	etcd, server, client := testServer()
+	defer server.Close()
+
+	etcd.Set("/dir/b", "B")
+	etcd.Set("/dir/a", "A")
+	etcd.Set("/dir/sub/c", "C")
+	etcd.SetDir("/dir/empty")
+
+	resp, err := client.Get("/dir", nil)
+	if err != nil {
+		t.Fatalf("unexpected error %#v", err)
+	}
+	nodes := resp.Node.Nodes
+	if !resp.Node.Dir || len(nodes) != 4 {
+		t.Fatalf("unexpected node %#v", resp.Node)
+	}
+	if nodes[0].Key != "/dir/a" || nodes[1].Key != "/dir/b" || nodes[2].Key != "/dir/empty" || nodes[3].Key != "/dir/sub" {
+		t.Errorf("unexpected nodes %#v %#v %#v %#v", nodes[0], nodes[1], nodes[2], nodes[3])
+	}
+	if !nodes[3].Dir || nodes[3].Nodes != nil {
+		t.Errorf("children of subdirectory shouldn't be listed without recursive: %#v", nodes[3])
+	}
+
+	resp, err = client.Get("/dir", &etcdclient.GetOptions{Recursive: true})
+	if err != nil {
+		t.Fatalf("unexpected error %#v", err)
+	}
+	sub := resp.Node.Nodes[3]
+	if len(sub.Nodes) != 1 || sub.Nodes[0].Key != "/dir/sub/c" || sub.Nodes[0].Value != "C" {
+		t.Errorf("unexpected node %#v", sub)
+	}
+
+	resp, err = client.Get("/", &etcdclient.GetOptions{Recursive: true})
+	if err != nil {
+		t.Fatalf("unexpected error %#v", err)
+	}
+	if resp.Node.Key != "" || !resp.Node.Dir || len(resp.Node.Nodes) != 1 {
+		t.Errorf("unexpected root node %#v", resp.Node)
+	}
+}
+
+func TestCreate(t *testing.T) {
+	etcd, server, client := testServer()
+	defer server.Close()
+
+	resp, err := client.Set("/key", "val", &etcdclient.SetOptions{PrevExist: etcdclient.PrevNoExist})
+	if err != nil {
+		t.Fatalf("unexpected error %#v", err)
+	}
+	if resp.Action != "create" {
+		t.Errorf("unexpected action %#v", resp.Action)
+	}
+
+	_, err = client.Set("/key", "val2", &etcdclient.SetOptions{PrevExist: etcdclient.PrevNoExist})
+	if !etcdclient.IsNodeExist(err) || err.(*etcdclient.Error).StatusCode != 412 {
+		t.Errorf("unexpected error %#v", err)
+	}
+	if value, _ := etcd.Get("/key"); value != "val" {
+		t.Errorf("unexpected value %#v", value)
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	etcd, server, client := testServer()
+	defer server.Close()
+
+	_, err := client.Set("/key", "val", &etcdclient.SetOptions{PrevExist: etcdclient.PrevExist})
+	if !etcdclient.IsKeyNotFound(err) {
+		t.Errorf("unexpected error %#v", err)
+	}
+
+	etcd.Set("/key", "val")
+	resp, err := client.Set("/key", "val2", &etcdclient.SetOptions{PrevExist: etcdclient.PrevExist})
+	if err != nil {
+		t.Fatalf("unexpected error %#v", err)
+	}
+	if resp.Action != "update" || resp.Node.CreatedIndex != 1 || resp.Node.ModifiedIndex != 2 {
+		t.Errorf("unexpected response %#v %#v", resp, resp.Node)
+	}
+}
+
+func TestCompareAndSwap(t *testing.T) {
+	etcd, server, client := testServer()
+	defer server.Close()
+
+	etcd.Set("/key", "val")
+
+	_, err := client.Set("/key", "new", &etcdclient.SetOptions{PrevValue: "wrong"})
+	if !etcdclient.IsTestFailed(err) || err.(*etcdclient.Error).Cause != "[wrong != val]" {
+		t.Errorf("unexpected error %#v", err)
+	}
+	_, err = client.Set("/key", "new", &etcdclient.SetOptions{PrevIndex: 42})
+	if !etcdclient.IsTestFailed(err) || err.(*etcdclient.Error).Cause != "[42 != 1]" {
+		t.Errorf("unexpected error %#v", err)
+	}
+	_, err = client.Set("/nope", "new", &etcdclient.SetOptions{PrevValue: "val"})
+	if !etcdclient.IsKeyNotFound(err) {
+		t.Errorf("unexpected error %#v", err)
+	}
+
+	resp, err := client.Set("/key", "new", &etcdclient.SetOptions{PrevValue: "val", PrevIndex: 1})
+	if err != nil {
+		t.Fatalf("unexpected error %#v", err)
+	}
+	if resp.Action != "compareAndSwap" || resp.Node.Value != "new" || resp.PrevNode.Value != "val" {
+		t.Errorf("unexpected response %#v", resp)
+	}
+	if etcd.Index() != 2 {
+		t.Errorf("failed compareAndSwap shouldn't increment index: %#v", etcd.Index())
+	}
+}
+
+func TestSetErrors(t *testing.T) {
+	etcd, server, client := testServer()
+	defer server.Close()
+
+	etcd.Set("/file", "val")
+	etcd.SetDir("/dir")
+
+	_, err := client.Set("/dir", "val", nil)
+	if errorCode(err) != etcdclient.ErrorCodeNotFile {
+		t.Errorf("unexpected error %#v", err)
+	}
+	_, err = client.Set("/file/child", "val", nil)
+	if errorCode(err) != etcdclient.ErrorCodeNotDir {
+		t.Errorf("unexpected error %#v", err)
+	}
+	_, err = client.Set("/file/a/b", "val", nil)
+	if errorCode(err) != etcdclient.ErrorCodeNotDir {
+		t.Errorf("unexpected error %#v", err)
+	}
+	if etcd.Index() != 2 {
+		t.Errorf("failed set shouldn't increment index: %#v", etcd.Index())
+	}
+}
+
+func TestDelete(t *testing.T) {
+	etcd, server, client := testServer()
+	defer server.Close()
+
+	etcd.Set("/key", "val")
+	etcd.Set("/dir/a", "A")
+	etcd.SetDir("/empty")
+
+	resp, err := client.Delete("/key", nil)
+	if err != nil {
+		t.Fatalf("unexpected error %#v", err)
+	}
+	if resp.Action != "delete" || resp.Node.ModifiedIndex != 4 || resp.PrevNode.Value != "val" {
+		t.Errorf("unexpected response %#v", resp)
+	}
+	if _, ok := etcd.Get("/key"); ok {
+		t.Errorf("key still exists")
+	}
+
+	_, err = client.Delete("/key", nil)
+	if !etcdclient.IsKeyNotFound(err) {
+		t.Errorf("unexpected error %#v", err)
+	}
+	_, err = client.Delete("/dir", nil)
+	if errorCode(err) != etcdclient.ErrorCodeNotFile {
+		t.Errorf("unexpected error %#v", err)
+	}
+	_, err = client.Delete("/dir", &etcdclient.DeleteOptions{Dir: true})
+	if errorCode(err) != etcdclient.ErrorCodeDirNotEmpty {
+		t.Errorf("unexpected error %#v", err)
+	}
+
+	if _, err = client.Delete("/empty", &etcdclient.DeleteOptions{Dir: true}); err != nil {
+		t.Errorf("unexpected error %#v", err)
+	}
+	if _, err = client.Delete("/dir", &etcdclient.DeleteOptions{Recursive: true}); err != nil {
+		t.Errorf("unexpected error %#v", err)
+	}
+	if _, ok := etcd.Get("/dir/a"); ok {
+		t.Errorf("key still exists")
+	}
+}
+
+func TestCompareAndDelete(t *testing.T) {
+	etcd, server, client := testServer()
+	defer server.Close()
+
+	etcd.Set("/key", "val")
+
+	_, err := client.Delete("/key", &etcdclient.DeleteOptions{PrevValue: "wrong"})
+	if !etcdclient.IsTestFailed(err) {
+		t.Errorf("unexpected error %#v", err)
+	}
+	resp, err := client.Delete("/key", &etcdclient.DeleteOptions{PrevIndex: 1})
+	if err != nil {
+		t.Fatalf("unexpected error %#v", err)
+	}
+	if resp.Action != "compareAndDelete" {
+		t.Errorf("unexpected action %#v", resp.Action)
+	}
+}
+
+func TestTTL(t *testing.T) {
+	etcd, server, client := testServer()
+	defer server.Close()
+
+	now := time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+	etcd.Now = func() time.Time { return now }
+
+	resp, err := client.Set("/key", "val", &etcdclient.SetOptions{TTL: 10})
+	if err != nil {
+		t.Fatalf("unexpected error %#v", err)
+	}
+	if resp.Node.TTL != 10 || resp.Node.Expiration != "2015-01-01T00:00:10Z" {
+		t.Errorf("unexpected node %#v", resp.Node)
+	}
+
+	now = now.Add(4 * time.Second)
+	resp, err = client.Get("/key", nil)
+	if err != nil {
+		t.Fatalf("unexpected error %#v", err)
+	}
+	if resp.Node.TTL != 6 {
+		t.Errorf("unexpected ttl %#v", resp.Node.TTL)
+	}
+
+	now = now.Add(6 * time.Second)
+	_, err = client.Get("/key", nil)
+	if !etcdclient.IsKeyNotFound(err) {
+		t.Errorf("unexpected error %#v", err)
+	}
+
+	resp, err = client.Watch("/key", &etcdclient.WatchOptions{WaitIndex: 2})
+	if err != nil {
+		t.Fatalf("unexpected error %#v", err)
+	}
+	if resp.Action != "expire" || resp.Node.ModifiedIndex != 2 || resp.PrevNode.Value != "val" {
+		t.Errorf("unexpected response %#v", resp)
+	}
+}
+
+func TestWatchHistory(t *testing.T) {
+	etcd, server, client := testServer()
+	defer server.Close()
+
+	etcd.Set("/dir/a", "A")
+	etcd.Set("/other", "O")
+	etcd.Set("/dir/b", "B")
+
+	resp, err := client.Watch("/dir", &etcdclient.WatchOptions{WaitIndex: 1, Recursive: true})
+	if err != nil {
+		t.Fatalf("unexpected error %#v", err)
+	}
+	if resp.Node.Key != "/dir/a" {
+		t.Errorf("unexpected node %#v", resp.Node)
+	}
+
+	resp, err = client.Watch("/dir", &etcdclient.WatchOptions{WaitIndex: 2, Recursive: true})
+	if err != nil {
+		t.Fatalf("unexpected error %#v", err)
+	}
+	if resp.Node.Key != "/dir/b" || resp.Node.ModifiedIndex != 3 {
+		t.Errorf("unexpected node %#v", resp.Node)
+	}
+
+	resp, err = client.Watch("/other", &etcdclient.WatchOptions{WaitIndex: 1})
+	if err != nil {
+		t.Fatalf("unexpected error %#v", err)
+	}
+	if resp.Node.Key != "/other" {
+		t.Errorf("unexpected node %#v", resp.Node)
+	}
+}
+
+func TestWatchWait(t *testing.T) {
+	etcd, server, client := testServer()
+	defer server.Close()
+
+	etcd.Set("/dir/a", "A")
+
+	type result struct {
+		resp *etcdclient.Response
+		err  error
+	}
+	results := make(chan result)
+	go func() {
+		resp, err := client.Watch("/dir", &etcdclient.WatchOptions{Recursive: true})
+		results <- result{resp, err}
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	etcd.Set("/other", "O")
+	etcd.Set("/dir/a", "A2")
+
+	select {
+	case r := <-results:
+		if r.err != nil {
+			t.Fatalf("unexpected error %#v", r.err)
+		}
+		if r.resp.Node.Key != "/dir/a" || r.resp.Node.Value != "A2" || r.resp.PrevNode.Value != "A" {
+			t.Errorf("unexpected response %#v", r.resp)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("watch didn't return")
+	}
+}
+
+func TestWatchMatches(t *testing.T) {
+	cases := []struct {
+		key       string
+		eventKey  string
+		recursive bool
+		expected  bool
+	}{
+		{"/dir", "/dir", false, true},
+		{"/dir", "/dir/a", false, false},
+		{"/dir", "/dir/a", true, true},
+		{"/dir", "/dirx", true, false},
+		{"/dir/a", "/dir", false, true}, // deletion of parent
+		{"/", "/a", true, true},
+	}
+
+	for _, c := range cases {
+		if matches(c.key, c.eventKey, c.recursive) != c.expected {
+			t.Errorf("unexpected result for %#v", c)
+		}
+	}
+}
+
+func TestWatchCleared(t *testing.T) {
+	etcd, server, client := testServer()
+	defer server.Close()
+
+	for i := 0; i < HistoryLength+1; i++ {
+		etcd.Set("/key", "val")
+	}
+
+	_, err := client.Watch("/key", &etcdclient.WatchOptions{WaitIndex: 1})
+	if errorCode(err) != etcdclient.ErrorCodeEventIndexCleared {
+		t.Errorf("unexpected error %#v", err)
+	}
+}
+
+func TestMembers(t *testing.T) {
+	etcd, server, _ := testServer()
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/v2/members")
+	if err != nil {
+		t.Fatalf("unexpected error %#v", err)
+	}
+	members := struct {
+		Members []Member `json:"members"`
+	}{}
+	err = json.NewDecoder(resp.Body).Decode(&members)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("unexpected error %#v", err)
+	}
+	if len(members.Members) != 1 || members.Members[0].ClientURLs[0] != server.URL {
+		t.Errorf("unexpected members %#v", members)
+	}
+
+	etcd.Members = []Member{
+		{Id: "a", Name: "a", PeerURLs: []string{"http://a:2380"}, ClientURLs: []string{"http://a:2379"}},
+		{Id: "b", Name: "b", PeerURLs: []string{"http://b:2380"}, ClientURLs: []string{"http://b:2379"}},
+	}
+	resp, err = http.Get(server.URL + "/members")
+	if err != nil {
+		t.Fatalf("unexpected error %#v", err)
+	}
+	peerMembers := []Member{}
+	err = json.NewDecoder(resp.Body).Decode(&peerMembers)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("unexpected error %#v", err)
+	}
+	if len(peerMembers) != 2 || peerMembers[1].PeerURLs[0] != "http://b:2380" {
+		t.Errorf("unexpected members %#v", peerMembers)
+	}
+}
+
+func postV3(t *testing.T, server *httptest.Server, endpoint string, body string, result interface{}) {
+	resp, err := http.Post(server.URL+"/v3/"+endpoint, "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("unexpected error %#v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		t.Fatalf("unexpected status %d", resp.StatusCode)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		t.Fatalf("unexpected error %#v", err)
+	}
+}
+
+type v3Result struct {
+	Header struct {
+		Revision string `json:"revision"`
+	} `json:"header"`
+	Kvs     []*v3Kv `json:"kvs"`
+	PrevKv  *v3Kv   `json:"prev_kv"`
+	PrevKvs []*v3Kv `json:"prev_kvs"`
+	Count   string  `json:"count"`
+	Deleted string  `json:"deleted"`
+}
+
+func TestV3PutAndRange(t *testing.T) {
+	etcd, server, _ := testServer()
+	defer server.Close()
+	etcd.PutV3("/app/a", "A")
+	etcd.Set("/app/a", "v2") // v2 and v3 are separated
+
+	var put v3Result
+	postV3(t, server, "kv/put", `{"key":"L2FwcC9h","value":"bmV3","prev_kv":true}`, &put)
+	if put.Header.Revision != "2" || put.PrevKv == nil || string(put.PrevKv.Value) != "A" {
+		t.Errorf("unexpected response %#v", put)
+	}
+	postV3(t, server, "kv/put", `{"key":"L2FwcC9i","value":"Qg=="}`, &put)
+	postV3(t, server, "kv/put", `{"key":"L2FwcGxl","value":"Qw=="}`, &put)
+
+	var single v3Result
+	postV3(t, server, "kv/range", `{"key":"L2FwcC9h"}`, &single)
+	if single.Count != "1" || string(single.Kvs[0].Value) != "new" || single.Kvs[0].CreateRevision != 1 || single.Kvs[0].ModRevision != 2 || single.Kvs[0].Version != 2 {
+		t.Errorf("unexpected response %#v %#v", single, single.Kvs)
+	}
+
+	// prefix "/app/": range_end "/app0"
+	var prefix v3Result
+	postV3(t, server, "kv/range", `{"key":"L2FwcC8=","range_end":"L2FwcDA="}`, &prefix)
+	if prefix.Count != "2" || string(prefix.Kvs[0].Key) != "/app/a" || string(prefix.Kvs[1].Key) != "/app/b" {
+		t.Errorf("unexpected response %#v", prefix)
+	}
+
+	if value, _ := etcd.Get("/app/a"); value != "v2" {
+		t.Errorf("unexpected v2 value %#v", value)
+	}
+}
+
+func TestV3DeleteRange(t *testing.T) {
+	etcd, server, _ := testServer()
+	defer server.Close()
+	etcd.PutV3("a", "A")
+	etcd.PutV3("b", "B")
+
+	var deleted v3Result
+	postV3(t, server, "kv/deleterange", `{"key":"YQ==","range_end":"AA==","prev_kv":true}`, &deleted)
+	if deleted.Deleted != "2" || len(deleted.PrevKvs) != 2 || string(deleted.PrevKvs[1].Value) != "B" {
+		t.Errorf("unexpected response %#v", deleted)
+	}
+	if _, ok := etcd.GetV3("a"); ok {
+		t.Errorf("unexpected existence")
+	}
+}
+
+func TestV3Txn(t *testing.T) {
+	etcd, server, _ := testServer()
+	defer server.Close()
+	etcd.PutV3("a", "A")
+
+	type txnResult struct {
+		Succeeded bool `json:"succeeded"`
+		Responses []struct {
+			ResponsePut   *v3Result `json:"response_put"`
+			ResponseRange *v3Result `json:"response_range"`
+		} `json:"responses"`
+	}
+
+	var txn txnResult
+
+	// value of "a" is "A": put "b" and range "a"
+	postV3(t, server, "kv/txn", `{"compare":[{"key":"YQ==","target":"VALUE","value":"QQ=="}],"success":[{"request_put":{"key":"Yg==","value":"Qg=="}},{"request_range":{"key":"YQ=="}}],"failure":[{"request_put":{"key":"Yw==","value":"Qw=="}}]}`, &txn)
+	if !txn.Succeeded || len(txn.Responses) != 2 || txn.Responses[0].ResponsePut == nil || string(txn.Responses[1].ResponseRange.Kvs[0].Value) != "A" {
+		t.Errorf("unexpected response %#v", txn)
+	}
+	if value, _ := etcd.GetV3("b"); value != "B" {
+		t.Errorf("unexpected value %#v", value)
+	}
+
+	// version of "c" is 0: failure
+	var failed txnResult
+	postV3(t, server, "kv/txn", `{"compare":[{"key":"Yw==","result":"GREATER","version":"0"}],"failure":[{"request_put":{"key":"Yw==","value":"Qw=="}}]}`, &failed)
+	if failed.Succeeded || len(failed.Responses) != 1 || failed.Responses[0].ResponsePut == nil {
+		t.Errorf("unexpected response %#v", failed)
+	}
+	if value, _ := etcd.GetV3("c"); value != "C" {
+		t.Errorf("unexpected value %#v", value)
+	}
+}
+
+func TestV3Watch(t *testing.T) {
+	etcd, server, _ := testServer()
+	defer server.Close()
+	etcd.PutV3("a", "old")
+
+	resp, err := http.Post(server.URL+"/v3/watch", "application/json", strings.NewReader(`{"create_request":{"key":"YQ==","start_revision":"1","prev_kv":true}}`))
+	if err != nil {
+		t.Fatalf("unexpected error %#v", err)
+	}
+	defer resp.Body.Close()
+	decoder := json.NewDecoder(resp.Body)
+
+	var created struct {
+		Result struct {
+			Created bool `json:"created"`
+		} `json:"result"`
+	}
+	if err := decoder.Decode(&created); err != nil || !created.Result.Created {
+		t.Fatalf("unexpected message %#v %#v", created, err)
+	}
+
+	etcd.PutV3("b", "ignored")
+	etcd.PutV3("a", "new")
+
+	for _, expected := range []string{"old", "new"} {
+		var message struct {
+			Result struct {
+				Events []*v3Event `json:"events"`
+			} `json:"result"`
+		}
+		if err := decoder.Decode(&message); err != nil {
+			t.Fatalf("unexpected error %#v", err)
+		}
+		if len(message.Result.Events) != 1 || string(message.Result.Events[0].Kv.Value) != expected {
+			t.Errorf("unexpected message %#v", message)
+		}
+		if expected == "new" && string(message.Result.Events[0].PrevKv.Value) != "old" {
+			t.Errorf("unexpected prev_kv %#v", message.Result.Events[0].PrevKv)
+		}
+	}
+}
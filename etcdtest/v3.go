@@ -0,0 +1,376 @@
+package etcdtest
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// v3 JSON gateway: /v3/kv/put, /v3/kv/range, /v3/kv/deleterange, /v3/kv/txn and /v3/watch, backed by a flat key-value
+// store with revisions separated from v2 keys, like etcd. Keys and values are base64 encoded, and int64
+// fields are encoded as strings, like grpc-gateway.
+
+type v3Header struct {
+	ClusterId uint64 `json:"cluster_id,string"`
+	MemberId  uint64 `json:"member_id,string"`
+	Revision  int64  `json:"revision,string"`
+	RaftTerm  uint64 `json:"raft_term,string"`
+}
+
+type v3Kv struct {
+	Key            []byte `json:"key,omitempty"`
+	CreateRevision int64  `json:"create_revision,string,omitempty"`
+	ModRevision    int64  `json:"mod_revision,string,omitempty"`
+	Version        int64  `json:"version,string,omitempty"`
+	Value          []byte `json:"value,omitempty"`
+}
+
+type v3Event struct {
+	Type   string `json:"type,omitempty"`
+	Kv     *v3Kv  `json:"kv"`
+	PrevKv *v3Kv  `json:"prev_kv,omitempty"`
+}
+
+type v3PutRequest struct {
+	Key    []byte `json:"key"`
+	Value  []byte `json:"value"`
+	PrevKv bool   `json:"prev_kv"`
+}
+
+type v3RangeRequest struct {
+	Key      []byte `json:"key"`
+	RangeEnd []byte `json:"range_end"`
+	PrevKv   bool   `json:"prev_kv"`
+}
+
+type v3Compare struct {
+	Key     []byte `json:"key"`
+	Target  string `json:"target"`
+	Result  string `json:"result"`
+	Value   []byte `json:"value"`
+	Version int64  `json:"version,string"`
+}
+
+type v3RequestOp struct {
+	RequestPut         *v3PutRequest   `json:"request_put"`
+	RequestRange       *v3RangeRequest `json:"request_range"`
+	RequestDeleteRange *v3RangeRequest `json:"request_delete_range"`
+	RequestTxn         *v3TxnRequest   `json:"request_txn"`
+}
+
+type v3TxnRequest struct {
+	Compare []*v3Compare   `json:"compare"`
+	Success []*v3RequestOp `json:"success"`
+	Failure []*v3RequestOp `json:"failure"`
+}
+
+type v3WatchRequest struct {
+	CreateRequest *struct {
+		Key           []byte      `json:"key"`
+		RangeEnd      []byte      `json:"range_end"`
+		StartRevision json.Number `json:"start_revision"`
+		PrevKv        bool        `json:"prev_kv"`
+	} `json:"create_request"`
+}
+
+// PutV3 puts value to key of v3 store; for preparing tests.
+func (server *Server) PutV3(key string, value string) {
+	server.Lock()
+	defer server.Unlock()
+	server.putV3([]byte(key), []byte(value))
+}
+
+// GetV3 returns value of key in v3 store.
+func (server *Server) GetV3(key string) (string, bool) {
+	server.Lock()
+	defer server.Unlock()
+	kv, ok := server.kvs[key]
+	if !ok {
+		return "", false
+	}
+	return string(kv.Value), true
+}
+
+func (server *Server) serveV3(response http.ResponseWriter, request *http.Request) {
+	if request.Method != "POST" {
+		http.Error(response, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	endpoint := strings.TrimPrefix(request.URL.Path, "/v3/")
+	if endpoint == "watch" {
+		server.serveV3Watch(response, request)
+		return
+	}
+
+	server.Lock()
+	defer server.Unlock()
+
+	switch endpoint {
+	case "kv/put":
+		var put v3PutRequest
+		if err := json.NewDecoder(request.Body).Decode(&put); err != nil {
+			http.Error(response, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeV3Json(response, server.v3Put(&put))
+	case "kv/range":
+		var rangeRequest v3RangeRequest
+		if err := json.NewDecoder(request.Body).Decode(&rangeRequest); err != nil {
+			http.Error(response, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeV3Json(response, server.v3Range(&rangeRequest))
+	case "kv/deleterange":
+		var rangeRequest v3RangeRequest
+		if err := json.NewDecoder(request.Body).Decode(&rangeRequest); err != nil {
+			http.Error(response, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeV3Json(response, server.v3DeleteRange(&rangeRequest))
+	case "kv/txn":
+		var txn v3TxnRequest
+		if err := json.NewDecoder(request.Body).Decode(&txn); err != nil {
+			http.Error(response, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeV3Json(response, server.v3Txn(&txn))
+	default:
+		http.Error(response, "Not Found", http.StatusNotFound)
+	}
+}
+
+func (server *Server) v3Put(put *v3PutRequest) interface{} {
+	prevKv := server.putV3(put.Key, put.Value)
+	result := struct {
+		Header v3Header `json:"header"`
+		PrevKv *v3Kv    `json:"prev_kv,omitempty"`
+	}{Header: server.v3Header()}
+	if put.PrevKv {
+		result.PrevKv = prevKv
+	}
+	return result
+}
+
+func (server *Server) v3Range(rangeRequest *v3RangeRequest) interface{} {
+	kvs := server.rangeV3(rangeRequest.Key, rangeRequest.RangeEnd)
+	return struct {
+		Header v3Header `json:"header"`
+		Kvs    []*v3Kv  `json:"kvs,omitempty"`
+		Count  int64    `json:"count,string,omitempty"`
+	}{Header: server.v3Header(), Kvs: kvs, Count: int64(len(kvs))}
+}
+
+func (server *Server) v3DeleteRange(rangeRequest *v3RangeRequest) interface{} {
+	kvs := server.rangeV3(rangeRequest.Key, rangeRequest.RangeEnd)
+	if len(kvs) > 0 {
+		server.revision++
+	}
+	for _, kv := range kvs {
+		delete(server.kvs, string(kv.Key))
+		server.recordV3(&v3Event{Type: "DELETE", Kv: &v3Kv{Key: kv.Key, ModRevision: server.revision}, PrevKv: kv})
+	}
+	result := struct {
+		Header  v3Header `json:"header"`
+		Deleted int64    `json:"deleted,string,omitempty"`
+		PrevKvs []*v3Kv  `json:"prev_kvs,omitempty"`
+	}{Header: server.v3Header(), Deleted: int64(len(kvs))}
+	if rangeRequest.PrevKv {
+		result.PrevKvs = kvs
+	}
+	return result
+}
+
+// v3Txn runs success or failure ops by compares. Unlike etcd, each put in a txn gets its own revision.
+func (server *Server) v3Txn(txn *v3TxnRequest) interface{} {
+	succeeded := true
+	for _, compare := range txn.Compare {
+		if !server.compareV3(compare) {
+			succeeded = false
+			break
+		}
+	}
+
+	ops := txn.Success
+	if !succeeded {
+		ops = txn.Failure
+	}
+
+	responses := []map[string]interface{}{}
+	for _, op := range ops {
+		switch {
+		case op.RequestPut != nil:
+			responses = append(responses, map[string]interface{}{"response_put": server.v3Put(op.RequestPut)})
+		case op.RequestRange != nil:
+			responses = append(responses, map[string]interface{}{"response_range": server.v3Range(op.RequestRange)})
+		case op.RequestDeleteRange != nil:
+			responses = append(responses, map[string]interface{}{"response_delete_range": server.v3DeleteRange(op.RequestDeleteRange)})
+		case op.RequestTxn != nil:
+			responses = append(responses, map[string]interface{}{"response_txn": server.v3Txn(op.RequestTxn)})
+		}
+	}
+
+	return struct {
+		Header    v3Header                 `json:"header"`
+		Succeeded bool                     `json:"succeeded,omitempty"`
+		Responses []map[string]interface{} `json:"responses,omitempty"`
+	}{Header: server.v3Header(), Succeeded: succeeded, Responses: responses}
+}
+
+// compareV3 evaluates a compare on VALUE or VERSION (default) of a key; missing keys have version 0.
+func (server *Server) compareV3(compare *v3Compare) bool {
+	var cmp int
+	kv := server.kvs[string(compare.Key)]
+	switch compare.Target {
+	case "VALUE":
+		var value []byte
+		if kv != nil {
+			value = kv.Value
+		}
+		cmp = bytes.Compare(value, compare.Value)
+	default:
+		var version int64
+		if kv != nil {
+			version = kv.Version
+		}
+		cmp = int(version - compare.Version)
+	}
+
+	switch compare.Result {
+	case "NOT_EQUAL":
+		return cmp != 0
+	case "GREATER":
+		return cmp > 0
+	case "LESS":
+		return cmp < 0
+	default:
+		return cmp == 0
+	}
+}
+
+func writeV3Json(response http.ResponseWriter, body interface{}) {
+	response.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(response).Encode(body)
+}
+
+func (server *Server) v3Header() v3Header {
+	return v3Header{ClusterId: 1, MemberId: 1, Revision: server.revision, RaftTerm: 1}
+}
+
+// putV3 puts value to key, and returns the previous kv or nil.
+func (server *Server) putV3(key []byte, value []byte) *v3Kv {
+	server.revision++
+	prevKv := server.kvs[string(key)]
+	kv := &v3Kv{Key: key, Value: value, CreateRevision: server.revision, ModRevision: server.revision, Version: 1}
+	if prevKv != nil {
+		kv.CreateRevision = prevKv.CreateRevision
+		kv.Version = prevKv.Version + 1
+	}
+	server.kvs[string(key)] = kv
+	server.recordV3(&v3Event{Kv: kv, PrevKv: prevKv})
+	return prevKv
+}
+
+// rangeV3 returns kvs in [key, rangeEnd) sorted by key. Empty rangeEnd means key only,
+// and "\0" means all keys greater than or equal to key, like etcd.
+func (server *Server) rangeV3(key []byte, rangeEnd []byte) []*v3Kv {
+	kvs := []*v3Kv{}
+	for _, kv := range server.kvs {
+		if inV3Range(kv.Key, key, rangeEnd) {
+			kvs = append(kvs, kv)
+		}
+	}
+	sort.Slice(kvs, func(i, j int) bool { return bytes.Compare(kvs[i].Key, kvs[j].Key) < 0 })
+	return kvs
+}
+
+func inV3Range(target []byte, key []byte, rangeEnd []byte) bool {
+	if len(rangeEnd) == 0 {
+		return bytes.Equal(target, key)
+	}
+	if bytes.Compare(target, key) < 0 {
+		return false
+	}
+	return bytes.Equal(rangeEnd, []byte{0}) || bytes.Compare(target, rangeEnd) < 0
+}
+
+func (server *Server) recordV3(e *v3Event) {
+	server.v3History = append(server.v3History, e)
+	if len(server.v3History) > HistoryLength {
+		server.v3History = server.v3History[len(server.v3History)-HistoryLength:]
+	}
+	server.broadcast()
+}
+
+// serveV3Watch streams events for the first create_request until the client goes away.
+func (server *Server) serveV3Watch(response http.ResponseWriter, request *http.Request) {
+	var watch v3WatchRequest
+	if err := json.NewDecoder(request.Body).Decode(&watch); err != nil || watch.CreateRequest == nil {
+		http.Error(response, "create_request is required", http.StatusBadRequest)
+		return
+	}
+	create := watch.CreateRequest
+
+	closeNotifyCh := make(<-chan bool)
+	if closeNotifier, ok := response.(http.CloseNotifier); ok {
+		closeNotifyCh = closeNotifier.CloseNotify()
+	}
+	flusher, _ := response.(http.Flusher)
+	encoder := json.NewEncoder(response)
+	send := func(result interface{}) {
+		encoder.Encode(struct {
+			Result interface{} `json:"result"`
+		}{Result: result})
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+
+	server.Lock()
+	nextRevision := server.revision + 1
+	if startRevision, _ := create.StartRevision.Int64(); startRevision > 0 {
+		nextRevision = startRevision
+	}
+	header := server.v3Header()
+	server.Unlock()
+
+	response.Header().Set("Content-Type", "application/json")
+	send(struct {
+		Header  v3Header `json:"header"`
+		Created bool     `json:"created"`
+	}{Header: header, Created: true})
+
+	for {
+		server.Lock()
+		events := []*v3Event{}
+		for _, e := range server.v3History {
+			if e.Kv.ModRevision < nextRevision || !inV3Range(e.Kv.Key, create.Key, create.RangeEnd) {
+				continue
+			}
+			sent := *e
+			if !create.PrevKv {
+				sent.PrevKv = nil
+			}
+			events = append(events, &sent)
+		}
+		nextRevision = server.revision + 1
+		header := server.v3Header()
+		changed := server.changed
+		server.Unlock()
+
+		for _, e := range events {
+			send(struct {
+				Header v3Header   `json:"header"`
+				Events []*v3Event `json:"events"`
+			}{Header: header, Events: []*v3Event{e}})
+		}
+
+		select {
+		case <-changed:
+		case <-closeNotifyCh:
+			return
+		}
+	}
+}
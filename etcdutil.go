@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"github.com/codegangsta/cli"
+	"github.com/sorah/etcvault/etcdclient"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// flags for commands talking to etcd directly (not through proxy)
+var etcdClientFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:  "etcd",
+		Usage: "etcd client URLs, separated by comma",
+	},
+	cli.StringFlag{
+		Name:  "client-ca-file",
+		Usage: "TLS CA file to verify certificate of etcd",
+	},
+	cli.StringFlag{
+		Name:  "client-cert-file",
+		Usage: "TLS certficate file to send to etcd",
+	},
+	cli.StringFlag{
+		Name:  "client-key-file",
+		Usage: "key for -client-cert-file",
+	},
+	cli.IntFlag{
+		Name:  "etcd-timeout",
+		Value: 60,
+		Usage: "Timeout (in second) for each request to etcd, before trying the next -etcd URL",
+	},
+}
+
+func etcdClientFromFlags(ctx *cli.Context) *etcdclient.Client {
+	if ctx.String("etcd") == "" {
+		fmt.Fprintln(os.Stderr, "Specify -etcd option")
+		os.Exit(1)
+	}
+	if ctx.Int("etcd-timeout") <= 0 {
+		fmt.Fprintf(os.Stderr, "-etcd-timeout should be positive: %d\n", ctx.Int("etcd-timeout"))
+		os.Exit(1)
+	}
+
+	endpoints, err := parseUrls(ctx.String("etcd"))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		os.Exit(1)
+	}
+
+	reloader, err := NewTlsReloader(ctx.String("client-cert-file"), ctx.String("client-key-file"), ctx.String("client-ca-file"), DefaultTlsPolicy())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		os.Exit(1)
+	}
+	transport := defaultHttpTransport()
+	reloader.ApplyToTransport(transport)
+
+	client := etcdclient.NewClientWithUrls(transport, endpoints)
+	// applied to each attempt, so a hung endpoint fails over to the next one
+	client.Timeout = time.Duration(ctx.Int("etcd-timeout")) * time.Second
+	return client
+}
+
+func parseUrls(str string) ([]*url.URL, error) {
+	urls := []*url.URL{}
+	for _, urlString := range strings.Split(str, ",") {
+		u, err := url.Parse(strings.TrimSpace(urlString))
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse url %s: %s", urlString, err.Error())
+		}
+		urls = append(urls, u)
+	}
+	return urls, nil
+}
+
+// fetchEtcdTree retrieves a node and its descendants, sorted.
+func fetchEtcdTree(client *etcdclient.Client, key string) (*etcdclient.Node, error) {
+	resp, err := client.Get(key, &etcdclient.GetOptions{Recursive: true, Sorted: true})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Node, nil
+}
+
+// walkEtcdNodes calls fn for each non-directory node under node, in order.
+func walkEtcdNodes(node *etcdclient.Node, fn func(node *etcdclient.Node)) {
+	if !node.Dir {
+		fn(node)
+		return
+	}
+	for _, child := range node.Nodes {
+		walkEtcdNodes(child, fn)
+	}
+}
+
+// maxModifiedIndex returns the largest modifiedIndex in node and its descendants.
+func maxModifiedIndex(node *etcdclient.Node) uint64 {
+	index := node.ModifiedIndex
+	for _, child := range node.Nodes {
+		if childIndex := maxModifiedIndex(child); childIndex > index {
+			index = childIndex
+		}
+	}
+	return index
+}
+
+// watchEtcdPrefix calls fn whenever values under prefix change after index; fn returns the largest modifiedIndex it has seen.
+// Never returns.
+func watchEtcdPrefix(client *etcdclient.Client, prefix string, index uint64, fn func() (uint64, error)) {
+	for {
+		var changedIndex uint64
+		resp, err := client.Watch(prefix, &etcdclient.WatchOptions{Recursive: true, WaitIndex: index + 1})
+		if err == nil {
+			changedIndex = resp.Node.ModifiedIndex
+		} else {
+			log.Printf("error while watching %s: %s", prefix, err.Error())
+			time.Sleep(time.Second)
+		}
+
+		fetchedIndex, err := fn()
+		if err != nil {
+			log.Printf("error while fetching %s: %s", prefix, err.Error())
+			time.Sleep(time.Second)
+			continue
+		}
+
+		// deletions aren't visible in fetched tree, so follow the index of events as well
+		index = fetchedIndex
+		if changedIndex > index {
+			index = changedIndex
+		}
+	}
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"flag"
+	"github.com/codegangsta/cli"
+	"testing"
+	"time"
+)
+
+func TestEtcdClientFromFlags(t *testing.T) {
+	set := flag.NewFlagSet("backup", flag.ContinueOnError)
+	for _, f := range etcdClientFlags {
+		f.Apply(set)
+	}
+	if err := set.Parse([]string{"-etcd", "http://etcd-1:2379,http://etcd-2:2379", "-etcd-timeout", "3"}); err != nil {
+		panic(err)
+	}
+
+	client := etcdClientFromFlags(cli.NewContext(cli.NewApp(), set, nil))
+	if client.Timeout != 3*time.Second {
+		t.Errorf("unexpected timeout %s", client.Timeout)
+	}
+	if endpoints := client.Endpoints(); len(endpoints) != 2 || endpoints[1].CandidateUrls()[0].String() != "http://etcd-2:2379" {
+		t.Errorf("unexpected endpoints %#v", endpoints)
+	}
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"fmt"
+	"github.com/codegangsta/cli"
+	"github.com/sorah/etcvault/engine"
+	"github.com/sorah/etcvault/etcdclient"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path"
+	"reflect"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// signals forwarded to a child process by exec -watch
+var forwardedSignals = []os.Signal{syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGQUIT, syscall.SIGUSR1, syscall.SIGUSR2}
+
+// envSource fetches values under Prefix, decrypts them with Engine, and maps them to environment variables.
+type envSource struct {
+	Client    *etcdclient.Client
+	Engine    *engine.Engine
+	Prefix    string
+	EnvPrefix string
+}
+
+// envNameForKey returns environment variable name for etcd key under prefix: /app1/db/password -> DB_PASSWORD
+// When prefix is the key itself, its basename is used: /app1/db/password -> PASSWORD
+func envNameForKey(prefix string, key string) string {
+	relative := strings.Trim(strings.TrimPrefix(key, prefix), "/")
+	if relative == "" {
+		relative = path.Base(key)
+	}
+
+	name := make([]rune, 0, len(relative))
+	for _, r := range strings.ToUpper(relative) {
+		if (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '_' {
+			name = append(name, r)
+		} else {
+			name = append(name, '_')
+		}
+	}
+	return string(name)
+}
+
+// Fetch returns environment variables and the largest modifiedIndex seen.
+func (source *envSource) Fetch() (map[string]string, uint64, error) {
+	root, err := fetchEtcdTree(source.Client, source.Prefix)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	vars := map[string]string{}
+	var lastErr error
+	walkEtcdNodes(root, func(node *etcdclient.Node) {
+		if lastErr != nil {
+			return
+		}
+
+		value, err := source.Engine.TransformWithPath(node.Value, node.Key)
+		if err != nil {
+			lastErr = fmt.Errorf("couldn't decrypt %s: %s", node.Key, err.Error())
+			return
+		}
+
+		name := source.EnvPrefix + envNameForKey(source.Prefix, node.Key)
+		if _, ok := vars[name]; ok {
+			log.Printf("%s maps to %s, which is already set by another key; overwriting", node.Key, name)
+		}
+		vars[name] = value
+	})
+	if lastErr != nil {
+		return nil, 0, lastErr
+	}
+
+	return vars, maxModifiedIndex(root), nil
+}
+
+// Watch sends environment variables to changes whenever values under the prefix change. Never returns.
+func (source *envSource) Watch(index uint64, current map[string]string, changes chan<- map[string]string) {
+	watchEtcdPrefix(source.Client, source.Prefix, index, func() (uint64, error) {
+		vars, index, err := source.Fetch()
+		if err != nil {
+			return 0, err
+		}
+		if !reflect.DeepEqual(vars, current) {
+			current = vars
+			changes <- vars
+		}
+		return index, nil
+	})
+}
+
+// buildEnv returns environ with vars added; vars take precedence over existing variables.
+func buildEnv(environ []string, vars map[string]string) []string {
+	env := make([]string, 0, len(environ)+len(vars))
+	for _, kv := range environ {
+		name := strings.SplitN(kv, "=", 2)[0]
+		if _, ok := vars[name]; ok {
+			continue
+		}
+		env = append(env, kv)
+	}
+	for name, value := range vars {
+		env = append(env, fmt.Sprintf("%s=%s", name, value))
+	}
+	return env
+}
+
+func parseSignal(name string) (syscall.Signal, error) {
+	switch strings.TrimPrefix(strings.ToUpper(name), "SIG") {
+	case "HUP":
+		return syscall.SIGHUP, nil
+	case "INT":
+		return syscall.SIGINT, nil
+	case "QUIT":
+		return syscall.SIGQUIT, nil
+	case "TERM":
+		return syscall.SIGTERM, nil
+	case "KILL":
+		return syscall.SIGKILL, nil
+	case "USR1":
+		return syscall.SIGUSR1, nil
+	case "USR2":
+		return syscall.SIGUSR2, nil
+	default:
+		return 0, fmt.Errorf("unsupported signal: %s", name)
+	}
+}
+
+func exitStatus(err error) int {
+	if err == nil {
+		return 0
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok {
+			if status.Signaled() {
+				return 128 + int(status.Signal())
+			}
+			return status.ExitStatus()
+		}
+	}
+	return 1
+}
+
+// childSupervisor runs a command as a child, and restarts or signals it when values change.
+type childSupervisor struct {
+	CommandPath string
+	Args        []string
+	// OnChange is "restart" or "signal"
+	OnChange     string
+	ChangeSignal syscall.Signal
+	KillSignal   syscall.Signal
+	// KillTimeout is how long to wait for the child to stop with KillSignal on restart, before sending SIGKILL.
+	KillTimeout time.Duration
+}
+
+func (supervisor *childSupervisor) start(vars map[string]string, exited chan<- error) (*exec.Cmd, error) {
+	cmd := exec.Command(supervisor.CommandPath, supervisor.Args...)
+	cmd.Env = buildEnv(os.Environ(), vars)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	go func() { exited <- cmd.Wait() }()
+	return cmd, nil
+}
+
+// Run starts the child with vars, then restarts or signals it on changes, and forwards signals to it.
+// Returns exit status of the child once it exits by itself.
+func (supervisor *childSupervisor) Run(vars map[string]string, changes <-chan map[string]string, signals <-chan os.Signal) (int, error) {
+	exited := make(chan error)
+	child, err := supervisor.start(vars, exited)
+	if err != nil {
+		return 0, err
+	}
+
+	for {
+		select {
+		case sig := <-signals:
+			child.Process.Signal(sig)
+		case err := <-exited:
+			return exitStatus(err), nil
+		case vars = <-changes:
+			if supervisor.OnChange == "signal" {
+				log.Printf("values changed; sending %s to child", supervisor.ChangeSignal)
+				child.Process.Signal(supervisor.ChangeSignal)
+				continue
+			}
+
+			log.Printf("values changed; restarting child")
+			child.Process.Signal(supervisor.KillSignal)
+			select {
+			case <-exited:
+			case <-time.After(supervisor.KillTimeout):
+				log.Printf("child didn't stop in %s with %s; sending %s", supervisor.KillTimeout, supervisor.KillSignal, syscall.SIGKILL)
+				child.Process.Kill()
+				<-exited
+			}
+
+			child, err = supervisor.start(vars, exited)
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+}
+
+func actionExec(ctx *cli.Context) {
+	args := []string(ctx.Args())
+	if len(args) > 0 && args[0] == "--" {
+		args = args[1:]
+	}
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: etcvault exec [options] -- COMMAND [ARGS...]")
+		os.Exit(1)
+	}
+	if ctx.String("keychain") == "" {
+		fmt.Fprintln(os.Stderr, "Specify -keychain option")
+		os.Exit(1)
+	}
+
+	onChange := ctx.String("on-change")
+	var changeSignal syscall.Signal
+	switch onChange {
+	case "restart":
+	case "signal":
+		var err error
+		changeSignal, err = parseSignal(ctx.String("signal"))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+			os.Exit(1)
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "-on-change should be restart or signal: %s\n", onChange)
+		os.Exit(1)
+	}
+	killSignal, err := parseSignal(ctx.String("kill-signal"))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		os.Exit(1)
+	}
+	if ctx.Int("kill-timeout") <= 0 {
+		fmt.Fprintf(os.Stderr, "-kill-timeout should be positive: %d\n", ctx.Int("kill-timeout"))
+		os.Exit(1)
+	}
+
+	source := &envSource{
+		Client:    etcdClientFromFlags(ctx),
+		Engine:    engineForKeychain(ctx.String("keychain")),
+		Prefix:    path.Join("/", ctx.String("prefix")),
+		EnvPrefix: ctx.String("env-prefix"),
+	}
+
+	vars, index, err := source.Fetch()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to fetch %s: %s\n", source.Prefix, err.Error())
+		os.Exit(1)
+	}
+
+	commandPath, err := exec.LookPath(args[0])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		os.Exit(1)
+	}
+
+	if !ctx.Bool("watch") {
+		err := syscall.Exec(commandPath, args, buildEnv(os.Environ(), vars))
+		fmt.Fprintf(os.Stderr, "failed to exec %s: %s\n", commandPath, err.Error())
+		os.Exit(1)
+	}
+
+	// -watch: keep running as a parent to restart or signal the child on changes
+	changes := make(chan map[string]string)
+	go source.Watch(index, vars, changes)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, forwardedSignals...)
+
+	supervisor := &childSupervisor{
+		CommandPath:  commandPath,
+		Args:         args[1:],
+		OnChange:     onChange,
+		ChangeSignal: changeSignal,
+		KillSignal:   killSignal,
+		KillTimeout:  time.Duration(ctx.Int("kill-timeout")) * time.Second,
+	}
+	status, err := supervisor.Run(vars, changes, signals)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to start %s: %s\n", commandPath, err.Error())
+		os.Exit(1)
+	}
+	os.Exit(status)
+}
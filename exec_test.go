@@ -0,0 +1,244 @@
+package main
+
+import (
+	"github.com/sorah/etcvault/etcdclient"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestEnvNameForKey(t *testing.T) {
+	tests := []struct {
+		Prefix string
+		Key    string
+		Expect string
+	}{
+		{"/app1", "/app1/db/password", "DB_PASSWORD"},
+		{"/app1/", "/app1/db/password", "DB_PASSWORD"},
+		{"/", "/app1/db/password", "APP1_DB_PASSWORD"},
+		{"/app1", "/app1/api-key", "API_KEY"},
+		{"/app1", "/app1/db.host", "DB_HOST"},
+		{"/app1", "/app1/Token_2", "TOKEN_2"},
+		// prefix names a single key
+		{"/app1/db/password", "/app1/db/password", "PASSWORD"},
+		{"/app1/api-key", "/app1/api-key", "API_KEY"},
+	}
+
+	for _, test := range tests {
+		name := envNameForKey(test.Prefix, test.Key)
+		if name != test.Expect {
+			t.Errorf("%#v, %#v: unexpected name %#v", test.Prefix, test.Key, name)
+		}
+	}
+}
+
+func TestBuildEnv(t *testing.T) {
+	environ := []string{"PATH=/bin", "DB_PASSWORD=old", "EMPTY=", "WEIRD=a=b"}
+	vars := map[string]string{"DB_PASSWORD": "new", "TOKEN": "t=k"}
+
+	env := buildEnv(environ, vars)
+	sort.Strings(env)
+
+	expected := []string{"DB_PASSWORD=new", "EMPTY=", "PATH=/bin", "TOKEN=t=k", "WEIRD=a=b"}
+	if !reflect.DeepEqual(env, expected) {
+		t.Errorf("unexpected env %#v", env)
+	}
+
+	if env := buildEnv(nil, map[string]string{}); len(env) != 0 {
+		t.Errorf("unexpected env %#v", env)
+	}
+}
+
+func TestParseSignal(t *testing.T) {
+	tests := []struct {
+		Case   string
+		Expect syscall.Signal
+		Err    bool
+	}{
+		{"HUP", syscall.SIGHUP, false},
+		{"SIGHUP", syscall.SIGHUP, false},
+		{"term", syscall.SIGTERM, false},
+		{"sigusr1", syscall.SIGUSR1, false},
+		{"KILL", syscall.SIGKILL, false},
+		{"STOP", 0, true},
+		{"", 0, true},
+	}
+
+	for _, test := range tests {
+		sig, err := parseSignal(test.Case)
+		if sig != test.Expect || (err != nil) != test.Err {
+			t.Errorf("%#v: unexpected result %#v, %#v", test.Case, sig, err)
+		}
+	}
+}
+
+func TestExitStatus(t *testing.T) {
+	tests := []struct {
+		Name   string
+		Args   []string
+		Expect int
+	}{
+		{"success", []string{"sh", "-c", "exit 0"}, 0},
+		{"exit", []string{"sh", "-c", "exit 3"}, 3},
+		{"signaled", []string{"sh", "-c", "kill -TERM $$"}, 128 + int(syscall.SIGTERM)},
+	}
+
+	for _, test := range tests {
+		err := exec.Command(test.Args[0], test.Args[1:]...).Run()
+		if status := exitStatus(err); status != test.Expect {
+			t.Errorf("%s: unexpected status %d (%#v)", test.Name, status, err)
+		}
+	}
+
+	if status := exitStatus(exec.ErrNotFound); status != 1 {
+		t.Errorf("unexpected status %d", status)
+	}
+}
+
+func TestEnvSourceFetch(t *testing.T) {
+	etcd, server := startEtcdtest()
+	defer server.Close()
+	u, _ := url.Parse(server.URL)
+
+	eng := testEngineWithKeys("app")
+	etcd.Set("/app1/name", "etcvault")
+	etcd.Set("/app1/db/password", testEncrypt(eng, "app", "secret"))
+	etcd.Set("/app2/name", "other")
+
+	source := &envSource{
+		Client:    etcdclient.NewClientWithUrls(http.DefaultTransport, []*url.URL{u}),
+		Engine:    eng,
+		Prefix:    "/app1",
+		EnvPrefix: "APP_",
+	}
+	vars, index, err := source.Fetch()
+	if err != nil {
+		t.Fatalf("unexpected err %#v", err)
+	}
+	if !reflect.DeepEqual(vars, map[string]string{"APP_NAME": "etcvault", "APP_DB_PASSWORD": "secret"}) {
+		t.Errorf("unexpected vars %#v", vars)
+	}
+	if index != 2 {
+		t.Errorf("unexpected index %d", index)
+	}
+
+	etcd.Set("/app1/broken", "ETCVAULT::1:unknown-key::aGVsbG8=::ETCVAULT")
+	if vars, _, err := source.Fetch(); err == nil || !strings.Contains(err.Error(), "/app1/broken") {
+		t.Errorf("unexpected result %#v, %#v", vars, err)
+	}
+}
+
+// waitForFile waits until the file at filePath has content, and returns it.
+func waitForFile(filePath string, content string) string {
+	var current []byte
+	for i := 0; i < 100; i++ {
+		current, _ = ioutil.ReadFile(filePath)
+		if string(current) == content {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return string(current)
+}
+
+func TestChildSupervisorRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "etcvault_exec")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+	outPath := path.Join(dir, "out")
+
+	// the child ignores TERM, so it's killed after KillTimeout
+	supervisor := &childSupervisor{
+		CommandPath: "/bin/sh",
+		Args:        []string{"-c", `echo $VALUE >> ` + outPath + `; trap "" TERM; while :; do sleep 0.1; done`},
+		OnChange:    "restart",
+		KillSignal:  syscall.SIGTERM,
+		KillTimeout: 200 * time.Millisecond,
+	}
+	changes := make(chan map[string]string)
+	signals := make(chan os.Signal, 1)
+	statusCh := make(chan int)
+	go func() {
+		status, err := supervisor.Run(map[string]string{"VALUE": "1"}, changes, signals)
+		if err != nil {
+			t.Errorf("unexpected err %#v", err)
+		}
+		statusCh <- status
+	}()
+
+	if out := waitForFile(outPath, "1\n"); out != "1\n" {
+		t.Fatalf("unexpected output %#v", out)
+	}
+	changes <- map[string]string{"VALUE": "2"}
+	if out := waitForFile(outPath, "1\n2\n"); out != "1\n2\n" {
+		t.Fatalf("unexpected output %#v", out)
+	}
+
+	signals <- syscall.SIGKILL
+	select {
+	case status := <-statusCh:
+		if status != 128+int(syscall.SIGKILL) {
+			t.Errorf("unexpected status %d", status)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("supervisor didn't return")
+	}
+}
+
+func TestChildSupervisorSignal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "etcvault_exec")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+	outPath := path.Join(dir, "out")
+
+	supervisor := &childSupervisor{
+		CommandPath:  "/bin/sh",
+		Args:         []string{"-c", `trap "echo hup >> ` + outPath + `" HUP; echo $VALUE >> ` + outPath + `; while :; do sleep 0.1; done`},
+		OnChange:     "signal",
+		ChangeSignal: syscall.SIGHUP,
+		KillSignal:   syscall.SIGTERM,
+		KillTimeout:  time.Second,
+	}
+	changes := make(chan map[string]string)
+	signals := make(chan os.Signal, 1)
+	statusCh := make(chan int)
+	go func() {
+		status, err := supervisor.Run(map[string]string{"VALUE": "1"}, changes, signals)
+		if err != nil {
+			t.Errorf("unexpected err %#v", err)
+		}
+		statusCh <- status
+	}()
+
+	if out := waitForFile(outPath, "1\n"); out != "1\n" {
+		t.Fatalf("unexpected output %#v", out)
+	}
+	// signaled, not restarted
+	changes <- map[string]string{"VALUE": "2"}
+	if out := waitForFile(outPath, "1\nhup\n"); out != "1\nhup\n" {
+		t.Fatalf("unexpected output %#v", out)
+	}
+
+	signals <- syscall.SIGTERM
+	select {
+	case status := <-statusCh:
+		if status != 128+int(syscall.SIGTERM) {
+			t.Errorf("unexpected status %d", status)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("supervisor didn't return")
+	}
+}
@@ -0,0 +1,76 @@
+package keys
+
+import (
+	"github.com/sorah/etcvault/etcdclient"
+	"log"
+	"path"
+)
+
+// EtcdKeySource reads and writes keys in an etcd directory (v2 API).
+// Each key is stored as PEM under Directory/NAME, wrapped with MasterKey; public keys too, so keys can't be
+// added or replaced by anyone who can write to etcd.
+type EtcdKeySource struct {
+	Client    *etcdclient.Client
+	Directory string
+	MasterKey []byte
+}
+
+func NewEtcdKeySource(client *etcdclient.Client, directory string, masterKey []byte) *EtcdKeySource {
+	return &EtcdKeySource{
+		Client:    client,
+		Directory: directory,
+		MasterKey: masterKey,
+	}
+}
+
+// Fetch retrieves all keys in the directory. Missing directory is treated as empty.
+// Keys which couldn't be loaded (e.g. not wrapped, or wrapped with different master key) are skipped.
+func (source *EtcdKeySource) Fetch() ([]*Key, error) {
+	resp, err := source.Client.Get(source.Directory, nil)
+	if etcdclient.IsKeyNotFound(err) {
+		return []*Key{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]*Key, 0, len(resp.Node.Nodes))
+	for _, node := range resp.Node.Nodes {
+		if node.Dir {
+			continue
+		}
+
+		key, err := LoadWrappedKey([]byte(node.Value), source.MasterKey)
+		if err != nil {
+			log.Printf("couldn't load key %s from etcd: %s", node.Key, err.Error())
+			continue
+		}
+
+		name := path.Base(node.Key)
+		if key.Name != name {
+			log.Printf("ignoring key %s from etcd: name in PEM (%s) differs", node.Key, key.Name)
+			continue
+		}
+
+		keys = append(keys, key)
+	}
+
+	return keys, nil
+}
+
+// Put writes key to the directory, wrapped with MasterKey. Returns ErrKeyAlreadyExists when the key already exists.
+func (source *EtcdKeySource) Put(key *Key) error {
+	if source.MasterKey == nil {
+		return ErrNoMasterKey
+	}
+	pemBytes, err := key.WrappedPem(source.MasterKey)
+	if err != nil {
+		return err
+	}
+
+	_, err = source.Client.Set(path.Join(source.Directory, key.Name), string(pemBytes), &etcdclient.SetOptions{PrevExist: etcdclient.PrevNoExist})
+	if etcdclient.IsNodeExist(err) {
+		return ErrKeyAlreadyExists
+	}
+	return err
+}
@@ -0,0 +1,135 @@
+package keys
+
+import (
+	"crypto/rsa"
+	"github.com/sorah/etcvault/etcdclient"
+	"github.com/sorah/etcvault/etcdtest"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func startEtcd() (*etcdtest.Server, *httptest.Server, *etcdclient.Client) {
+	etcd := etcdtest.NewServer()
+	server := httptest.NewServer(etcd)
+	serverUrl, _ := url.Parse(server.URL)
+	return etcd, server, etcdclient.NewClientWithUrls(http.DefaultTransport, []*url.URL{serverUrl})
+}
+
+func TestEtcdKeySourcePutAndFetch(t *testing.T) {
+	etcd, server, client := startEtcd()
+	defer server.Close()
+
+	masterKey, _ := GenerateMasterKey()
+	source := NewEtcdKeySource(client, "/etcvault/keys", masterKey)
+
+	err := source.Put(NewPrivateKey("the-key", &rsaKey))
+	if err != nil {
+		t.Errorf("unexpected error %#v", err)
+	}
+	if value, _ := etcd.Get("/etcvault/keys/the-key"); strings.Contains(value, "RSA PRIVATE KEY") || !strings.Contains(value, WrappedPrivateKeyPemType) {
+		t.Errorf("private key is stored without wrapping: %s", value)
+	}
+
+	err = source.Put(NewPrivateKey("the-key", &rsaKey))
+	if err != ErrKeyAlreadyExists {
+		t.Errorf("unexpected error %#v", err)
+	}
+
+	keys, err := source.Fetch()
+	if err != nil {
+		t.Errorf("unexpected error %#v", err)
+	}
+	if len(keys) != 1 || keys[0].Name != "the-key" || keys[0].Private == nil {
+		t.Errorf("unexpected keys %#v", keys)
+	}
+}
+
+func TestEtcdKeySourcePutPublicKey(t *testing.T) {
+	etcd, server, client := startEtcd()
+	defer server.Close()
+
+	masterKey, _ := GenerateMasterKey()
+	source := NewEtcdKeySource(client, "/etcvault/keys", masterKey)
+
+	if err := source.Put(NewPublicKey("public-key", rsaKey.Public().(*rsa.PublicKey))); err != nil {
+		t.Errorf("unexpected error %#v", err)
+	}
+	if value, _ := etcd.Get("/etcvault/keys/public-key"); !strings.Contains(value, WrappedPublicKeyPemType) {
+		t.Errorf("public key is stored without wrapping: %s", value)
+	}
+
+	keys, err := source.Fetch()
+	if err != nil {
+		t.Errorf("unexpected error %#v", err)
+	}
+	if len(keys) != 1 || keys[0].Name != "public-key" || keys[0].Private != nil {
+		t.Errorf("unexpected keys %#v", keys)
+	}
+
+	err = NewEtcdKeySource(client, "/etcvault/keys", nil).Put(NewPublicKey("another-key", rsaKey.Public().(*rsa.PublicKey)))
+	if err != ErrNoMasterKey {
+		t.Errorf("unexpected error %#v", err)
+	}
+}
+
+func TestEtcdKeySourceFetchNotWrapped(t *testing.T) {
+	etcd, server, client := startEtcd()
+	defer server.Close()
+
+	masterKey, _ := GenerateMasterKey()
+	wrapped, _ := NewPrivateKey("the-key", &rsaKey).WrappedPrivatePem(masterKey)
+
+	// keys written by someone without the master key
+	etcd.Set("/etcvault/keys/the-key", string(wrapped))
+	etcd.Set("/etcvault/keys/public-key", strings.Replace(string(testRsaPublicKey), "Name: the-key", "Name: public-key", 1))
+	etcd.Set("/etcvault/keys/private-key", strings.Replace(string(testRsaPrivateKey), "Name: the-key", "Name: private-key", 1))
+	etcd.Set("/etcvault/keys/renamed", string(wrapped))
+	etcd.SetDir("/etcvault/keys/dir")
+
+	keys, err := NewEtcdKeySource(client, "/etcvault/keys", masterKey).Fetch()
+	if err != nil {
+		t.Errorf("unexpected error %#v", err)
+	}
+	if len(keys) != 1 || keys[0].Name != "the-key" {
+		t.Errorf("unexpected keys %#v", keys)
+	}
+
+	keys, err = NewEtcdKeySource(client, "/etcvault/keys", nil).Fetch()
+	if err != nil {
+		t.Errorf("unexpected error %#v", err)
+	}
+	if len(keys) != 0 {
+		t.Errorf("unexpected keys %#v", keys)
+	}
+}
+
+func TestEtcdKeySourceFetchNotFound(t *testing.T) {
+	_, server, client := startEtcd()
+	defer server.Close()
+
+	keys, err := NewEtcdKeySource(client, "/missing", nil).Fetch()
+	if err != nil {
+		t.Errorf("unexpected error %#v", err)
+	}
+	if len(keys) != 0 {
+		t.Errorf("unexpected keys %#v", keys)
+	}
+}
+
+func TestEtcdKeySourceUnavailable(t *testing.T) {
+	_, server, client := startEtcd()
+	server.Close()
+
+	masterKey, _ := GenerateMasterKey()
+	source := NewEtcdKeySource(client, "/etcvault/keys", masterKey)
+
+	if _, err := source.Fetch(); err == nil || !strings.Contains(err.Error(), etcdclient.ErrNoEndpointsAvailable.Error()) {
+		t.Errorf("unexpected error %#v", err)
+	}
+	if err := source.Put(NewPrivateKey("the-key", &rsaKey)); err == nil || !strings.Contains(err.Error(), etcdclient.ErrNoEndpointsAvailable.Error()) {
+		t.Errorf("unexpected error %#v", err)
+	}
+}
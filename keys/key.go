@@ -3,10 +3,13 @@ package keys
 import (
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/x509"
+	"encoding/hex"
 	"encoding/pem"
 	"errors"
 	"io/ioutil"
+	"time"
 )
 
 var ErrMissingPem = errors.New("invalid pem (couldn't decode)")
@@ -17,6 +20,15 @@ type Key struct {
 	Name    string
 	Public  *rsa.PublicKey
 	Private *rsa.PrivateKey
+
+	// metadata; stored in PEM headers (see metadata.go)
+	CreatedAt time.Time
+	// NotAfter is the time after that the key can't be used for encryption. Zero for no expiration.
+	NotAfter time.Time
+	// AllowedPaths is etcd path prefixes where values encrypted with the key can be decrypted. Empty for any path.
+	AllowedPaths []string
+	// Usage is KeyUsageEncrypt, KeyUsageDecrypt or KeyUsageAny.
+	Usage string
 }
 
 func NewPrivateKey(name string, rsaPrivateKey *rsa.PrivateKey) *Key {
@@ -45,6 +57,7 @@ func LoadKey(pemBytes []byte) (*Key, error) {
 
 	name := pem.Headers["Name"]
 
+	var key *Key
 	switch pem.Type {
 	case "PUBLIC KEY", "RSA PUBLIC KEY":
 		parsedKey, err := x509.ParsePKIXPublicKey(pem.Bytes)
@@ -58,7 +71,7 @@ func LoadKey(pemBytes []byte) (*Key, error) {
 			return nil, ErrNotRsaKey
 		}
 
-		return NewPublicKey(name, pubKey), nil
+		key = NewPublicKey(name, pubKey)
 
 	case "PRIVATE KEY", "RSA PRIVATE KEY":
 		privateKey, err := x509.ParsePKCS1PrivateKey(pem.Bytes)
@@ -66,11 +79,16 @@ func LoadKey(pemBytes []byte) (*Key, error) {
 			return nil, err
 		}
 
-		return NewPrivateKey(name, privateKey), nil
+		key = NewPrivateKey(name, privateKey)
 
 	default:
 		return nil, ErrInvalidPem
 	}
+
+	if err := key.loadPemHeaders(pem.Headers); err != nil {
+		return nil, err
+	}
+	return key, nil
 }
 
 func LoadKeyFromFile(path string) (*Key, error) {
@@ -88,7 +106,9 @@ func GenerateKey(name string, bits int) (*Key, error) {
 		return nil, err
 	}
 
-	return NewPrivateKey(name, rsaKey), nil
+	key := NewPrivateKey(name, rsaKey)
+	key.CreatedAt = time.Now().UTC().Truncate(time.Second)
+	return key, nil
 }
 
 func (key *Key) PublicPem() []byte {
@@ -101,7 +121,7 @@ func (key *Key) PublicPem() []byte {
 
 	block := &pem.Block{
 		Type:    "PUBLIC KEY",
-		Headers: map[string]string{"Name": key.Name},
+		Headers: key.pemHeaders(),
 		Bytes:   der,
 	}
 
@@ -116,9 +136,20 @@ func (key *Key) PrivatePem() []byte {
 	der := x509.MarshalPKCS1PrivateKey(key.Private)
 	block := &pem.Block{
 		Type:    "PRIVATE KEY",
-		Headers: map[string]string{"Name": key.Name},
+		Headers: key.pemHeaders(),
 		Bytes:   der,
 	}
 
 	return pem.EncodeToMemory(block)
 }
+
+// Fingerprint returns short fingerprint of the public key; hex of the first 8 bytes of SHA-256 of PKIX DER.
+func (key *Key) Fingerprint() string {
+	der, err := x509.MarshalPKIXPublicKey(key.Public)
+	if err != nil {
+		panic(err)
+	}
+
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[0:8])
+}
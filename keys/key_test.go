@@ -265,3 +265,15 @@ func TestPrivatePemOnPublicKey(t *testing.T) {
 		t.Errorf("unexpected value %#v", pemBytes)
 	}
 }
+
+func TestKeyFingerprint(t *testing.T) {
+	privateKey, _ := LoadKey(testRsaPrivateKey)
+	publicKey, _ := LoadKey(testRsaPublicKey)
+
+	if privateKey.Fingerprint() != "318e40c9eb5ee156" {
+		t.Errorf("unexpected fingerprint %#v", privateKey.Fingerprint())
+	}
+	if publicKey.Fingerprint() != privateKey.Fingerprint() {
+		t.Errorf("fingerprint differs between public and private key: %#v", publicKey.Fingerprint())
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"path"
 	"path/filepath"
 	"strings"
+	"sync"
 )
 
 var ErrKeyNotFound = errors.New("couldn't find specified key")
@@ -17,6 +18,10 @@ var ErrKeyAlreadyExists = errors.New("another key already exists with same name"
 type Keychain struct {
 	Path  string
 	Cache map[string]*Key
+	// EmitPublicKey makes Save write NAME.pub next to NAME.pem
+	EmitPublicKey bool
+
+	lock sync.RWMutex
 }
 
 func NewKeychain(path string) *Keychain {
@@ -27,7 +32,10 @@ func NewKeychain(path string) *Keychain {
 }
 
 func (keychain *Keychain) Find(name string) (*Key, error) {
-	if key, ok := keychain.Cache[name]; ok {
+	keychain.lock.RLock()
+	key, ok := keychain.Cache[name]
+	keychain.lock.RUnlock()
+	if ok {
 		return key, nil
 	}
 
@@ -39,7 +47,9 @@ func (keychain *Keychain) Find(name string) (*Key, error) {
 		if err != nil {
 			return nil, err
 		}
+		keychain.lock.Lock()
 		keychain.Cache[name] = key
+		keychain.lock.Unlock()
 		return key, nil
 	} else if _, err := os.Stat(publicKeyPath); err == nil {
 		key, err := LoadKeyFromFile(publicKeyPath)
@@ -52,16 +62,94 @@ func (keychain *Keychain) Find(name string) (*Key, error) {
 	}
 }
 
+// Save writes key into the directory, creating the directory when missing.
+// Private key is written as NAME.pem, and also NAME.pub when EmitPublicKey is true.
+// Existing key files are never overwritten, even when another process is saving a key with the same name.
 func (keychain *Keychain) Save(key *Key) error {
 	if _, err := keychain.Find(key.Name); err == nil {
 		return ErrKeyAlreadyExists
+	} else if err != ErrKeyNotFound {
+		// refuse to overwrite unreadable or broken key files
+		return err
+	}
+
+	if err := os.MkdirAll(keychain.Path, 0700); err != nil {
+		return err
 	}
+
+	publicKeyPath := path.Join(keychain.Path, key.Name+".pub")
 	if key.Private == nil {
-		publicKeyPath := path.Join(keychain.Path, key.Name+".pub")
-		return ioutil.WriteFile(publicKeyPath, key.PublicPem(), 0644)
-	} else {
-		privateKeyPath := path.Join(keychain.Path, key.Name+".pem")
-		return ioutil.WriteFile(privateKeyPath, key.PrivatePem(), 0600)
+		return createFileAtomically(publicKeyPath, key.PublicPem(), 0644)
+	}
+
+	privateKeyPath := path.Join(keychain.Path, key.Name+".pem")
+	if err := createFileAtomically(privateKeyPath, key.PrivatePem(), 0600); err != nil {
+		return err
+	}
+	if keychain.EmitPublicKey {
+		return createFileAtomically(publicKeyPath, key.PublicPem(), 0644)
+	}
+	return nil
+}
+
+// createFileAtomically writes to a temporary file in the same directory then hard-links it, so readers never
+// see partially written keys, and it fails with ErrKeyAlreadyExists rather than replacing an existing file.
+func createFileAtomically(filePath string, content []byte, mode os.FileMode) error {
+	tempPath, err := writeTempFile(filePath, content, mode)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tempPath)
+
+	if err := os.Link(tempPath, filePath); err != nil {
+		if os.IsExist(err) {
+			return ErrKeyAlreadyExists
+		}
+		return err
+	}
+	return nil
+}
+
+// writeTempFile writes content to a new temporary file next to filePath and returns its path.
+func writeTempFile(filePath string, content []byte, mode os.FileMode) (string, error) {
+	file, err := ioutil.TempFile(path.Dir(filePath), "."+path.Base(filePath)+".tmp")
+	if err != nil {
+		return "", err
+	}
+	tempPath := file.Name()
+
+	err = func() error {
+		defer file.Close()
+		if err := file.Chmod(mode); err != nil {
+			return err
+		}
+		if _, err := file.Write(content); err != nil {
+			return err
+		}
+		return file.Sync()
+	}()
+	if err != nil {
+		os.Remove(tempPath)
+		return "", err
+	}
+	return tempPath, nil
+}
+
+// Remove deletes both private and public key files of the key.
+func (keychain *Keychain) Remove(name string) error {
+	if _, err := keychain.Find(name); err != nil {
+		return err
+	}
+
+	keychain.lock.Lock()
+	delete(keychain.Cache, name)
+	keychain.lock.Unlock()
+
+	for _, ext := range []string{"pem", "pub"} {
+		keyPath := path.Join(keychain.Path, fmt.Sprintf("%s.%s", name, ext))
+		if err := os.Remove(keyPath); err != nil && !os.IsNotExist(err) {
+			return err
+		}
 	}
 	return nil
 }
@@ -5,6 +5,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path"
+	"path/filepath"
 	"reflect"
 	"sort"
 	"testing"
@@ -213,6 +214,65 @@ func TestKeychainSaveAlreadyExist(t *testing.T) {
 	}
 }
 
+func TestKeychainSaveBrokenKeyExists(t *testing.T) {
+	keychain := GetKeychain()
+	defer DestroyKeychain(keychain)
+
+	keyPath := path.Join(keychain.Path, "the-key.pem")
+	if err := ioutil.WriteFile(keyPath, []byte("broken"), 0600); err != nil {
+		panic(err)
+	}
+
+	key, err := LoadKey(testRsaPrivateKey)
+	if err != nil {
+		panic(err)
+	}
+
+	if err := keychain.Save(key); err == nil || err == ErrKeyAlreadyExists {
+		t.Errorf("unexpected error %#v", err)
+	}
+
+	content, _ := ioutil.ReadFile(keyPath)
+	if string(content) != "broken" {
+		t.Errorf("existing file shouldn't be overwritten: %#v", content)
+	}
+}
+
+func TestKeychainSaveConcurrently(t *testing.T) {
+	keychain := GetKeychain()
+	defer DestroyKeychain(keychain)
+
+	errs := make(chan error)
+	for i := 0; i < 8; i++ {
+		go func() {
+			key, err := GenerateKey("the-key", 512)
+			if err != nil {
+				panic(err)
+			}
+			// each goroutine has own keychain, not to share the cache
+			errs <- NewKeychain(keychain.Path).Save(key)
+		}()
+	}
+
+	saved := 0
+	for i := 0; i < 8; i++ {
+		err := <-errs
+		if err == nil {
+			saved++
+		} else if err != ErrKeyAlreadyExists {
+			t.Errorf("unexpected error %#v", err)
+		}
+	}
+	if saved != 1 {
+		t.Errorf("unexpected number of saved keys %d", saved)
+	}
+
+	matches, _ := filepath.Glob(path.Join(keychain.Path, ".*.tmp*"))
+	if len(matches) != 0 {
+		t.Errorf("temporary files are left: %#v", matches)
+	}
+}
+
 func TestKeychainListKeys(t *testing.T) {
 	keychain := GetKeychain()
 	defer DestroyKeychain(keychain)
@@ -252,3 +312,111 @@ func TestKeychainListKeys(t *testing.T) {
 		t.Errorf("unexpected ListForDecryption result: %#v", list)
 	}
 }
+
+func TestKeychainRemove(t *testing.T) {
+	keychain := GetKeychain()
+	defer DestroyKeychain(keychain)
+
+	if err := ioutil.WriteFile(path.Join(keychain.Path, "the-key.pem"), testRsaPrivateKey, 0600); err != nil {
+		panic(err)
+	}
+	if err := ioutil.WriteFile(path.Join(keychain.Path, "the-key.pub"), testRsaPublicKey, 0644); err != nil {
+		panic(err)
+	}
+	if _, err := keychain.Find("the-key"); err != nil {
+		panic(err)
+	}
+
+	if err := keychain.Remove("the-key"); err != nil {
+		t.Errorf("unexpected error %#v", err)
+	}
+
+	if _, err := keychain.Find("the-key"); err != ErrKeyNotFound {
+		t.Errorf("unexpected error %#v", err)
+	}
+	if list := keychain.List(); len(list) != 0 {
+		t.Errorf("unexpected List result: %#v", list)
+	}
+
+	if err := keychain.Remove("the-key"); err != ErrKeyNotFound {
+		t.Errorf("unexpected error %#v", err)
+	}
+}
+
+func TestKeychainSaveCreatesDirectory(t *testing.T) {
+	keychain := GetKeychain()
+	defer DestroyKeychain(keychain)
+
+	subKeychain := NewKeychain(path.Join(keychain.Path, "sub"))
+
+	key, err := LoadKey(testRsaPrivateKey)
+	if err != nil {
+		panic(err)
+	}
+
+	if err := subKeychain.Save(key); err != nil {
+		t.Errorf("unexpected error %#v", err)
+	}
+
+	if fi, err := os.Stat(subKeychain.Path); err == nil {
+		if fi.Mode().Perm() != 0700 {
+			t.Errorf("unexpected directory mode %s", fi.Mode())
+		}
+	} else {
+		t.Errorf("directory should be created: %s", err.Error())
+	}
+
+	files, _ := ioutil.ReadDir(subKeychain.Path)
+	if len(files) != 1 || files[0].Name() != "the-key.pem" {
+		t.Errorf("unexpected files (temporary file remains?): %#v", files)
+	}
+}
+
+func TestKeychainSaveEmitPublicKey(t *testing.T) {
+	keychain := GetKeychain()
+	defer DestroyKeychain(keychain)
+	keychain.EmitPublicKey = true
+
+	key, err := LoadKey(testRsaPrivateKey)
+	if err != nil {
+		panic(err)
+	}
+
+	if err := keychain.Save(key); err != nil {
+		t.Errorf("unexpected error %#v", err)
+	}
+
+	publicKeyPath := path.Join(keychain.Path, "the-key.pub")
+	if fi, err := os.Stat(publicKeyPath); err == nil {
+		if fi.Mode() != 0644 {
+			t.Errorf("unexpected file mode %s", fi.Mode())
+		}
+	} else {
+		t.Errorf("public key should be written: %s", err.Error())
+	}
+
+	bytes, _ := ioutil.ReadFile(publicKeyPath)
+	if !reflect.DeepEqual(key.PublicPem(), bytes) {
+		t.Errorf("key file content unexpected %#v", bytes)
+	}
+}
+
+func TestKeychainSaveUnwritable(t *testing.T) {
+	keychain := GetKeychain()
+	defer DestroyKeychain(keychain)
+
+	// a file blocks creating directory
+	blocker := path.Join(keychain.Path, "blocker")
+	if err := ioutil.WriteFile(blocker, []byte{}, 0600); err != nil {
+		panic(err)
+	}
+
+	key, err := LoadKey(testRsaPrivateKey)
+	if err != nil {
+		panic(err)
+	}
+
+	if err := NewKeychain(path.Join(blocker, "sub")).Save(key); err == nil {
+		t.Errorf("error should be returned")
+	}
+}
@@ -0,0 +1,76 @@
+package keys
+
+import (
+	"sync"
+)
+
+// MemoryStore is a Store keeping keys in memory, such as keys retrieved from etcd.
+type MemoryStore struct {
+	sync.RWMutex
+	keys map[string]*Key
+}
+
+func NewMemoryStore(keys []*Key) *MemoryStore {
+	store := &MemoryStore{}
+	store.Replace(keys)
+	return store
+}
+
+// Replace replaces all keys in the store.
+func (store *MemoryStore) Replace(keys []*Key) {
+	keysMap := make(map[string]*Key, len(keys))
+	for _, key := range keys {
+		keysMap[key.Name] = key
+	}
+
+	store.Lock()
+	defer store.Unlock()
+	store.keys = keysMap
+}
+
+func (store *MemoryStore) Find(name string) (*Key, error) {
+	store.RLock()
+	defer store.RUnlock()
+
+	if key, ok := store.keys[name]; ok {
+		return key, nil
+	}
+	return nil, ErrKeyNotFound
+}
+
+func (store *MemoryStore) Save(key *Key) error {
+	store.Lock()
+	defer store.Unlock()
+
+	if _, ok := store.keys[key.Name]; ok {
+		return ErrKeyAlreadyExists
+	}
+	store.keys[key.Name] = key
+	return nil
+}
+
+func (store *MemoryStore) names(privateOnly bool) []string {
+	store.RLock()
+	defer store.RUnlock()
+
+	names := make([]string, 0, len(store.keys))
+	for name, key := range store.keys {
+		if privateOnly && key.Private == nil {
+			continue
+		}
+		names = append(names, name)
+	}
+	return names
+}
+
+func (store *MemoryStore) List() []string {
+	return store.names(false)
+}
+
+func (store *MemoryStore) ListForEncryption() []string {
+	return store.names(true)
+}
+
+func (store *MemoryStore) ListForDecryption() []string {
+	return store.List()
+}
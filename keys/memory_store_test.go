@@ -0,0 +1,59 @@
+package keys
+
+import (
+	"crypto/rsa"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestMemoryStore(t *testing.T) {
+	store := NewMemoryStore([]*Key{
+		NewPrivateKey("priv", &rsaKey),
+		NewPublicKey("pub", rsaKey.Public().(*rsa.PublicKey)),
+	})
+
+	key, err := store.Find("priv")
+	if err != nil {
+		t.Errorf("unexpected error %#v", err)
+	}
+	if key.Name != "priv" || key.Private == nil {
+		t.Errorf("unexpected key %#v", key)
+	}
+
+	if _, err := store.Find("unexist"); err != ErrKeyNotFound {
+		t.Errorf("unexpected error %#v", err)
+	}
+
+	var list []string
+
+	list = store.List()
+	sort.Strings(list)
+	if !reflect.DeepEqual(list, []string{"priv", "pub"}) {
+		t.Errorf("unexpected List result: %#v", list)
+	}
+
+	list = store.ListForEncryption()
+	if !reflect.DeepEqual(list, []string{"priv"}) {
+		t.Errorf("unexpected ListForEncryption result: %#v", list)
+	}
+}
+
+func TestMemoryStoreSaveAndReplace(t *testing.T) {
+	store := NewMemoryStore([]*Key{})
+
+	if err := store.Save(NewPrivateKey("the-key", &rsaKey)); err != nil {
+		t.Errorf("unexpected error %#v", err)
+	}
+	if err := store.Save(NewPrivateKey("the-key", &rsaKey)); err != ErrKeyAlreadyExists {
+		t.Errorf("unexpected error %#v", err)
+	}
+
+	store.Replace([]*Key{NewPrivateKey("another-key", &rsaKey)})
+	if _, err := store.Find("the-key"); err != ErrKeyNotFound {
+		t.Errorf("unexpected error %#v", err)
+	}
+	if _, err := store.Find("another-key"); err != nil {
+		t.Errorf("unexpected error %#v", err)
+	}
+}
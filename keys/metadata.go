@@ -0,0 +1,106 @@
+package keys
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	KeyUsageAny     = ""
+	KeyUsageEncrypt = "encrypt"
+	KeyUsageDecrypt = "decrypt"
+)
+
+const (
+	pemHeaderCreatedAt    = "Created-At"
+	pemHeaderNotAfter     = "Not-After"
+	pemHeaderAllowedPaths = "Allowed-Paths"
+	pemHeaderUsage        = "Usage"
+)
+
+func ParseKeyUsage(str string) (string, error) {
+	switch str {
+	case KeyUsageAny, KeyUsageEncrypt, KeyUsageDecrypt:
+		return str, nil
+	default:
+		return "", fmt.Errorf("unknown key usage %s (should be encrypt or decrypt)", str)
+	}
+}
+
+// Expired returns true when NotAfter has passed.
+func (key *Key) Expired() bool {
+	return !key.NotAfter.IsZero() && time.Now().After(key.NotAfter)
+}
+
+func (key *Key) CanEncrypt() bool {
+	return key.Usage != KeyUsageDecrypt
+}
+
+func (key *Key) CanDecrypt() bool {
+	return key.Usage != KeyUsageEncrypt
+}
+
+// AllowsPath returns true when etcd path is one of AllowedPaths or under them, or AllowedPaths is empty.
+// Paths are matched on path segments; "/app1" (or "/app1/") allows "/app1/x" but not "/app10/x".
+func (key *Key) AllowsPath(path string) bool {
+	if len(key.AllowedPaths) == 0 {
+		return true
+	}
+	for _, prefix := range key.AllowedPaths {
+		if path == prefix || strings.HasPrefix(path, strings.TrimSuffix(prefix, "/")+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+func (key *Key) pemHeaders() map[string]string {
+	headers := map[string]string{"Name": key.Name}
+
+	if !key.CreatedAt.IsZero() {
+		headers[pemHeaderCreatedAt] = key.CreatedAt.Format(time.RFC3339)
+	}
+	if !key.NotAfter.IsZero() {
+		headers[pemHeaderNotAfter] = key.NotAfter.Format(time.RFC3339)
+	}
+	if len(key.AllowedPaths) > 0 {
+		headers[pemHeaderAllowedPaths] = strings.Join(key.AllowedPaths, ",")
+	}
+	if key.Usage != KeyUsageAny {
+		headers[pemHeaderUsage] = key.Usage
+	}
+
+	return headers
+}
+
+func (key *Key) loadPemHeaders(headers map[string]string) error {
+	var err error
+
+	if value, ok := headers[pemHeaderCreatedAt]; ok {
+		key.CreatedAt, err = time.Parse(time.RFC3339, value)
+		if err != nil {
+			return fmt.Errorf("invalid %s header: %s", pemHeaderCreatedAt, err.Error())
+		}
+	}
+	if value, ok := headers[pemHeaderNotAfter]; ok {
+		key.NotAfter, err = time.Parse(time.RFC3339, value)
+		if err != nil {
+			return fmt.Errorf("invalid %s header: %s", pemHeaderNotAfter, err.Error())
+		}
+	}
+	if value, ok := headers[pemHeaderAllowedPaths]; ok && value != "" {
+		key.AllowedPaths = []string{}
+		for _, path := range strings.Split(value, ",") {
+			key.AllowedPaths = append(key.AllowedPaths, strings.TrimSpace(path))
+		}
+	}
+	if value, ok := headers[pemHeaderUsage]; ok {
+		key.Usage, err = ParseKeyUsage(value)
+		if err != nil {
+			return fmt.Errorf("invalid %s header: %s", pemHeaderUsage, err.Error())
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,133 @@
+package keys
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestKeyMetadataRoundtrip(t *testing.T) {
+	key := NewPrivateKey("the-key", &rsaKey)
+	key.CreatedAt = time.Date(2015, 6, 1, 0, 0, 0, 0, time.UTC)
+	key.NotAfter = time.Date(2016, 6, 1, 0, 0, 0, 0, time.UTC)
+	key.AllowedPaths = []string{"/app1/", "/app2/"}
+	key.Usage = KeyUsageDecrypt
+
+	for _, pemBytes := range [][]byte{key.PrivatePem(), key.PublicPem()} {
+		loadedKey, err := LoadKey(pemBytes)
+		if err != nil {
+			t.Errorf("unexpected error %#v", err)
+			continue
+		}
+
+		if !loadedKey.CreatedAt.Equal(key.CreatedAt) {
+			t.Errorf("unexpected CreatedAt %#v", loadedKey.CreatedAt)
+		}
+		if !loadedKey.NotAfter.Equal(key.NotAfter) {
+			t.Errorf("unexpected NotAfter %#v", loadedKey.NotAfter)
+		}
+		if !reflect.DeepEqual(loadedKey.AllowedPaths, key.AllowedPaths) {
+			t.Errorf("unexpected AllowedPaths %#v", loadedKey.AllowedPaths)
+		}
+		if loadedKey.Usage != KeyUsageDecrypt {
+			t.Errorf("unexpected Usage %#v", loadedKey.Usage)
+		}
+	}
+}
+
+func TestKeyMetadataWrapped(t *testing.T) {
+	masterKey, _ := GenerateMasterKey()
+
+	key := NewPrivateKey("the-key", &rsaKey)
+	key.AllowedPaths = []string{"/app1/"}
+
+	wrapped, _ := key.WrappedPrivatePem(masterKey)
+	loadedKey, err := LoadWrappedKey(wrapped, masterKey)
+	if err != nil {
+		t.Errorf("unexpected error %#v", err)
+	}
+	if !reflect.DeepEqual(loadedKey.AllowedPaths, []string{"/app1/"}) {
+		t.Errorf("unexpected AllowedPaths %#v", loadedKey.AllowedPaths)
+	}
+}
+
+func TestKeyMetadataInvalid(t *testing.T) {
+	pemString := strings.Replace(string(testRsaPrivateKey), "Name: the-key\n", "Name: the-key\nNot-After: tomorrow\n", 1)
+	_, err := LoadKey([]byte(pemString))
+	if err == nil || !strings.Contains(err.Error(), "Not-After") {
+		t.Errorf("unexpected error %#v", err)
+	}
+
+	pemString = strings.Replace(string(testRsaPrivateKey), "Name: the-key\n", "Name: the-key\nUsage: sign\n", 1)
+	_, err = LoadKey([]byte(pemString))
+	if err == nil || !strings.Contains(err.Error(), "Usage") {
+		t.Errorf("unexpected error %#v", err)
+	}
+}
+
+func TestKeyExpired(t *testing.T) {
+	key := NewPrivateKey("the-key", &rsaKey)
+	if key.Expired() {
+		t.Errorf("key without NotAfter shouldn't expire")
+	}
+
+	key.NotAfter = time.Now().Add(-time.Minute)
+	if !key.Expired() {
+		t.Errorf("key should be expired")
+	}
+
+	key.NotAfter = time.Now().Add(time.Minute)
+	if key.Expired() {
+		t.Errorf("key shouldn't be expired")
+	}
+}
+
+func TestKeyUsage(t *testing.T) {
+	key := NewPrivateKey("the-key", &rsaKey)
+	if !key.CanEncrypt() || !key.CanDecrypt() {
+		t.Errorf("key should be usable for both")
+	}
+
+	key.Usage = KeyUsageEncrypt
+	if !key.CanEncrypt() || key.CanDecrypt() {
+		t.Errorf("key should be encrypt-only")
+	}
+
+	key.Usage = KeyUsageDecrypt
+	if key.CanEncrypt() || !key.CanDecrypt() {
+		t.Errorf("key should be decrypt-only")
+	}
+}
+
+func TestKeyAllowsPath(t *testing.T) {
+	key := NewPrivateKey("the-key", &rsaKey)
+	if !key.AllowsPath("/anything") {
+		t.Errorf("key without AllowedPaths should allow any path")
+	}
+
+	tests := []struct {
+		AllowedPaths []string
+		Path         string
+		Expect       bool
+	}{
+		{[]string{"/app1/", "/shared/"}, "/app1/db/password", true},
+		{[]string{"/app1/", "/shared/"}, "/shared/token", true},
+		{[]string{"/app1/", "/shared/"}, "/app2/db/password", false},
+		{[]string{"/app1"}, "/app1", true},
+		{[]string{"/app1"}, "/app1/db/password", true},
+		{[]string{"/app1"}, "/app10/x", false},
+		{[]string{"/app1"}, "/app1-admin", false},
+		{[]string{"/app1/"}, "/app10/x", false},
+		{[]string{"/app1/"}, "/app1-admin/password", false},
+		{[]string{"/app1/"}, "/app1/", true},
+		{[]string{"/"}, "/anything", true},
+	}
+
+	for _, test := range tests {
+		key.AllowedPaths = test.AllowedPaths
+		if key.AllowsPath(test.Path) != test.Expect {
+			t.Errorf("AllowedPaths %#v: unexpected result for %s", test.AllowedPaths, test.Path)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package keys
+
+// MultiStore combines multiple stores. Find looks up stores in order, and Save saves into the first store.
+type MultiStore struct {
+	Stores []Store
+}
+
+func NewMultiStore(stores ...Store) *MultiStore {
+	return &MultiStore{
+		Stores: stores,
+	}
+}
+
+func (store *MultiStore) Find(name string) (*Key, error) {
+	for _, s := range store.Stores {
+		key, err := s.Find(name)
+		if err == ErrKeyNotFound {
+			continue
+		}
+		return key, err
+	}
+	return nil, ErrKeyNotFound
+}
+
+func (store *MultiStore) Save(key *Key) error {
+	if _, err := store.Find(key.Name); err == nil {
+		return ErrKeyAlreadyExists
+	}
+	return store.Stores[0].Save(key)
+}
+
+func mergeNames(lists ...[]string) []string {
+	namesMap := make(map[string]bool)
+	names := []string{}
+	for _, list := range lists {
+		for _, name := range list {
+			if !namesMap[name] {
+				namesMap[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	return names
+}
+
+func (store *MultiStore) List() []string {
+	lists := make([][]string, 0, len(store.Stores))
+	for _, s := range store.Stores {
+		lists = append(lists, s.List())
+	}
+	return mergeNames(lists...)
+}
+
+func (store *MultiStore) ListForEncryption() []string {
+	lists := make([][]string, 0, len(store.Stores))
+	for _, s := range store.Stores {
+		lists = append(lists, s.ListForEncryption())
+	}
+	return mergeNames(lists...)
+}
+
+func (store *MultiStore) ListForDecryption() []string {
+	lists := make([][]string, 0, len(store.Stores))
+	for _, s := range store.Stores {
+		lists = append(lists, s.ListForDecryption())
+	}
+	return mergeNames(lists...)
+}
@@ -0,0 +1,78 @@
+package keys
+
+import (
+	"crypto/rsa"
+	"io/ioutil"
+	"path"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestMultiStore(t *testing.T) {
+	keychain := GetKeychain()
+	defer DestroyKeychain(keychain)
+
+	if err := ioutil.WriteFile(path.Join(keychain.Path, "the-key.pem"), testRsaPrivateKey, 0600); err != nil {
+		panic(err)
+	}
+
+	memoryStore := NewMemoryStore([]*Key{
+		NewPrivateKey("the-key", &rsaKey),
+		NewPrivateKey("memory-priv", &rsaKey),
+		NewPublicKey("memory-pub", rsaKey.Public().(*rsa.PublicKey)),
+	})
+
+	store := NewMultiStore(keychain, memoryStore)
+
+	key, err := store.Find("memory-priv")
+	if err != nil {
+		t.Errorf("unexpected error %#v", err)
+	}
+	if key.Name != "memory-priv" {
+		t.Errorf("unexpected key %#v", key)
+	}
+
+	key, err = store.Find("the-key")
+	if err != nil {
+		t.Errorf("unexpected error %#v", err)
+	}
+	if key != keychain.Cache["the-key"] {
+		t.Errorf("key in first store should take precedence: %#v", key)
+	}
+
+	if _, err := store.Find("unexist"); err != ErrKeyNotFound {
+		t.Errorf("unexpected error %#v", err)
+	}
+
+	var list []string
+
+	list = store.List()
+	sort.Strings(list)
+	if !reflect.DeepEqual(list, []string{"memory-priv", "memory-pub", "the-key"}) {
+		t.Errorf("unexpected List result: %#v", list)
+	}
+
+	list = store.ListForEncryption()
+	sort.Strings(list)
+	if !reflect.DeepEqual(list, []string{"memory-priv", "the-key"}) {
+		t.Errorf("unexpected ListForEncryption result: %#v", list)
+	}
+}
+
+func TestMultiStoreSave(t *testing.T) {
+	memoryStore := NewMemoryStore([]*Key{NewPrivateKey("memory-key", &rsaKey)})
+	firstStore := NewMemoryStore([]*Key{})
+	store := NewMultiStore(firstStore, memoryStore)
+
+	if err := store.Save(NewPrivateKey("memory-key", &rsaKey)); err != ErrKeyAlreadyExists {
+		t.Errorf("unexpected error %#v", err)
+	}
+
+	if err := store.Save(NewPrivateKey("new-key", &rsaKey)); err != nil {
+		t.Errorf("unexpected error %#v", err)
+	}
+	if _, err := firstStore.Find("new-key"); err != nil {
+		t.Errorf("key should be saved into first store: %#v", err)
+	}
+}
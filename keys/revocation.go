@@ -0,0 +1,106 @@
+package keys
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"sync"
+)
+
+// RevocationListFileName is the name of revocation list file in keychain directory.
+const RevocationListFileName = "revoked"
+
+// RevocationList holds revoked keys. Each line of revocation list is one of:
+//
+//	NAME               revokes any key named NAME
+//	@FINGERPRINT       revokes the key with FINGERPRINT, regardless of name
+//	NAME@FINGERPRINT   same as @FINGERPRINT (name is informative)
+//
+// Empty lines and lines starting with # are ignored.
+type RevocationList struct {
+	sync.RWMutex
+	names        map[string]bool
+	fingerprints map[string]bool
+}
+
+func NewRevocationList() *RevocationList {
+	return &RevocationList{
+		names:        make(map[string]bool),
+		fingerprints: make(map[string]bool),
+	}
+}
+
+// Load adds entries in content to the list.
+func (list *RevocationList) Load(content []byte) {
+	list.Lock()
+	defer list.Unlock()
+
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if i := strings.LastIndex(line, "@"); i != -1 {
+			list.fingerprints[line[i+1:]] = true
+		} else {
+			list.names[line] = true
+		}
+	}
+}
+
+// LoadFile adds entries in file to the list. Missing file is treated as empty.
+func (list *RevocationList) LoadFile(filePath string) error {
+	content, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	list.Load(content)
+	return nil
+}
+
+// Replace replaces entries with ones in other list.
+func (list *RevocationList) Replace(other *RevocationList) {
+	other.RLock()
+	names := other.names
+	fingerprints := other.fingerprints
+	other.RUnlock()
+
+	list.Lock()
+	defer list.Unlock()
+	list.names = names
+	list.fingerprints = fingerprints
+}
+
+// IsRevoked returns true when name or fingerprint is revoked. Empty fingerprint is ignored.
+func (list *RevocationList) IsRevoked(name string, fingerprint string) bool {
+	list.RLock()
+	defer list.RUnlock()
+
+	if list.names[name] {
+		return true
+	}
+	return fingerprint != "" && list.fingerprints[fingerprint]
+}
+
+func (list *RevocationList) IsKeyRevoked(key *Key) bool {
+	return list.IsRevoked(key.Name, key.Fingerprint())
+}
+
+func (list *RevocationList) Len() int {
+	list.RLock()
+	defer list.RUnlock()
+	return len(list.names) + len(list.fingerprints)
+}
+
+// RevocationListPath returns path to revocation list file in the keychain directory.
+func (keychain *Keychain) RevocationListPath() string {
+	return path.Join(keychain.Path, RevocationListFileName)
+}
@@ -0,0 +1,81 @@
+package keys
+
+import (
+	"io/ioutil"
+	"path"
+	"testing"
+)
+
+func TestRevocationList(t *testing.T) {
+	list := NewRevocationList()
+	list.Load([]byte(`
+# comment
+revoked-key
+@0123456789abcdef
+other@fedcba9876543210
+`))
+
+	tests := []struct {
+		Name        string
+		Fingerprint string
+		Revoked     bool
+	}{
+		{"revoked-key", "", true},
+		{"revoked-key", "1111111111111111", true},
+		{"any", "0123456789abcdef", true},
+		{"other", "fedcba9876543210", true},
+		{"renamed", "fedcba9876543210", true},
+		{"other", "", false},
+		{"fine-key", "1111111111111111", false},
+		{"# comment", "", false},
+	}
+
+	for _, test := range tests {
+		if revoked := list.IsRevoked(test.Name, test.Fingerprint); revoked != test.Revoked {
+			t.Errorf("IsRevoked(%#v, %#v) = %#v", test.Name, test.Fingerprint, revoked)
+		}
+	}
+
+	if list.Len() != 3 {
+		t.Errorf("unexpected Len() %#v", list.Len())
+	}
+}
+
+func TestRevocationListIsKeyRevoked(t *testing.T) {
+	key := NewPrivateKey("the-key", &rsaKey)
+
+	list := NewRevocationList()
+	if list.IsKeyRevoked(key) {
+		t.Errorf("key shouldn't be revoked")
+	}
+
+	list.Load([]byte("@" + key.Fingerprint() + "\n"))
+	if !list.IsKeyRevoked(key) {
+		t.Errorf("key should be revoked")
+	}
+}
+
+func TestRevocationListLoadFile(t *testing.T) {
+	keychain := GetKeychain()
+	defer DestroyKeychain(keychain)
+
+	list := NewRevocationList()
+	if err := list.LoadFile(keychain.RevocationListPath()); err != nil {
+		t.Errorf("missing file should be ignored: %#v", err)
+	}
+
+	if err := ioutil.WriteFile(path.Join(keychain.Path, "revoked"), []byte("the-key\n"), 0644); err != nil {
+		panic(err)
+	}
+	if err := list.LoadFile(keychain.RevocationListPath()); err != nil {
+		t.Errorf("unexpected error %#v", err)
+	}
+	if !list.IsRevoked("the-key", "") {
+		t.Errorf("the-key should be revoked")
+	}
+
+	list.Replace(NewRevocationList())
+	if list.IsRevoked("the-key", "") {
+		t.Errorf("the-key shouldn't be revoked after Replace")
+	}
+}
@@ -0,0 +1,16 @@
+package keys
+
+// Store is a set of keys used by engine. Keychain (keys in a directory) is the default implementation.
+type Store interface {
+	Find(name string) (*Key, error)
+	Save(key *Key) error
+	// List returns names of all keys.
+	List() []string
+	// ListForEncryption returns names of keys which have private keys.
+	ListForEncryption() []string
+	ListForDecryption() []string
+}
+
+var _ Store = &Keychain{}
+var _ Store = &MemoryStore{}
+var _ Store = &MultiStore{}
@@ -0,0 +1,188 @@
+package keys
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+)
+
+const MasterKeyLength = 32
+const WrappedPrivateKeyPemType = "ETCVAULT WRAPPED PRIVATE KEY"
+const WrappedPublicKeyPemType = "ETCVAULT WRAPPED PUBLIC KEY"
+
+var ErrInvalidMasterKey = errors.New("invalid master key (should be base64 encoded 32 bytes)")
+var ErrNoMasterKey = errors.New("master key is required to unwrap private key")
+var ErrInvalidWrappedKey = errors.New("invalid wrapped key")
+var ErrNotWrappedKey = errors.New("key isn't wrapped with master key")
+var ErrNoPrivateKey = errors.New("key has no private key")
+
+func GenerateMasterKey() ([]byte, error) {
+	masterKey := make([]byte, MasterKeyLength)
+	if _, err := rand.Read(masterKey); err != nil {
+		return nil, err
+	}
+	return masterKey, nil
+}
+
+func EncodeMasterKey(masterKey []byte) []byte {
+	return []byte(base64.StdEncoding.EncodeToString(masterKey) + "\n")
+}
+
+func LoadMasterKey(encoded []byte) ([]byte, error) {
+	masterKey, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(encoded)))
+	if err != nil || len(masterKey) != MasterKeyLength {
+		return nil, ErrInvalidMasterKey
+	}
+	return masterKey, nil
+}
+
+func LoadMasterKeyFromFile(path string) ([]byte, error) {
+	bytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return LoadMasterKey(bytes)
+}
+
+// WrappedPem returns the key sealed with master key (AES-256-GCM), in PEM; private key when present, or public key.
+// Public keys are sealed too, so keys can't be replaced or added (e.g. in etcd) without the master key.
+func (key *Key) WrappedPem(masterKey []byte) ([]byte, error) {
+	if key.Private != nil {
+		return key.WrappedPrivatePem(masterKey)
+	}
+
+	der, err := x509.MarshalPKIXPublicKey(key.Public)
+	if err != nil {
+		return nil, err
+	}
+	return key.wrapPem(WrappedPublicKeyPemType, der, masterKey)
+}
+
+// WrappedPrivatePem returns private key encrypted with master key (AES-256-GCM), in PEM.
+func (key *Key) WrappedPrivatePem(masterKey []byte) ([]byte, error) {
+	if key.Private == nil {
+		return nil, ErrNoPrivateKey
+	}
+
+	return key.wrapPem(WrappedPrivateKeyPemType, x509.MarshalPKCS1PrivateKey(key.Private), masterKey)
+}
+
+func (key *Key) wrapPem(pemType string, der []byte, masterKey []byte) ([]byte, error) {
+	aead, err := masterKeyAead(masterKey)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	headers := key.pemHeaders()
+	sealed := aead.Seal(nonce, nonce, der, wrapAdditionalData(pemType, headers))
+
+	block := &pem.Block{
+		Type:    pemType,
+		Headers: headers,
+		Bytes:   sealed,
+	}
+
+	return pem.EncodeToMemory(block), nil
+}
+
+// LoadWrappedKey loads key from PEM made by WrappedPem, unwrapping it with master key.
+// Non-wrapped PEM is refused with ErrNotWrappedKey, as anyone could have written it.
+func LoadWrappedKey(pemBytes []byte, masterKey []byte) (*Key, error) {
+	block, _ := pem.Decode(pemBytes)
+	if block == nil {
+		return nil, ErrMissingPem
+	}
+
+	if block.Type != WrappedPrivateKeyPemType && block.Type != WrappedPublicKeyPemType {
+		return nil, ErrNotWrappedKey
+	}
+
+	if masterKey == nil {
+		return nil, ErrNoMasterKey
+	}
+
+	aead, err := masterKeyAead(masterKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(block.Bytes) < aead.NonceSize() {
+		return nil, ErrInvalidWrappedKey
+	}
+
+	nonce := block.Bytes[0:aead.NonceSize()]
+	der, err := aead.Open(nil, nonce, block.Bytes[aead.NonceSize():], wrapAdditionalData(block.Type, block.Headers))
+	if err != nil {
+		return nil, ErrInvalidWrappedKey
+	}
+
+	name := block.Headers["Name"]
+	var key *Key
+	if block.Type == WrappedPrivateKeyPemType {
+		privateKey, err := x509.ParsePKCS1PrivateKey(der)
+		if err != nil {
+			return nil, err
+		}
+		key = NewPrivateKey(name, privateKey)
+	} else {
+		parsedKey, err := x509.ParsePKIXPublicKey(der)
+		if err != nil {
+			return nil, err
+		}
+		publicKey, ok := parsedKey.(*rsa.PublicKey)
+		if !ok {
+			return nil, ErrNotRsaKey
+		}
+		key = NewPublicKey(name, publicKey)
+	}
+
+	if err := key.loadPemHeaders(block.Headers); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// wrapAdditionalData returns additional data to authenticate with a wrapped key: PEM type and all headers,
+// sorted and length-prefixed. Then name and metadata (Not-After, Allowed-Paths, Usage, ...) of a wrapped key
+// can't be modified, added or removed without the master key.
+func wrapAdditionalData(pemType string, headers map[string]string) []byte {
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	data := []byte(fmt.Sprintf("%d:%s", len(pemType), pemType))
+	for _, name := range names {
+		data = append(data, fmt.Sprintf("%d:%s%d:%s", len(name), name, len(headers[name]), headers[name])...)
+	}
+	return data
+}
+
+func masterKeyAead(masterKey []byte) (cipher.AEAD, error) {
+	if len(masterKey) != MasterKeyLength {
+		return nil, ErrInvalidMasterKey
+	}
+
+	block, err := aes.NewCipher(masterKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
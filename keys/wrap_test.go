@@ -0,0 +1,159 @@
+package keys
+
+import (
+	"crypto/rsa"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWrappedPrivatePem(t *testing.T) {
+	masterKey, err := GenerateMasterKey()
+	if err != nil {
+		panic(err)
+	}
+
+	key := NewPrivateKey("the-key", &rsaKey)
+	wrapped, err := key.WrappedPrivatePem(masterKey)
+	if err != nil {
+		t.Errorf("unexpected error %#v", err)
+	}
+
+	loadedKey, err := LoadWrappedKey(wrapped, masterKey)
+	if err != nil {
+		t.Errorf("unexpected error %#v", err)
+	}
+	if loadedKey.Name != "the-key" {
+		t.Errorf("unexpected name %#v", loadedKey.Name)
+	}
+	if loadedKey.Private == nil || loadedKey.Private.D.Cmp(rsaKey.D) != 0 {
+		t.Errorf("unexpected private key %#v", loadedKey.Private)
+	}
+}
+
+func TestLoadWrappedKeyWithWrongMasterKey(t *testing.T) {
+	masterKey, _ := GenerateMasterKey()
+	anotherMasterKey, _ := GenerateMasterKey()
+
+	wrapped, _ := NewPrivateKey("the-key", &rsaKey).WrappedPrivatePem(masterKey)
+
+	_, err := LoadWrappedKey(wrapped, anotherMasterKey)
+	if err != ErrInvalidWrappedKey {
+		t.Errorf("unexpected error %#v", err)
+	}
+
+	_, err = LoadWrappedKey(wrapped, nil)
+	if err != ErrNoMasterKey {
+		t.Errorf("unexpected error %#v", err)
+	}
+}
+
+func TestLoadWrappedKeyNotWrapped(t *testing.T) {
+	masterKey, _ := GenerateMasterKey()
+
+	for _, pemBytes := range [][]byte{testRsaPublicKey, testRsaPrivateKey} {
+		key, err := LoadWrappedKey(pemBytes, masterKey)
+		if key != nil || err != ErrNotWrappedKey {
+			t.Errorf("unexpected result %#v, %#v", key, err)
+		}
+	}
+}
+
+func TestLoadWrappedKeyRenamed(t *testing.T) {
+	masterKey, _ := GenerateMasterKey()
+	wrapped, _ := NewPrivateKey("the-key", &rsaKey).WrappedPrivatePem(masterKey)
+
+	renamed := strings.Replace(string(wrapped), "Name: the-key", "Name: another-key", 1)
+	if _, err := LoadWrappedKey([]byte(renamed), masterKey); err != ErrInvalidWrappedKey {
+		t.Errorf("unexpected error %#v", err)
+	}
+}
+
+func TestLoadWrappedKeyMetadataTampered(t *testing.T) {
+	masterKey, _ := GenerateMasterKey()
+	key := NewPrivateKey("the-key", &rsaKey)
+	key.NotAfter = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	key.AllowedPaths = []string{"/app1"}
+	key.Usage = KeyUsageDecrypt
+	wrapped, _ := key.WrappedPrivatePem(masterKey)
+
+	if _, err := LoadWrappedKey(wrapped, masterKey); err != nil {
+		t.Fatalf("unexpected error %#v", err)
+	}
+
+	tests := []struct {
+		Name string
+		Old  string
+		New  string
+	}{
+		{"Not-After", "Not-After: 2020-01-01T00:00:00Z", "Not-After: 2099-01-01T00:00:00Z"},
+		{"Allowed-Paths", "Allowed-Paths: /app1", "Allowed-Paths: /"},
+		{"Usage", "Usage: decrypt", "Usage: encrypt"},
+		{"removed", "Usage: decrypt\n", ""},
+		{"added", "Name: the-key\n", "Name: the-key\nCreated-At: 2020-01-01T00:00:00Z\n"},
+		{"type", "ETCVAULT WRAPPED PRIVATE KEY", "ETCVAULT WRAPPED PUBLIC KEY"},
+	}
+
+	for _, test := range tests {
+		tampered := strings.Replace(string(wrapped), test.Old, test.New, -1)
+		if tampered == string(wrapped) {
+			t.Fatalf("%s: header not found in %s", test.Name, wrapped)
+		}
+		if _, err := LoadWrappedKey([]byte(tampered), masterKey); err != ErrInvalidWrappedKey {
+			t.Errorf("%s: unexpected error %#v", test.Name, err)
+		}
+	}
+}
+
+func TestWrappedPemPublicKey(t *testing.T) {
+	masterKey, _ := GenerateMasterKey()
+	anotherMasterKey, _ := GenerateMasterKey()
+
+	wrapped, err := NewPublicKey("the-key", rsaKey.Public().(*rsa.PublicKey)).WrappedPem(masterKey)
+	if err != nil {
+		t.Fatalf("unexpected error %#v", err)
+	}
+	if !strings.Contains(string(wrapped), WrappedPublicKeyPemType) {
+		t.Errorf("unexpected pem %s", wrapped)
+	}
+
+	loadedKey, err := LoadWrappedKey(wrapped, masterKey)
+	if err != nil {
+		t.Fatalf("unexpected error %#v", err)
+	}
+	if loadedKey.Name != "the-key" || loadedKey.Private != nil || loadedKey.Public.N.Cmp(rsaKey.N) != 0 {
+		t.Errorf("unexpected key %#v", loadedKey)
+	}
+
+	if _, err := LoadWrappedKey(wrapped, anotherMasterKey); err != ErrInvalidWrappedKey {
+		t.Errorf("unexpected error %#v", err)
+	}
+	if _, err := LoadWrappedKey(wrapped, nil); err != ErrNoMasterKey {
+		t.Errorf("unexpected error %#v", err)
+	}
+}
+
+func TestWrappedPrivatePemPublicKey(t *testing.T) {
+	masterKey, _ := GenerateMasterKey()
+	_, err := NewPublicKey("the-key", rsaKey.Public().(*rsa.PublicKey)).WrappedPrivatePem(masterKey)
+	if err != ErrNoPrivateKey {
+		t.Errorf("unexpected error %#v", err)
+	}
+}
+
+func TestLoadMasterKey(t *testing.T) {
+	masterKey, _ := GenerateMasterKey()
+
+	loaded, err := LoadMasterKey(EncodeMasterKey(masterKey))
+	if err != nil {
+		t.Errorf("unexpected error %#v", err)
+	}
+	if string(loaded) != string(masterKey) {
+		t.Errorf("unexpected master key %#v", loaded)
+	}
+
+	_, err = LoadMasterKey([]byte("Zm9v\n"))
+	if err != ErrInvalidMasterKey {
+		t.Errorf("unexpected error %#v", err)
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"fmt"
+	"github.com/codegangsta/cli"
+	"github.com/sorah/etcvault/keys"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+var keychainFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:  "keychain",
+		Usage: "Path to directory for keys",
+	},
+}
+
+var keysCommand = cli.Command{
+	Name:  "keys",
+	Usage: "manage keys in keychain",
+	Subcommands: []cli.Command{
+		{
+			Name:   "list",
+			Usage:  "list keys in keychain",
+			Action: actionKeysList,
+			Flags:  keychainFlags,
+		},
+		{
+			Name:   "export-public",
+			Usage:  "print public key of the key, to distribute to hosts only encrypting",
+			Action: actionKeysExportPublic,
+			Flags:  keychainFlags,
+		},
+		{
+			Name:   "import",
+			Usage:  "validate key file and import it into keychain",
+			Action: actionKeysImport,
+			Flags: append([]cli.Flag{
+				cli.StringFlag{
+					Name:  "name",
+					Usage: "Name of the imported key (default: Name header in PEM, or file name)",
+				},
+			}, keychainFlags...),
+		},
+		{
+			Name:   "remove",
+			Usage:  "remove key from keychain",
+			Action: actionKeysRemove,
+			Flags:  keychainFlags,
+		},
+		{
+			Name:   "show",
+			Usage:  "show details of keys (all keys when no name given)",
+			Action: actionKeysShow,
+			Flags:  keychainFlags,
+		},
+	},
+}
+
+func keychainFromFlag(ctx *cli.Context) *keys.Keychain {
+	keychainDir := ctx.String("keychain")
+	if keychainDir == "" {
+		fmt.Fprintln(os.Stderr, "Specify -keychain option")
+		os.Exit(1)
+	}
+	return keys.NewKeychain(keychainDir)
+}
+
+func keyNameFromArgs(ctx *cli.Context) string {
+	if len(ctx.Args()) != 1 {
+		fmt.Fprintln(os.Stderr, "specify key name")
+		os.Exit(1)
+	}
+	return ctx.Args()[0]
+}
+
+func actionKeysList(ctx *cli.Context) {
+	keychain := keychainFromFlag(ctx)
+
+	names := keychain.List()
+	sort.Strings(names)
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(writer, "NAME\tTYPE\tBITS\tPRIVATE\tFINGERPRINT")
+	for _, name := range names {
+		key, err := keychain.Find(name)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", name, err.Error())
+			continue
+		}
+		fmt.Fprintf(writer, "%s\tRSA\t%d\t%t\t%s\n", key.Name, key.Public.N.BitLen(), key.Private != nil, key.Fingerprint())
+	}
+	writer.Flush()
+}
+
+func actionKeysExportPublic(ctx *cli.Context) {
+	keychain := keychainFromFlag(ctx)
+	name := keyNameFromArgs(ctx)
+
+	key, err := keychain.Find(name)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", name, err.Error())
+		os.Exit(1)
+	}
+
+	fmt.Printf("%s", key.PublicPem())
+}
+
+func actionKeysImport(ctx *cli.Context) {
+	keychain := keychainFromFlag(ctx)
+	if len(ctx.Args()) != 1 {
+		fmt.Fprintln(os.Stderr, "specify key file to import")
+		os.Exit(1)
+	}
+	keyPath := ctx.Args()[0]
+
+	key, err := keys.LoadKeyFromFile(keyPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", keyPath, err.Error())
+		os.Exit(1)
+	}
+
+	if name := ctx.String("name"); name != "" {
+		key.Name = name
+	} else if key.Name == "" {
+		key.Name = strings.TrimSuffix(filepath.Base(keyPath), filepath.Ext(keyPath))
+	}
+	if !validKeyName(key.Name) {
+		fmt.Fprintf(os.Stderr, "invalid key name %#v; use -name to specify another\n", key.Name)
+		os.Exit(1)
+	}
+
+	if err := keychain.Save(key); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to import %s: %s\n", key.Name, err.Error())
+		os.Exit(1)
+	}
+
+	fmt.Printf("imported %s (fingerprint: %s, private: %t)\n", key.Name, key.Fingerprint(), key.Private != nil)
+}
+
+func actionKeysRemove(ctx *cli.Context) {
+	keychain := keychainFromFlag(ctx)
+	name := keyNameFromArgs(ctx)
+
+	if err := keychain.Remove(name); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", name, err.Error())
+		os.Exit(1)
+	}
+}
+
+// validKeyName checks key name is usable as file name and in containers.
+func validKeyName(name string) bool {
+	if name == "" || name == "." || name == ".." {
+		return false
+	}
+	return !strings.ContainsAny(name, "/:@\\\n")
+}
+
+func actionKeysShow(ctx *cli.Context) {
+	keychain := keychainFromFlag(ctx)
+
+	names := []string(ctx.Args())
+	if len(names) == 0 {
+		names = keychain.List()
+		sort.Strings(names)
+	}
+
+	failed := false
+	for i, name := range names {
+		key, err := keychain.Find(name)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", name, err.Error())
+			failed = true
+			continue
+		}
+
+		if i > 0 {
+			fmt.Println()
+		}
+		printKey(key)
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+}
+
+func printKey(key *keys.Key) {
+	fmt.Printf("name: %s\n", key.Name)
+	fmt.Printf("type: RSA %d bits\n", key.Public.N.BitLen())
+	fmt.Printf("private: %t\n", key.Private != nil)
+	fmt.Printf("fingerprint: %s\n", key.Fingerprint())
+	if !key.CreatedAt.IsZero() {
+		fmt.Printf("created-at: %s\n", key.CreatedAt.Format(time.RFC3339))
+	}
+	if !key.NotAfter.IsZero() {
+		expired := ""
+		if key.Expired() {
+			expired = " (expired)"
+		}
+		fmt.Printf("not-after: %s%s\n", key.NotAfter.Format(time.RFC3339), expired)
+	}
+	if len(key.AllowedPaths) > 0 {
+		fmt.Printf("allowed-paths: %s\n", strings.Join(key.AllowedPaths, ","))
+	}
+	if key.Usage != keys.KeyUsageAny {
+		fmt.Printf("usage: %s\n", key.Usage)
+	}
+}
@@ -0,0 +1,134 @@
+package keyservice
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+type cacheEntry struct {
+	dataKey   []byte
+	expiresAt time.Time
+}
+
+// Client calls key service to wrap and unwrap content keys. Unwrapped keys are cached
+// in memory for CacheTtl, so repeated reads of the same value don't call the service.
+type Client struct {
+	Url        *url.URL
+	HttpClient *http.Client
+	CacheTtl   time.Duration
+
+	lock  sync.Mutex
+	cache map[[sha256.Size]byte]*cacheEntry
+}
+
+func NewClient(serviceUrl *url.URL, transport http.RoundTripper, timeout time.Duration, cacheTtl time.Duration) *Client {
+	return &Client{
+		Url: serviceUrl,
+		HttpClient: &http.Client{
+			Transport: transport,
+			Timeout:   timeout,
+		},
+		CacheTtl: cacheTtl,
+		cache:    make(map[[sha256.Size]byte]*cacheEntry),
+	}
+}
+
+func (client *Client) WrapKey(keyName string, dataKey []byte) ([]byte, error) {
+	resp := &keyResponse{}
+	if err := client.post("/v1/wrap", &wrapRequest{Key: keyName, DataKey: dataKey}, resp); err != nil {
+		return nil, err
+	}
+	return resp.WrappedKey, nil
+}
+
+func (client *Client) UnwrapKey(keyName string, wrappedKey []byte, path string) ([]byte, error) {
+	// path is a part of cache key, as the service may refuse the same key for another path
+	cacheKey := sha256.Sum256(append([]byte(keyName+"\x00"+path+"\x00"), wrappedKey...))
+	if dataKey := client.cached(cacheKey); dataKey != nil {
+		return dataKey, nil
+	}
+
+	resp := &keyResponse{}
+	if err := client.post("/v1/unwrap", &unwrapRequest{Key: keyName, WrappedKey: wrappedKey, Path: path}, resp); err != nil {
+		return nil, err
+	}
+
+	client.store(cacheKey, resp.DataKey)
+	return resp.DataKey, nil
+}
+
+func (client *Client) cached(cacheKey [sha256.Size]byte) []byte {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+
+	entry, ok := client.cache[cacheKey]
+	if !ok {
+		return nil
+	}
+	if time.Now().After(entry.expiresAt) {
+		delete(client.cache, cacheKey)
+		return nil
+	}
+	return entry.dataKey
+}
+
+func (client *Client) store(cacheKey [sha256.Size]byte, dataKey []byte) {
+	if client.CacheTtl <= 0 {
+		return
+	}
+
+	client.lock.Lock()
+	defer client.lock.Unlock()
+
+	now := time.Now()
+	// drop expired entries, to not keep data keys longer than necessary
+	for k, entry := range client.cache {
+		if now.After(entry.expiresAt) {
+			delete(client.cache, k)
+		}
+	}
+
+	client.cache[cacheKey] = &cacheEntry{
+		dataKey:   dataKey,
+		expiresAt: now.Add(client.CacheTtl),
+	}
+}
+
+func (client *Client) post(path string, reqBody interface{}, respBody interface{}) error {
+	u := new(url.URL)
+	*u = *client.Url
+	u.Path = path
+
+	body, err := json.Marshal(reqBody)
+	if err != nil {
+		return err
+	}
+
+	resp, err := client.HttpClient.Post(u.String(), "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	respBytes, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		errResp := &errorResponse{}
+		if err := json.Unmarshal(respBytes, errResp); err != nil || errResp.Message == "" {
+			return fmt.Errorf("key service returned status %d", resp.StatusCode)
+		}
+		return fmt.Errorf("key service returned status %d: %s", resp.StatusCode, errResp.Message)
+	}
+
+	return json.Unmarshal(respBytes, respBody)
+}
@@ -0,0 +1,81 @@
+package keyservice
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type countingHandler struct {
+	handler http.Handler
+	count   int32
+}
+
+func (h *countingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	atomic.AddInt32(&h.count, 1)
+	h.handler.ServeHTTP(w, r)
+}
+
+func TestClientUnwrapCache(t *testing.T) {
+	handler := &countingHandler{handler: NewServer(testKeychain)}
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	serverUrl, _ := url.Parse(server.URL)
+
+	client := NewClient(serverUrl, http.DefaultTransport, 0, time.Minute)
+
+	wrappedKey, err := client.WrapKey("the-key", []byte("data-key"))
+	if err != nil {
+		t.Errorf("unexpected error %#v", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		dataKey, err := client.UnwrapKey("the-key", wrappedKey, "")
+		if err != nil {
+			t.Errorf("unexpected error %#v", err)
+		}
+		if string(dataKey) != "data-key" {
+			t.Errorf("unexpected data key %#v", dataKey)
+		}
+	}
+
+	if count := atomic.LoadInt32(&handler.count); count != 2 {
+		t.Errorf("unexpected request count %d (should be wrap once and unwrap once)", count)
+	}
+}
+
+func TestClientUnwrapCacheExpiry(t *testing.T) {
+	handler := &countingHandler{handler: NewServer(testKeychain)}
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	serverUrl, _ := url.Parse(server.URL)
+
+	client := NewClient(serverUrl, http.DefaultTransport, 0, time.Millisecond)
+
+	wrappedKey, _ := client.WrapKey("the-key", []byte("data-key"))
+	client.UnwrapKey("the-key", wrappedKey, "")
+	time.Sleep(5 * time.Millisecond)
+	client.UnwrapKey("the-key", wrappedKey, "")
+
+	if count := atomic.LoadInt32(&handler.count); count != 3 {
+		t.Errorf("unexpected request count %d", count)
+	}
+}
+
+func TestClientTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer server.Close()
+	serverUrl, _ := url.Parse(server.URL)
+
+	client := NewClient(serverUrl, http.DefaultTransport, 50*time.Millisecond, 0)
+
+	_, err := client.UnwrapKey("the-key", []byte("wrapped"), "")
+	if err == nil {
+		t.Errorf("error should be returned on timeout")
+	}
+}
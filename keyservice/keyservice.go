@@ -0,0 +1,33 @@
+// Package keyservice implements a key wrapping service and its client. The service holds
+// private keys and wraps/unwraps content keys with them, so hosts using the client never
+// have private keys.
+//
+// API (JSON over HTTP POST, binary fields in base64):
+//
+//	POST /v1/wrap   {"key": NAME, "data_key": ...}    => {"key": NAME, "wrapped_key": ...}
+//	POST /v1/unwrap {"key": NAME, "wrapped_key": ..., "path": PATH} => {"key": NAME, "data_key": ...}
+//
+// path is etcd path of the value being decrypted, checked against Allowed-Paths of the key.
+// Errors are returned with non-2xx status and {"message": ...}.
+package keyservice
+
+type wrapRequest struct {
+	Key     string `json:"key"`
+	DataKey []byte `json:"data_key"`
+}
+
+type unwrapRequest struct {
+	Key        string `json:"key"`
+	WrappedKey []byte `json:"wrapped_key"`
+	Path       string `json:"path,omitempty"`
+}
+
+type keyResponse struct {
+	Key        string `json:"key"`
+	DataKey    []byte `json:"data_key,omitempty"`
+	WrappedKey []byte `json:"wrapped_key,omitempty"`
+}
+
+type errorResponse struct {
+	Message string `json:"message"`
+}
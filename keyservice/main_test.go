@@ -0,0 +1,37 @@
+package keyservice
+
+import (
+	"github.com/sorah/etcvault/keys"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+)
+
+var testKeychain *keys.MemoryStore
+
+func startTestServer() (*httptest.Server, *url.URL) {
+	server := httptest.NewServer(NewServer(testKeychain))
+	serverUrl, err := url.Parse(server.URL)
+	if err != nil {
+		panic(err)
+	}
+	return server, serverUrl
+}
+
+func TestMain(m *testing.M) {
+	key, err := keys.GenerateKey("the-key", 1024)
+	if err != nil {
+		panic(err)
+	}
+	publicKey := keys.NewPublicKey("pubkey", key.Public)
+	appKey, err := keys.GenerateKey("app-key", 1024)
+	if err != nil {
+		panic(err)
+	}
+	appKey.AllowedPaths = []string{"/app1"}
+
+	testKeychain = keys.NewMemoryStore([]*keys.Key{key, publicKey, appKey})
+
+	os.Exit(m.Run())
+}
@@ -0,0 +1,157 @@
+package keyservice
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/json"
+	"github.com/sorah/etcvault/keys"
+	"io/ioutil"
+	"log"
+	"net/http"
+)
+
+const maxRequestBodySize = 64 * 1024
+
+// Server wraps and unwraps content keys with keys in Keychain, using RSA-OAEP (SHA-256).
+type Server struct {
+	Keychain keys.Store
+	// Keys in RevocationList are refused for both wrapping and unwrapping.
+	RevocationList *keys.RevocationList
+}
+
+func NewServer(keychain keys.Store) *Server {
+	return &Server{
+		Keychain: keychain,
+	}
+}
+
+func (server *Server) ServeHTTP(response http.ResponseWriter, request *http.Request) {
+	if request.Method != "POST" {
+		writeError(response, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	switch request.URL.Path {
+	case "/v1/wrap":
+		server.serveWrap(response, request)
+	case "/v1/unwrap":
+		server.serveUnwrap(response, request)
+	default:
+		writeError(response, http.StatusNotFound, "not found")
+	}
+}
+
+func (server *Server) serveWrap(response http.ResponseWriter, request *http.Request) {
+	wrapReq := &wrapRequest{}
+	if !readJson(response, request, wrapReq) {
+		return
+	}
+
+	key, ok := server.findKey(response, wrapReq.Key)
+	if !ok {
+		return
+	}
+	if server.isRevoked(key) {
+		writeError(response, http.StatusForbidden, "key "+key.Name+" is revoked")
+		return
+	}
+	if !key.CanEncrypt() || key.Expired() {
+		writeError(response, http.StatusForbidden, "key "+key.Name+" is not allowed to be used for encryption")
+		return
+	}
+
+	wrappedKey, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, key.Public, wrapReq.DataKey, []byte{})
+	if err != nil {
+		writeError(response, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	writeJson(response, &keyResponse{Key: key.Name, WrappedKey: wrappedKey})
+}
+
+func (server *Server) serveUnwrap(response http.ResponseWriter, request *http.Request) {
+	unwrapReq := &unwrapRequest{}
+	if !readJson(response, request, unwrapReq) {
+		return
+	}
+
+	key, ok := server.findKey(response, unwrapReq.Key)
+	if !ok {
+		return
+	}
+	if server.isRevoked(key) {
+		writeError(response, http.StatusForbidden, "key "+key.Name+" is revoked")
+		return
+	}
+	if key.Private == nil {
+		writeError(response, http.StatusForbidden, "no private key for "+key.Name)
+		return
+	}
+	if !key.CanDecrypt() {
+		writeError(response, http.StatusForbidden, "key "+key.Name+" is not allowed to be used for decryption")
+		return
+	}
+	if !key.AllowsPath(unwrapReq.Path) {
+		writeError(response, http.StatusForbidden, "key "+key.Name+" is not allowed to be used for path "+unwrapReq.Path)
+		return
+	}
+
+	dataKey, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, key.Private, unwrapReq.WrappedKey, []byte{})
+	if err != nil {
+		writeError(response, http.StatusUnprocessableEntity, "couldn't unwrap key")
+		return
+	}
+
+	writeJson(response, &keyResponse{Key: key.Name, DataKey: dataKey})
+}
+
+func (server *Server) isRevoked(key *keys.Key) bool {
+	return server.RevocationList != nil && server.RevocationList.IsKeyRevoked(key)
+}
+
+func (server *Server) findKey(response http.ResponseWriter, name string) (*keys.Key, bool) {
+	key, err := server.Keychain.Find(name)
+	if err == keys.ErrKeyNotFound {
+		writeError(response, http.StatusNotFound, err.Error())
+		return nil, false
+	}
+	if err != nil {
+		log.Printf("error while finding key %s: %s", name, err.Error())
+		writeError(response, http.StatusInternalServerError, "couldn't load key")
+		return nil, false
+	}
+	return key, true
+}
+
+func readJson(response http.ResponseWriter, request *http.Request, v interface{}) bool {
+	body, err := ioutil.ReadAll(http.MaxBytesReader(response, request.Body, maxRequestBodySize))
+	if err != nil {
+		writeError(response, http.StatusBadRequest, err.Error())
+		return false
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		writeError(response, http.StatusBadRequest, err.Error())
+		return false
+	}
+	return true
+}
+
+func writeJson(response http.ResponseWriter, v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	response.Header().Set("Content-Type", "application/json")
+	response.Header().Set("Server", "etcvault")
+	response.WriteHeader(http.StatusOK)
+	response.Write(body)
+}
+
+func writeError(response http.ResponseWriter, status int, message string) {
+	body, _ := json.Marshal(&errorResponse{Message: message})
+	response.Header().Set("Content-Type", "application/json")
+	response.Header().Set("Server", "etcvault")
+	response.WriteHeader(status)
+	response.Write(body)
+}
@@ -0,0 +1,146 @@
+package keyservice
+
+import (
+	"github.com/sorah/etcvault/keys"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestServerWrapAndUnwrap(t *testing.T) {
+	server, serverUrl := startTestServer()
+	defer server.Close()
+
+	client := NewClient(serverUrl, http.DefaultTransport, 0, 0)
+
+	wrappedKey, err := client.WrapKey("the-key", []byte("data-key"))
+	if err != nil {
+		t.Errorf("unexpected error %#v", err)
+	}
+	if strings.Contains(string(wrappedKey), "data-key") {
+		t.Errorf("wrapped key contains original key: %#v", wrappedKey)
+	}
+
+	dataKey, err := client.UnwrapKey("the-key", wrappedKey, "")
+	if err != nil {
+		t.Errorf("unexpected error %#v", err)
+	}
+	if string(dataKey) != "data-key" {
+		t.Errorf("unexpected data key %#v", dataKey)
+	}
+}
+
+func TestServerUnwrapWithoutPrivateKey(t *testing.T) {
+	server, serverUrl := startTestServer()
+	defer server.Close()
+
+	client := NewClient(serverUrl, http.DefaultTransport, 0, 0)
+
+	wrappedKey, err := client.WrapKey("pubkey", []byte("data-key"))
+	if err != nil {
+		t.Errorf("unexpected error %#v", err)
+	}
+
+	_, err = client.UnwrapKey("pubkey", wrappedKey, "")
+	if err == nil || !strings.Contains(err.Error(), "status 403") {
+		t.Errorf("unexpected error %#v", err)
+	}
+}
+
+func TestServerUnwrapWithAllowedPaths(t *testing.T) {
+	server, serverUrl := startTestServer()
+	defer server.Close()
+
+	client := NewClient(serverUrl, http.DefaultTransport, 0, 0)
+
+	wrappedKey, err := client.WrapKey("app-key", []byte("data-key"))
+	if err != nil {
+		t.Errorf("unexpected error %#v", err)
+	}
+
+	dataKey, err := client.UnwrapKey("app-key", wrappedKey, "/app1/password")
+	if err != nil {
+		t.Errorf("unexpected error %#v", err)
+	}
+	if string(dataKey) != "data-key" {
+		t.Errorf("unexpected data key %#v", dataKey)
+	}
+
+	for _, path := range []string{"/app2/password", "/app10/password", ""} {
+		_, err = client.UnwrapKey("app-key", wrappedKey, path)
+		if err == nil || !strings.Contains(err.Error(), "status 403") {
+			t.Errorf("unexpected error for %#v: %#v", path, err)
+		}
+	}
+}
+
+func TestServerRevokedKey(t *testing.T) {
+	revocationList := keys.NewRevocationList()
+	handler := NewServer(testKeychain)
+	handler.RevocationList = revocationList
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	serverUrl, _ := url.Parse(server.URL)
+
+	client := NewClient(serverUrl, http.DefaultTransport, 0, 0)
+
+	wrappedKey, err := client.WrapKey("the-key", []byte("data-key"))
+	if err != nil {
+		t.Fatalf("unexpected error %#v", err)
+	}
+
+	revocationList.Load([]byte("the-key\n"))
+	if _, err := client.UnwrapKey("the-key", wrappedKey, ""); err == nil || !strings.Contains(err.Error(), "status 403") {
+		t.Errorf("unexpected error %#v", err)
+	}
+	if _, err := client.WrapKey("the-key", []byte("data-key")); err == nil || !strings.Contains(err.Error(), "status 403") {
+		t.Errorf("unexpected error %#v", err)
+	}
+
+	// revoked by fingerprint
+	key, _ := testKeychain.Find("app-key")
+	revocationList.Load([]byte("app-key@" + key.Fingerprint() + "\n"))
+	if _, err := client.WrapKey("app-key", []byte("data-key")); err == nil || !strings.Contains(err.Error(), "status 403") {
+		t.Errorf("unexpected error %#v", err)
+	}
+}
+
+func TestServerKeyNotFound(t *testing.T) {
+	server, serverUrl := startTestServer()
+	defer server.Close()
+
+	client := NewClient(serverUrl, http.DefaultTransport, 0, 0)
+
+	_, err := client.WrapKey("unexist", []byte("data-key"))
+	if err == nil || !strings.Contains(err.Error(), "status 404") {
+		t.Errorf("unexpected error %#v", err)
+	}
+}
+
+func TestServerUnwrapBroken(t *testing.T) {
+	server, serverUrl := startTestServer()
+	defer server.Close()
+
+	client := NewClient(serverUrl, http.DefaultTransport, 0, 0)
+
+	_, err := client.UnwrapKey("the-key", []byte("broken"), "")
+	if err == nil || !strings.Contains(err.Error(), "status 422") {
+		t.Errorf("unexpected error %#v", err)
+	}
+}
+
+func TestServerMethodNotAllowed(t *testing.T) {
+	server, _ := startTestServer()
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/v1/unwrap")
+	if err != nil {
+		panic(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 405 {
+		t.Errorf("unexpected status %d", resp.StatusCode)
+	}
+}
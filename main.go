@@ -2,18 +2,194 @@ package main
 
 import (
 	"bufio"
+	"crypto/tls"
 	"fmt"
 	"github.com/codegangsta/cli"
-	"github.com/sorah/etcvault/engine"
 	"github.com/sorah/etcvault/keys"
+	"github.com/sorah/etcvault/keyservice"
 	"io"
+	"log"
+	"net"
+	"net/http"
 	"net/url"
 	"os"
 	"strings"
 	"time"
 )
 
+var startFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:  "keychain",
+		Usage: "Path to directory for keys",
+	},
+	cli.StringFlag{
+		Name:  "keys-etcd-dir",
+		Usage: "etcd directory to load additional keys from (e.g. /etcvault/keys). Keys there are wrapped by -master-key-file",
+	},
+	cli.StringFlag{
+		Name:  "master-key-file",
+		Usage: "Path to master key file (generate by `etcvault master-keygen`) to unwrap keys in -keys-etcd-dir",
+	},
+	cli.IntFlag{
+		Name:  "keys-etcd-interval",
+		Value: 60,
+		Usage: "Interval (in second) to reload keys from -keys-etcd-dir",
+	},
+	cli.StringFlag{
+		Name:  "revocation-etcd-key",
+		Usage: "etcd key holding revocation list, in addition to \"revoked\" file in keychain directory",
+	},
+	cli.IntFlag{
+		Name:  "revocation-interval",
+		Value: 30,
+		Usage: "Interval (in second) to reload revocation list",
+	},
+	cli.StringFlag{
+		Name:  "key-service-url",
+		Usage: "URL of remote key service (`etcvault key-service`). When given, values are encrypted with content keys wrapped by the service, and no private keys are needed locally",
+	},
+	cli.IntFlag{
+		Name:  "key-service-timeout",
+		Value: 5,
+		Usage: "Timeout (in second) for requests to -key-service-url",
+	},
+	cli.IntFlag{
+		Name:  "key-service-cache-ttl",
+		Value: 300,
+		Usage: "Duration (in second) to cache content keys unwrapped by -key-service-url",
+	},
+	cli.StringFlag{
+		Name:  "listen",
+		Value: "http://localhost:2381",
+		Usage: "URLs to listen, separated by comma. Specify https as scheme to listen HTTPS, unix (unix:///path/to/sock) to listen unix domain socket.",
+	},
+	cli.StringFlag{
+		Name:  "listen-socket-mode",
+		Value: "0660",
+		Usage: "Permission (in octal) of unix domain socket to listen",
+	},
+	cli.StringFlag{
+		Name:  "advertise-url",
+		Value: "http://localhost:2381",
+		Usage: "Client URL to advertise. Usually specify etcvault's URL",
+	},
+
+	cli.StringFlag{
+		Name:  "discovery-srv",
+		Usage: "domain to fetch SRV records for backend etcd",
+	},
+	cli.StringFlag{
+		Name:  "discovery-url",
+		Usage: "etcd discovery service URL (e.g. https://discovery.etcd.io/TOKEN) to find backend etcd members",
+	},
+	cli.StringFlag{
+		Name:  "discovery-file",
+		Usage: "path to file listing backend etcd client urls (one per line, or separated by comma). Re-read on change",
+	},
+	cli.StringFlag{
+		Name:  "initial-backends",
+		Usage: "backend urls to fetch backend etcd members, separeted by comma",
+	},
+	cli.StringFlag{
+		Name:  "backend-prefer-scheme",
+		Usage: "when etcd member advertises multiple client urls, prefer urls with this scheme (http or https)",
+	},
+	cli.StringFlag{
+		Name:  "backend-prefer-networks",
+		Usage: "when etcd member advertises multiple client urls, prefer urls in these networks (CIDR, separated by comma)",
+	},
+	cli.StringFlag{
+		Name:  "client-ca-file",
+		Usage: "TLS CA file to verify certificate of etcd client ports (https://...:2379/)",
+	},
+	cli.StringFlag{
+		Name:  "client-cert-file",
+		Usage: "TLS certficate file to send when communicating with etcd client ports (https://...:2379/)",
+	},
+	cli.StringFlag{
+		Name:  "client-key-file",
+		Usage: "key for -client-cert-file",
+	},
+	cli.StringFlag{
+		Name:  "peer-ca-file",
+		Usage: "TLS CA file to verify certificate of etcd peer ports (https://...:2380/)",
+	},
+	cli.StringFlag{
+		Name:  "peer-cert-file",
+		Usage: "TLS certficate file to send when communicating with etcd peer ports (https://...:2380/)",
+	},
+	cli.StringFlag{
+		Name:  "peer-key-file",
+		Usage: "key for -peer-cert-file",
+	},
+	cli.StringFlag{
+		Name:  "listen-ca-file",
+		Usage: "When listening HTTPS and this is present, etcvault will validate its client with using this CA certificate. If not present, -client-ca-file will be used.",
+	},
+	cli.StringFlag{
+		Name:  "listen-cert-file",
+		Usage: "When listening HTTPS and this is present, etcvault will use this certificate to listen. If not present, -client-cert-file will be used.",
+	},
+	cli.StringFlag{
+		Name:  "listen-key-file",
+		Usage: "key for -listen-cert-file",
+	},
+	cli.IntFlag{
+		Name:  "discovery-interval",
+		Value: 120,
+		Usage: "Interval (in second) to refresh backends with specified discovery method",
+	},
+	cli.StringFlag{
+		Name:  "tls-min-version",
+		Value: "1.0",
+		Usage: "Minimum TLS version to use for listen, client and peer (1.0, 1.1, 1.2 or 1.3)",
+	},
+	cli.StringFlag{
+		Name:  "tls-max-version",
+		Usage: "Maximum TLS version to use for listen, client and peer (1.0, 1.1, 1.2 or 1.3)",
+	},
+	cli.StringFlag{
+		Name:  "tls-cipher-suites",
+		Usage: "TLS cipher suites (e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256) to allow, separated by comma. Not applied to TLS 1.3",
+	},
+	cli.StringFlag{
+		Name:  "tls-curves",
+		Usage: "Elliptic curves to allow, separated by comma (P256, P384, P521, X25519)",
+	},
+	cli.StringFlag{
+		Name:  "listen-client-auth",
+		Value: "require",
+		Usage: "How to verify client certificates when listening HTTPS with CA file: require, or verify-if-given",
+	},
+	cli.IntFlag{
+		Name:  "tls-reload-interval",
+		Value: 60,
+		Usage: "Interval (in second) to check TLS certificate, key and CA files for changes. Files are also reloaded on SIGHUP",
+	},
+	cli.BoolFlag{
+		Name:  "readonly",
+		Usage: "if set, etcvault will reject non GET requests",
+	},
+	cli.BoolFlag{
+		Name:  "omit-metadata",
+		Usage: "if set, _etcvault and _etcvault_error are not added to nodes in responses. Can be overridden by X-Etcvault-Metadata request header",
+	},
+	cli.BoolFlag{
+		Name:  "strict",
+		Usage: "if set, responses with values couldn't be decrypted become 500 errors. Can be overridden by X-Etcvault-Strict request header",
+	},
+	cli.IntFlag{
+		Name:  "decrypt-concurrency",
+		Usage: "Number of values decrypted in parallel for a response (e.g. recursive GET). 0 means the number of CPUs",
+	},
+}
+
 func main() {
+	newApp().Run(os.Args)
+}
+
+// newApp returns the etcvault command line application.
+func newApp() *cli.App {
 	app := cli.NewApp()
 	app.Name = "etcvault"
 	app.Usage = "proxy for etcd, adding transparent encryption"
@@ -24,90 +200,278 @@ func main() {
 			Name:   "start",
 			Usage:  "start etcvault proxy",
 			Action: actionStart,
-			Flags: []cli.Flag{
+			Flags: append([]cli.Flag{
+				cli.StringFlag{
+					Name:  "config",
+					Usage: "Path to configuration file (TOML, or YAML with .yml/.yaml extension). Flags and ETCVAULT_* environment variables take precedence.",
+				},
+			}, startFlags...),
+		},
+		{
+			Name:  "config",
+			Usage: "configuration file utilities",
+			Subcommands: []cli.Command{
+				{
+					Name:   "check",
+					Usage:  "validate configuration file for `etcvault start` without starting",
+					Action: actionConfigCheck,
+					Flags: append([]cli.Flag{
+						cli.StringFlag{
+							Name:  "config",
+							Usage: "Path to configuration file to check",
+						},
+					}, startFlags...),
+				},
+			},
+		},
+		{
+			Name:   "keygen",
+			Usage:  "Generate new private key with specified name",
+			Action: actionKeygen,
+			Flags: append([]cli.Flag{
+				cli.StringFlag{
+					Name:  "save",
+					Usage: "Save generated key into specfied directory (keychain)",
+				},
+				cli.BoolFlag{
+					Name:  "pub",
+					Usage: "With -save, also write public key (NAME.pub) next to private key",
+				},
+				cli.IntFlag{
+					Name:  "bits",
+					Value: 2048,
+					Usage: "RSA key bit length to generate",
+				},
+				cli.StringFlag{
+					Name:  "not-after",
+					Usage: "Expiration of the key for encryption, in RFC3339 (2016-01-01T00:00:00Z) or duration from now (e.g. 8760h)",
+				},
+				cli.StringFlag{
+					Name:  "allowed-paths",
+					Usage: "etcd path prefixes (separated by comma) where values encrypted with the key can be decrypted",
+				},
+				cli.StringFlag{
+					Name:  "usage",
+					Usage: "Restrict the key to encrypt or decrypt only",
+				},
+				cli.StringFlag{
+					Name:  "etcd-dir",
+					Usage: "Save generated key into etcd directory (e.g. /etcvault/keys) at -etcd, instead of -save. Requires -master-key-file",
+				},
+				cli.StringFlag{
+					Name:  "master-key-file",
+					Usage: "Path to master key file to wrap private key with",
+				},
+			}, etcdClientFlags...),
+		},
+		keysCommand,
+		{
+			Name:   "scan",
+			Usage:  "report how values in etcd are encrypted, by container version and key",
+			Action: actionScan,
+			Flags: append([]cli.Flag{
+				cli.StringFlag{
+					Name:  "prefix",
+					Value: "/",
+					Usage: "etcd path to scan recursively",
+				},
+				cli.BoolFlag{
+					Name:  "summary",
+					Usage: "print only summary, not each key",
+				},
+				cli.BoolFlag{
+					Name:  "detect-secrets",
+					Usage: "flag plaintext values which look like secrets (by key name, entropy and known formats)",
+				},
+			}, etcdClientFlags...),
+		},
+		{
+			Name:   "exec",
+			Usage:  "run a command with values under etcd path as environment variables",
+			Action: actionExec,
+			Flags: append([]cli.Flag{
+				cli.StringFlag{
+					Name:  "prefix",
+					Value: "/",
+					Usage: "etcd path to read values from (recursively)",
+				},
 				cli.StringFlag{
 					Name:  "keychain",
 					Usage: "Path to directory for keys",
 				},
 				cli.StringFlag{
-					Name:  "listen",
-					Value: "http://localhost:2381",
-					Usage: "URL to listen. Specify https as scheme to listen HTTPS.",
+					Name:  "env-prefix",
+					Usage: "prefix to add to environment variable names",
+				},
+				cli.BoolFlag{
+					Name:  "watch",
+					Usage: "watch values and restart (or signal) the command on change",
 				},
 				cli.StringFlag{
-					Name:  "advertise-url",
-					Value: "http://localhost:2381",
-					Usage: "Client URL to advertise. Usually specify etcvault's URL",
+					Name:  "on-change",
+					Value: "restart",
+					Usage: "what to do on change with -watch: restart or signal",
 				},
-
 				cli.StringFlag{
-					Name:  "discovery-srv",
-					Usage: "domain to fetch SRV records for backend etcd",
+					Name:  "signal",
+					Value: "HUP",
+					Usage: "signal to send on change with -on-change=signal",
 				},
 				cli.StringFlag{
-					Name:  "initial-backends",
-					Usage: "backend urls to fetch backend etcd members, separeted by comma",
+					Name:  "kill-signal",
+					Value: "TERM",
+					Usage: "signal to stop the command when restarting",
+				},
+				cli.IntFlag{
+					Name:  "kill-timeout",
+					Value: 10,
+					Usage: "seconds to wait for the command to stop with -kill-signal, before sending KILL",
 				},
+			}, etcdClientFlags...),
+		},
+		{
+			Name:   "template",
+			Usage:  "render a template with values in etcd",
+			Action: actionTemplate,
+			Flags: append([]cli.Flag{
 				cli.StringFlag{
-					Name:  "client-ca-file",
-					Usage: "TLS CA file to verify certificate of etcd client ports (https://...:2379/)",
+					Name:  "src",
+					Usage: "Path to template (text/template)",
 				},
 				cli.StringFlag{
-					Name:  "client-cert-file",
-					Usage: "TLS certficate file to send when communicating with etcd client ports (https://...:2379/)",
+					Name:  "dest",
+					Usage: "Path to write rendered template",
 				},
 				cli.StringFlag{
-					Name:  "client-key-file",
-					Usage: "key for -client-cert-file",
+					Name:  "mode",
+					Value: "0644",
+					Usage: "file mode of -dest, in octal",
 				},
 				cli.StringFlag{
-					Name:  "peer-ca-file",
-					Usage: "TLS CA file to verify certificate of etcd peer ports (https://...:2380/)",
+					Name:  "prefix",
+					Value: "/",
+					Usage: "etcd path to read values from; keys in template are relative to this",
 				},
 				cli.StringFlag{
-					Name:  "peer-cert-file",
-					Usage: "TLS certficate file to send when communicating with etcd peer ports (https://...:2380/)",
+					Name:  "keychain",
+					Usage: "Path to directory for keys",
+				},
+				cli.BoolFlag{
+					Name:  "watch",
+					Usage: "watch values and render again on change",
 				},
 				cli.StringFlag{
-					Name:  "peer-key-file",
-					Usage: "key for -peer-cert-file",
+					Name:  "reload-cmd",
+					Usage: "command to run (with sh -c) after -dest is updated",
 				},
+			}, etcdClientFlags...),
+		},
+		{
+			Name:   "backup",
+			Usage:  "dump etcd subtree to a file, leaving values encrypted",
+			Action: actionBackup,
+			Flags: append([]cli.Flag{
 				cli.StringFlag{
-					Name:  "listen-ca-file",
-					Usage: "When listening HTTPS and this is present, etcvault will validate its client with using this CA certificate. If not present, -client-ca-file will be used.",
+					Name:  "prefix",
+					Value: "/",
+					Usage: "etcd path to back up recursively",
 				},
 				cli.StringFlag{
-					Name:  "listen-cert-file",
-					Usage: "When listening HTTPS and this is present, etcvault will use this certificate to listen. If not present, -client-cert-file will be used.",
+					Name:  "output, o",
+					Usage: "Path to write backup (default: stdout)",
 				},
+			}, etcdClientFlags...),
+		},
+		{
+			Name:   "restore",
+			Usage:  "restore etcd subtree from a file made by backup",
+			Action: actionRestore,
+			Flags: append([]cli.Flag{
 				cli.StringFlag{
-					Name:  "listen-key-file",
-					Usage: "key for -listen-cert-file",
+					Name:  "prefix",
+					Usage: "etcd path to restore to (default: the path backed up)",
 				},
-				cli.IntFlag{
-					Name:  "discovery-interval",
-					Value: 120,
-					Usage: "Interval (in second) to refresh backends with specified discovery method",
+				cli.BoolFlag{
+					Name:  "overwrite",
+					Usage: "overwrite existing keys",
 				},
 				cli.BoolFlag{
-					Name:  "readonly",
-					Usage: "if set, etcvault will reject non GET requests",
+					Name:  "rewrap",
+					Usage: "decrypt values with -keychain and encrypt again with -dest-keychain",
 				},
-			},
+				cli.StringFlag{
+					Name:  "keychain",
+					Usage: "Path to directory for keys to decrypt values in backup",
+				},
+				cli.StringFlag{
+					Name:  "dest-keychain",
+					Usage: "Path to directory for keys to encrypt values for destination",
+				},
+				cli.StringFlag{
+					Name:  "rewrap-key",
+					Usage: "Key name to encrypt values with (default: the same name as original)",
+				},
+			}, etcdClientFlags...),
 		},
 		{
-			Name:   "keygen",
-			Usage:  "Generate new private key with specified name",
-			Action: actionKeygen,
+			Name:   "find-revoked",
+			Usage:  "find values in etcd encrypted with revoked keys",
+			Action: actionFindRevoked,
+			Flags: append([]cli.Flag{
+				cli.StringFlag{
+					Name:  "prefix",
+					Value: "/",
+					Usage: "etcd path to search recursively",
+				},
+				cli.StringFlag{
+					Name:  "keychain",
+					Usage: "Path to directory for keys, to use its revocation list (\"revoked\" file)",
+				},
+				cli.StringFlag{
+					Name:  "revocation-list",
+					Usage: "Path to revocation list file",
+				},
+				cli.StringFlag{
+					Name:  "revocation-etcd-key",
+					Usage: "etcd key holding revocation list",
+				},
+			}, etcdClientFlags...),
+		},
+		{
+			Name:   "master-keygen",
+			Usage:  "Generate new master key to wrap private keys stored in etcd",
+			Action: actionMasterKeygen,
+		},
+		{
+			Name:   "key-service",
+			Usage:  "start key service, which wraps and unwraps content keys with keys in keychain for -key-service-url",
+			Action: actionKeyService,
 			Flags: []cli.Flag{
 				cli.StringFlag{
-					Name:  "save",
-					Usage: "Save generated key into specfied directory (keychain)",
+					Name:  "keychain",
+					Usage: "Path to directory for keys",
+				},
+				cli.StringFlag{
+					Name:  "listen",
+					Value: "http://localhost:2382",
+					Usage: "URL to listen. Specify https as scheme to listen HTTPS",
+				},
+				cli.StringFlag{
+					Name:  "listen-ca-file",
+					Usage: "CA file to verify client certificates. Strongly recommended to restrict clients",
+				},
+				cli.StringFlag{
+					Name:  "listen-cert-file",
+					Usage: "TLS certificate file to listen HTTPS",
+				},
+				cli.StringFlag{
+					Name:  "listen-key-file",
+					Usage: "key for -listen-cert-file",
 				},
 				cli.IntFlag{
-					Name:  "bits",
-					Value: 2048,
-					Usage: "RSA key bit length to generate",
+					Name:  "revocation-interval",
+					Value: 30,
+					Usage: "Interval (in second) to reload revocation list in -keychain",
 				},
 			},
 		},
@@ -128,7 +492,7 @@ func main() {
 		},
 	}
 
-	app.Run(os.Args)
+	return app
 }
 
 func actionKeygen(ctx *cli.Context) {
@@ -140,19 +504,96 @@ func actionKeygen(ctx *cli.Context) {
 	name := ctx.Args()[0]
 	bits := ctx.Int("bits")
 
+	if !validKeyName(name) {
+		fmt.Fprintf(os.Stderr, "invalid key name %#v\n", name)
+		os.Exit(1)
+	}
+
 	key, err := keys.GenerateKey(name, bits)
 	if err != nil {
-		panic(err)
+		fmt.Fprintf(os.Stderr, "failed to generate key: %s\n", err.Error())
+		os.Exit(1)
+	}
+
+	if err := applyKeyMetadataFlags(ctx, key); err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		os.Exit(1)
 	}
 
 	saveDir := ctx.String("save")
 
-	if saveDir == "" {
+	if ctx.String("etcd") == "" && (ctx.String("etcd-dir") != "" || ctx.String("master-key-file") != "") {
+		fmt.Fprintln(os.Stderr, "Specify -etcd option to save key into -etcd-dir")
+		os.Exit(1)
+	}
+
+	if ctx.String("etcd") != "" {
+		saveKeyToEtcd(ctx, key)
+	} else if saveDir == "" {
 		fmt.Printf("%s", key.PrivatePem())
 	} else {
 		keychain := keys.NewKeychain(saveDir)
-		keychain.Save(key)
+		keychain.EmitPublicKey = ctx.Bool("pub")
+		if err := keychain.Save(key); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to save key %s into %s: %s\n", name, saveDir, err.Error())
+			os.Exit(1)
+		}
+	}
+}
+
+func applyKeyMetadataFlags(ctx *cli.Context, key *keys.Key) error {
+	if notAfter := ctx.String("not-after"); notAfter != "" {
+		if duration, err := time.ParseDuration(notAfter); err == nil {
+			key.NotAfter = key.CreatedAt.Add(duration)
+		} else if t, err := time.Parse(time.RFC3339, notAfter); err == nil {
+			key.NotAfter = t
+		} else {
+			return fmt.Errorf("couldn't parse -not-after: %s", notAfter)
+		}
+	}
+
+	if allowedPaths := ctx.String("allowed-paths"); allowedPaths != "" {
+		key.AllowedPaths = []string{}
+		for _, path := range strings.Split(allowedPaths, ",") {
+			key.AllowedPaths = append(key.AllowedPaths, strings.TrimSpace(path))
+		}
+	}
+
+	usage, err := keys.ParseKeyUsage(ctx.String("usage"))
+	if err != nil {
+		return err
 	}
+	key.Usage = usage
+
+	return nil
+}
+
+func saveKeyToEtcd(ctx *cli.Context, key *keys.Key) {
+	if ctx.String("etcd-dir") == "" || ctx.String("master-key-file") == "" {
+		fmt.Fprintln(os.Stderr, "Specify -etcd-dir and -master-key-file options")
+		os.Exit(1)
+	}
+
+	masterKey, err := keys.LoadMasterKeyFromFile(ctx.String("master-key-file"))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to load master key: %s\n", err.Error())
+		os.Exit(1)
+	}
+
+	source := keys.NewEtcdKeySource(etcdClientFromFlags(ctx), ctx.String("etcd-dir"), masterKey)
+	if err := source.Put(key); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to save key into etcd: %s\n", err.Error())
+		os.Exit(1)
+	}
+}
+
+func actionMasterKeygen(ctx *cli.Context) {
+	masterKey, err := keys.GenerateMasterKey()
+	if err != nil {
+		panic(err)
+	}
+
+	fmt.Printf("%s", keys.EncodeMasterKey(masterKey))
 }
 
 func actionTransform(ctx *cli.Context) {
@@ -162,8 +603,7 @@ func actionTransform(ctx *cli.Context) {
 		os.Exit(1)
 	}
 
-	keychain := keys.NewKeychain(keychainDir)
-	engine := engine.NewEngine(keychain)
+	engine := engineForKeychain(keychainDir)
 
 	if ctx.Bool("stdin") {
 		reader := bufio.NewReader(os.Stderr)
@@ -200,86 +640,135 @@ func actionTransform(ctx *cli.Context) {
 	}
 }
 
-func actionStart(ctx *cli.Context) {
+func actionKeyService(ctx *cli.Context) {
 	keychainDir := ctx.String("keychain")
 	if keychainDir == "" {
 		fmt.Fprintln(os.Stderr, "Specify -keychain option")
 		os.Exit(1)
 	}
 
-	discoverySrvDomain := ctx.String("discovery-srv")
-	initialBackendUrlStrings := ctx.String("initial-backends")
-	if discoverySrvDomain == "" && initialBackendUrlStrings == "" {
-		fmt.Fprintln(os.Stderr, "Specify -discovery-srv or -initial-backends option")
+	listenUrl, err := url.Parse(ctx.String("listen"))
+	if err != nil || (listenUrl.Scheme != "http" && listenUrl.Scheme != "https") {
+		fmt.Fprintf(os.Stderr, "listen URL should be http or https: %s\n", ctx.String("listen"))
+		os.Exit(1)
+	}
+
+	listener, err := net.Listen("tcp", listenUrl.Host)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to listen %s: %s\n", listenUrl.String(), err.Error())
 		os.Exit(1)
 	}
-	if discoverySrvDomain != "" && initialBackendUrlStrings != "" {
-		fmt.Fprintln(os.Stderr, "Only specifying only either -discovery-srv or -initial-backends is accepted.")
+
+	if listenUrl.Scheme == "https" {
+		if ctx.String("listen-cert-file") == "" || ctx.String("listen-key-file") == "" {
+			fmt.Fprintln(os.Stderr, "Specify -listen-cert-file and -listen-key-file options to listen https")
+			os.Exit(1)
+		}
+		reloader, err := NewTlsReloader(ctx.String("listen-cert-file"), ctx.String("listen-key-file"), ctx.String("listen-ca-file"), DefaultTlsPolicy())
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+			os.Exit(1)
+		}
+		listener = tls.NewListener(listener, reloader.ServerConfig())
+	}
+
+	if ctx.Int("revocation-interval") <= 0 {
+		fmt.Fprintf(os.Stderr, "-revocation-interval should be positive: %d\n", ctx.Int("revocation-interval"))
 		os.Exit(1)
 	}
 
-	clientCaFilePath := ctx.String("client-ca-file")
-	clientCertFilePath := ctx.String("client-cert-file")
-	clientKeyFilePath := ctx.String("client-key-file")
-	if (clientCertFilePath != "" || clientKeyFilePath != "") && !(clientCertFilePath != "" && clientKeyFilePath != "") {
-		fmt.Fprintln(os.Stderr, "provide both -client-cert-file and -client-key-file")
+	keychain := keys.NewKeychain(keychainDir)
+	handler := keyservice.NewServer(keychain)
+	handler.RevocationList = keys.NewRevocationList()
+	if err := handler.RevocationList.LoadFile(keychain.RevocationListPath()); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to load revocation list: %s\n", err.Error())
 		os.Exit(1)
 	}
+	go func() {
+		for _ = range time.Tick(time.Duration(ctx.Int("revocation-interval")) * time.Second) {
+			list := keys.NewRevocationList()
+			if err := list.LoadFile(keychain.RevocationListPath()); err != nil {
+				// keep previous list
+				log.Printf("failed to reload revocation list: %s", err.Error())
+				continue
+			}
+			handler.RevocationList.Replace(list)
+		}
+	}()
+
+	server := &http.Server{
+		Handler:     handler,
+		ReadTimeout: 1 * time.Minute,
+	}
 
-	peerCaFilePath := ctx.String("peer-ca-file")
-	peerCertFilePath := ctx.String("peer-cert-file")
-	peerKeyFilePath := ctx.String("peer-key-file")
-	if (peerCertFilePath != "" || peerKeyFilePath != "") && !(peerCertFilePath != "" && peerKeyFilePath != "") {
-		fmt.Fprintln(os.Stderr, "provide both -peer-cert-file and -peer-key-file")
+	fmt.Printf("Serving key service at %s\n", listenUrl.String())
+	if err := server.Serve(listener); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to serve: %s\n", err.Error())
 		os.Exit(1)
 	}
+}
+
+func loadConfig(ctx *cli.Context) (*Config, []error) {
+	config := &Config{}
+
+	configPath := ctx.String("config")
+	if configPath == "" {
+		configPath = os.Getenv(envVarName("config"))
+	}
+	if configPath != "" {
+		var err error
+		config, err = LoadConfigFile(configPath)
+		if err != nil {
+			return nil, []error{err}
+		}
+	}
+
+	errs := config.ApplyEnv()
+	return config, errs
+}
+
+func printConfigErrors(errs []error) {
+	for _, err := range errs {
+		fmt.Fprintf(os.Stderr, "ERR: %s\n", err.Error())
+	}
+}
 
-	listenCaFilePath := ctx.String("listen-ca-file")
-	listenCertFilePath := ctx.String("listen-cert-file")
-	listenKeyFilePath := ctx.String("listen-key-file")
-	if (listenCertFilePath != "" || listenKeyFilePath != "") && !(listenCertFilePath != "" && listenKeyFilePath != "") {
-		fmt.Fprintln(os.Stderr, "provide both -listen-cert-file and -listen-key-file")
+func actionStart(ctx *cli.Context) {
+	config, errs := loadConfig(ctx)
+	if len(errs) > 0 {
+		printConfigErrors(errs)
 		os.Exit(1)
 	}
 
-	discoveryInterval := ctx.Int("discovery-interval")
+	config.ApplyFlags(ctx)
 
-	readonly := ctx.Bool("readonly")
+	if errs := config.Validate(); len(errs) > 0 {
+		printConfigErrors(errs)
+		os.Exit(1)
+	}
 
-	listenUrl, err := url.Parse(ctx.String("listen"))
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "couldn't parse -listen as URL: %s\n", err.Error())
+	NewProxyStarter(config).Start()
+}
+
+func actionConfigCheck(ctx *cli.Context) {
+	if ctx.String("config") == "" && os.Getenv(envVarName("config")) == "" {
+		fmt.Fprintln(os.Stderr, "Specify -config option")
 		os.Exit(1)
 	}
-	if listenUrl.Path != "" && listenUrl.Path != "/ " {
-		fmt.Fprintf(os.Stderr, "-listen URL shouldn't include path: %s\n", listenUrl.Path)
+
+	config, errs := loadConfig(ctx)
+	if len(errs) > 0 {
+		printConfigErrors(errs)
 		os.Exit(1)
 	}
-	if !(clientCertFilePath != "" && clientKeyFilePath != "") && listenUrl.Scheme == "https" {
-		fmt.Fprintln(os.Stderr, "provide both -cert-file and -key-file when listen https")
+
+	// fill defaults
+	config.ApplyFlags(ctx)
+
+	if errs := config.Validate(); len(errs) > 0 {
+		printConfigErrors(errs)
 		os.Exit(1)
 	}
 
-	advertiseUrl := ctx.String("advertise-url")
-
-	starter := &ProxyStarter{
-		Listen:                   listenUrl,
-		keychainDir:              keychainDir,
-		DiscoverySrvDomain:       discoverySrvDomain,
-		initialBackendUrlStrings: initialBackendUrlStrings,
-		clientCaFilePath:         clientCaFilePath,
-		clientCertFilePath:       clientCertFilePath,
-		clientKeyFilePath:        clientKeyFilePath,
-		peerCaFilePath:           peerCaFilePath,
-		peerCertFilePath:         peerCertFilePath,
-		peerKeyFilePath:          peerKeyFilePath,
-		listenCaFilePath:         listenCaFilePath,
-		listenCertFilePath:       listenCertFilePath,
-		listenKeyFilePath:        listenKeyFilePath,
-		discoveryInterval:        time.Duration(discoveryInterval) * time.Second,
-		readonly:                 readonly,
-		AdvertiseUrl:             advertiseUrl,
-	}
-
-	starter.Start()
+	fmt.Println("OK")
 }
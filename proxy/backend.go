@@ -2,28 +2,186 @@ package proxy
 
 import (
 	"log"
+	"net"
 	"net/url"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 )
 
+// for testing...
+var lookupIP = net.LookupIP
+
 type Backend struct {
 	sync.Mutex
+	// Url is the URL currently used for the backend; one of Urls.
 	Url               *url.URL
+	Urls              []*url.URL
 	Available         bool
 	nextCheckInterval time.Duration
 	resumeTimer       *time.Timer
 }
 
-func NewBackend(url *url.URL) *Backend {
+// UrlPreference decides which URL to use first when a backend has multiple URLs.
+// URLs with Scheme are preferred, then URLs whose host is in Networks.
+type UrlPreference struct {
+	Scheme   string
+	Networks []*net.IPNet
+}
+
+func NewBackend(u *url.URL) *Backend {
+	return NewBackendWithUrls([]*url.URL{u})
+}
+
+func NewBackendWithUrls(urls []*url.URL) *Backend {
 	return &Backend{
-		Url:               url,
+		Url:               urls[0],
+		Urls:              urls,
 		Available:         true,
 		nextCheckInterval: time.Duration(time.Second) * 15,
 		resumeTimer:       nil,
 	}
 }
 
+// CandidateUrls returns URLs to try in order; the current URL first, then the rest.
+func (backend *Backend) CandidateUrls() []*url.URL {
+	backend.Lock()
+	defer backend.Unlock()
+
+	urls := make([]*url.URL, 0, len(backend.Urls))
+	urls = append(urls, backend.Url)
+	for _, u := range backend.Urls {
+		if u != backend.Url {
+			urls = append(urls, u)
+		}
+	}
+	return urls
+}
+
+// SwitchUrl changes the current URL, used after failing over to other URL of the same backend.
+func (backend *Backend) SwitchUrl(u *url.URL) {
+	backend.Lock()
+	defer backend.Unlock()
+
+	if backend.Url == u {
+		return
+	}
+	log.Printf("Backend %s switched to %s", backend.Url.String(), u.String())
+	backend.Url = u
+}
+
+// Prefer sorts Urls by preference and resets the current URL to the most preferred one.
+func (backend *Backend) Prefer(preference *UrlPreference) {
+	backend.Lock()
+	defer backend.Unlock()
+
+	sorter := &urlSorter{
+		urls:   backend.Urls,
+		scores: make([]int, len(backend.Urls)),
+	}
+	for i, u := range backend.Urls {
+		sorter.scores[i] = preference.score(u)
+	}
+	sort.Stable(sorter)
+
+	backend.Url = backend.Urls[0]
+}
+
+// urlSetKey returns URLs of the backend, sorted and joined, to find the same backend among discovery results.
+func (backend *Backend) urlSetKey() string {
+	backend.Lock()
+	defer backend.Unlock()
+
+	urlStrings := make([]string, len(backend.Urls))
+	for i, u := range backend.Urls {
+		urlStrings[i] = u.String()
+	}
+	sort.Strings(urlStrings)
+	return strings.Join(urlStrings, ",")
+}
+
+// inheritUrls takes the order of Urls and the current URL from previous, discovered before with the same URLs,
+// so a URL switched to by failover stays in use.
+func (backend *Backend) inheritUrls(previous *Backend) {
+	previous.Lock()
+	previousUrls := make([]string, len(previous.Urls))
+	for i, u := range previous.Urls {
+		previousUrls[i] = u.String()
+	}
+	currentUrl := previous.Url.String()
+	previous.Unlock()
+
+	backend.Lock()
+	defer backend.Unlock()
+
+	urlsByString := make(map[string]*url.URL, len(backend.Urls))
+	for _, u := range backend.Urls {
+		urlsByString[u.String()] = u
+	}
+	urls := make([]*url.URL, len(previousUrls))
+	for i, urlString := range previousUrls {
+		urls[i] = urlsByString[urlString]
+	}
+	backend.Urls = urls
+	backend.Url = urlsByString[currentUrl]
+}
+
+func (preference *UrlPreference) score(u *url.URL) int {
+	score := 0
+
+	if preference.Scheme != "" && u.Scheme == preference.Scheme {
+		score += 2
+	}
+
+	if len(preference.Networks) > 0 {
+		host, _, err := net.SplitHostPort(u.Host)
+		if err != nil {
+			host = u.Host
+		}
+
+		var ips []net.IP
+		if ip := net.ParseIP(host); ip != nil {
+			ips = []net.IP{ip}
+		} else {
+			ips, err = lookupIP(host)
+			if err != nil {
+				log.Printf("error when looking up %s: %s", host, err.Error())
+			}
+		}
+
+	networkLoop:
+		for _, network := range preference.Networks {
+			for _, ip := range ips {
+				if network.Contains(ip) {
+					score += 1
+					break networkLoop
+				}
+			}
+		}
+	}
+
+	return score
+}
+
+type urlSorter struct {
+	urls   []*url.URL
+	scores []int
+}
+
+func (sorter *urlSorter) Len() int {
+	return len(sorter.urls)
+}
+
+func (sorter *urlSorter) Less(i, j int) bool {
+	return sorter.scores[i] > sorter.scores[j]
+}
+
+func (sorter *urlSorter) Swap(i, j int) {
+	sorter.urls[i], sorter.urls[j] = sorter.urls[j], sorter.urls[i]
+	sorter.scores[i], sorter.scores[j] = sorter.scores[j], sorter.scores[i]
+}
+
 func (backend *Backend) Fail() {
 	backend.Lock()
 	defer backend.Unlock()
@@ -0,0 +1,103 @@
+package proxy
+
+import (
+	"net"
+	"net/url"
+	"testing"
+)
+
+func parseUrlsForTest(urlStrings ...string) []*url.URL {
+	urls := make([]*url.URL, 0, len(urlStrings))
+	for _, urlString := range urlStrings {
+		u, err := url.Parse(urlString)
+		if err != nil {
+			panic(err)
+		}
+		urls = append(urls, u)
+	}
+	return urls
+}
+
+func TestNewBackendWithUrls(t *testing.T) {
+	backend := NewBackendWithUrls(parseUrlsForTest("http://a:2379", "https://b:2379"))
+
+	if backend.Url.String() != "http://a:2379" {
+		t.Errorf("unexpected Url %s", backend.Url.String())
+	}
+	if len(backend.Urls) != 2 {
+		t.Errorf("unexpected Urls size %d", len(backend.Urls))
+	}
+}
+
+func TestBackendCandidateUrls(t *testing.T) {
+	backend := NewBackendWithUrls(parseUrlsForTest("http://a:2379", "http://b:2379", "http://c:2379"))
+	backend.SwitchUrl(backend.Urls[1])
+
+	urls := backend.CandidateUrls()
+
+	if len(urls) != 3 {
+		t.Errorf("unexpected urls size %d", len(urls))
+		return
+	}
+	if urls[0].Host != "b:2379" {
+		t.Errorf("unexpected urls[0] %s", urls[0].String())
+	}
+	if urls[1].Host != "a:2379" {
+		t.Errorf("unexpected urls[1] %s", urls[1].String())
+	}
+	if urls[2].Host != "c:2379" {
+		t.Errorf("unexpected urls[2] %s", urls[2].String())
+	}
+}
+
+func TestBackendPreferScheme(t *testing.T) {
+	backend := NewBackendWithUrls(parseUrlsForTest("http://10.0.0.1:2379", "https://10.0.0.1:2379"))
+
+	backend.Prefer(&UrlPreference{Scheme: "https"})
+
+	if backend.Url.String() != "https://10.0.0.1:2379" {
+		t.Errorf("unexpected Url %s", backend.Url.String())
+	}
+	if backend.Urls[1].String() != "http://10.0.0.1:2379" {
+		t.Errorf("unexpected Urls[1] %s", backend.Urls[1].String())
+	}
+}
+
+func TestBackendPreferNetwork(t *testing.T) {
+	lookupIP = func(host string) ([]net.IP, error) {
+		if host == "internal" {
+			return []net.IP{net.ParseIP("192.168.0.1")}, nil
+		}
+		return []net.IP{net.ParseIP("203.0.113.1")}, nil
+	}
+	defer func() { lookupIP = net.LookupIP }()
+
+	_, network, _ := net.ParseCIDR("192.168.0.0/16")
+	backend := NewBackendWithUrls(parseUrlsForTest("http://external:2379", "http://10.0.0.1:2379", "http://internal:2379", "http://192.168.1.1:2379"))
+
+	backend.Prefer(&UrlPreference{Networks: []*net.IPNet{network}})
+
+	if backend.Url.String() != "http://internal:2379" {
+		t.Errorf("unexpected Url %s", backend.Url.String())
+	}
+	if backend.Urls[1].String() != "http://192.168.1.1:2379" {
+		t.Errorf("unexpected Urls[1] %s", backend.Urls[1].String())
+	}
+	if backend.Urls[2].String() != "http://external:2379" {
+		t.Errorf("unexpected Urls[2] %s", backend.Urls[2].String())
+	}
+}
+
+func TestBackendPreferSchemeOverNetwork(t *testing.T) {
+	_, network, _ := net.ParseCIDR("10.0.0.0/8")
+	backend := NewBackendWithUrls(parseUrlsForTest("http://10.0.0.1:2379", "https://192.168.0.1:2379", "https://10.0.0.1:2379"))
+
+	backend.Prefer(&UrlPreference{Scheme: "https", Networks: []*net.IPNet{network}})
+
+	if backend.Url.String() != "https://10.0.0.1:2379" {
+		t.Errorf("unexpected Url %s", backend.Url.String())
+	}
+	if backend.Urls[1].String() != "https://192.168.0.1:2379" {
+		t.Errorf("unexpected Urls[1] %s", backend.Urls[1].String())
+	}
+}
@@ -2,14 +2,21 @@ package proxy
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
 	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
 )
 
+var ErrDiscoveryUrlNotFound = errors.New("discovery url returned no registrations")
+
 // for testing...
 var lookupSRV = net.LookupSRV
 
@@ -23,6 +30,17 @@ type etcdMembers struct {
 	Members []etcdMember
 }
 
+type discoveryNode struct {
+	Key   string
+	Value string
+	Dir   bool
+	Nodes []discoveryNode
+}
+
+type discoveryResponse struct {
+	Node discoveryNode
+}
+
 func DiscoverBackendsFromDns(transport *http.Transport, domain string) ([]*Backend, error) {
 	_, records, errA := lookupSRV("etcd-server", "tcp", domain)
 	if errA != nil {
@@ -119,14 +137,19 @@ func fetchBackendsFromEtcd(transport *http.Transport, urls []*url.URL, path stri
 		backends := make([]*Backend, 0, len(members))
 
 		for _, member := range members {
-			if len(member.ClientURLs) < 1 {
-				continue
+			clientUrls := make([]*url.URL, 0, len(member.ClientURLs))
+			for _, clientUrlString := range member.ClientURLs {
+				clientUrl, err := url.Parse(clientUrlString)
+				if err != nil {
+					log.Printf("ignoring invalid client url %s of member %s: %s", clientUrlString, member.Name, err.Error())
+					continue
+				}
+				clientUrls = append(clientUrls, clientUrl)
 			}
-			clientUrl, err := url.Parse(member.ClientURLs[0])
-			if err != nil {
+			if len(clientUrls) < 1 {
 				continue
 			}
-			backend := NewBackend(clientUrl)
+			backend := NewBackendWithUrls(clientUrls)
 
 			backends = append(backends, backend)
 		}
@@ -136,3 +159,208 @@ func fetchBackendsFromEtcd(transport *http.Transport, urls []*url.URL, path stri
 
 	return []*Backend{}
 }
+
+// DiscoverBackendsFromDiscoveryUrl reads member registrations (name=peerURL) under
+// etcd discovery service token directory, then fetches members from their peer URLs.
+func DiscoverBackendsFromDiscoveryUrl(discoveryTransport *http.Transport, peerTransport *http.Transport, discoveryUrl *url.URL) ([]*Backend, error) {
+	client := &http.Client{Transport: discoveryTransport}
+
+	resp, err := client.Get(discoveryUrl.String())
+	if err != nil {
+		return nil, err
+	}
+	respBody, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("discovery url %s returned status %d", discoveryUrl.String(), resp.StatusCode)
+	}
+
+	jsonData := &discoveryResponse{}
+	if err := json.Unmarshal(respBody, jsonData); err != nil {
+		return nil, err
+	}
+
+	urls := make([]*url.URL, 0, len(jsonData.Node.Nodes))
+	for _, node := range jsonData.Node.Nodes {
+		if node.Dir {
+			continue
+		}
+
+		// value may contain multiple peer urls (name=http://a:2380,name=http://b:2380)
+		for _, pair := range strings.Split(node.Value, ",") {
+			nameAndUrl := strings.SplitN(pair, "=", 2)
+			if len(nameAndUrl) < 2 {
+				log.Printf("ignoring invalid registration %s on discovery url: %#v", node.Key, node.Value)
+				continue
+			}
+			u, err := url.Parse(nameAndUrl[1])
+			if err != nil {
+				log.Printf("ignoring invalid peer url %s on discovery url: %s", nameAndUrl[1], err.Error())
+				continue
+			}
+			urls = append(urls, u)
+		}
+	}
+
+	if len(urls) == 0 {
+		return nil, ErrDiscoveryUrlNotFound
+	}
+
+	return DiscoverBackendsFromEtcdPeer(peerTransport, urls), nil
+}
+
+// FileDiscovery reads client URLs from a file (separated by newline or comma, # for comments).
+// The file is re-read only when its modification time has been changed, so
+// backends (and their failure state) are kept while the file stays the same.
+type FileDiscovery struct {
+	sync.Mutex
+	Path     string
+	modTime  time.Time
+	backends []*Backend
+	stopCh   chan bool
+}
+
+func NewFileDiscovery(path string) *FileDiscovery {
+	return &FileDiscovery{
+		Path:     path,
+		backends: nil,
+		stopCh:   nil,
+	}
+}
+
+func (discovery *FileDiscovery) Changed() bool {
+	discovery.Lock()
+	defer discovery.Unlock()
+
+	fi, err := os.Stat(discovery.Path)
+	if err != nil {
+		return discovery.backends != nil
+	}
+	return discovery.backends == nil || !fi.ModTime().Equal(discovery.modTime)
+}
+
+func (discovery *FileDiscovery) Backends() ([]*Backend, error) {
+	discovery.Lock()
+	defer discovery.Unlock()
+
+	fi, err := os.Stat(discovery.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	if discovery.backends != nil && fi.ModTime().Equal(discovery.modTime) {
+		return discovery.backends, nil
+	}
+
+	backends, err := DiscoverBackendsFromFile(discovery.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	discovery.modTime = fi.ModTime()
+	discovery.backends = backends
+
+	return backends, nil
+}
+
+// StartWatch calls callback when the file has been changed, checking at specified interval.
+func (discovery *FileDiscovery) StartWatch(interval time.Duration, callback func()) {
+	discovery.Lock()
+	defer discovery.Unlock()
+
+	if discovery.stopCh != nil {
+		return
+	}
+	discovery.stopCh = make(chan bool)
+	stopCh := discovery.stopCh
+
+	go func() {
+		for {
+			select {
+			case <-stopCh:
+				return
+			case <-time.After(interval):
+				if discovery.Changed() {
+					log.Printf("Discovery file %s has been changed", discovery.Path)
+					callback()
+				}
+			}
+		}
+	}()
+}
+
+// StopWatch stops watching. stopCh is closed rather than sent to, as the watcher may be waiting for the lock in Changed().
+func (discovery *FileDiscovery) StopWatch() {
+	discovery.Lock()
+	defer discovery.Unlock()
+
+	if discovery.stopCh != nil {
+		close(discovery.stopCh)
+		discovery.stopCh = nil
+	}
+}
+
+func DiscoverBackendsFromFile(path string) ([]*Backend, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	backends := []*Backend{}
+
+	for _, line := range strings.Split(string(content), "\n") {
+		if idx := strings.Index(line, "#"); idx != -1 {
+			line = line[0:idx]
+		}
+
+		for _, urlString := range strings.Split(line, ",") {
+			urlString = strings.TrimSpace(urlString)
+			if urlString == "" {
+				continue
+			}
+
+			u, err := url.Parse(urlString)
+			if err != nil {
+				return nil, err
+			}
+			if u.Scheme == "" || u.Host == "" {
+				return nil, fmt.Errorf("invalid backend url in %s: %s", path, urlString)
+			}
+
+			backends = append(backends, NewBackend(u))
+		}
+	}
+
+	return backends, nil
+}
+
+// PreferBackendUrls wraps updateFunc to sort URLs of each discovered backend by preference.
+// Backends discovered before with the same URLs keep their current URL, so refreshes don't undo failover.
+func PreferBackendUrls(updateFunc BackendUpdateFunc, preference *UrlPreference) BackendUpdateFunc {
+	previousBackends := map[string]*Backend{}
+
+	return func() ([]*Backend, error) {
+		backends, err := updateFunc()
+		if err != nil {
+			return nil, err
+		}
+
+		currentBackends := make(map[string]*Backend, len(backends))
+		for _, backend := range backends {
+			key := backend.urlSetKey()
+			if previous, ok := previousBackends[key]; ok {
+				backend.inheritUrls(previous)
+			} else {
+				backend.Prefer(preference)
+			}
+			currentBackends[key] = backend
+		}
+		previousBackends = currentBackends
+
+		return backends, nil
+	}
+}
@@ -4,12 +4,17 @@ import (
 	"crypto/tls"
 	"encoding/json"
 	"fmt"
+	"github.com/sorah/etcvault/etcdtest"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
+	"path"
 	"strconv"
 	"testing"
+	"time"
 )
 
 func membersMock(count int, peer bool) (server *httptest.Server, tlsServer *httptest.Server, transport *http.Transport) {
@@ -23,7 +28,7 @@ func membersMock(count int, peer bool) (server *httptest.Server, tlsServer *http
 	members := make([]memberT, 0, count)
 	for i := 0; i < count; i++ {
 		member := memberT{
-			ClientURLs: []string{fmt.Sprintf("http://member-%d:2379", i)},
+			ClientURLs: []string{fmt.Sprintf("http://member-%d:2379", i), fmt.Sprintf("https://member-%d:2379", i)},
 			PeerURLs:   []string{fmt.Sprintf("http://member-%d:2380", i)},
 			Name:       fmt.Sprintf("member-%d", i),
 			Id:         fmt.Sprintf("%x", i),
@@ -119,11 +124,76 @@ func TestDiscoverBackendsFromEtcd(t *testing.T) {
 		t.Errorf("unexpected backends[2] url %s", backends[2].Url.String())
 	}
 
+	if len(backends[0].Urls) != 2 || backends[0].Urls[1].String() != "https://member-0:2379" {
+		t.Errorf("unexpected backends[0] urls %#v", backends[0].Urls)
+	}
+
 	if u.String() != "http://node:2379" {
 		t.Errorf("url changed %s", u.String())
 	}
 }
 
+func TestPreferBackendUrls(t *testing.T) {
+	testServer, tlsServer, transport := membersMock(2, false)
+	defer testServer.Close()
+	defer tlsServer.Close()
+
+	u, err := url.Parse("http://node:2379")
+	if err != nil {
+		panic(err)
+	}
+
+	updateFunc := PreferBackendUrls(func() ([]*Backend, error) {
+		return DiscoverBackendsFromEtcd(transport, []*url.URL{u}), nil
+	}, &UrlPreference{Scheme: "https"})
+
+	backends, err := updateFunc()
+	if err != nil {
+		t.Errorf("err %s", err.Error())
+	}
+
+	if len(backends) != 2 {
+		t.Errorf("unexpected backends size %d", len(backends))
+		return
+	}
+
+	if backends[0].Url.String() != "https://member-0:2379" {
+		t.Errorf("unexpected backends[0] url %s", backends[0].Url.String())
+	}
+	if backends[1].Url.String() != "https://member-1:2379" {
+		t.Errorf("unexpected backends[1] url %s", backends[1].Url.String())
+	}
+}
+
+func TestPreferBackendUrlsKeepsFailover(t *testing.T) {
+	urlStrings := []string{"http://a:2379", "https://b:2379"}
+	updateFunc := PreferBackendUrls(func() ([]*Backend, error) {
+		return []*Backend{NewBackendWithUrls(parseUrlsForTest(urlStrings...))}, nil
+	}, &UrlPreference{Scheme: "https"})
+
+	backends, _ := updateFunc()
+	if backends[0].Url.String() != "https://b:2379" {
+		t.Errorf("unexpected url %s", backends[0].Url.String())
+	}
+
+	// failed over, then refreshed
+	backends[0].SwitchUrl(backends[0].Urls[1])
+	backends, _ = updateFunc()
+	if backends[0].Url.String() != "http://a:2379" {
+		t.Errorf("unexpected url after refresh %s", backends[0].Url.String())
+	}
+	if candidates := backends[0].CandidateUrls(); len(candidates) != 2 || candidates[1].String() != "https://b:2379" {
+		t.Errorf("unexpected candidate urls %#v", candidates)
+	}
+
+	// URLs changed: preference is applied again
+	urlStrings = []string{"http://a:2379", "https://b:2379", "https://c:2379"}
+	backends, _ = updateFunc()
+	if backends[0].Url.String() != "https://b:2379" {
+		t.Errorf("unexpected url after change %s", backends[0].Url.String())
+	}
+}
+
 func TestDiscoverBackendsFromEtcdPeer(t *testing.T) {
 	testServer, tlsServer, transport := membersMock(3, true)
 	defer testServer.Close()
@@ -266,3 +336,292 @@ func TestDiscoverBackendsFromDnsError(t *testing.T) {
 		return
 	}
 }
+
+func discoveryUrlMock(values []string) *httptest.Server {
+	nodes := make([]discoveryNode, 0, len(values))
+	for i, value := range values {
+		nodes = append(nodes, discoveryNode{
+			Key:   fmt.Sprintf("/_etcd/registry/token/%x", i),
+			Value: value,
+		})
+	}
+
+	responseJson, err := json.Marshal(map[string]interface{}{
+		"action": "get",
+		"node": map[string]interface{}{
+			"key":   "/_etcd/registry/token",
+			"dir":   true,
+			"nodes": nodes,
+		},
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	return httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, request *http.Request) {
+		if request.URL.Path == "/token" && request.Method == "GET" {
+			resp.Header().Add("Content-Type", "application/json")
+			resp.WriteHeader(200)
+			_, _ = resp.Write(responseJson)
+		} else {
+			http.Error(resp, "not found", 404)
+		}
+	}))
+}
+
+func TestDiscoverBackendsFromDiscoveryUrl(t *testing.T) {
+	testServer, tlsServer, transport := membersMock(3, true)
+	defer testServer.Close()
+	defer tlsServer.Close()
+
+	discoveryServer := discoveryUrlMock([]string{"node=http://node:2380", "invalid"})
+	defer discoveryServer.Close()
+
+	u, err := url.Parse(discoveryServer.URL + "/token")
+	if err != nil {
+		panic(err)
+	}
+
+	backends, err := DiscoverBackendsFromDiscoveryUrl(&http.Transport{}, transport, u)
+
+	if err != nil {
+		t.Errorf("err %s", err.Error())
+	}
+
+	if len(backends) != 3 {
+		t.Errorf("unexpected backends size %d", len(backends))
+		return
+	}
+
+	if backends[0].Url.String() != "http://member-0:2379" {
+		t.Errorf("unexpected backends[0] url %s", backends[0].Url.String())
+	}
+	if backends[1].Url.String() != "http://member-1:2379" {
+		t.Errorf("unexpected backends[1] url %s", backends[1].Url.String())
+	}
+	if backends[2].Url.String() != "http://member-2:2379" {
+		t.Errorf("unexpected backends[2] url %s", backends[2].Url.String())
+	}
+}
+
+func TestDiscoverBackendsFromDiscoveryUrlEmpty(t *testing.T) {
+	discoveryServer := discoveryUrlMock([]string{})
+	defer discoveryServer.Close()
+
+	u, err := url.Parse(discoveryServer.URL + "/token")
+	if err != nil {
+		panic(err)
+	}
+
+	backends, err := DiscoverBackendsFromDiscoveryUrl(&http.Transport{}, &http.Transport{}, u)
+
+	if err != ErrDiscoveryUrlNotFound {
+		t.Errorf("unexpected err %#v", err)
+	}
+	if backends != nil {
+		t.Errorf("unexpected backends %#v", backends)
+	}
+}
+
+func TestDiscoverBackendsFromDiscoveryUrlNotFound(t *testing.T) {
+	discoveryServer := discoveryUrlMock([]string{})
+	defer discoveryServer.Close()
+
+	u, err := url.Parse(discoveryServer.URL + "/unknown")
+	if err != nil {
+		panic(err)
+	}
+
+	_, err = DiscoverBackendsFromDiscoveryUrl(&http.Transport{}, &http.Transport{}, u)
+
+	if err == nil {
+		t.Errorf("unexpected success")
+	}
+}
+
+func TestDiscoverBackendsFromFile(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "discovery_test")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	filePath := path.Join(tmpDir, "backends")
+	if err := ioutil.WriteFile(filePath, []byte("# comment\nhttp://member-0:2379\n\nhttp://member-1:2379,https://member-2:2379 # trailing\n"), 0644); err != nil {
+		panic(err)
+	}
+
+	backends, err := DiscoverBackendsFromFile(filePath)
+
+	if err != nil {
+		t.Errorf("err %s", err.Error())
+	}
+
+	if len(backends) != 3 {
+		t.Errorf("unexpected backends size %d", len(backends))
+		return
+	}
+
+	if backends[0].Url.String() != "http://member-0:2379" {
+		t.Errorf("unexpected backends[0] url %s", backends[0].Url.String())
+	}
+	if backends[1].Url.String() != "http://member-1:2379" {
+		t.Errorf("unexpected backends[1] url %s", backends[1].Url.String())
+	}
+	if backends[2].Url.String() != "https://member-2:2379" {
+		t.Errorf("unexpected backends[2] url %s", backends[2].Url.String())
+	}
+}
+
+func TestDiscoverBackendsFromFileInvalid(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "discovery_test")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	filePath := path.Join(tmpDir, "backends")
+	if err := ioutil.WriteFile(filePath, []byte("member-0\n"), 0644); err != nil {
+		panic(err)
+	}
+
+	_, err = DiscoverBackendsFromFile(filePath)
+
+	if err == nil {
+		t.Errorf("unexpected success")
+	}
+}
+
+func TestFileDiscoveryReload(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "discovery_test")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	filePath := path.Join(tmpDir, "backends")
+	if err := ioutil.WriteFile(filePath, []byte("http://member-0:2379\n"), 0644); err != nil {
+		panic(err)
+	}
+
+	discovery := NewFileDiscovery(filePath)
+
+	if !discovery.Changed() {
+		t.Errorf("unexpected Changed() before first read")
+	}
+
+	backends, err := discovery.Backends()
+	if err != nil {
+		t.Errorf("err %s", err.Error())
+	}
+	if len(backends) != 1 {
+		t.Errorf("unexpected backends size %d", len(backends))
+		return
+	}
+
+	if discovery.Changed() {
+		t.Errorf("unexpected Changed() after read")
+	}
+
+	backendsAgain, _ := discovery.Backends()
+	if backendsAgain[0] != backends[0] {
+		t.Errorf("backends should be kept while file is unchanged")
+	}
+
+	if err := ioutil.WriteFile(filePath, []byte("http://member-0:2379\nhttp://member-1:2379\n"), 0644); err != nil {
+		panic(err)
+	}
+	future := time.Now().Add(time.Minute)
+	if err := os.Chtimes(filePath, future, future); err != nil {
+		panic(err)
+	}
+
+	if !discovery.Changed() {
+		t.Errorf("unexpected Changed() after file update")
+	}
+
+	backends, err = discovery.Backends()
+	if err != nil {
+		t.Errorf("err %s", err.Error())
+	}
+	if len(backends) != 2 {
+		t.Errorf("unexpected backends size %d", len(backends))
+	}
+}
+
+func TestFileDiscoveryWatch(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "discovery_test")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	filePath := path.Join(tmpDir, "backends")
+	if err := ioutil.WriteFile(filePath, []byte("http://member-0:2379\n"), 0644); err != nil {
+		panic(err)
+	}
+
+	discovery := NewFileDiscovery(filePath)
+	called := make(chan bool, 1)
+	discovery.StartWatch(time.Millisecond, func() {
+		discovery.Backends()
+		select {
+		case called <- true:
+		default:
+		}
+	})
+
+	select {
+	case <-called:
+	case <-time.After(3 * time.Second):
+		t.Fatalf("callback wasn't called")
+	}
+
+	// make the watcher wait for the lock in Changed(), then stop; StopWatch shouldn't deadlock with it
+	stopped := make(chan bool)
+	go func() {
+		discovery.Lock()
+		time.Sleep(50 * time.Millisecond)
+		discovery.Unlock()
+		discovery.StopWatch()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(3 * time.Second):
+		t.Fatalf("StopWatch didn't return")
+	}
+
+	discovery.StopWatch() // no-op when not watching
+}
+
+func TestDiscoverBackendsFromEtcdtest(t *testing.T) {
+	etcd := etcdtest.NewServer()
+	etcd.Members = []etcdtest.Member{
+		{Id: "a", Name: "a", PeerURLs: []string{"http://a:2380"}, ClientURLs: []string{"http://a:2379", "https://a:2379"}},
+		{Id: "b", Name: "b", PeerURLs: []string{"http://b:2380"}, ClientURLs: []string{"http://b:2379"}},
+	}
+	server := httptest.NewServer(etcd)
+	defer server.Close()
+
+	u, err := url.Parse(server.URL)
+	if err != nil {
+		panic(err)
+	}
+
+	for _, backends := range [][]*Backend{
+		DiscoverBackendsFromEtcd(&http.Transport{}, []*url.URL{u}),
+		DiscoverBackendsFromEtcdPeer(&http.Transport{}, []*url.URL{u}),
+	} {
+		if len(backends) != 2 {
+			t.Errorf("unexpected backends size %d", len(backends))
+			continue
+		}
+		if len(backends[0].Urls) != 2 || backends[0].Urls[1].String() != "https://a:2379" {
+			t.Errorf("unexpected backends[0] urls %#v", backends[0].Urls)
+		}
+		if backends[1].Url.String() != "http://b:2379" {
+			t.Errorf("unexpected backends[1] url %s", backends[1].Url.String())
+		}
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"io/ioutil"
 	"log"
 	"net/http"
+	"strconv"
 )
 
 type ClosableBuffer struct {
@@ -37,9 +38,12 @@ type Proxy struct {
 	Router       *Router
 	Engine       engine.Transformable
 	AdvertiseUrl string
+	// ResponseOptions is used for transforming responses; can be overridden per request with
+	// X-Etcvault-Metadata and X-Etcvault-Strict headers.
+	ResponseOptions engine.ResponseOptions
 }
 
-func NewProxy(transport *http.Transport, router *Router, e engine.Transformable, advertiseUrl string) http.Handler {
+func NewProxy(transport *http.Transport, router *Router, e engine.Transformable, advertiseUrl string) *Proxy {
 	return &Proxy{
 		Transport:    transport,
 		Router:       router,
@@ -55,25 +59,23 @@ func (proxy *Proxy) ServeHTTP(response http.ResponseWriter, request *http.Reques
 		proxy.serveMachinesRequest(response, request)
 	} else if request.URL.Path == "/_etcvault/keys" {
 		proxy.serveEtcvaultKeysRequest(response, request)
+	} else if _, ok := v3Endpoint(request.URL.Path); ok {
+		proxy.serveV3Request(response, request)
 	} else {
 		proxy.serveProxyRequest(response, request)
 	}
 }
 
 func (proxy *Proxy) serveProxyRequest(response http.ResponseWriter, request *http.Request) {
-	backendRequest := new(http.Request)
-	// copy
-	*backendRequest = *request
-	backendRequest.Header = make(http.Header)
-
-	backendRequest.Proto = "HTTP/1.1"
-	backendRequest.ProtoMajor = 1
-	backendRequest.ProtoMinor = 1
-	backendRequest.Close = false
+	options, err := proxy.responseOptions(request)
+	if err != nil {
+		http.Error(response, err.Error(), 400)
+		return
+	}
 
-	copyHeader(request.Header, backendRequest.Header)
-	removeSingleHopHeaders(&backendRequest.Header)
+	backendRequest := newBackendRequest(request)
 
+	var body []byte
 	if (backendRequest.Method == "POST" || backendRequest.Method == "PUT" || backendRequest.Method == "PATCH") && backendRequest.Body != nil {
 		origBody := backendRequest.Body
 		defer origBody.Close()
@@ -86,20 +88,109 @@ func (proxy *Proxy) serveProxyRequest(response http.ResponseWriter, request *htt
 
 		if backendRequest.PostForm != nil {
 			origValue := backendRequest.PostForm.Get("value")
-			value, err := proxy.Engine.Transform(origValue)
+			value, err := proxy.Engine.TransformForWrite(origValue)
 			if err == nil {
 				backendRequest.PostForm.Set("value", value)
 			} else {
 				log.Printf("failed to transform value: %s", err.Error())
 			}
-			newFormString := backendRequest.PostForm.Encode()
-			backendRequest.Body = ClosableBuffer{bytes.NewBufferString(newFormString)}
-			backendRequest.ContentLength = int64(len(newFormString))
+			body = []byte(backendRequest.PostForm.Encode())
+		}
+	}
+
+	closedCh, complete := proxy.cancelOnClientClose(response, backendRequest)
+	defer complete()
+
+	backendResponse := proxy.roundTripBackends(backendRequest, body)
+	if backendResponse == nil {
+		log.Printf("all backends not available...")
+		http.Error(response, "backends all unavailable", http.StatusBadGateway)
+		return
+	}
+
+	defer backendResponse.Body.Close()
+
+	removeSingleHopHeaders(&backendResponse.Header)
+	copyHeader(backendResponse.Header, response.Header())
+
+	if backendResponse.Header.Get("Content-Type") == "application/json" {
+		json, err := ioutil.ReadAll(backendResponse.Body)
+		if isClosed(closedCh) {
+			return
+		}
+		if err != nil {
+			panic(err)
+		}
+
+		transformedJson, err := proxy.Engine.TransformEtcdJsonResponseWithOptions(json, options)
+		if err != nil {
+			if options.Strict {
+				respondTransformFailure(response, err)
+				return
+			}
+			log.Printf("transform error %s", err.Error())
+			transformedJson = json
 		}
+		response.Header().Set("Content-Length", fmt.Sprintf("%d", len(transformedJson)))
+		response.WriteHeader(backendResponse.StatusCode)
+		response.Write(transformedJson)
+	} else {
+		response.WriteHeader(backendResponse.StatusCode)
+		io.Copy(response, backendResponse.Body)
 	}
+}
 
-	var backendResponse *http.Response
+// responseOptions returns options for transforming responses, applying X-Etcvault-Metadata and
+// X-Etcvault-Strict headers of request to the defaults.
+func (proxy *Proxy) responseOptions(request *http.Request) (engine.ResponseOptions, error) {
+	options := proxy.ResponseOptions
 
+	if header := request.Header.Get("X-Etcvault-Metadata"); header != "" {
+		metadata, err := strconv.ParseBool(header)
+		if err != nil {
+			return options, fmt.Errorf("invalid X-Etcvault-Metadata header: %s", header)
+		}
+		options.OmitMetadata = !metadata
+	}
+	if header := request.Header.Get("X-Etcvault-Strict"); header != "" {
+		strict, err := strconv.ParseBool(header)
+		if err != nil {
+			return options, fmt.Errorf("invalid X-Etcvault-Strict header: %s", header)
+		}
+		options.Strict = strict
+	}
+
+	return options, nil
+}
+
+// respondTransformFailure responds an error for a response couldn't be transformed in strict mode,
+// instead of the backend response.
+func respondTransformFailure(response http.ResponseWriter, err error) {
+	log.Printf("transform error %s", err.Error())
+	response.Header().Del("Content-Length")
+	http.Error(response, err.Error(), http.StatusInternalServerError)
+}
+
+func newBackendRequest(request *http.Request) *http.Request {
+	backendRequest := new(http.Request)
+	// copy
+	*backendRequest = *request
+	backendRequest.Header = make(http.Header)
+
+	backendRequest.Proto = "HTTP/1.1"
+	backendRequest.ProtoMajor = 1
+	backendRequest.ProtoMinor = 1
+	backendRequest.Close = false
+
+	copyHeader(request.Header, backendRequest.Header)
+	removeSingleHopHeaders(&backendRequest.Header)
+
+	return backendRequest
+}
+
+// cancelOnClientClose cancels backendRequest when the client connection is closed before complete is called.
+// closedCh is closed on cancellation.
+func (proxy *Proxy) cancelOnClientClose(response http.ResponseWriter, backendRequest *http.Request) (closedCh <-chan struct{}, complete func()) {
 	var closeNotifyCh <-chan bool
 	closeNotifier, ok := response.(http.CloseNotifier)
 	if ok {
@@ -108,75 +199,65 @@ func (proxy *Proxy) serveProxyRequest(response http.ResponseWriter, request *htt
 		closeNotifyCh = make(<-chan bool)
 	}
 
-	completeCh := make(chan bool, 2)
-	closed := false
+	closed := make(chan struct{})
+	completeCh := make(chan struct{})
 	go func() {
 		select {
 		case <-closeNotifyCh:
 			log.Printf("Request connection closed; cancelling ongoing backend request")
-			closed = true
+			close(closed)
 			proxy.Transport.CancelRequest(backendRequest)
 		case <-completeCh:
 		}
-		if backendResponse != nil {
-			backendResponse.Body.Close()
-		}
-	}()
-	defer func() {
-		completeCh <- true
 	}()
 
+	return closed, func() { close(completeCh) }
+}
+
+func isClosed(closedCh <-chan struct{}) bool {
+	select {
+	case <-closedCh:
+		return true
+	default:
+		return false
+	}
+}
+
+// roundTripBackends sends backendRequest to available backends in turn, and returns the first response.
+// When body is not nil, it is sent as a request body on each attempt. Returns nil when all backends failed.
+func (proxy *Proxy) roundTripBackends(backendRequest *http.Request, body []byte) *http.Response {
 	backends := proxy.Router.ShuffledAvailableBackends()
 	for _, backend := range backends {
-		backendRequest.URL.Scheme = backend.Url.Scheme
-		backendRequest.URL.Host = backend.Url.Host
+		var backendResponse *http.Response
+		// try all URLs of the member before moving to another member
+		for _, u := range backend.CandidateUrls() {
+			backendRequest.URL.Scheme = u.Scheme
+			backendRequest.URL.Host = u.Host
+			if body != nil {
+				backendRequest.Body = ClosableBuffer{bytes.NewBuffer(body)}
+				backendRequest.ContentLength = int64(len(body))
+			}
 
-		var err error
-		backendResponse, err = proxy.Transport.RoundTrip(backendRequest)
-		if err != nil {
-			log.Printf("backend %s response error: %s", backend.Url.String(), err.Error())
+			var err error
+			backendResponse, err = proxy.Transport.RoundTrip(backendRequest)
+			if err != nil {
+				log.Printf("backend %s response error: %s", u.String(), err.Error())
+				backendResponse = nil
+				continue
+			}
+			backend.SwitchUrl(u)
+			break
+		}
+
+		if backendResponse == nil {
 			backend.Fail()
 			continue
 		}
 		backend.Ok()
-		break
-	}
-
-	if backendResponse == nil {
-		log.Printf("all backends not available...")
-		http.Error(response, "backends all unavailable", http.StatusBadGateway)
-		return
+		return backendResponse
 	}
 
-	defer backendResponse.Body.Close()
-
-	removeSingleHopHeaders(&backendResponse.Header)
-	copyHeader(backendResponse.Header, response.Header())
-
-	if backendResponse.Header.Get("Content-Type") == "application/json" {
-		json, err := ioutil.ReadAll(backendResponse.Body)
-		if closed {
-			return
-		}
-		if err != nil {
-			panic(err)
-		}
-
-		transformedJson, err := proxy.Engine.TransformEtcdJsonResponse(json)
-		if err == nil {
-			response.Header().Set("Content-Length", fmt.Sprintf("%d", len(transformedJson)+1))
-			response.WriteHeader(backendResponse.StatusCode)
-			response.Write(transformedJson)
-			response.Write([]byte("\n"))
-		} else {
-			fmt.Printf("transform error %s\n", err.Error())
-			response.WriteHeader(backendResponse.StatusCode)
-			response.Write(json)
-		}
-	} else {
-		response.WriteHeader(backendResponse.StatusCode)
-		io.Copy(response, backendResponse.Body)
-	}
+	return nil
 }
 
 func (proxy *Proxy) serveMembersRequest(response http.ResponseWriter, request *http.Request) {
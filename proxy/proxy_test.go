@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/sorah/etcvault/engine"
+	"github.com/sorah/etcvault/etcdtest"
 	"math/rand"
 	"net/http"
 	"net/http/httptest"
@@ -23,6 +24,14 @@ func (e *mockEngine) Transform(str string) (string, error) {
 	return fmt.Sprintf("<%s>", str), nil
 }
 
+func (e *mockEngine) TransformWithPath(str string, path string) (string, error) {
+	return e.Transform(str)
+}
+
+func (e *mockEngine) TransformForWrite(str string) (string, error) {
+	return e.Transform(str)
+}
+
 func etcdMock(notify func(request *http.Request)) (cancel func(), serverUrl *url.URL, deadServerUrl *url.URL, deadServer *httptest.Server, transport *http.Transport) {
 	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, request *http.Request) {
 		_ = request.ParseForm()
@@ -255,6 +264,41 @@ func TestProxyBackendRetry(t *testing.T) {
 	}
 }
 
+func TestProxyBackendUrlFailover(t *testing.T) {
+	cancel, serverURL, deadServerURL, deadServer, transport := etcdMock(func(request *http.Request) {
+	})
+	defer cancel()
+	deadServer.Close()
+
+	backend := NewBackendWithUrls([]*url.URL{deadServerURL, serverURL})
+	otherBackend := NewBackend(deadServerURL)
+	otherBackend.Available = false
+	backends := []*Backend{
+		backend,
+		otherBackend,
+	}
+
+	router := NewRouter(time.Hour*24, func() ([]*Backend, error) {
+		return backends, nil
+	})
+
+	proxyHandler := NewProxy(transport, router, &mockEngine{}, "http://localhost:2381")
+
+	request, _ := http.NewRequest("GET", "http://localhost/v2/keys/greeting", nil)
+	recorder := httptest.NewRecorder()
+	proxyHandler.ServeHTTP(recorder, request)
+
+	if recorder.Code != 200 {
+		t.Errorf("unexpected response code: %d", recorder.Code)
+	}
+	if !backend.Available {
+		t.Errorf("unexpected backend unavailable")
+	}
+	if backend.Url != serverURL {
+		t.Errorf("backend url should be switched to alive one: %s", backend.Url.String())
+	}
+}
+
 func TestProxyBackendFailureBackendNoRequest(t *testing.T) {
 	cancel, serverURL, deadServerURL, _, transport := etcdMock(func(request *http.Request) {
 		if request.URL.Host == "dead" {
@@ -320,7 +364,7 @@ func TestProxyInvalidJsonResponse(t *testing.T) {
 	if recorder.Code != 200 {
 		t.Errorf("unexpected response code: %d", recorder.Code)
 	}
-	if recorder.Body.String() != "{\"action\":\"create\",\"node\":{\"key\":\"\n" {
+	if recorder.Body.String() != "{\"action\":\"create\",\"node\":{\"key\":\"" {
 		t.Errorf("unexpected response body: %#v", recorder.Body.String())
 	}
 	if header := recorder.Header().Get("Content-Type"); header != "application/json" {
@@ -534,3 +578,239 @@ func TestProxyMachines(t *testing.T) {
 		t.Errorf("unexpected response body: %s", recorder.Body.String())
 	}
 }
+
+func etcdtestProxy() (etcd *etcdtest.Server, proxyHandler http.Handler, cancel func()) {
+	etcd = etcdtest.NewServer()
+	server := httptest.NewServer(etcd)
+	serverURL, _ := url.Parse(server.URL)
+
+	router := NewRouter(time.Hour*24, func() ([]*Backend, error) {
+		return []*Backend{NewBackend(serverURL)}, nil
+	})
+	router.Update()
+
+	return etcd, NewProxy(&http.Transport{}, router, &mockEngine{}, "http://localhost:2381"), server.Close
+}
+
+func TestProxyEtcdRecursiveGet(t *testing.T) {
+	etcd, proxyHandler, cancel := etcdtestProxy()
+	defer cancel()
+
+	etcd.Set("/app/a", "A")
+	etcd.Set("/app/sub/b", "B")
+
+	request, _ := http.NewRequest("GET", "http://localhost/v2/keys/app?recursive=true", nil)
+	recorder := httptest.NewRecorder()
+	proxyHandler.ServeHTTP(recorder, request)
+
+	if recorder.Code != 200 {
+		t.Errorf("unexpected response code: %d", recorder.Code)
+	}
+	if recorder.Header().Get("X-Etcd-Index") != "2" {
+		t.Errorf("unexpected X-Etcd-Index: %s", recorder.Header().Get("X-Etcd-Index"))
+	}
+	// etcd terminates JSON with a newline, and it's kept as is
+	if !strings.HasSuffix(recorder.Body.String(), "}\n") {
+		t.Errorf("unexpected response body: %#v", recorder.Body.String())
+	}
+	if header := recorder.Header().Get("Content-Length"); header != fmt.Sprintf("%d", recorder.Body.Len()) {
+		t.Errorf("unexpected Content-Length: %s", header)
+	}
+
+	body := struct {
+		Node struct {
+			Nodes []struct {
+				Key   string
+				Value string
+				Nodes []struct {
+					Key   string
+					Value string
+				}
+			}
+		}
+	}{}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &body); err != nil {
+		t.Fatalf("unexpected error %#v", err)
+	}
+	nodes := body.Node.Nodes
+	if len(nodes) != 2 || nodes[0].Value != "A" || len(nodes[1].Nodes) != 1 || nodes[1].Nodes[0].Value != "B" {
+		t.Errorf("unexpected response body: %s", recorder.Body.String())
+	}
+}
+
+func TestProxyEtcdCompareAndSwap(t *testing.T) {
+	etcd, proxyHandler, cancel := etcdtestProxy()
+	defer cancel()
+
+	etcd.Set("/greeting", "hello")
+
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest("PUT", "http://localhost/v2/keys/greeting?prevIndex=42", bytes.NewBufferString("value=hola"))
+	request.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	proxyHandler.ServeHTTP(recorder, request)
+
+	if recorder.Code != 412 {
+		t.Errorf("unexpected response code: %d", recorder.Code)
+	}
+	if value, _ := etcd.Get("/greeting"); value != "hello" {
+		t.Errorf("unexpected value: %s", value)
+	}
+
+	recorder = httptest.NewRecorder()
+	request, _ = http.NewRequest("PUT", "http://localhost/v2/keys/greeting?prevIndex=1", bytes.NewBufferString("value=hola"))
+	request.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	proxyHandler.ServeHTTP(recorder, request)
+
+	if recorder.Code != 200 {
+		t.Errorf("unexpected response code: %d", recorder.Code)
+	}
+	if value, _ := etcd.Get("/greeting"); value != "<hola>" {
+		t.Errorf("unexpected value: %s", value)
+	}
+}
+
+func TestProxyEtcdWatch(t *testing.T) {
+	etcd, proxyHandler, cancel := etcdtestProxy()
+	defer cancel()
+
+	etcd.Set("/app/a", "A")
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		request, _ := http.NewRequest("GET", "http://localhost/v2/keys/app?wait=true&recursive=true&waitIndex=2", nil)
+		recorder := httptest.NewRecorder()
+		proxyHandler.ServeHTTP(recorder, request)
+		done <- recorder
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	etcd.Set("/app/a", "A2")
+
+	select {
+	case recorder := <-done:
+		if recorder.Code != 200 {
+			t.Errorf("unexpected response code: %d", recorder.Code)
+		}
+		if !strings.Contains(recorder.Body.String(), `"value":"A2"`) {
+			t.Errorf("unexpected response body: %s", recorder.Body.String())
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("watch didn't return")
+	}
+}
+
+func TestProxyEtcdCompareFailedRedacted(t *testing.T) {
+	etcd, proxyHandler, cancel := etcdtestProxy()
+	defer cancel()
+
+	etcd.Set("/greeting", "ETCVAULT::1:the-key::c2VjcmV0::ETCVAULT")
+
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest("PUT", "http://localhost/v2/keys/greeting?prevValue=hello", bytes.NewBufferString("value=hola"))
+	request.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	proxyHandler.ServeHTTP(recorder, request)
+
+	if recorder.Code != 412 {
+		t.Errorf("unexpected response code: %d", recorder.Code)
+	}
+	if body := recorder.Body.String(); strings.Contains(body, "c2VjcmV0") || !strings.Contains(body, `"cause":"[hello != ETCVAULT::redacted::ETCVAULT]"`) {
+		t.Errorf("unexpected response body: %s", body)
+	}
+}
+
+func TestProxyEtcdResponseOptions(t *testing.T) {
+	etcd, proxyHandler, cancel := etcdtestProxy()
+	defer cancel()
+	proxy := proxyHandler.(*Proxy)
+
+	etcd.Set("/app/a", "ETCVAULT::asis:A::ETCVAULT")
+	etcd.Set("/app/b", "ETCVAULT::plain1::ETCVAULT")
+
+	tests := []struct {
+		Name     string
+		Defaults engine.ResponseOptions
+		Headers  map[string]string
+		Code     int
+		Contains []string
+		Excludes []string
+	}{
+		{
+			Name:     "default",
+			Code:     200,
+			Contains: []string{`"_etcvault":`, `"_etcvault_error":`, `"value":"A"`},
+		},
+		{
+			Name:     "metadata disabled by header",
+			Headers:  map[string]string{"X-Etcvault-Metadata": "false"},
+			Code:     200,
+			Contains: []string{`"value":"A"`, `"value":"ETCVAULT::plain1::ETCVAULT"`},
+			Excludes: []string{`"_etcvault`},
+		},
+		{
+			Name:     "metadata disabled by default, enabled by header",
+			Defaults: engine.ResponseOptions{OmitMetadata: true},
+			Headers:  map[string]string{"X-Etcvault-Metadata": "true"},
+			Code:     200,
+			Contains: []string{`"_etcvault":`},
+		},
+		{
+			Name:     "strict by header",
+			Headers:  map[string]string{"X-Etcvault-Strict": "true"},
+			Code:     500,
+			Contains: []string{"couldn't transform value of /app/b"},
+			Excludes: []string{"ETCVAULT::plain1::ETCVAULT"},
+		},
+		{
+			Name:     "strict by default, disabled by header",
+			Defaults: engine.ResponseOptions{Strict: true},
+			Headers:  map[string]string{"X-Etcvault-Strict": "false"},
+			Code:     200,
+		},
+		{
+			Name:    "invalid header",
+			Headers: map[string]string{"X-Etcvault-Strict": "maybe"},
+			Code:    400,
+		},
+	}
+
+	for _, test := range tests {
+		proxy.ResponseOptions = test.Defaults
+
+		request, _ := http.NewRequest("GET", "http://localhost/v2/keys/app?recursive=true", nil)
+		for name, value := range test.Headers {
+			request.Header.Set(name, value)
+		}
+		recorder := httptest.NewRecorder()
+		proxy.ServeHTTP(recorder, request)
+
+		if recorder.Code != test.Code {
+			t.Errorf("%s: unexpected response code: %d", test.Name, recorder.Code)
+		}
+		for _, str := range test.Contains {
+			if !strings.Contains(recorder.Body.String(), str) {
+				t.Errorf("%s: unexpected response body: %s", test.Name, recorder.Body.String())
+			}
+		}
+		for _, str := range test.Excludes {
+			if strings.Contains(recorder.Body.String(), str) {
+				t.Errorf("%s: unexpected response body: %s", test.Name, recorder.Body.String())
+			}
+		}
+	}
+}
+
+func TestProxyV3Strict(t *testing.T) {
+	etcd, proxyHandler, cancel := etcdtestProxy()
+	defer cancel()
+
+	etcd.PutV3("/a", "ETCVAULT::plain1::ETCVAULT")
+
+	request, _ := http.NewRequest("POST", "http://localhost/v3/kv/range", strings.NewReader(`{"key":"L2E="}`))
+	request.Header.Set("X-Etcvault-Strict", "true")
+	recorder := httptest.NewRecorder()
+	proxyHandler.ServeHTTP(recorder, request)
+
+	if recorder.Code != 500 {
+		t.Errorf("unexpected response code: %d", recorder.Code)
+	}
+}
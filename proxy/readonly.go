@@ -6,12 +6,13 @@ import (
 )
 
 func NewReadonlyProxy(transport *http.Transport, router *Router, e engine.Transformable, advertiseUrl string) http.Handler {
-	return readonlyHandler(NewProxy(transport, router, e, advertiseUrl))
+	return ReadonlyHandler(NewProxy(transport, router, e, advertiseUrl))
 }
 
-func readonlyHandler(handler http.Handler) http.Handler {
+// ReadonlyHandler rejects requests to handler which may modify the data.
+func ReadonlyHandler(handler http.Handler) http.Handler {
 	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
-		if request.Method != "GET" {
+		if request.Method != "GET" && !(request.Method == "POST" && isV3ReadonlyEndpoint(request.URL.Path)) {
 			// I prefer method not allowed, but following etcd's proxy mode behavior for compat
 			response.WriteHeader(http.StatusNotImplemented)
 			return
@@ -67,3 +67,34 @@ func TestReadonlyProxyPost(t *testing.T) {
 		t.Errorf("unexpected response code: %d", recorder.Code)
 	}
 }
+
+func TestReadonlyProxyV3(t *testing.T) {
+	etcd, proxyHandler, cancel := etcdtestProxy()
+	defer cancel()
+	proxyHandler = ReadonlyHandler(proxyHandler)
+	etcd.PutV3("/greeting", "hello")
+
+	tests := []struct {
+		Path string
+		Code int
+	}{
+		{"/v3/kv/range", 200},
+		{"/v3/watch", 400}, // etcdtest requires create_request
+		{"/v3/kv/put", 501},
+		{"/v3/kv/deleterange", 501},
+	}
+
+	for _, test := range tests {
+		request, _ := http.NewRequest("POST", "http://localhost"+test.Path, strings.NewReader(`{"key":"L2dyZWV0aW5n","value":"aG9sYQ=="}`))
+		recorder := httptest.NewRecorder()
+		proxyHandler.ServeHTTP(recorder, request)
+
+		if recorder.Code != test.Code {
+			t.Errorf("%s: unexpected response code: %d", test.Path, recorder.Code)
+		}
+	}
+
+	if value, _ := etcd.GetV3("/greeting"); value != "hello" {
+		t.Errorf("unexpected value: %s", value)
+	}
+}
@@ -0,0 +1,226 @@
+package proxy
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/sorah/etcvault/engine"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// Path prefixes of etcd v3 JSON gateway (grpc-gateway); older etcd releases serve v3alpha and v3beta.
+var v3Prefixes = []string{"/v3/", "/v3beta/", "/v3alpha/"}
+
+// v3Endpoint returns an endpoint name of v3 JSON gateway (e.g. "kv/range") for path.
+func v3Endpoint(path string) (string, bool) {
+	for _, prefix := range v3Prefixes {
+		if strings.HasPrefix(path, prefix) {
+			return strings.TrimPrefix(path, prefix), true
+		}
+	}
+	return "", false
+}
+
+// isV3ReadonlyEndpoint returns true for v3 endpoints which don't modify the data, though requested with POST.
+func isV3ReadonlyEndpoint(path string) bool {
+	endpoint, ok := v3Endpoint(path)
+	return ok && (endpoint == "kv/range" || endpoint == "watch")
+}
+
+type v3PutRequest struct {
+	Value string `json:"value"`
+}
+
+func (proxy *Proxy) serveV3Request(response http.ResponseWriter, request *http.Request) {
+	endpoint, _ := v3Endpoint(request.URL.Path)
+	options, err := proxy.responseOptions(request)
+	if err != nil {
+		http.Error(response, err.Error(), 400)
+		return
+	}
+
+	backendRequest := newBackendRequest(request)
+
+	var body []byte
+	if backendRequest.Body != nil {
+		defer backendRequest.Body.Close()
+
+		body, err = ioutil.ReadAll(backendRequest.Body)
+		if err != nil {
+			log.Printf("couldn't read request body: %s", err.Error())
+			http.Error(response, "couldn't read request body", 400)
+			return
+		}
+
+		var transformedBody []byte
+		switch endpoint {
+		case "kv/put":
+			transformedBody, err = proxy.transformV3PutRequest(body)
+		case "kv/txn":
+			transformedBody, err = proxy.transformV3TxnRequest(body)
+		}
+		if transformedBody != nil {
+			body = transformedBody
+		} else if err != nil {
+			log.Printf("failed to transform value: %s", err.Error())
+		}
+	}
+
+	closedCh, complete := proxy.cancelOnClientClose(response, backendRequest)
+	defer complete()
+
+	backendResponse := proxy.roundTripBackends(backendRequest, body)
+	if backendResponse == nil {
+		log.Printf("all backends not available...")
+		http.Error(response, "backends all unavailable", http.StatusBadGateway)
+		return
+	}
+
+	defer backendResponse.Body.Close()
+
+	removeSingleHopHeaders(&backendResponse.Header)
+	copyHeader(backendResponse.Header, response.Header())
+
+	isJson := strings.HasPrefix(backendResponse.Header.Get("Content-Type"), "application/json")
+	switch {
+	case isJson && endpoint == "watch":
+		proxy.streamV3WatchResponse(response, backendResponse, options)
+	case isJson && (endpoint == "kv/range" || endpoint == "kv/put" || endpoint == "kv/deleterange" || endpoint == "kv/txn"):
+		json, err := ioutil.ReadAll(backendResponse.Body)
+		if isClosed(closedCh) {
+			return
+		}
+		if err != nil {
+			log.Printf("couldn't read backend response: %s", err.Error())
+			http.Error(response, "couldn't read backend response", http.StatusBadGateway)
+			return
+		}
+
+		transformedJson, err := proxy.Engine.TransformEtcdV3JsonResponseWithOptions(json, options)
+		if err != nil {
+			if options.Strict {
+				respondTransformFailure(response, err)
+				return
+			}
+			log.Printf("transform error %s", err.Error())
+			transformedJson = json
+		}
+		response.Header().Set("Content-Length", fmt.Sprintf("%d", len(transformedJson)))
+		response.WriteHeader(backendResponse.StatusCode)
+		response.Write(transformedJson)
+	default:
+		response.WriteHeader(backendResponse.StatusCode)
+		io.Copy(response, backendResponse.Body)
+	}
+}
+
+// transformV3PutRequest encrypts a value in a request body of /v3/kv/put. Keys and values are base64 encoded.
+func (proxy *Proxy) transformV3PutRequest(body []byte) ([]byte, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return nil, err
+	}
+	var put v3PutRequest
+	if err := json.Unmarshal(body, &put); err != nil {
+		return nil, err
+	}
+
+	value, err := base64.StdEncoding.DecodeString(put.Value)
+	if err != nil {
+		return nil, err
+	}
+
+	newValue, err := proxy.Engine.TransformForWrite(string(value))
+	if err != nil {
+		return nil, err
+	}
+
+	encodedValue, err := json.Marshal(base64.StdEncoding.EncodeToString([]byte(newValue)))
+	if err != nil {
+		return nil, err
+	}
+	fields["value"] = encodedValue // other fields (e.g. lease, prev_kv) are kept as is
+
+	return json.Marshal(fields)
+}
+
+// transformV3TxnRequest encrypts values of request_put in success and failure of a request body of /v3/kv/txn,
+// recursively for nested request_txn. Compares are kept as is; they're evaluated against values stored in etcd.
+func (proxy *Proxy) transformV3TxnRequest(body []byte) ([]byte, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return nil, err
+	}
+
+	for _, name := range []string{"success", "failure"} {
+		if _, ok := fields[name]; !ok {
+			continue
+		}
+		var ops []map[string]json.RawMessage
+		if err := json.Unmarshal(fields[name], &ops); err != nil {
+			return nil, err
+		}
+
+		for _, op := range ops {
+			var err error
+			if put, ok := op["request_put"]; ok {
+				op["request_put"], err = proxy.transformV3PutRequest(put)
+			} else if txn, ok := op["request_txn"]; ok {
+				op["request_txn"], err = proxy.transformV3TxnRequest(txn)
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		encodedOps, err := json.Marshal(ops)
+		if err != nil {
+			return nil, err
+		}
+		fields[name] = encodedOps
+	}
+
+	return json.Marshal(fields)
+}
+
+// streamV3WatchResponse transforms each message of /v3/watch response stream and flushes it.
+// In strict mode, the stream is closed on a message couldn't be transformed, as the status has been sent.
+func (proxy *Proxy) streamV3WatchResponse(response http.ResponseWriter, backendResponse *http.Response, options engine.ResponseOptions) {
+	response.Header().Del("Content-Length")
+	response.WriteHeader(backendResponse.StatusCode)
+	flusher, _ := response.(http.Flusher)
+	if flusher != nil {
+		flusher.Flush()
+	}
+
+	decoder := json.NewDecoder(backendResponse.Body)
+	for {
+		var message json.RawMessage
+		if err := decoder.Decode(&message); err != nil {
+			if err != io.EOF {
+				log.Printf("watch stream ended: %s", err.Error())
+			}
+			return
+		}
+
+		transformedMessage, err := proxy.Engine.TransformEtcdV3JsonResponseWithOptions(message, options)
+		if err != nil {
+			if options.Strict {
+				log.Printf("transform error %s; closing watch stream", err.Error())
+				return
+			}
+			log.Printf("transform error %s", err.Error())
+			transformedMessage = message
+		}
+		if _, err := response.Write(append(transformedMessage, '\n')); err != nil {
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+}
@@ -0,0 +1,290 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/sorah/etcvault/etcdtest"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func b64(str string) string {
+	return base64.StdEncoding.EncodeToString([]byte(str))
+}
+
+type v3Kv struct {
+	Key      string
+	Value    string
+	Etcvault map[string]interface{} `json:"_etcvault"`
+}
+
+func TestV3Endpoint(t *testing.T) {
+	tests := []struct {
+		Path     string
+		Endpoint string
+		Ok       bool
+	}{
+		{"/v3/kv/range", "kv/range", true},
+		{"/v3beta/watch", "watch", true},
+		{"/v3alpha/kv/put", "kv/put", true},
+		{"/v2/keys/v3/kv/range", "", false},
+		{"/v3", "", false},
+	}
+
+	for _, test := range tests {
+		endpoint, ok := v3Endpoint(test.Path)
+		if endpoint != test.Endpoint || ok != test.Ok {
+			t.Errorf("%s: unexpected result %#v, %#v", test.Path, endpoint, ok)
+		}
+	}
+}
+
+func TestProxyV3Put(t *testing.T) {
+	etcd, proxyHandler, cancel := etcdtestProxy()
+	defer cancel()
+
+	etcd.PutV3("/greeting", "ETCVAULT::asis:hello::ETCVAULT")
+
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest("POST", "http://localhost/v3/kv/put", strings.NewReader(`{"key":"`+b64("/greeting")+`","value":"`+b64("hola")+`","prev_kv":true}`))
+	proxyHandler.ServeHTTP(recorder, request)
+
+	if recorder.Code != 200 {
+		t.Errorf("unexpected response code: %d", recorder.Code)
+	}
+	if value, _ := etcd.GetV3("/greeting"); value != "<hola>" {
+		t.Errorf("unexpected value: %s", value)
+	}
+
+	var body struct {
+		PrevKv v3Kv `json:"prev_kv"`
+	}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &body); err != nil {
+		t.Fatalf("unexpected error %#v", err)
+	}
+	if body.PrevKv.Value != b64("hello") || body.PrevKv.Etcvault["version"] != "asis" {
+		t.Errorf("unexpected response body: %s", recorder.Body.String())
+	}
+}
+
+func TestProxyV3PutInvalidBody(t *testing.T) {
+	etcd, proxyHandler, cancel := etcdtestProxy()
+	defer cancel()
+
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest("POST", "http://localhost/v3/kv/put", strings.NewReader(`{"key":"`+b64("/greeting")+`","value":"!"}`))
+	proxyHandler.ServeHTTP(recorder, request)
+
+	// passed through as is, and etcd rejects it
+	if recorder.Code != 400 {
+		t.Errorf("unexpected response code: %d", recorder.Code)
+	}
+	if _, ok := etcd.GetV3("/greeting"); ok {
+		t.Errorf("unexpected existence")
+	}
+}
+
+func TestProxyV3Txn(t *testing.T) {
+	etcd, proxyHandler, cancel := etcdtestProxy()
+	defer cancel()
+
+	etcd.PutV3("/app/a", "ETCVAULT::asis:A::ETCVAULT")
+
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest("POST", "http://localhost/v3/kv/txn", strings.NewReader(`{"compare":[{"key":"`+b64("/app/a")+`","result":"GREATER","version":"0"}],"success":[{"request_put":{"key":"`+b64("/app/b")+`","value":"`+b64("hola")+`"}},{"request_txn":{"success":[{"request_put":{"key":"`+b64("/app/c")+`","value":"`+b64("hello")+`"}}]}},{"request_range":{"key":"`+b64("/app/a")+`"}}]}`))
+	proxyHandler.ServeHTTP(recorder, request)
+
+	if recorder.Code != 200 {
+		t.Errorf("unexpected response code: %d", recorder.Code)
+	}
+	if value, _ := etcd.GetV3("/app/b"); value != "<hola>" {
+		t.Errorf("unexpected value: %s", value)
+	}
+	if value, _ := etcd.GetV3("/app/c"); value != "<hello>" {
+		t.Errorf("unexpected value: %s", value)
+	}
+
+	var body struct {
+		Succeeded bool
+		Responses []struct {
+			ResponseRange *struct {
+				Kvs []v3Kv
+			} `json:"response_range"`
+		}
+	}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &body); err != nil {
+		t.Fatalf("unexpected error %#v", err)
+	}
+	if !body.Succeeded || len(body.Responses) != 3 || body.Responses[2].ResponseRange == nil {
+		t.Fatalf("unexpected response body: %s", recorder.Body.String())
+	}
+	if kv := body.Responses[2].ResponseRange.Kvs[0]; kv.Value != b64("A") || kv.Etcvault["version"] != "asis" {
+		t.Errorf("unexpected kv: %#v", kv)
+	}
+}
+
+func TestProxyV3TxnInvalidBody(t *testing.T) {
+	etcd, proxyHandler, cancel := etcdtestProxy()
+	defer cancel()
+
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest("POST", "http://localhost/v3/kv/txn", strings.NewReader(`{"success":[{"request_put":{"key":"`+b64("/greeting")+`","value":"!"}}]}`))
+	proxyHandler.ServeHTTP(recorder, request)
+
+	// passed through as is, and etcd rejects it
+	if recorder.Code != 400 {
+		t.Errorf("unexpected response code: %d", recorder.Code)
+	}
+	if _, ok := etcd.GetV3("/greeting"); ok {
+		t.Errorf("unexpected existence")
+	}
+}
+
+func TestProxyV3Range(t *testing.T) {
+	etcd, proxyHandler, cancel := etcdtestProxy()
+	defer cancel()
+
+	etcd.PutV3("/app/a", "ETCVAULT::asis:A::ETCVAULT")
+	etcd.PutV3("/app/b", "B")
+
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest("POST", "http://localhost/v3/kv/range", strings.NewReader(`{"key":"`+b64("/app/")+`","range_end":"`+b64("/app0")+`"}`))
+	proxyHandler.ServeHTTP(recorder, request)
+
+	if recorder.Code != 200 {
+		t.Errorf("unexpected response code: %d", recorder.Code)
+	}
+
+	var body struct {
+		Header struct {
+			Revision string
+		}
+		Kvs []v3Kv
+	}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &body); err != nil {
+		t.Fatalf("unexpected error %#v", err)
+	}
+	if body.Header.Revision != "2" || len(body.Kvs) != 2 {
+		t.Fatalf("unexpected response body: %s", recorder.Body.String())
+	}
+	if body.Kvs[0].Value != b64("A") || body.Kvs[0].Etcvault == nil {
+		t.Errorf("unexpected kv: %#v", body.Kvs[0])
+	}
+	if body.Kvs[1].Value != b64("B") || body.Kvs[1].Etcvault != nil {
+		t.Errorf("unexpected kv: %#v", body.Kvs[1])
+	}
+}
+
+func TestProxyV3Watch(t *testing.T) {
+	etcd, proxyHandler, cancel := etcdtestProxy()
+	defer cancel()
+	server := httptest.NewServer(proxyHandler)
+	defer server.Close()
+
+	resp, err := http.Post(server.URL+"/v3/watch", "application/json", strings.NewReader(`{"create_request":{"key":"`+b64("/app/")+`","range_end":"`+b64("/app0")+`"}}`))
+	if err != nil {
+		t.Fatalf("unexpected error %#v", err)
+	}
+	defer resp.Body.Close()
+
+	type message struct {
+		Result struct {
+			Created bool
+			Events  []struct {
+				Kv v3Kv
+			}
+		}
+	}
+	messages := make(chan *message)
+	go func() {
+		decoder := json.NewDecoder(resp.Body)
+		for {
+			m := &message{}
+			if err := decoder.Decode(m); err != nil {
+				close(messages)
+				return
+			}
+			messages <- m
+		}
+	}()
+
+	receive := func() *message {
+		select {
+		case m := <-messages:
+			if m == nil {
+				t.Fatalf("watch stream ended")
+			}
+			return m
+		case <-time.After(3 * time.Second):
+			t.Fatalf("watch didn't return")
+		}
+		return nil
+	}
+
+	if m := receive(); !m.Result.Created {
+		t.Errorf("unexpected message: %#v", m)
+	}
+
+	etcd.PutV3("/app/a", "ETCVAULT::asis:A::ETCVAULT")
+	if m := receive(); len(m.Result.Events) != 1 || m.Result.Events[0].Kv.Value != b64("A") {
+		t.Errorf("unexpected message: %#v", m)
+	}
+
+	etcd.PutV3("/app/b", "ETCVAULT::asis:B::ETCVAULT")
+	if m := receive(); len(m.Result.Events) != 1 || m.Result.Events[0].Kv.Value != b64("B") {
+		t.Errorf("unexpected message: %#v", m)
+	}
+}
+
+func TestProxyV3PassThrough(t *testing.T) {
+	_, proxyHandler, cancel := etcdtestProxy()
+	defer cancel()
+
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest("POST", "http://localhost/v3/lease/grant", strings.NewReader(`{"TTL":60}`))
+	proxyHandler.ServeHTTP(recorder, request)
+
+	// etcdtest doesn't implement leases
+	if recorder.Code != 404 {
+		t.Errorf("unexpected response code: %d", recorder.Code)
+	}
+}
+
+func TestProxyV3BackendRetryWithBody(t *testing.T) {
+	etcd := etcdtest.NewServer()
+	server := httptest.NewServer(etcd)
+	defer server.Close()
+	serverURL, _ := url.Parse(server.URL)
+
+	// accepts a connection, but fails after reading the request
+	brokenServer := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		var body bytes.Buffer
+		body.ReadFrom(request.Body)
+		conn, _, _ := response.(http.Hijacker).Hijack()
+		conn.Close()
+	}))
+	defer brokenServer.Close()
+	brokenServerURL, _ := url.Parse(brokenServer.URL)
+
+	router := NewRouter(time.Hour*24, func() ([]*Backend, error) {
+		return []*Backend{NewBackendWithUrls([]*url.URL{brokenServerURL, serverURL})}, nil
+	})
+	router.Update()
+	proxyHandler := NewProxy(&http.Transport{}, router, &mockEngine{}, "http://localhost:2381")
+
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest("POST", "http://localhost/v3/kv/put", strings.NewReader(`{"key":"`+b64("/greeting")+`","value":"`+b64("hola")+`"}`))
+	proxyHandler.ServeHTTP(recorder, request)
+
+	if recorder.Code != 200 {
+		t.Errorf("unexpected response code: %d", recorder.Code)
+	}
+	if value, _ := etcd.GetV3("/greeting"); value != "<hola>" {
+		t.Errorf("unexpected value: %s", value)
+	}
+}
@@ -2,18 +2,20 @@ package main
 
 import (
 	"crypto/tls"
-	"crypto/x509"
-	"encoding/pem"
 	"fmt"
 	"github.com/sorah/etcvault/engine"
+	"github.com/sorah/etcvault/etcdclient"
 	"github.com/sorah/etcvault/keys"
+	"github.com/sorah/etcvault/keyservice"
 	"github.com/sorah/etcvault/proxy"
-	"io/ioutil"
+	"log"
 	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 )
 
@@ -28,86 +30,24 @@ func defaultHttpTransport() *http.Transport {
 	}
 }
 
-func caPool(caPath string) *x509.CertPool {
-	pool := x509.NewCertPool()
-	remainingPem, err := ioutil.ReadFile(caPath)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "error loading CA file %s: %s", caPath, err)
-		os.Exit(1)
-	}
-
-	for { // load while file ends
-		var block *pem.Block
-		block, remainingPem = pem.Decode(remainingPem)
-		if block == nil {
-			return pool
-		}
-		cert, err := x509.ParseCertificate(block.Bytes)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "error while parsing CA PEM blocks: %s", err.Error())
-			os.Exit(1)
-		}
-		pool.AddCert(cert)
-	}
-}
-
-func parseTlsKeypair(certPath, keyPath string) *tls.Config {
-	certBytes, err := ioutil.ReadFile(certPath)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "error loading certificate %s: %s\n", certPath, err.Error())
-		os.Exit(1)
-	}
-	keyBytes, err := ioutil.ReadFile(keyPath)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "error loading certificate %s: %s\n", certPath, err.Error())
-		os.Exit(1)
-	}
-
-	keypair, err := tls.X509KeyPair(certBytes, keyBytes)
-	if err != nil {
-		fmt.Printf("error loading keypair: %s\n", err.Error())
-	}
-
-	return &tls.Config{
-		Certificates: []tls.Certificate{keypair},
-		MinVersion:   tls.VersionTLS10,
-	}
-}
-
-func tlsConfigurationForClientUse(config *tls.Config, caPath string) *tls.Config {
-	if config == nil {
-		config = &tls.Config{}
-	}
-
-	if caPath != "" {
-		config.RootCAs = caPool(caPath)
-	}
-
-	return config
-}
-
-func tlsConfigurationForServerUse(config *tls.Config, caPath string) *tls.Config {
-	if config == nil {
-		config = &tls.Config{}
-	}
-
-	if caPath != "" {
-		config.ClientAuth = tls.RequireAndVerifyClientCert
-		config.ClientCAs = caPool(caPath)
-	} else {
-		config.ClientAuth = tls.NoClientCert
-	}
-
-	return config
-}
-
 type ProxyStarter struct {
 	// arguments
-	Listen       *url.URL
-	AdvertiseUrl string
+	Listens          []*url.URL
+	AdvertiseUrl     string
+	listenSocketMode os.FileMode
 
 	keychainDir              string
+	keysEtcdDir              string
+	masterKeyFilePath        string
+	keysEtcdInterval         time.Duration
+	revocationEtcdKey        string
+	revocationInterval       time.Duration
+	keyServiceUrl            *url.URL
+	keyServiceTimeout        time.Duration
+	keyServiceCacheTtl       time.Duration
 	DiscoverySrvDomain       string
+	DiscoveryUrl             string
+	discoveryFilePath        string
 	initialBackendUrlStrings string
 
 	clientCaFilePath   string
@@ -122,11 +62,83 @@ type ProxyStarter struct {
 	listenCertFilePath string
 	listenKeyFilePath  string
 
-	readonly bool
+	backendUrlPreference *proxy.UrlPreference
+
+	readonly           bool
+	responseOptions    engine.ResponseOptions
+	decryptConcurrency int
 
 	discoveryInterval time.Duration
 
-	router *proxy.Router
+	tlsReloadInterval time.Duration
+	tlsPolicy         *TlsPolicy
+
+	keychain       keys.Store
+	etcdKeys       *keys.MemoryStore
+	revocationList *keys.RevocationList
+	router         *proxy.Router
+	fileDiscovery  *proxy.FileDiscovery
+	tlsReloaders   map[string]*TlsReloader
+}
+
+// NewProxyStarter builds ProxyStarter from validated Config.
+func NewProxyStarter(config *Config) *ProxyStarter {
+	listenUrls, _ := config.ListenUrls()
+	listenSocketMode, _ := config.ListenSocketFileMode()
+
+	tlsPolicy, _ := config.TlsPolicy()
+
+	var keyServiceUrl *url.URL
+	if config.KeyService.Url != "" {
+		keyServiceUrl, _ = config.KeyServiceUrl()
+	}
+
+	var backendUrlPreference *proxy.UrlPreference
+	if config.Discovery.PreferScheme != "" || config.Discovery.PreferNetworks != "" {
+		networks, _ := config.BackendPreferNetworks()
+		backendUrlPreference = &proxy.UrlPreference{
+			Scheme:   config.Discovery.PreferScheme,
+			Networks: networks,
+		}
+	}
+
+	return &ProxyStarter{
+		Listens:                  listenUrls,
+		listenSocketMode:         listenSocketMode,
+		keychainDir:              config.Keychain,
+		keysEtcdDir:              config.Keys.EtcdDir,
+		masterKeyFilePath:        config.Keys.MasterKeyFile,
+		keysEtcdInterval:         time.Duration(config.Keys.EtcdInterval) * time.Second,
+		revocationEtcdKey:        config.Revocation.EtcdKey,
+		revocationInterval:       time.Duration(config.Revocation.Interval) * time.Second,
+		keyServiceUrl:            keyServiceUrl,
+		keyServiceTimeout:        time.Duration(config.KeyService.Timeout) * time.Second,
+		keyServiceCacheTtl:       time.Duration(config.KeyService.CacheTtl) * time.Second,
+		DiscoverySrvDomain:       config.Discovery.Srv,
+		DiscoveryUrl:             config.Discovery.Url,
+		discoveryFilePath:        config.Discovery.File,
+		initialBackendUrlStrings: config.Discovery.InitialBackends,
+		backendUrlPreference:     backendUrlPreference,
+		clientCaFilePath:         config.Tls.Client.CaFile,
+		clientCertFilePath:       config.Tls.Client.CertFile,
+		clientKeyFilePath:        config.Tls.Client.KeyFile,
+		peerCaFilePath:           config.Tls.Peer.CaFile,
+		peerCertFilePath:         config.Tls.Peer.CertFile,
+		peerKeyFilePath:          config.Tls.Peer.KeyFile,
+		listenCaFilePath:         config.Tls.Listen.CaFile,
+		listenCertFilePath:       config.Tls.Listen.CertFile,
+		listenKeyFilePath:        config.Tls.Listen.KeyFile,
+		discoveryInterval:        time.Duration(config.Discovery.Interval) * time.Second,
+		tlsReloadInterval:        time.Duration(config.Tls.ReloadInterval) * time.Second,
+		tlsPolicy:                tlsPolicy,
+		readonly:                 config.Policy.Readonly,
+		AdvertiseUrl:             config.AdvertiseUrl,
+		responseOptions: engine.ResponseOptions{
+			OmitMetadata: config.Policy.OmitMetadata,
+			Strict:       config.Policy.Strict,
+		},
+		decryptConcurrency: config.Policy.DecryptConcurrency,
+	}
 }
 
 func (starter *ProxyStarter) InitialBackendUrls() []*url.URL {
@@ -145,76 +157,262 @@ func (starter *ProxyStarter) InitialBackendUrls() []*url.URL {
 	return urls
 }
 
-func (starter *ProxyStarter) Keychain() *keys.Keychain {
-	return keys.NewKeychain(starter.keychainDir)
+// Keychain returns key store for engine; keys in keychain directory, then keys loaded from etcd.
+func (starter *ProxyStarter) Keychain() keys.Store {
+	if starter.keychain != nil {
+		return starter.keychain
+	}
+
+	var keychain keys.Store
+	if starter.keychainDir == "" {
+		// only remote key service is used
+		keychain = keys.NewMemoryStore([]*keys.Key{})
+	} else {
+		keychain = keys.NewKeychain(starter.keychainDir)
+	}
+
+	if starter.keysEtcdDir == "" {
+		starter.keychain = keychain
+	} else {
+		starter.etcdKeys = keys.NewMemoryStore([]*keys.Key{})
+		starter.keychain = keys.NewMultiStore(keychain, starter.etcdKeys)
+	}
+	return starter.keychain
 }
 
-func (starter *ProxyStarter) Engine() *engine.Engine {
-	return engine.NewEngine(starter.Keychain())
+func (starter *ProxyStarter) EtcdKeySource() *keys.EtcdKeySource {
+	var masterKey []byte
+	if starter.masterKeyFilePath != "" {
+		var err error
+		masterKey, err = keys.LoadMasterKeyFromFile(starter.masterKeyFilePath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to load master key: %s\n", err.Error())
+			os.Exit(1)
+		}
+	}
+
+	client := starter.EtcdClient()
+	client.Timeout = 30 * time.Second
+	return keys.NewEtcdKeySource(client, starter.keysEtcdDir, masterKey)
 }
 
-func (starter *ProxyStarter) ListenTlsConfig() *tls.Config {
-	if starter.listenKeyFilePath != "" && starter.listenCertFilePath != "" {
-		return parseTlsKeypair(starter.listenCertFilePath, starter.listenKeyFilePath)
-	} else {
-		return nil
+func (starter *ProxyStarter) updateKeysFromEtcd(source *keys.EtcdKeySource) error {
+	etcdKeys, err := source.Fetch()
+	if err != nil {
+		return err
 	}
+	starter.etcdKeys.Replace(etcdKeys)
+	return nil
 }
 
-func (starter *ProxyStarter) PeerTlsConfig() *tls.Config {
-	if starter.peerKeyFilePath != "" && starter.peerCertFilePath != "" {
-		return parseTlsKeypair(starter.peerCertFilePath, starter.peerKeyFilePath)
-	} else {
-		return nil
+// WatchEtcdKeys loads keys stored in etcd into keychain, and refreshes them periodically.
+func (starter *ProxyStarter) WatchEtcdKeys() {
+	if starter.keysEtcdDir == "" {
+		return
 	}
+
+	starter.Keychain() // ensure etcdKeys store is built
+	source := starter.EtcdKeySource()
+	if err := starter.updateKeysFromEtcd(source); err != nil {
+		log.Printf("failed to load keys from etcd: %s", err.Error())
+	}
+
+	go func() {
+		for _ = range time.Tick(starter.keysEtcdInterval) {
+			if err := starter.updateKeysFromEtcd(source); err != nil {
+				log.Printf("failed to refresh keys from etcd: %s", err.Error())
+			}
+		}
+	}()
 }
 
-func (starter *ProxyStarter) ClientTlsConfig() *tls.Config {
-	if starter.clientKeyFilePath != "" && starter.clientCertFilePath != "" {
-		return parseTlsKeypair(starter.clientCertFilePath, starter.clientKeyFilePath)
-	} else {
-		return nil
+// loadRevocationList reads revocation list from keychain directory and etcd.
+func (starter *ProxyStarter) loadRevocationList(client *etcdclient.Client) (*keys.RevocationList, error) {
+	list := keys.NewRevocationList()
+
+	if starter.keychainDir != "" {
+		if err := list.LoadFile(keys.NewKeychain(starter.keychainDir).RevocationListPath()); err != nil {
+			return nil, err
+		}
+	}
+
+	if starter.revocationEtcdKey != "" {
+		resp, err := client.Get(starter.revocationEtcdKey, nil)
+		if err != nil && !etcdclient.IsKeyNotFound(err) {
+			return nil, err
+		}
+		if resp != nil {
+			list.Load([]byte(resp.Node.Value))
+		}
 	}
+
+	return list, nil
+}
+
+// RevocationList returns revocation list for engine; loaded at first call, then reloaded by WatchRevocationList.
+func (starter *ProxyStarter) RevocationList() *keys.RevocationList {
+	if starter.revocationList != nil {
+		return starter.revocationList
+	}
+
+	starter.revocationList = keys.NewRevocationList()
+	if starter.keychainDir != "" {
+		if err := starter.revocationList.LoadFile(keys.NewKeychain(starter.keychainDir).RevocationListPath()); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to load revocation list: %s\n", err.Error())
+			os.Exit(1)
+		}
+	}
+	return starter.revocationList
+}
+
+// WatchRevocationList reloads revocation list periodically.
+func (starter *ProxyStarter) WatchRevocationList() {
+	revocationList := starter.RevocationList()
+	client := starter.EtcdClient()
+	client.Timeout = 30 * time.Second
+
+	update := func() {
+		list, err := starter.loadRevocationList(client)
+		if err != nil {
+			// keep previous list
+			log.Printf("failed to reload revocation list: %s", err.Error())
+			return
+		}
+		revocationList.Replace(list)
+	}
+
+	if starter.revocationEtcdKey != "" {
+		update()
+	}
+
+	go func() {
+		for _ = range time.Tick(starter.revocationInterval) {
+			update()
+		}
+	}()
+}
+
+func (starter *ProxyStarter) Engine() *engine.Engine {
+	e := engine.NewEngine(starter.Keychain())
+	e.RevocationList = starter.RevocationList()
+	e.Concurrency = starter.decryptConcurrency
+	if starter.keyServiceUrl != nil {
+		e.KeyWrapper = keyservice.NewClient(starter.keyServiceUrl, starter.ClientHttpTransport(), starter.keyServiceTimeout, starter.keyServiceCacheTtl)
+	}
+	return e
+}
+
+func (starter *ProxyStarter) tlsReloader(certPath, keyPath, caPath string) *TlsReloader {
+	if starter.tlsReloaders == nil {
+		starter.tlsReloaders = make(map[string]*TlsReloader)
+	}
+
+	cacheKey := strings.Join([]string{certPath, keyPath, caPath}, "\x00")
+	if reloader, ok := starter.tlsReloaders[cacheKey]; ok {
+		return reloader
+	}
+
+	reloader, err := NewTlsReloader(certPath, keyPath, caPath, starter.tlsPolicy)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		os.Exit(1)
+	}
+	starter.tlsReloaders[cacheKey] = reloader
+	return reloader
 }
 
 func (starter *ProxyStarter) TlsConfigForServerUse() *tls.Config {
 	if starter.listenKeyFilePath != "" && starter.listenCertFilePath != "" {
-		return tlsConfigurationForServerUse(starter.ListenTlsConfig(), starter.listenCaFilePath)
+		return starter.tlsReloader(starter.listenCertFilePath, starter.listenKeyFilePath, starter.listenCaFilePath).ServerConfig()
 	} else if starter.clientKeyFilePath != "" && starter.clientCertFilePath != "" {
-		return tlsConfigurationForServerUse(starter.ClientTlsConfig(), starter.clientCaFilePath)
+		return starter.tlsReloader(starter.clientCertFilePath, starter.clientKeyFilePath, starter.clientCaFilePath).ServerConfig()
 	} else {
 		return nil
 	}
 }
 
-func (starter *ProxyStarter) ClientTlsConfigForClientUse() *tls.Config {
-	return tlsConfigurationForClientUse(starter.ClientTlsConfig(), starter.clientCaFilePath)
-}
-
-func (starter *ProxyStarter) PeerTlsConfigForClientUse() *tls.Config {
-	return tlsConfigurationForClientUse(starter.PeerTlsConfig(), starter.peerCaFilePath)
+// WatchTlsFiles reloads certificates and CA files when changed, or on SIGHUP.
+func (starter *ProxyStarter) WatchTlsFiles() {
+	hupCh := make(chan os.Signal, 1)
+	signal.Notify(hupCh, syscall.SIGHUP)
+
+	go func() {
+		for {
+			force := false
+			select {
+			case <-hupCh:
+				log.Println("Received SIGHUP; reloading TLS files")
+				force = true
+			case <-time.After(starter.tlsReloadInterval):
+			}
+
+			for _, reloader := range starter.tlsReloaders {
+				var err error
+				if force {
+					err = reloader.Reload()
+				} else {
+					err = reloader.ReloadIfChanged()
+				}
+				if err != nil {
+					log.Printf("Failed to reload TLS files (keeping current ones): %s", err.Error())
+				}
+			}
+		}
+	}()
 }
 
 func (starter *ProxyStarter) PeerHttpTransport() *http.Transport {
 	transport := defaultHttpTransport()
-	transport.TLSClientConfig = starter.PeerTlsConfigForClientUse()
+	starter.tlsReloader(starter.peerCertFilePath, starter.peerKeyFilePath, starter.peerCaFilePath).ApplyToTransport(transport)
 	return transport
 }
 
 func (starter *ProxyStarter) ClientHttpTransport() *http.Transport {
 	transport := defaultHttpTransport()
-	transport.TLSClientConfig = starter.ClientTlsConfigForClientUse()
+	starter.tlsReloader(starter.clientCertFilePath, starter.clientKeyFilePath, starter.clientCaFilePath).ApplyToTransport(transport)
 	return transport
 }
 
-func (starter *ProxyStarter) Listener() net.Listener {
-	listener, err := net.Listen("tcp", starter.Listen.Host)
+func listenUnix(socketPath string, mode os.FileMode) (net.Listener, error) {
+	if fi, err := os.Stat(socketPath); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		// remove stale socket, unless other process is still listening on it
+		if conn, err := net.Dial("unix", socketPath); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s is in use by another process", socketPath)
+		}
+		if err := os.Remove(socketPath); err != nil {
+			return nil, err
+		}
+	}
+
+	listener, err := net.Listen("unix", socketPath)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "failed to listen %s: %s", starter.Listen.String(), err.Error())
+		return nil, err
+	}
+
+	if err := os.Chmod(socketPath, mode); err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	return listener, nil
+}
+
+func (starter *ProxyStarter) Listener(listenUrl *url.URL) net.Listener {
+	var listener net.Listener
+	var err error
+
+	if listenUrl.Scheme == "unix" {
+		listener, err = listenUnix(listenUrl.Path, starter.listenSocketMode)
+	} else {
+		listener, err = net.Listen("tcp", listenUrl.Host)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to listen %s: %s", listenUrl.String(), err.Error())
 		os.Exit(1)
 	}
 
-	if starter.Listen.Scheme == "https" {
+	if listenUrl.Scheme == "https" {
 		tlsConfig := starter.TlsConfigForServerUse()
 		listener = tls.NewListener(listener, tlsConfig)
 	}
@@ -222,12 +420,40 @@ func (starter *ProxyStarter) Listener() net.Listener {
 	return listener
 }
 
+func (starter *ProxyStarter) Listeners() []net.Listener {
+	listeners := make([]net.Listener, 0, len(starter.Listens))
+	for _, listenUrl := range starter.Listens {
+		listeners = append(listeners, starter.Listener(listenUrl))
+	}
+	return listeners
+}
+
+func (starter *ProxyStarter) FileDiscovery() *proxy.FileDiscovery {
+	if starter.fileDiscovery == nil {
+		starter.fileDiscovery = proxy.NewFileDiscovery(starter.discoveryFilePath)
+	}
+	return starter.fileDiscovery
+}
+
 func (starter *ProxyStarter) BackendUpdateFunc() proxy.BackendUpdateFunc {
 	if starter.DiscoverySrvDomain != "" {
 		transport := starter.PeerHttpTransport()
 		return func() ([]*proxy.Backend, error) {
 			return proxy.DiscoverBackendsFromDns(transport, starter.DiscoverySrvDomain)
 		}
+	} else if starter.DiscoveryUrl != "" {
+		discoveryUrl, err := url.Parse(starter.DiscoveryUrl)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to parse url %s: %s\n", starter.DiscoveryUrl, err.Error())
+			os.Exit(1)
+		}
+		discoveryTransport := defaultHttpTransport()
+		transport := starter.PeerHttpTransport()
+		return func() ([]*proxy.Backend, error) {
+			return proxy.DiscoverBackendsFromDiscoveryUrl(discoveryTransport, transport, discoveryUrl)
+		}
+	} else if starter.discoveryFilePath != "" {
+		return starter.FileDiscovery().Backends
 	} else {
 		transport := starter.ClientHttpTransport()
 		return func() ([]*proxy.Backend, error) {
@@ -241,20 +467,44 @@ func (starter *ProxyStarter) Router() *proxy.Router {
 		return starter.router
 	}
 
-	starter.router = proxy.NewRouter(starter.discoveryInterval, starter.BackendUpdateFunc())
+	updateFunc := starter.BackendUpdateFunc()
+	if starter.backendUrlPreference != nil {
+		updateFunc = proxy.PreferBackendUrls(updateFunc, starter.backendUrlPreference)
+	}
+
+	starter.router = proxy.NewRouter(starter.discoveryInterval, updateFunc)
 	err := starter.router.StartUpdate()
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "error starting backend discovery: %s", err.Error())
 	}
 
+	if starter.discoveryFilePath != "" {
+		starter.FileDiscovery().StartWatch(5*time.Second, starter.router.Update)
+	}
+
 	return starter.router
 }
 
+// EtcdClient returns etcd client using client TLS transport, failing over across backends of Router.
+func (starter *ProxyStarter) EtcdClient() *etcdclient.Client {
+	router := starter.Router()
+	return etcdclient.NewClient(starter.ClientHttpTransport(), func() []etcdclient.Endpoint {
+		backends := router.ShuffledAvailableBackends()
+		endpoints := make([]etcdclient.Endpoint, len(backends))
+		for i, backend := range backends {
+			endpoints[i] = backend
+		}
+		return endpoints
+	})
+}
+
 func (starter *ProxyStarter) Proxy() http.Handler {
+	p := proxy.NewProxy(starter.ClientHttpTransport(), starter.Router(), starter.Engine(), starter.AdvertiseUrl)
+	p.ResponseOptions = starter.responseOptions
 	if starter.readonly {
-		return proxy.NewReadonlyProxy(starter.ClientHttpTransport(), starter.Router(), starter.Engine(), starter.AdvertiseUrl)
+		return proxy.ReadonlyHandler(p)
 	} else {
-		return proxy.NewProxy(starter.ClientHttpTransport(), starter.Router(), starter.Engine(), starter.AdvertiseUrl)
+		return p
 	}
 }
 
@@ -266,6 +516,23 @@ func (starter *ProxyStarter) HttpServer() *http.Server {
 }
 
 func (starter *ProxyStarter) Start() {
-	fmt.Printf("Serving at %s\n", starter.Listen.String())
-	starter.HttpServer().Serve(starter.Listener())
+	server := starter.HttpServer()
+	listeners := starter.Listeners()
+
+	// start after all TLS files are loaded by HttpServer and Listeners
+	starter.WatchTlsFiles()
+	starter.WatchEtcdKeys()
+	starter.WatchRevocationList()
+
+	errCh := make(chan error, len(listeners))
+	for i, listener := range listeners {
+		fmt.Printf("Serving at %s\n", starter.Listens[i].String())
+		go func(listener net.Listener) {
+			errCh <- server.Serve(listener)
+		}(listener)
+	}
+
+	err := <-errCh
+	fmt.Fprintf(os.Stderr, "failed to serve: %s\n", err.Error())
+	os.Exit(1)
 }
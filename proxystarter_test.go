@@ -0,0 +1,128 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestListenUnix(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "etcvault_test")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	socketPath := path.Join(tmpDir, "etcvault.sock")
+
+	listener, err := listenUnix(socketPath, 0600)
+	if err != nil {
+		t.Fatalf("unexpected err %s", err.Error())
+	}
+	defer listener.Close()
+
+	fi, err := os.Stat(socketPath)
+	if err != nil {
+		t.Fatalf("unexpected err %s", err.Error())
+	}
+	if fi.Mode()&os.ModeSocket == 0 || fi.Mode().Perm() != 0600 {
+		t.Errorf("unexpected mode %s", fi.Mode().String())
+	}
+
+	go http.Serve(listener, http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		response.Write([]byte("hello"))
+	}))
+	client := &http.Client{Transport: &http.Transport{
+		Dial: func(network, addr string) (net.Conn, error) {
+			return net.Dial("unix", socketPath)
+		},
+	}}
+	resp, err := client.Get("http://etcvault/")
+	if err != nil {
+		t.Fatalf("unexpected err %s", err.Error())
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "hello" {
+		t.Errorf("unexpected body %s", body)
+	}
+
+	if _, err := listenUnix(socketPath, 0600); err == nil {
+		t.Errorf("unexpected success on a socket in use")
+	}
+}
+
+func TestListenUnixStaleSocket(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "etcvault_test")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	socketPath := path.Join(tmpDir, "etcvault.sock")
+
+	// leave a socket file nobody listens on
+	stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: socketPath, Net: "unix"})
+	if err != nil {
+		panic(err)
+	}
+	stale.SetUnlinkOnClose(false)
+	stale.Close()
+
+	listener, err := listenUnix(socketPath, 0660)
+	if err != nil {
+		t.Fatalf("unexpected err %s", err.Error())
+	}
+	listener.Close()
+}
+
+func TestListenUnixNonSocket(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "etcvault_test")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	socketPath := path.Join(tmpDir, "etcvault.sock")
+
+	if err := ioutil.WriteFile(socketPath, []byte("not a socket"), 0644); err != nil {
+		panic(err)
+	}
+
+	if _, err := listenUnix(socketPath, 0660); err == nil {
+		t.Errorf("unexpected success")
+	}
+	if content, _ := ioutil.ReadFile(socketPath); string(content) != "not a socket" {
+		t.Errorf("regular file shouldn't be removed")
+	}
+}
+
+func TestProxyStarterListeners(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "etcvault_test")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	tcpUrl, _ := url.Parse("http://127.0.0.1:0")
+	unixUrl, _ := url.Parse("unix://" + path.Join(tmpDir, "etcvault.sock"))
+	starter := &ProxyStarter{Listens: []*url.URL{tcpUrl, unixUrl}, listenSocketMode: 0660}
+
+	listeners := starter.Listeners()
+	defer func() {
+		for _, listener := range listeners {
+			listener.Close()
+		}
+	}()
+
+	if len(listeners) != 2 {
+		t.Fatalf("unexpected listeners %#v", listeners)
+	}
+	if listeners[0].Addr().Network() != "tcp" {
+		t.Errorf("unexpected listeners[0] %s", listeners[0].Addr().String())
+	}
+	if listeners[1].Addr().Network() != "unix" || listeners[1].Addr().String() != unixUrl.Path {
+		t.Errorf("unexpected listeners[1] %s", listeners[1].Addr().String())
+	}
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"fmt"
+	"github.com/codegangsta/cli"
+	"github.com/sorah/etcvault/container"
+	"github.com/sorah/etcvault/etcdclient"
+	"github.com/sorah/etcvault/keys"
+	"math"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// kinds of values reported by scan
+const (
+	scanKindPlain   = "plain"
+	scanKindV1Short = "v1-short"
+	scanKindV1Long  = "v1-long"
+	scanKindRemote1 = "remote1"
+	scanKindPlain1  = "plain1" // unencrypted container; written bypassing etcvault
+	scanKindAsis    = "asis"
+	scanKindUnknown = "unknown"
+	scanKindBroken  = "broken"
+)
+
+var scanKinds = []string{scanKindPlain, scanKindV1Short, scanKindV1Long, scanKindRemote1, scanKindPlain1, scanKindAsis, scanKindUnknown, scanKindBroken}
+
+// scanKeyStat counts values encrypted with a key, by kind.
+type scanKeyStat struct {
+	Name  string
+	Kinds map[string]int
+}
+
+var (
+	secretKeyNamePattern  = regexp.MustCompile(`(?i)(passw(or)?d|secret|token|credential|api[_-]?key|private[_-]?key|access[_-]?key)`)
+	awsAccessKeyIdPattern = regexp.MustCompile(`\b(AKIA|ASIA)[0-9A-Z]{16}\b`)
+)
+
+// containerKey returns key name and fingerprint of containers encrypted with a key.
+func containerKey(c container.Container) (string, string, bool) {
+	switch c := c.(type) {
+	case *container.V1:
+		return c.KeyName, c.KeyFingerprint, true
+	case *container.Remote1:
+		return c.KeyName, "", true
+	default:
+		return "", "", false
+	}
+}
+
+// classifyValue returns a kind of value and a key name used to encrypt it (if any).
+func classifyValue(value string) (string, string) {
+	if !strings.HasPrefix(value, "ETCVAULT::") {
+		return scanKindPlain, ""
+	}
+
+	c, err := container.Parse(value)
+	if err == container.ErrUnknownVersion {
+		return scanKindUnknown, ""
+	}
+	if err != nil {
+		return scanKindBroken, ""
+	}
+
+	switch c := c.(type) {
+	case *container.V1:
+		if c.ContentKey == nil {
+			return scanKindV1Short, c.KeyName
+		}
+		return scanKindV1Long, c.KeyName
+	case *container.Remote1:
+		return scanKindRemote1, c.KeyName
+	case *container.Plain1:
+		return scanKindPlain1, c.KeyName
+	case *container.Asis:
+		return scanKindAsis, ""
+	default:
+		return scanKindUnknown, ""
+	}
+}
+
+// looksLikeSecret guesses whether a plaintext value at key looks like a secret, and returns a reason.
+func looksLikeSecret(key string, value string) (string, bool) {
+	if value == "" {
+		return "", false
+	}
+	if strings.Contains(value, "-----BEGIN") && strings.Contains(value, "PRIVATE KEY") {
+		return "private key", true
+	}
+	if awsAccessKeyIdPattern.MatchString(value) {
+		return "aws access key id", true
+	}
+	if secretKeyNamePattern.MatchString(path.Base(key)) {
+		return "key name", true
+	}
+	if len(value) >= 20 && !strings.ContainsAny(value, " \t\n") && shannonEntropy(value) >= 4.0 {
+		return "high entropy", true
+	}
+	return "", false
+}
+
+// shannonEntropy returns entropy of str in bits per character.
+func shannonEntropy(str string) float64 {
+	counts := map[rune]int{}
+	total := 0
+	for _, r := range str {
+		counts[r]++
+		total++
+	}
+
+	entropy := 0.0
+	for _, count := range counts {
+		p := float64(count) / float64(total)
+		entropy -= p * math.Log2(p)
+	}
+	return entropy
+}
+
+func actionScan(ctx *cli.Context) {
+	client := etcdClientFromFlags(ctx)
+
+	root, err := fetchEtcdTree(client, ctx.String("prefix"))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to retrieve %s: %s\n", ctx.String("prefix"), err.Error())
+		os.Exit(1)
+	}
+
+	verbose := !ctx.Bool("summary")
+	detectSecrets := ctx.Bool("detect-secrets")
+
+	kindCounts := map[string]int{}
+	keyStats := map[string]*scanKeyStat{}
+	suspicious := 0
+
+	out := tabwriter.NewWriter(os.Stdout, 0, 8, 1, ' ', 0)
+	walkEtcdNodes(root, func(node *etcdclient.Node) {
+		kind, keyName := classifyValue(node.Value)
+		kindCounts[kind]++
+
+		if keyName != "" {
+			stat, ok := keyStats[keyName]
+			if !ok {
+				stat = &scanKeyStat{Name: keyName, Kinds: map[string]int{}}
+				keyStats[keyName] = stat
+			}
+			stat.Kinds[kind]++
+		}
+
+		note := ""
+		if detectSecrets && kind == scanKindPlain {
+			if reason, ok := looksLikeSecret(node.Key, node.Value); ok {
+				suspicious++
+				note = fmt.Sprintf("possible secret (%s)", reason)
+			}
+		}
+
+		if verbose || note != "" {
+			fmt.Fprintf(out, "%s\t%s\t%s\t%s\n", node.Key, kind, keyName, note)
+		}
+	})
+	out.Flush()
+
+	if verbose || suspicious > 0 {
+		fmt.Println()
+	}
+
+	fmt.Fprintln(out, "KIND\tCOUNT")
+	for _, kind := range scanKinds {
+		if kindCounts[kind] > 0 {
+			fmt.Fprintf(out, "%s\t%d\n", kind, kindCounts[kind])
+		}
+	}
+	out.Flush()
+
+	if len(keyStats) > 0 {
+		names := make([]string, 0, len(keyStats))
+		for name := range keyStats {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		fmt.Println()
+		fmt.Fprintln(out, "KEY\tV1-SHORT\tV1-LONG\tREMOTE1\tPLAIN1")
+		for _, name := range names {
+			stat := keyStats[name]
+			fmt.Fprintf(out, "%s\t%d\t%d\t%d\t%d\n", name, stat.Kinds[scanKindV1Short], stat.Kinds[scanKindV1Long], stat.Kinds[scanKindRemote1], stat.Kinds[scanKindPlain1])
+		}
+		out.Flush()
+	}
+
+	if detectSecrets {
+		fmt.Fprintf(os.Stderr, "%d plaintext value(s) look like secrets\n", suspicious)
+	}
+}
+
+func actionFindRevoked(ctx *cli.Context) {
+	client := etcdClientFromFlags(ctx)
+
+	revocationList := keys.NewRevocationList()
+	if keychainDir := ctx.String("keychain"); keychainDir != "" {
+		if err := revocationList.LoadFile(keys.NewKeychain(keychainDir).RevocationListPath()); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to load revocation list: %s\n", err.Error())
+			os.Exit(1)
+		}
+	}
+	if listPath := ctx.String("revocation-list"); listPath != "" {
+		if _, err := os.Stat(listPath); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to load revocation list: %s\n", err.Error())
+			os.Exit(1)
+		}
+		if err := revocationList.LoadFile(listPath); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to load revocation list: %s\n", err.Error())
+			os.Exit(1)
+		}
+	}
+	if etcdKey := ctx.String("revocation-etcd-key"); etcdKey != "" {
+		resp, err := client.Get(etcdKey, nil)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to load revocation list from etcd: %s\n", err.Error())
+			os.Exit(1)
+		}
+		revocationList.Load([]byte(resp.Node.Value))
+	}
+	if revocationList.Len() == 0 {
+		fmt.Fprintln(os.Stderr, "revocation list is empty; specify -keychain, -revocation-list or -revocation-etcd-key")
+		os.Exit(1)
+	}
+
+	root, err := fetchEtcdTree(client, ctx.String("prefix"))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to retrieve %s: %s\n", ctx.String("prefix"), err.Error())
+		os.Exit(1)
+	}
+
+	found := 0
+	walkEtcdNodes(root, func(node *etcdclient.Node) {
+		c, err := container.Parse(node.Value)
+		if err != nil {
+			return
+		}
+		name, fingerprint, ok := containerKey(c)
+		if !ok || !revocationList.IsRevoked(name, fingerprint) {
+			return
+		}
+
+		found++
+		if fingerprint == "" {
+			fmt.Printf("%s\t%s\n", node.Key, name)
+		} else {
+			fmt.Printf("%s\t%s@%s\n", node.Key, name, fingerprint)
+		}
+	})
+
+	fmt.Fprintf(os.Stderr, "%d value(s) encrypted with revoked keys\n", found)
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/codegangsta/cli"
+	"github.com/sorah/etcvault/engine"
+	"github.com/sorah/etcvault/etcdclient"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// templateRenderer renders a template with values under Prefix, decrypting them with Engine.
+type templateRenderer struct {
+	Client   *etcdclient.Client
+	Engine   *engine.Engine
+	Prefix   string
+	Template *template.Template
+}
+
+// templateData holds a snapshot of etcd nodes for one rendering.
+type templateData struct {
+	engine *engine.Engine
+	prefix string
+	nodes  map[string]*etcdclient.Node
+}
+
+func newTemplateData(eng *engine.Engine, prefix string, root *etcdclient.Node) *templateData {
+	data := &templateData{
+		engine: eng,
+		prefix: prefix,
+		nodes:  map[string]*etcdclient.Node{},
+	}
+
+	var walk func(node *etcdclient.Node)
+	walk = func(node *etcdclient.Node) {
+		data.nodes[path.Join("/", node.Key)] = node
+		for _, child := range node.Nodes {
+			walk(child)
+		}
+	}
+	walk(root)
+
+	return data
+}
+
+// resolve returns absolute etcd path for key; keys in templates are relative to the prefix.
+func (data *templateData) resolve(key string) string {
+	return path.Join("/", data.prefix, key)
+}
+
+// Getv returns a decrypted value of key, or defaultValue when given and the key doesn't exist.
+func (data *templateData) Getv(key string, defaultValue ...string) (string, error) {
+	node, ok := data.nodes[data.resolve(key)]
+	if !ok || node.Dir {
+		if len(defaultValue) > 0 {
+			return defaultValue[0], nil
+		}
+		return "", fmt.Errorf("key not found: %s", data.resolve(key))
+	}
+
+	value, err := data.engine.TransformWithPath(node.Value, node.Key)
+	if err != nil {
+		return "", fmt.Errorf("couldn't decrypt %s: %s", node.Key, err.Error())
+	}
+	return value, nil
+}
+
+// Exists returns true when key exists.
+func (data *templateData) Exists(key string) bool {
+	_, ok := data.nodes[data.resolve(key)]
+	return ok
+}
+
+// Ls returns names of children in directory key, sorted.
+func (data *templateData) Ls(key string) []string {
+	return data.children(key, false)
+}
+
+// Lsdir returns names of child directories in directory key, sorted.
+func (data *templateData) Lsdir(key string) []string {
+	return data.children(key, true)
+}
+
+func (data *templateData) children(key string, dirOnly bool) []string {
+	names := []string{}
+	node, ok := data.nodes[data.resolve(key)]
+	if !ok || !node.Dir {
+		return names
+	}
+
+	for _, child := range node.Nodes {
+		if dirOnly && !child.Dir {
+			continue
+		}
+		names = append(names, path.Base(child.Key))
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (data *templateData) funcMap() template.FuncMap {
+	return template.FuncMap{
+		"getv":   data.Getv,
+		"exists": data.Exists,
+		"ls":     data.Ls,
+		"lsdir":  data.Lsdir,
+	}
+}
+
+// templateFuncMap has placeholders of functions to parse templates; they're replaced on each rendering.
+func templateFuncMap() template.FuncMap {
+	data := &templateData{nodes: map[string]*etcdclient.Node{}}
+	funcs := data.funcMap()
+	funcs["base"] = path.Base
+	funcs["dir"] = path.Dir
+	funcs["join"] = strings.Join
+	funcs["split"] = strings.Split
+	funcs["toUpper"] = strings.ToUpper
+	funcs["toLower"] = strings.ToLower
+	return funcs
+}
+
+// Render returns rendered content and the largest modifiedIndex seen.
+func (renderer *templateRenderer) Render() ([]byte, uint64, error) {
+	root, err := fetchEtcdTree(renderer.Client, renderer.Prefix)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	data := newTemplateData(renderer.Engine, renderer.Prefix, root)
+	tmpl, err := renderer.Template.Clone()
+	if err != nil {
+		return nil, 0, err
+	}
+	tmpl.Funcs(data.funcMap())
+
+	out := &bytes.Buffer{}
+	if err := tmpl.Execute(out, nil); err != nil {
+		return nil, 0, err
+	}
+	return out.Bytes(), maxModifiedIndex(root), nil
+}
+
+// writeFileAtomically writes content to a temporary file in the same directory, then renames it over filePath,
+// so readers never see partially written files.
+func writeFileAtomically(filePath string, content []byte, mode os.FileMode) error {
+	file, err := ioutil.TempFile(path.Dir(filePath), "."+path.Base(filePath)+".tmp")
+	if err != nil {
+		return err
+	}
+	tempPath := file.Name()
+
+	err = func() error {
+		defer file.Close()
+		if err := file.Chmod(mode); err != nil {
+			return err
+		}
+		if _, err := file.Write(content); err != nil {
+			return err
+		}
+		return file.Sync()
+	}()
+	if err == nil {
+		err = os.Rename(tempPath, filePath)
+	}
+	if err != nil {
+		os.Remove(tempPath)
+		return err
+	}
+	return nil
+}
+
+func actionTemplate(ctx *cli.Context) {
+	src := ctx.String("src")
+	dest := ctx.String("dest")
+	if src == "" || dest == "" {
+		fmt.Fprintln(os.Stderr, "Specify -src and -dest options")
+		os.Exit(1)
+	}
+	if ctx.String("keychain") == "" {
+		fmt.Fprintln(os.Stderr, "Specify -keychain option")
+		os.Exit(1)
+	}
+
+	mode, err := strconv.ParseUint(ctx.String("mode"), 8, 32)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid -mode: %s\n", ctx.String("mode"))
+		os.Exit(1)
+	}
+
+	tmpl, err := template.New(path.Base(src)).Funcs(templateFuncMap()).ParseFiles(src)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to parse template: %s\n", err.Error())
+		os.Exit(1)
+	}
+
+	renderer := &templateRenderer{
+		Client:   etcdClientFromFlags(ctx),
+		Engine:   engineForKeychain(ctx.String("keychain")),
+		Prefix:   path.Join("/", ctx.String("prefix")),
+		Template: tmpl,
+	}
+	reloadCommand := ctx.String("reload-cmd")
+
+	// update renders the template and writes it when changed, then runs reload command
+	update := func() (uint64, error) {
+		content, index, err := renderer.Render()
+		if err != nil {
+			return 0, err
+		}
+
+		if current, err := ioutil.ReadFile(dest); err == nil && bytes.Equal(current, content) {
+			return index, nil
+		}
+		if err := writeFileAtomically(dest, content, os.FileMode(mode)); err != nil {
+			return 0, err
+		}
+		log.Printf("wrote %s", dest)
+
+		if reloadCommand != "" {
+			cmd := exec.Command("sh", "-c", reloadCommand)
+			cmd.Stdout = os.Stdout
+			cmd.Stderr = os.Stderr
+			if err := cmd.Run(); err != nil {
+				log.Printf("reload command failed: %s", err.Error())
+			}
+		}
+		return index, nil
+	}
+
+	index, err := update()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to render %s: %s\n", src, err.Error())
+		os.Exit(1)
+	}
+
+	if ctx.Bool("watch") {
+		watchEtcdPrefix(renderer.Client, renderer.Prefix, index, update)
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"github.com/sorah/etcvault/etcdclient"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"text/template"
+)
+
+func testTemplateData() *templateData {
+	eng := testEngineWithKeys("app")
+	root := &etcdclient.Node{Key: "/app1", Dir: true, Nodes: []*etcdclient.Node{
+		{Key: "/app1/name", Value: "etcvault"},
+		{Key: "/app1/password", Value: testEncrypt(eng, "app", "secret")},
+		{Key: "/app1/broken", Value: "ETCVAULT::1:unknown-key::aGVsbG8=::ETCVAULT"},
+		{Key: "/app1/db", Dir: true, Nodes: []*etcdclient.Node{
+			{Key: "/app1/db/port", Value: "5432"},
+			{Key: "/app1/db/host", Value: "db.example.com"},
+		}},
+		{Key: "/app1/cache", Dir: true},
+	}}
+	return newTemplateData(eng, "/app1", root)
+}
+
+func TestTemplateDataGetv(t *testing.T) {
+	data := testTemplateData()
+
+	tests := []struct {
+		Key     string
+		Default []string
+		Expect  string
+		Err     bool
+	}{
+		{"name", nil, "etcvault", false},
+		{"/name", nil, "etcvault", false},
+		{"password", nil, "secret", false},
+		{"db/host", nil, "db.example.com", false},
+		{"missing", []string{"default"}, "default", false},
+		{"missing", nil, "", true},
+		{"db", nil, "", true},
+		{"db", []string{"default"}, "default", false},
+		{"broken", nil, "", true},
+	}
+
+	for _, test := range tests {
+		value, err := data.Getv(test.Key, test.Default...)
+		if value != test.Expect || (err != nil) != test.Err {
+			t.Errorf("%#v: unexpected result %#v, %#v", test.Key, value, err)
+		}
+	}
+}
+
+func TestTemplateDataExistsAndLs(t *testing.T) {
+	data := testTemplateData()
+
+	if !data.Exists("name") || !data.Exists("db") || data.Exists("missing") {
+		t.Errorf("unexpected exists")
+	}
+
+	tests := []struct {
+		Name   string
+		Result []string
+		Expect []string
+	}{
+		{"ls", data.Ls("/"), []string{"broken", "cache", "db", "name", "password"}},
+		{"ls db", data.Ls("db"), []string{"host", "port"}},
+		{"ls value", data.Ls("name"), []string{}},
+		{"ls missing", data.Ls("missing"), []string{}},
+		{"lsdir", data.Lsdir(""), []string{"cache", "db"}},
+		{"lsdir db", data.Lsdir("db"), []string{}},
+	}
+
+	for _, test := range tests {
+		if !reflect.DeepEqual(test.Result, test.Expect) {
+			t.Errorf("%s: unexpected result %#v", test.Name, test.Result)
+		}
+	}
+}
+
+func TestTemplateFuncs(t *testing.T) {
+	data := testTemplateData()
+
+	tests := []struct {
+		Case   string
+		Expect string
+	}{
+		{`{{getv "name"}}`, "etcvault"},
+		{`{{getv "password"}}`, "secret"},
+		{`{{getv "missing" "none"}}`, "none"},
+		{`{{if exists "db"}}yes{{end}}`, "yes"},
+		{`{{range ls "db"}}{{.}}={{getv (printf "db/%s" .)}};{{end}}`, "host=db.example.com;port=5432;"},
+		{`{{join (lsdir "/") ","}}`, "cache,db"},
+		{`{{base "/app1/db/host"}} {{dir "/app1/db/host"}}`, "host /app1/db"},
+		{`{{toUpper "a"}}{{toLower "B"}}`, "Ab"},
+		{`{{index (split "a,b" ",") 1}}`, "b"},
+	}
+
+	for _, test := range tests {
+		tmpl, err := template.New("test").Funcs(templateFuncMap()).Parse(test.Case)
+		if err != nil {
+			t.Errorf("%#v: unexpected parse error %#v", test.Case, err)
+			continue
+		}
+		tmpl.Funcs(data.funcMap())
+
+		out := &bytes.Buffer{}
+		if err := tmpl.Execute(out, nil); err != nil || out.String() != test.Expect {
+			t.Errorf("%#v: unexpected result %#v, %#v", test.Case, out.String(), err)
+		}
+	}
+
+	tmpl := template.Must(template.New("test").Funcs(templateFuncMap()).Parse(`{{getv "broken"}}`))
+	tmpl.Funcs(data.funcMap())
+	if err := tmpl.Execute(&bytes.Buffer{}, nil); err == nil || !strings.Contains(err.Error(), "couldn't decrypt /app1/broken") {
+		t.Errorf("unexpected err %#v", err)
+	}
+}
+
+func TestWriteFileAtomically(t *testing.T) {
+	dir, err := ioutil.TempDir("", "etcvault-write")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filePath := path.Join(dir, "file")
+	if err := writeFileAtomically(filePath, []byte("old"), 0600); err != nil {
+		t.Errorf("unexpected error %#v", err)
+	}
+	if err := writeFileAtomically(filePath, []byte("new"), 0644); err != nil {
+		t.Errorf("unexpected error %#v", err)
+	}
+
+	content, _ := ioutil.ReadFile(filePath)
+	if string(content) != "new" {
+		t.Errorf("unexpected content %#v", content)
+	}
+	if fi, err := os.Stat(filePath); err != nil || fi.Mode() != 0644 {
+		t.Errorf("unexpected stat %#v, %#v", fi, err)
+	}
+
+	matches, _ := filepath.Glob(path.Join(dir, ".*"))
+	if len(matches) != 0 {
+		t.Errorf("temporary files are left: %#v", matches)
+	}
+
+	if err := writeFileAtomically(path.Join(dir, "missing", "file"), []byte("new"), 0644); err == nil {
+		t.Errorf("error should be returned")
+	}
+}
@@ -1,7 +1,7 @@
 #!/bin/bash
 set -e
 
-PKGS="./keys ./container ./engine ./proxy"
+PKGS=". ./keys ./container ./engine ./proxy ./keyservice ./etcdclient ./etcdtest"
 FORMATS="$PKGS *.go"
 
 for pkg in $PKGS; do
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"strings"
+)
+
+// TlsPolicy is applied to all TLS configurations etcvault uses (listen, client and peer).
+type TlsPolicy struct {
+	MinVersion       uint16
+	MaxVersion       uint16
+	CipherSuites     []uint16
+	CurvePreferences []tls.CurveID
+	// ClientAuth is used when listening HTTPS with a CA file.
+	ClientAuth tls.ClientAuthType
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+var tlsCurves = map[string]tls.CurveID{
+	"P256":   tls.CurveP256,
+	"P384":   tls.CurveP384,
+	"P521":   tls.CurveP521,
+	"X25519": tls.X25519,
+}
+
+var tlsClientAuthTypes = map[string]tls.ClientAuthType{
+	"require":         tls.RequireAndVerifyClientCert,
+	"verify-if-given": tls.VerifyClientCertIfGiven,
+}
+
+func DefaultTlsPolicy() *TlsPolicy {
+	return &TlsPolicy{
+		MinVersion: tls.VersionTLS10,
+		ClientAuth: tls.RequireAndVerifyClientCert,
+	}
+}
+
+func ParseTlsVersion(str string) (uint16, error) {
+	if version, ok := tlsVersions[str]; ok {
+		return version, nil
+	}
+	return 0, fmt.Errorf("unknown TLS version %s (should be 1.0, 1.1, 1.2 or 1.3)", str)
+}
+
+func ParseTlsCipherSuites(str string) ([]uint16, error) {
+	suites := map[string]uint16{}
+	for _, suite := range tls.CipherSuites() {
+		suites[suite.Name] = suite.ID
+	}
+	for _, suite := range tls.InsecureCipherSuites() {
+		suites[suite.Name] = suite.ID
+	}
+
+	ids := []uint16{}
+	for _, name := range strings.Split(str, ",") {
+		name = strings.TrimSpace(name)
+		id, ok := suites[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown TLS cipher suite %s", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+func ParseTlsCurves(str string) ([]tls.CurveID, error) {
+	curves := []tls.CurveID{}
+	for _, name := range strings.Split(str, ",") {
+		name = strings.TrimSpace(name)
+		curve, ok := tlsCurves[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown TLS curve %s (should be P256, P384, P521 or X25519)", name)
+		}
+		curves = append(curves, curve)
+	}
+	return curves, nil
+}
+
+func ParseTlsClientAuth(str string) (tls.ClientAuthType, error) {
+	if clientAuth, ok := tlsClientAuthTypes[str]; ok {
+		return clientAuth, nil
+	}
+	return tls.NoClientCert, fmt.Errorf("unknown client auth mode %s (should be require or verify-if-given)", str)
+}
+
+func (policy *TlsPolicy) Apply(config *tls.Config) {
+	config.MinVersion = policy.MinVersion
+	config.MaxVersion = policy.MaxVersion
+	config.CipherSuites = policy.CipherSuites
+	config.CurvePreferences = policy.CurvePreferences
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"crypto/tls"
+	"reflect"
+	"testing"
+)
+
+func TestParseTlsVersion(t *testing.T) {
+	tests := []struct {
+		Case   string
+		Expect uint16
+		Err    bool
+	}{
+		{"1.0", tls.VersionTLS10, false},
+		{"1.2", tls.VersionTLS12, false},
+		{"1.3", tls.VersionTLS13, false},
+		{"TLS1.2", 0, true},
+		{"", 0, true},
+	}
+
+	for _, test := range tests {
+		version, err := ParseTlsVersion(test.Case)
+		if version != test.Expect || (err != nil) != test.Err {
+			t.Errorf("%#v: unexpected result %#v, %#v", test.Case, version, err)
+		}
+	}
+}
+
+func TestParseTlsCipherSuites(t *testing.T) {
+	suites, err := ParseTlsCipherSuites("TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384")
+	expected := []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384}
+	if err != nil || !reflect.DeepEqual(suites, expected) {
+		t.Errorf("unexpected result %#v, %#v", suites, err)
+	}
+
+	// insecure ones are accepted too, when explicitly given
+	if _, err := ParseTlsCipherSuites("TLS_RSA_WITH_RC4_128_SHA"); err != nil {
+		t.Errorf("unexpected err %s", err.Error())
+	}
+
+	if _, err := ParseTlsCipherSuites("TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,TLS_UNKNOWN"); err == nil {
+		t.Errorf("unexpected success")
+	}
+}
+
+func TestParseTlsCurves(t *testing.T) {
+	curves, err := ParseTlsCurves("X25519, P256")
+	if err != nil || !reflect.DeepEqual(curves, []tls.CurveID{tls.X25519, tls.CurveP256}) {
+		t.Errorf("unexpected result %#v, %#v", curves, err)
+	}
+
+	if _, err := ParseTlsCurves("P224"); err == nil {
+		t.Errorf("unexpected success")
+	}
+}
+
+func TestParseTlsClientAuth(t *testing.T) {
+	tests := []struct {
+		Case   string
+		Expect tls.ClientAuthType
+		Err    bool
+	}{
+		{"require", tls.RequireAndVerifyClientCert, false},
+		{"verify-if-given", tls.VerifyClientCertIfGiven, false},
+		{"none", tls.NoClientCert, true},
+	}
+
+	for _, test := range tests {
+		clientAuth, err := ParseTlsClientAuth(test.Case)
+		if clientAuth != test.Expect || (err != nil) != test.Err {
+			t.Errorf("%#v: unexpected result %#v, %#v", test.Case, clientAuth, err)
+		}
+	}
+}
+
+func TestConfigTlsPolicy(t *testing.T) {
+	config := &Config{Tls: TlsConfig{MinVersion: "1.2", Curves: "P384", ListenClientAuth: "verify-if-given"}}
+	policy, errs := config.TlsPolicy()
+	if len(errs) > 0 {
+		t.Fatalf("unexpected errs %#v", errs)
+	}
+	expected := &TlsPolicy{MinVersion: tls.VersionTLS12, CurvePreferences: []tls.CurveID{tls.CurveP384}, ClientAuth: tls.VerifyClientCertIfGiven}
+	if !reflect.DeepEqual(policy, expected) {
+		t.Errorf("unexpected policy %#v", policy)
+	}
+
+	if policy, _ := (&Config{}).TlsPolicy(); !reflect.DeepEqual(policy, DefaultTlsPolicy()) {
+		t.Errorf("unexpected default policy %#v", policy)
+	}
+
+	config = &Config{Tls: TlsConfig{MinVersion: "1.4", CipherSuites: "TLS_UNKNOWN", Curves: "P224", ListenClientAuth: "none"}}
+	if _, errs := config.TlsPolicy(); len(errs) != 4 {
+		t.Errorf("unexpected errs %#v", errs)
+	}
+}
+
+func TestTlsPolicyApplied(t *testing.T) {
+	policy := DefaultTlsPolicy()
+	policy.MinVersion = tls.VersionTLS12
+	policy.MaxVersion = tls.VersionTLS13
+	policy.CurvePreferences = []tls.CurveID{tls.X25519}
+	policy.ClientAuth = tls.VerifyClientCertIfGiven
+
+	reloader := &TlsReloader{caPath: "/ca.pem", policy: policy}
+
+	for _, config := range []*tls.Config{reloader.ServerConfig(), reloader.ClientConfig("etcd")} {
+		if config.MinVersion != tls.VersionTLS12 || config.MaxVersion != tls.VersionTLS13 || !reflect.DeepEqual(config.CurvePreferences, policy.CurvePreferences) {
+			t.Errorf("policy isn't applied: %#v", config)
+		}
+	}
+	if clientAuth := reloader.ServerConfig().ClientAuth; clientAuth != tls.VerifyClientCertIfGiven {
+		t.Errorf("unexpected client auth %#v", clientAuth)
+	}
+
+	// client auth of the policy is used only with CA file
+	reloader.caPath = ""
+	if clientAuth := reloader.ServerConfig().ClientAuth; clientAuth != tls.NoClientCert {
+		t.Errorf("unexpected client auth without CA file %#v", clientAuth)
+	}
+}
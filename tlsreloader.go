@@ -0,0 +1,260 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+func loadCaPool(caPath string) (*x509.CertPool, error) {
+	pool := x509.NewCertPool()
+	remainingPem, err := ioutil.ReadFile(caPath)
+	if err != nil {
+		return nil, fmt.Errorf("error loading CA file %s: %s", caPath, err.Error())
+	}
+
+	for { // load while file ends
+		var block *pem.Block
+		block, remainingPem = pem.Decode(remainingPem)
+		if block == nil {
+			return pool, nil
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("error while parsing CA PEM blocks in %s: %s", caPath, err.Error())
+		}
+		pool.AddCert(cert)
+	}
+}
+
+func loadTlsKeypair(certPath, keyPath string) (*tls.Certificate, error) {
+	certBytes, err := ioutil.ReadFile(certPath)
+	if err != nil {
+		return nil, fmt.Errorf("error loading certificate %s: %s", certPath, err.Error())
+	}
+	keyBytes, err := ioutil.ReadFile(keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("error loading key %s: %s", keyPath, err.Error())
+	}
+
+	keypair, err := tls.X509KeyPair(certBytes, keyBytes)
+	if err != nil {
+		return nil, fmt.Errorf("error loading keypair %s, %s: %s", certPath, keyPath, err.Error())
+	}
+
+	return &keypair, nil
+}
+
+// TlsReloader holds a certificate and CA bundle loaded from files, and reloads them on request.
+// tls.Config made by ServerConfig, and transports given to ApplyToTransport, always use the latest ones
+// for new connections, so reloading doesn't affect established connections.
+type TlsReloader struct {
+	sync.RWMutex
+	certPath string
+	keyPath  string
+	caPath   string
+	policy   *TlsPolicy
+
+	certificate *tls.Certificate
+	caPool      *x509.CertPool
+	modTimes    map[string]time.Time
+}
+
+func NewTlsReloader(certPath, keyPath, caPath string, policy *TlsPolicy) (*TlsReloader, error) {
+	reloader := &TlsReloader{
+		certPath: certPath,
+		keyPath:  keyPath,
+		caPath:   caPath,
+		policy:   policy,
+		modTimes: make(map[string]time.Time),
+	}
+
+	if err := reloader.Reload(); err != nil {
+		return nil, err
+	}
+
+	return reloader, nil
+}
+
+func (reloader *TlsReloader) paths() []string {
+	paths := make([]string, 0, 3)
+	for _, path := range []string{reloader.certPath, reloader.keyPath, reloader.caPath} {
+		if path != "" {
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
+
+// Reload loads files. When failed, previously loaded ones are kept.
+func (reloader *TlsReloader) Reload() error {
+	var certificate *tls.Certificate
+	var caPool *x509.CertPool
+	var err error
+
+	modTimes := make(map[string]time.Time)
+	for _, path := range reloader.paths() {
+		if fi, err := os.Stat(path); err == nil {
+			modTimes[path] = fi.ModTime()
+		}
+	}
+
+	if reloader.certPath != "" && reloader.keyPath != "" {
+		certificate, err = loadTlsKeypair(reloader.certPath, reloader.keyPath)
+		if err != nil {
+			return err
+		}
+	}
+
+	if reloader.caPath != "" {
+		caPool, err = loadCaPool(reloader.caPath)
+		if err != nil {
+			return err
+		}
+	}
+
+	reloader.Lock()
+	defer reloader.Unlock()
+
+	reloader.certificate = certificate
+	reloader.caPool = caPool
+	reloader.modTimes = modTimes
+
+	return nil
+}
+
+func (reloader *TlsReloader) Changed() bool {
+	reloader.RLock()
+	defer reloader.RUnlock()
+
+	for _, path := range reloader.paths() {
+		fi, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		if !fi.ModTime().Equal(reloader.modTimes[path]) {
+			return true
+		}
+	}
+	return false
+}
+
+func (reloader *TlsReloader) ReloadIfChanged() error {
+	if !reloader.Changed() {
+		return nil
+	}
+
+	log.Printf("Reloading TLS files: %v", reloader.paths())
+	return reloader.Reload()
+}
+
+func (reloader *TlsReloader) Certificate() *tls.Certificate {
+	reloader.RLock()
+	defer reloader.RUnlock()
+	return reloader.certificate
+}
+
+func (reloader *TlsReloader) CaPool() *x509.CertPool {
+	reloader.RLock()
+	defer reloader.RUnlock()
+	return reloader.caPool
+}
+
+func (reloader *TlsReloader) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return reloader.Certificate(), nil
+}
+
+func (reloader *TlsReloader) GetClientCertificate(request *tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	certificate := reloader.Certificate()
+	if certificate == nil {
+		// send no certificate
+		return &tls.Certificate{}, nil
+	}
+	return certificate, nil
+}
+
+func (reloader *TlsReloader) baseConfig() *tls.Config {
+	config := &tls.Config{}
+	reloader.policy.Apply(config)
+	return config
+}
+
+// ServerConfig returns tls.Config to listen. When CA file is given, client certificates are
+// verified with it, following ClientAuth of the policy.
+func (reloader *TlsReloader) ServerConfig() *tls.Config {
+	config := reloader.baseConfig()
+	config.GetCertificate = reloader.GetCertificate
+
+	if reloader.caPath != "" {
+		config.ClientAuth = reloader.policy.ClientAuth
+		config.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			clientConfig := config.Clone()
+			clientConfig.GetConfigForClient = nil
+			clientConfig.ClientCAs = reloader.CaPool()
+			return clientConfig, nil
+		}
+	} else {
+		config.ClientAuth = tls.NoClientCert
+	}
+
+	return config
+}
+
+// ClientConfig returns tls.Config to connect serverName, with the latest certificate and CA bundle.
+// When CA file is given, server certificates are verified with it, instead of system roots.
+func (reloader *TlsReloader) ClientConfig(serverName string) *tls.Config {
+	config := reloader.baseConfig()
+	config.ServerName = serverName
+
+	if reloader.certPath != "" && reloader.keyPath != "" {
+		config.GetClientCertificate = reloader.GetClientCertificate
+	}
+	if reloader.caPath != "" {
+		config.RootCAs = reloader.CaPool()
+	}
+
+	return config
+}
+
+// ApplyToTransport makes transport build ClientConfig for each new connection, so reloaded
+// CA bundle is used to verify servers while the host (or IP address) dialed is verified as usual.
+func (reloader *TlsReloader) ApplyToTransport(transport *http.Transport) {
+	dial := transport.Dial
+	if dial == nil {
+		dial = net.Dial
+	}
+	handshakeTimeout := transport.TLSHandshakeTimeout
+
+	transport.TLSClientConfig = nil
+	transport.DialTLS = func(network, addr string) (net.Conn, error) {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+
+		rawConn, err := dial(network, addr)
+		if err != nil {
+			return nil, err
+		}
+
+		conn := tls.Client(rawConn, reloader.ClientConfig(host))
+		if handshakeTimeout > 0 {
+			conn.SetDeadline(time.Now().Add(handshakeTimeout))
+		}
+		if err := conn.Handshake(); err != nil {
+			rawConn.Close()
+			return nil, err
+		}
+		conn.SetDeadline(time.Time{})
+
+		return conn, nil
+	}
+}
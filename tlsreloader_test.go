@@ -0,0 +1,173 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+type testCa struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCa() *testCa {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "etcvault test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		panic(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCa{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue returns a server certificate for ips and dnsNames.
+func (ca *testCa) issue(ips []net.IP, dnsNames []string) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "etcd"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses:  ips,
+		DNSNames:     dnsNames,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		panic(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func tlsServer(cert tls.Certificate) *httptest.Server {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		response.Write([]byte("ok"))
+	}))
+	server.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+	server.Config.ErrorLog = log.New(ioutil.Discard, "", 0) // handshake errors are expected
+	server.StartTLS()
+	return server
+}
+
+func getWithReloader(reloader *TlsReloader, url string) error {
+	transport := defaultHttpTransport()
+	reloader.ApplyToTransport(transport)
+	defer transport.CloseIdleConnections()
+
+	resp, err := (&http.Client{Transport: transport}).Get(url)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func TestTlsReloaderClientVerifiesHost(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "etcvault_test")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	ca := newTestCa()
+	caPath := path.Join(tmpDir, "ca.pem")
+	if err := ioutil.WriteFile(caPath, ca.pem, 0644); err != nil {
+		panic(err)
+	}
+	reloader, err := NewTlsReloader("", "", caPath, DefaultTlsPolicy())
+	if err != nil {
+		t.Fatalf("unexpected err %s", err.Error())
+	}
+
+	tests := []struct {
+		Name string
+		Cert tls.Certificate
+		Ok   bool
+	}{
+		{"IP SAN", ca.issue([]net.IP{net.ParseIP("127.0.0.1")}, nil), true},
+		{"other IP SAN", ca.issue([]net.IP{net.ParseIP("192.0.2.1")}, nil), false},
+		{"DNS SAN only", ca.issue(nil, []string{"etcd.example.org"}), false},
+		{"other CA", newTestCa().issue([]net.IP{net.ParseIP("127.0.0.1")}, nil), false},
+	}
+
+	for _, test := range tests {
+		server := tlsServer(test.Cert)
+		err := getWithReloader(reloader, server.URL)
+		server.Close()
+
+		if test.Ok && err != nil {
+			t.Errorf("%s: unexpected err %s", test.Name, err.Error())
+		}
+		if !test.Ok && err == nil {
+			t.Errorf("%s: unexpected success", test.Name)
+		}
+	}
+}
+
+func TestTlsReloaderClientReloadsCa(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "etcvault_test")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	oldCa, newCa := newTestCa(), newTestCa()
+	caPath := path.Join(tmpDir, "ca.pem")
+	if err := ioutil.WriteFile(caPath, oldCa.pem, 0644); err != nil {
+		panic(err)
+	}
+	reloader, err := NewTlsReloader("", "", caPath, DefaultTlsPolicy())
+	if err != nil {
+		t.Fatalf("unexpected err %s", err.Error())
+	}
+
+	server := tlsServer(newCa.issue([]net.IP{net.ParseIP("127.0.0.1")}, nil))
+	defer server.Close()
+
+	if err := getWithReloader(reloader, server.URL); err == nil {
+		t.Errorf("unexpected success before reload")
+	}
+
+	if err := ioutil.WriteFile(caPath, newCa.pem, 0644); err != nil {
+		panic(err)
+	}
+	if err := reloader.Reload(); err != nil {
+		t.Fatalf("unexpected err %s", err.Error())
+	}
+
+	if err := getWithReloader(reloader, server.URL); err != nil {
+		t.Errorf("unexpected err after reload: %s", err.Error())
+	}
+}